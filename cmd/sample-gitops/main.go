@@ -6,6 +6,8 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/fluxcd/go-git-providers/github"
@@ -21,6 +23,7 @@ import (
 	"github.com/weaveworks/libgitops/pkg/storage"
 	"github.com/weaveworks/libgitops/pkg/storage/transaction"
 	githubpr "github.com/weaveworks/libgitops/pkg/storage/transaction/pullrequest/github"
+	localpr "github.com/weaveworks/libgitops/pkg/storage/transaction/pullrequest/local"
 	"github.com/weaveworks/libgitops/pkg/storage/watch"
 	"github.com/weaveworks/libgitops/pkg/storage/watch/update"
 )
@@ -32,6 +35,11 @@ var (
 	gitURLFlag      = pflag.String("git-url", "", "HTTPS Git URL; where the Git repository is, e.g. https://github.com/luxas/ignite-gitops")
 	prAssigneeFlag  = pflag.StringSlice("pr-assignees", nil, "What user logins to assign for the created PR. The user must have pull access to the repo.")
 	prMilestoneFlag = pflag.String("pr-milestone", "", "What milestone to tag the PR with")
+	subdirFlag      = pflag.String("subdirectory", "", "Subdirectory of the Git repository to operate in, defaults to the repository root")
+	cacheDirFlag    = pflag.String("cache-dir", "", "Persistent directory to clone the Git repository into, defaults to a temporary directory")
+	webhookFlag     = pflag.String("webhook-secret", "", "Secret of the push event webhook served at /webhook, which triggers immediate pulls. The webhook is disabled if empty")
+	prUpdateFlag    = pflag.String("pr-update", "none", "Whether to update the open PR of a car instead of creating a new one: none, append (a commit) or squash (all commits)")
+	localRepoFlag   = pflag.String("local-repo", "", "Path to a local bare Git repository to use instead of --git-url. PRs are recorded and merged locally, without a Git provider")
 )
 
 const (
@@ -62,15 +70,6 @@ func expandAndRead(filePath string) ([]byte, error) {
 
 func run(identityFile, gitURL, ghToken, authorName, authorEmail string) error {
 	// Validate parameters
-	if len(identityFile) == 0 {
-		return fmt.Errorf("--identity-file is required")
-	}
-	if len(gitURL) == 0 {
-		return fmt.Errorf("--git-url is required")
-	}
-	if len(ghToken) == 0 {
-		return fmt.Errorf("--github-token is required")
-	}
 	if len(authorName) == 0 {
 		return fmt.Errorf("--author-name is required")
 	}
@@ -78,49 +77,36 @@ func run(identityFile, gitURL, ghToken, authorName, authorEmail string) error {
 		return fmt.Errorf("--author-email is required")
 	}
 
-	// Read the identity and known_hosts files
-	identityContent, err := expandAndRead(identityFile)
-	if err != nil {
-		return err
-	}
-	knownHostsContent, err := expandAndRead(sshKnownHostsFile)
-	if err != nil {
-		return err
-	}
-
-	// Parse the HTTPS clone URL
-	repoRef, err := gitprovider.ParseOrgRepositoryURL(gitURL)
-	if err != nil {
-		return err
-	}
-
-	// Create a new GitHub client using the given token
-	ghClient, err := github.NewClient(github.WithOAuth2Token(ghToken))
+	prUpdate, err := parsePRUpdate(*prUpdateFlag)
 	if err != nil {
 		return err
 	}
 
-	// Authenticate to the GitDirectory using Git SSH
-	authMethod, err := gitdir.NewSSHAuthMethod(identityContent, knownHostsContent)
-	if err != nil {
-		return err
+	opts := gitdir.GitDirectoryOptions{
+		Branch:       "master",
+		Interval:     10 * time.Second,
+		Subdirectory: *subdirFlag,
+		CacheDir:     *cacheDirFlag,
 	}
 
-	// Construct the GitDirectory implementation which backs the storage
-	gitDir, err := gitdir.NewGitDirectory(repoRef, gitdir.GitDirectoryOptions{
-		Branch:     "master",
-		Interval:   10 * time.Second,
-		AuthMethod: authMethod,
-	})
-	if err != nil {
-		return err
+	var gitDir gitdir.GitDirectory
+	var prProvider transaction.PullRequestProvider
+	var localProvider *localpr.Provider
+	if len(*localRepoFlag) != 0 {
+		// Work offline with the local repository, and record the PRs next to it
+		if gitDir, err = gitdir.NewGitDirectoryFromURL(*localRepoFlag, opts); err != nil {
+			return err
+		}
+		if localProvider, err = localpr.NewLocalPRProvider(*localRepoFlag); err != nil {
+			return err
+		}
+		prProvider = localProvider
+	} else {
+		if gitDir, prProvider, err = newGitHubDirectory(identityFile, gitURL, ghToken, opts); err != nil {
+			return err
+		}
 	}
 
-	// Create a new PR provider for the GitStorage
-	prProvider, err := githubpr.NewGitHubPRProvider(ghClient)
-	if err != nil {
-		return err
-	}
 	// Create a new GitStorage using the GitDirectory, PR provider, and Serializer
 	gitStorage, err := transaction.NewGitStorage(gitDir, prProvider, scheme.Serializer)
 	if err != nil {
@@ -147,6 +133,16 @@ func run(identityFile, gitURL, ghToken, authorName, authorEmail string) error {
 
 	e := common.NewEcho()
 
+	// Pull immediately when notified about pushes to the repository. The webhook is only served
+	// with a secret, as anyone could trigger pulls otherwise.
+	if len(*webhookFlag) != 0 {
+		webhook, err := gitdir.NewWebhookHandler(gitDir, gitdir.WebhookOptions{Secret: *webhookFlag})
+		if err != nil {
+			return err
+		}
+		e.POST("/webhook", echo.WrapHandler(webhook))
+	}
+
 	e.GET("/git/", func(c echo.Context) error {
 		objs, err := gitStorage.List(storage.NewKindKey(common.CarGVK))
 		if err != nil {
@@ -162,7 +158,7 @@ func run(identityFile, gitURL, ghToken, authorName, authorEmail string) error {
 		}
 
 		objKey := common.CarKeyForName(name)
-		err := gitStorage.Transaction(context.Background(), fmt.Sprintf("%s-update-", name), func(ctx context.Context, s storage.Storage) (transaction.CommitResult, error) {
+		result, err := gitStorage.Transaction(context.Background(), fmt.Sprintf("%s-update-", name), func(ctx context.Context, s storage.Storage) (transaction.CommitResult, error) {
 
 			// Update the status of the car
 			if err := common.SetNewCarStatus(s, objKey); err != nil {
@@ -180,13 +176,118 @@ func run(identityFile, gitURL, ghToken, authorName, authorEmail string) error {
 				Assignees: *prAssigneeFlag,
 				Milestone: *prMilestoneFlag,
 			}, nil
-		})
+		}, prUpdate)
 		if err != nil {
 			return err
 		}
 
+		if pr := result.PullRequest; pr != nil {
+			return c.String(200, strings.TrimSpace(fmt.Sprintf("OK! PR #%d %s", pr.Number, pr.URL)))
+		}
 		return c.String(200, "OK!")
 	})
 
+	if localProvider != nil {
+		registerLocalPRs(e, gitDir, localProvider, authorName, authorEmail)
+	}
+
 	return common.StartEcho(e)
 }
+
+// parsePRUpdate parses the value of the --pr-update flag
+func parsePRUpdate(value string) (transaction.PullRequestUpdate, error) {
+	for _, u := range []transaction.PullRequestUpdate{transaction.PullRequestUpdateNone, transaction.PullRequestUpdateAppend, transaction.PullRequestUpdateSquash} {
+		if strings.EqualFold(value, u.String()) {
+			return u, nil
+		}
+	}
+	return transaction.PullRequestUpdateNone, fmt.Errorf("--pr-update must be none, append or squash, got %q", value)
+}
+
+// newGitHubDirectory creates a GitDirectory for the GitHub repository with the given URL
+// authenticating using Git SSH, and a PR provider for it using the given token
+func newGitHubDirectory(identityFile, gitURL, ghToken string, opts gitdir.GitDirectoryOptions) (gitdir.GitDirectory, transaction.PullRequestProvider, error) {
+	// Validate parameters
+	if len(identityFile) == 0 {
+		return nil, nil, fmt.Errorf("--identity-file is required")
+	}
+	if len(gitURL) == 0 {
+		return nil, nil, fmt.Errorf("--git-url or --local-repo is required")
+	}
+	if len(ghToken) == 0 {
+		return nil, nil, fmt.Errorf("--github-token is required")
+	}
+
+	// Read the identity and known_hosts files
+	identityContent, err := expandAndRead(identityFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	knownHostsContent, err := expandAndRead(sshKnownHostsFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Parse the HTTPS clone URL
+	repoRef, err := gitprovider.ParseOrgRepositoryURL(gitURL)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Create a new GitHub client using the given token
+	ghClient, err := github.NewClient(github.WithOAuth2Token(ghToken))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Authenticate to the GitDirectory using Git SSH
+	opts.AuthMethod, err = gitdir.NewSSHAuthMethod(identityContent, knownHostsContent)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Construct the GitDirectory implementation which backs the storage
+	gitDir, err := gitdir.NewGitDirectory(repoRef, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Create a new PR provider for the GitStorage
+	prProvider, err := githubpr.NewGitHubPRProvider(ghClient)
+	if err != nil {
+		return nil, nil, err
+	}
+	return gitDir, prProvider, nil
+}
+
+// registerLocalPRs exposes the PRs recorded by the local provider at /pulls/, and lets them
+// be merged and closed. The GitDirectory pulls immediately after merging a PR.
+func registerLocalPRs(e *echo.Echo, gitDir gitdir.GitDirectory, p *localpr.Provider, authorName, authorEmail string) {
+	e.GET("/pulls/", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, p.ListPullRequests())
+	})
+
+	e.POST("/pulls/:number/merge", func(c echo.Context) error {
+		number, err := strconv.Atoi(c.Param("number"))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Please set a valid PR number")
+		}
+		pr, err := p.MergePullRequest(c.Request().Context(), number, authorName, authorEmail)
+		if err != nil {
+			return err
+		}
+		gitDir.TriggerPull()
+		return c.JSON(http.StatusOK, pr)
+	})
+
+	e.POST("/pulls/:number/close", func(c echo.Context) error {
+		number, err := strconv.Atoi(c.Param("number"))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Please set a valid PR number")
+		}
+		if err := p.ClosePullRequest(number); err != nil {
+			return err
+		}
+		return c.String(200, "OK!")
+	})
+}
@@ -54,8 +54,25 @@ func run() error {
 		}
 	}()
 
+	errors := make(update.ErrorStream, 4096)
+	watchStorage.SetErrorStream(errors)
+
+	go func() {
+		for fileErr := range errors {
+			logrus.Errorf("Invalid file: %v", fileErr)
+		}
+	}()
+
 	e := common.NewEcho()
 
+	e.GET("/watch/invalid", func(c echo.Context) error {
+		invalid := []string{}
+		for _, fileErr := range watchStorage.InvalidFiles() {
+			invalid = append(invalid, fileErr.Error())
+		}
+		return c.JSON(http.StatusOK, invalid)
+	})
+
 	e.GET("/watch/:name", func(c echo.Context) error {
 		name := c.Param("name")
 		if len(name) == 0 {
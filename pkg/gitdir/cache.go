@@ -0,0 +1,209 @@
+package gitdir
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	log "github.com/sirupsen/logrus"
+	"github.com/weaveworks/libgitops/pkg/util"
+	"golang.org/x/sys/unix"
+)
+
+// ErrCacheDirLocked happens if the cache directory is already in use by another GitDirectory,
+// possibly in another process.
+var ErrCacheDirLocked = errors.New("the cache directory is locked by another GitDirectory")
+
+// ErrCacheDirNotEmpty happens if the cache directory contains files not created by a GitDirectory,
+// which aren't removed, e.g. in case the cache directory was misconfigured.
+var ErrCacheDirNotEmpty = errors.New("the cache directory isn't empty, and wasn't created by a GitDirectory")
+
+// cacheSentinel is the file marking a clone in a cache directory as created by a GitDirectory,
+// relative to the cache directory. Only such cache directories are emptied.
+const cacheSentinel = ".git/libgitops-cache"
+
+// lockCacheDir creates the cache directory if needed, and acquires an exclusive lock
+// for it using the lock file next to it. The lock is released by closing the file.
+func lockCacheDir(cacheDir string) (*os.File, error) {
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return nil, err
+	}
+
+	lockFile, err := os.OpenFile(cacheDir+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := unix.Flock(int(lockFile.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		_ = lockFile.Close()
+		if err == unix.EWOULDBLOCK {
+			return nil, fmt.Errorf("%w: %s", ErrCacheDirLocked, cacheDir)
+		}
+		return nil, err
+	}
+
+	return lockFile, nil
+}
+
+// unlockCacheDir releases the lock acquired with lockCacheDir
+func unlockCacheDir(lockFile *os.File) error {
+	if err := unix.Flock(int(lockFile.Fd()), unix.LOCK_UN); err != nil {
+		_ = lockFile.Close()
+		return err
+	}
+	return lockFile.Close()
+}
+
+// openCache tries to reuse an existing clone in the cache directory. The remote is pointed to the
+// configured URL, the configured branch is fetched, and the worktree is hard-reset to it and cleaned,
+// so that any local changes (e.g. from a crash during a transaction) are discarded. If the cache
+// directory doesn't contain a usable clone, it's emptied, and false is returned so that the
+// repository is cloned from scratch. If the cache directory isn't empty, and wasn't created by a
+// GitDirectory, an error wrapping ErrCacheDirNotEmpty is returned instead.
+func (d *gitDirectory) openCache(ctx context.Context) (bool, error) {
+	repo, err := git.PlainOpen(d.cloneDir)
+	if err == git.ErrRepositoryNotExists {
+		return false, d.emptyCache()
+	} else if err != nil {
+		log.Warnf("Failed to open the cached clone in %q, re-cloning: %v", d.cloneDir, err)
+		return false, d.emptyCache()
+	}
+
+	if err := d.adoptCache(repo); err != nil {
+		return false, err
+	}
+	if err := d.validateRemote(repo); err != nil {
+		return false, err
+	}
+
+	// Fetch the configured branch incrementally
+	branch := plumbing.NewBranchReferenceName(d.Branch)
+	remoteBranch := plumbing.NewRemoteReferenceName(defaultRemote, d.Branch)
+	err = d.fetchBranch(ctx, repo, d.Branch)
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		if ctx.Err() != nil {
+			return false, ctx.Err()
+		}
+		log.Warnf("Failed to fetch into the cached clone in %q, re-cloning: %v", d.cloneDir, err)
+		return false, d.emptyCache()
+	}
+
+	remoteRef, err := repo.Reference(remoteBranch, true)
+	if err != nil {
+		log.Warnf("Failed to resolve %q in the cached clone in %q, re-cloning: %v", remoteBranch, d.cloneDir, err)
+		return false, d.emptyCache()
+	}
+
+	// Point the local branch to the fetched commit, check it out, and discard any local changes
+	if err := repo.Storer.SetReference(plumbing.NewHashReference(branch, remoteRef.Hash())); err != nil {
+		return false, err
+	}
+
+	wt, err := repo.Worktree()
+	if err != nil {
+		return false, err
+	}
+
+	if err := wt.Checkout(&git.CheckoutOptions{Branch: branch, Force: true}); err != nil {
+		return false, fmt.Errorf("failed to check out %q in the cached clone: %v", d.Branch, err)
+	}
+
+	if err := wt.Reset(&git.ResetOptions{Commit: remoteRef.Hash(), Mode: git.HardReset}); err != nil {
+		return false, fmt.Errorf("failed to reset the cached clone: %v", err)
+	}
+
+	if err := wt.Clean(&git.CleanOptions{Dir: true}); err != nil {
+		return false, fmt.Errorf("failed to clean the cached clone: %v", err)
+	}
+
+	log.Infof("Reusing the cached clone in %q at %s", d.cloneDir, remoteRef.Hash())
+	d.repo = repo
+	return true, nil
+}
+
+// validateRemote makes sure the remote of the cached clone points to the configured URL
+func (d *gitDirectory) validateRemote(repo *git.Repository) error {
+	remote, err := repo.Remote(defaultRemote)
+	if err == nil && len(remote.Config().URLs) == 1 && remote.Config().URLs[0] == d.cloneURL() {
+		return nil
+	}
+
+	log.Infof("Updating the remote of the cached clone in %q to %s", d.cloneDir, d.displayURL())
+	if err == nil {
+		if err := repo.DeleteRemote(defaultRemote); err != nil {
+			return err
+		}
+	} else if err != git.ErrRemoteNotFound {
+		return err
+	}
+
+	_, err = repo.CreateRemote(&config.RemoteConfig{
+		Name:  defaultRemote,
+		URLs:  []string{d.cloneURL()},
+		Fetch: []config.RefSpec{config.RefSpec(fmt.Sprintf("+refs/heads/%s:refs/remotes/%s/%[1]s", d.Branch, defaultRemote))},
+	})
+	return err
+}
+
+// adoptCache makes sure the given repository in the cache directory was created by a GitDirectory.
+// Clones without the cacheSentinel, e.g. created before it was introduced, are only adopted if
+// their remote points to the configured URL.
+func (d *gitDirectory) adoptCache(repo *git.Repository) error {
+	if util.FileExists(filepath.Join(d.cloneDir, filepath.FromSlash(cacheSentinel))) {
+		return nil
+	}
+
+	remote, err := repo.Remote(defaultRemote)
+	if err != nil || len(remote.Config().URLs) != 1 || remote.Config().URLs[0] != d.cloneURL() {
+		return fmt.Errorf("%w: %s", ErrCacheDirNotEmpty, d.cloneDir)
+	}
+
+	log.Infof("Adopting the existing clone of %s in %q", d.displayURL(), d.cloneDir)
+	return d.markCache()
+}
+
+// markCache marks the clone in the cache directory as created by a GitDirectory
+func (d *gitDirectory) markCache() error {
+	return ioutil.WriteFile(filepath.Join(d.cloneDir, filepath.FromSlash(cacheSentinel)), nil, 0644)
+}
+
+// emptyCache removes the contents of the cache directory, but not the directory itself. Only
+// cache directories marked with the cacheSentinel are emptied, for other non-empty directories
+// an error wrapping ErrCacheDirNotEmpty is returned.
+func (d *gitDirectory) emptyCache() error {
+	entries, err := ioutil.ReadDir(d.cloneDir)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	if !util.FileExists(filepath.Join(d.cloneDir, filepath.FromSlash(cacheSentinel))) {
+		return fmt.Errorf("%w: %s", ErrCacheDirNotEmpty, d.cloneDir)
+	}
+
+	return d.removeCache()
+}
+
+// removeCache removes the contents of the cache directory unconditionally
+func (d *gitDirectory) removeCache() error {
+	entries, err := ioutil.ReadDir(d.cloneDir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(d.cloneDir, entry.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,86 @@
+package gitdir
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/weaveworks/libgitops/pkg/internal/testutil"
+)
+
+func TestCommitPaths(t *testing.T) {
+	bareDir, _ := testutil.NewBareRepo(t, map[string]string{"car.yaml": "kind: Car", "bike.yaml": "kind: Bike"})
+	defer os.RemoveAll(bareDir)
+
+	d, err := NewGitDirectoryFromURL(bareDir, GitDirectoryOptions{Interval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = d.Cleanup() }()
+	if err := d.StartCheckoutLoop(); err != nil {
+		t.Fatal(err)
+	}
+
+	commit := func(opts ...CommitOption) error {
+		d.Suspend()
+		defer d.Resume()
+		return d.Commit(context.Background(), "Test", "test@example.com", "commit", opts...)
+	}
+
+	// Unrelated changes are rejected if requested
+	writeFiles(t, d.Dir(), map[string]string{"car.yaml": "kind: Car\nspec: {}", "bike.yaml": "kind: Bike\nspec: {}", "stray.txt": "stray"})
+	err = commit(&CommitOptions{Paths: []string{"car.yaml"}, RejectDirty: true})
+	var dirtyErr *DirtyWorktreeError
+	if !errors.As(err, &dirtyErr) {
+		t.Fatalf("expected a DirtyWorktreeError, got %v", err)
+	}
+	if !reflect.DeepEqual(dirtyErr.Paths, []string{"bike.yaml", "stray.txt"}) {
+		t.Errorf("unexpected dirty paths: %v", dirtyErr.Paths)
+	}
+
+	// Otherwise, only the given paths are committed
+	if err := commit(&CommitOptions{Paths: []string{"car.yaml"}}); err != nil {
+		t.Fatal(err)
+	}
+	changes, err := d.Diff("HEAD~1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].Path != "car.yaml" {
+		t.Errorf("expected only car.yaml to be committed, got %v", changes)
+	}
+	if head, err := getBranchHash(bareDir); err != nil || head.String() != mustResolve(t, d, "") {
+		t.Errorf("expected the commit to be pushed: %v", err)
+	}
+
+	// Nothing is committed if none of the paths changed
+	if err := commit(&CommitOptions{Paths: []string{"car.yaml", "removed.yaml"}}); err != nil {
+		t.Fatal(err)
+	}
+	if log, err := d.Log(LogOptions{}); err != nil || len(log) != 2 {
+		t.Errorf("expected no new commit, got %d commits: %v", len(log), err)
+	}
+
+	// The committer can differ from the author
+	if err := commit(&CommitOptions{Paths: []string{"bike.yaml"}, CommitterName: "Bot", CommitterEmail: "bot@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	log, err := d.Log(LogOptions{MaxCount: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := log[0]; c.AuthorName != "Test" || c.AuthorEmail != "test@example.com" || c.CommitterName != "Bot" || c.CommitterEmail != "bot@example.com" {
+		t.Errorf("unexpected author or committer: %+v", c)
+	}
+}
+
+func mustResolve(t *testing.T, d GitDirectory, rev string) string {
+	hash, err := d.ResolveRevision(rev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
@@ -0,0 +1,147 @@
+package gitdir
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	log "github.com/sirupsen/logrus"
+	"github.com/weaveworks/libgitops/pkg/util/gitmerge"
+)
+
+// subscriberBuffer is the number of events buffered for each subscriber
+const subscriberBuffer = 1024
+
+// CommitEvent describes a new commit observed by the GitDirectory
+type CommitEvent struct {
+	// OldCommit is the SHA of the previously observed commit, empty for the commit observed by the clone
+	OldCommit string
+	// NewCommit is the SHA of the new commit
+	NewCommit string
+	// Branch is the name of the branch the commit was observed on
+	Branch string
+	// AuthorName is the name of the author of the new commit
+	AuthorName string
+	// AuthorEmail is the email of the author of the new commit
+	AuthorEmail string
+	// When is the time the new commit was authored
+	When time.Time
+	// Paths are the slash-separated paths of the files under Dir() that changed between
+	// the two commits. For the commit observed by the clone, all files are included.
+	Paths []string
+}
+
+// Subscribe returns a channel receiving an event for every new commit observed by the GitDirectory
+// from now on, i.e. by the clone, pulls and commits. The channel is closed when the given context is
+// done, or the GitDirectory is cleaned up. Events are buffered, but never block the GitDirectory: if
+// the buffer of a subscriber is full, its events are dropped until it catches up.
+func (d *gitDirectory) Subscribe(ctx context.Context) <-chan CommitEvent {
+	ch := make(chan CommitEvent, subscriberBuffer)
+
+	d.subLock.Lock()
+	d.subscribers[ch] = struct{}{}
+	d.subLock.Unlock()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-d.ctx.Done():
+		}
+
+		d.subLock.Lock()
+		delete(d.subscribers, ch)
+		close(ch)
+		d.subLock.Unlock()
+	}()
+
+	return ch
+}
+
+// publish sends the given event to all subscribers, and its commit to the CommitChannel if it has
+// been created, without blocking on full buffers
+func (d *gitDirectory) publish(event CommitEvent) {
+	d.subLock.Lock()
+	defer d.subLock.Unlock()
+
+	if d.commitChan != nil {
+		select {
+		case d.commitChan <- event.NewCommit:
+		default:
+			log.Warnf("Dropping commit %s, as the CommitChannel isn't read", event.NewCommit)
+		}
+	}
+
+	for ch := range d.subscribers {
+		select {
+		case ch <- event:
+		default:
+			log.Warnf("Dropping the event for commit %s, as a subscriber isn't keeping up", event.NewCommit)
+		}
+	}
+}
+
+// newCommitEvent creates the event for a change from the given old commit, which may be zero, to the new one
+func (d *gitDirectory) newCommitEvent(oldCommit, newCommit plumbing.Hash) CommitEvent {
+	event := CommitEvent{
+		NewCommit: newCommit.String(),
+		Branch:    d.Branch,
+	}
+	if !oldCommit.IsZero() {
+		event.OldCommit = oldCommit.String()
+	}
+	if head, err := d.repo.Storer.Reference(plumbing.HEAD); err == nil && head.Target().IsBranch() {
+		event.Branch = head.Target().Short()
+	}
+
+	c, err := d.commitObject(newCommit)
+	if err != nil {
+		log.Errorf("Failed to get commit %s for its event: %v", newCommit, err)
+		return event
+	}
+	event.AuthorName = c.Author.Name
+	event.AuthorEmail = c.Author.Email
+	event.When = c.Author.When
+
+	paths, err := d.changedPaths(oldCommit, newCommit)
+	if err != nil {
+		log.Errorf("Failed to list the paths changed by commit %s for its event: %v", newCommit, err)
+	}
+	event.Paths = paths
+	return event
+}
+
+// changedPaths lists the paths of the files under Dir() that differ between the
+// given commits. If the old commit is zero, all files at the new commit are listed.
+func (d *gitDirectory) changedPaths(oldCommit, newCommit plumbing.Hash) ([]string, error) {
+	var oldTree *object.Tree
+	if !oldCommit.IsZero() {
+		tree, err := d.commitTree(d.repo, oldCommit)
+		if err != nil {
+			return nil, err
+		}
+		if oldTree, err = d.subdirectoryOf(tree); err != nil {
+			return nil, err
+		}
+	}
+
+	tree, err := d.commitTree(d.repo, newCommit)
+	if err != nil {
+		return nil, err
+	}
+	newTree, err := d.subdirectoryOf(tree)
+	if err != nil {
+		return nil, err
+	}
+
+	changes, err := object.DiffTree(oldTree, newTree)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, 0, len(changes))
+	for _, change := range changes {
+		paths = append(paths, gitmerge.ChangeName(change))
+	}
+	return paths, nil
+}
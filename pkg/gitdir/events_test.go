@@ -0,0 +1,71 @@
+package gitdir
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/weaveworks/libgitops/pkg/internal/testutil"
+)
+
+func TestSubscribe(t *testing.T) {
+	bareDir, _ := testutil.NewBareRepo(t, map[string]string{"car.yaml": "kind: Car", "bike.yaml": "kind: Bike"})
+	defer os.RemoveAll(bareDir)
+
+	d, err := NewGitDirectoryFromURL(bareDir, GitDirectoryOptions{Interval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = d.Cleanup() }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := d.Subscribe(ctx)
+	second := d.Subscribe(context.Background())
+	if err := d.StartCheckoutLoop(); err != nil {
+		t.Fatal(err)
+	}
+	cloned, err := d.ResolveRevision("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := CommitEvent{NewCommit: cloned, Branch: "master", AuthorName: "Test", AuthorEmail: "test@example.com", Paths: []string{"bike.yaml", "car.yaml"}}
+	for _, ch := range []<-chan CommitEvent{first, second} {
+		event := <-ch
+		event.When = time.Time{}
+		if !reflect.DeepEqual(event, expected) {
+			t.Errorf("expected clone event %+v, got %+v", expected, event)
+		}
+	}
+
+	// Both subscribers get the pulled commit, even if the deprecated CommitChannel isn't read
+	pushed := pushCommit(t, bareDir, map[string]string{"car.yaml": "kind: Car\nspec: {}"}, "second commit")
+	if err := d.Pull(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	expected = CommitEvent{OldCommit: cloned, NewCommit: pushed.String(), Branch: "master", AuthorName: "Test", AuthorEmail: "test@example.com", Paths: []string{"car.yaml"}}
+	for _, ch := range []<-chan CommitEvent{first, second} {
+		event := <-ch
+		event.When = time.Time{}
+		if !reflect.DeepEqual(event, expected) {
+			t.Errorf("expected pull event %+v, got %+v", expected, event)
+		}
+	}
+
+	if d.(*gitDirectory).commitChan != nil {
+		t.Error("expected the CommitChannel to be created only when used")
+	}
+
+	// Cancelling the context closes the channel
+	cancel()
+	select {
+	case _, ok := <-first:
+		if ok {
+			t.Error("expected no more events")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("expected the channel to be closed")
+	}
+}
@@ -5,7 +5,12 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	neturl "net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -13,8 +18,9 @@ import (
 	git "github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
 	log "github.com/sirupsen/logrus"
-	"k8s.io/apimachinery/pkg/util/wait"
+	"github.com/weaveworks/libgitops/pkg/util"
 )
 
 var (
@@ -23,13 +29,32 @@ var (
 	ErrNotStarted = errors.New("the gitDirectory hasn't been started (and hence, cloned) yet")
 	// ErrCannotWriteToReadOnly happens if you try to do a write operation for a non-authenticated Git repo.
 	ErrCannotWriteToReadOnly = errors.New("the gitDirectory is read-only, cannot write")
+	// ErrHistoryUnavailable happens if an operation needs a commit that hasn't been fetched, as the
+	// gitDirectory has been configured with a limited Depth.
+	ErrHistoryUnavailable = errors.New("the requested history is unavailable in the shallow clone")
 )
 
+// DirtyWorktreeError is returned by Commit if CommitOptions.RejectDirty is set,
+// and files not included in CommitOptions.Paths are changed
+type DirtyWorktreeError struct {
+	// Paths are the slash-separated paths of the changed files, relative to Dir()
+	Paths []string
+}
+
+var _ error = &DirtyWorktreeError{}
+
+func (e *DirtyWorktreeError) Error() string {
+	return fmt.Sprintf("unrelated changed files in the worktree: %s", strings.Join(e.Paths, ", "))
+}
+
 const (
 	defaultBranch   = "master"
 	defaultRemote   = "origin"
 	defaultInterval = 30 * time.Second
 	defaultTimeout  = 1 * time.Minute
+	defaultBackoff  = 5 * time.Minute
+
+	defaultPushRetries = 3
 )
 
 // GitDirectoryOptions provides options for the gitDirectory.
@@ -39,10 +64,43 @@ type GitDirectoryOptions struct {
 	Branch   string        // default "master"
 	Interval time.Duration // default 30s
 	Timeout  time.Duration // default 1m
-	// TODO: Support folder prefixes
+	// MaxBackoff limits the delay between pulls of the checkout loop after consecutive
+	// failures, as the Interval is doubled for each of them. Default 5m, or the Interval if longer.
+	MaxBackoff time.Duration
+	// Depth limits the history fetched by the clone and pulls to the given number of
+	// commits. Zero (the default) fetches the full history. Operations needing older
+	// history fail with ErrHistoryUnavailable.
+	Depth int
+	// SingleBranch specifies whether only the configured branch should be fetched. Default true.
+	SingleBranch *bool
+	// Subdirectory scopes the GitDirectory to the given slash-separated path in the
+	// repository. Dir() returns the path of the subdirectory in the clone, commits only
+	// include changes under it, and new commits are only reported if they change it.
+	// Note: The full repository is still cloned, as go-git doesn't support sparse
+	// checkouts. The subdirectory is created if it doesn't exist in the repository.
+	Subdirectory string
+	// CacheDir specifies a persistent directory to clone into, instead of a temporary
+	// directory. If it already contains a clone, it's reused: the remote is validated,
+	// the branch is fetched incrementally, and the worktree is hard-reset and cleaned.
+	// Only a directory that is empty, or contains a clone created by a GitDirectory, is
+	// used. For other directories, cloning fails with an error wrapping ErrCacheDirNotEmpty.
+	// The directory is locked using the file CacheDir + ".lock" for as long as the
+	// GitDirectory is in use, and it's not removed by Cleanup.
+	CacheDir string
+	// PushRetries is the number of times a rejected push is retried after rebasing the
+	// commit onto the new commits of the remote branch. Default 3.
+	PushRetries *int
 
 	// Authentication
 	AuthMethod AuthMethod
+
+	// Signer signs every commit created by Commit (and hence, transactions), if set.
+	// Use NewOpenPGPSigner or NewSSHSigner to create one.
+	Signer CommitSigner
+	// Verifier verifies the signatures of the commits observed when cloning and pulling, if set.
+	// Pulls of commits that fail verification are rolled back, and a *SignatureError is returned.
+	// Use NewOpenPGPVerifier or NewSSHVerifier to create one.
+	Verifier CommitVerifier
 }
 
 func (o *GitDirectoryOptions) Default() {
@@ -55,6 +113,41 @@ func (o *GitDirectoryOptions) Default() {
 	if o.Timeout == 0 {
 		o.Timeout = defaultTimeout
 	}
+	if o.MaxBackoff == 0 {
+		o.MaxBackoff = defaultBackoff
+		if o.MaxBackoff < o.Interval {
+			o.MaxBackoff = o.Interval
+		}
+	}
+	if o.PushRetries == nil {
+		o.PushRetries = util.IntPtr(defaultPushRetries)
+	}
+	if o.SingleBranch == nil {
+		o.SingleBranch = util.BoolPtr(true)
+	}
+	if o.Subdirectory != "" {
+		o.Subdirectory = strings.Trim(path.Clean(filepath.ToSlash(o.Subdirectory)), "/")
+		if o.Subdirectory == "." {
+			o.Subdirectory = ""
+		}
+	}
+}
+
+// Validate validates the (defaulted) options.
+func (o *GitDirectoryOptions) Validate() error {
+	if o.MaxBackoff < o.Interval {
+		return fmt.Errorf("max backoff %s must not be shorter than the interval %s", o.MaxBackoff, o.Interval)
+	}
+	if *o.PushRetries < 0 {
+		return fmt.Errorf("push retries %d must not be negative", *o.PushRetries)
+	}
+	if o.Depth < 0 {
+		return fmt.Errorf("depth %d must not be negative", o.Depth)
+	}
+	if o.Subdirectory == ".." || strings.HasPrefix(o.Subdirectory, "../") {
+		return fmt.Errorf("subdirectory %q must be within the repository", o.Subdirectory)
+	}
+	return nil
 }
 
 // GitDirectory is an abstraction layer for a temporary Git clone. It pulls
@@ -62,11 +155,13 @@ func (o *GitDirectoryOptions) Default() {
 // high-level access to write operations, like creating a new branch, committing,
 // and pushing.
 type GitDirectory interface {
-	// Dir returns the backing temporary directory of the git clone.
+	// Dir returns the backing temporary directory of the git clone. If a
+	// subdirectory is configured, the path of the subdirectory is returned.
 	Dir() string
 	// MainBranch returns the configured main branch.
 	MainBranch() string
-	// RepositoryRef returns the repository reference.
+	// RepositoryRef returns the repository reference. This is nil if the
+	// GitDirectory was created from a plain URL using NewGitDirectoryFromURL.
 	RepositoryRef() gitprovider.RepositoryRef
 
 	// StartCheckoutLoop clones the repo synchronously, and then starts the checkout loop non-blocking.
@@ -82,21 +177,79 @@ type GitDirectory interface {
 	// Pull performs a pull & checkout to the latest revision.
 	// ErrNotStarted is returned if the repo hasn't been cloned yet.
 	Pull(ctx context.Context) error
+	// Status returns the health of the checkout loop, e.g. the time of the latest successful
+	// pull and the number of consecutive failures. It doesn't block on ongoing operations.
+	Status() Status
+	// TriggerPull makes the checkout loop pull immediately, instead of waiting for the next
+	// Interval, e.g. when notified about a push. Triggers while a pull is pending are coalesced.
+	TriggerPull()
 
 	// CheckoutNewBranch creates a new branch and checks out to it.
 	// ErrNotStarted is returned if the repo hasn't been cloned yet.
 	CheckoutNewBranch(branchName string) error
+	// CheckoutBranch fetches the existing remote branch with the given name, and checks it out,
+	// discarding any unpushed local commits of it, e.g. to push more commits to the branch of a PR.
+	// ErrNotStarted is returned if the repo hasn't been cloned yet.
+	CheckoutBranch(ctx context.Context, branchName string) error
 	// CheckoutMainBranch goes back to the main branch.
 	// ErrNotStarted is returned if the repo hasn't been cloned yet.
 	CheckoutMainBranch() error
 
 	// Commit creates a commit of all changes in the current worktree with the given parameters.
-	// It also automatically pushes the branch after the commit.
+	// If a subdirectory is configured, only the changes under it are committed.
+	// It also automatically pushes the branch after the commit. If the push is rejected, as the
+	// remote branch has new commits, the commit is rebased onto them and pushed again, up to
+	// PushRetries times. If the new commits changed the same files, a *PushConflictError is
+	// returned. If the push fails for good, the commit is discarded.
 	// ErrNotStarted is returned if the repo hasn't been cloned yet.
-	// ErrCannotWriteToReadOnly is returned if opts.AuthMethod wasn't provided.
-	Commit(ctx context.Context, authorName, authorEmail, msg string) error
+	// ErrCannotWriteToReadOnly is returned if opts.AuthMethod wasn't provided for a remote repository.
+	Commit(ctx context.Context, authorName, authorEmail, msg string, opts ...CommitOption) error
 	// CommitChannel is a channel to where new observed Git SHAs are written.
+	// If a subdirectory is configured, commits not changing it aren't written.
+	// The channel is created on the first call, and only commits observed from
+	// then on are written. If the channel is full, new SHAs are dropped.
+	//
+	// Deprecated: Use Subscribe, which supports multiple consumers.
 	CommitChannel() chan string
+	// Subscribe returns a channel receiving a CommitEvent for every new commit observed from now on.
+	// If a subdirectory is configured, commits not changing it aren't included. Slow subscribers
+	// never block the GitDirectory, but miss events. The channel is closed when ctx is done.
+	Subscribe(ctx context.Context) <-chan CommitEvent
+
+	// Revert applies the inverse of the changes of the given commit to the worktree, to be
+	// committed by the next call to Commit, and returns the paths of the changed files,
+	// relative to Dir(). If later commits changed the same files, a *ConflictError is returned.
+	// ErrNotStarted is returned if the repo hasn't been cloned yet.
+	// ErrCannotWriteToReadOnly is returned if opts.AuthMethod wasn't provided for a remote repository.
+	Revert(commit string) ([]string, error)
+	// Restore sets the given files, relative to Dir(), in the worktree to their state at the
+	// given revision, to be committed by the next call to Commit.
+	// ErrNotStarted is returned if the repo hasn't been cloned yet.
+	// ErrCannotWriteToReadOnly is returned if opts.AuthMethod wasn't provided for a remote repository.
+	Restore(rev string, paths []string) error
+
+	// ResolveRevision resolves the given revision (e.g. a SHA, branch or tag) to a
+	// commit SHA. An empty revision resolves to the main branch.
+	ResolveRevision(rev string) (string, error)
+	// Log lists the commits reachable from the given revision, newest first,
+	// optionally only the ones changing a given path.
+	Log(opts LogOptions) ([]CommitInfo, error)
+	// ReadFile returns the contents of the given file, relative to Dir(), at the given revision.
+	ReadFile(rev, path string) ([]byte, error)
+	// ListFiles lists the paths of all files under Dir() at the given revision.
+	ListFiles(rev string) ([]string, error)
+	// Diff lists the files under Dir() that changed between the two given revisions.
+	// If some history needed by these operations isn't available in a shallow
+	// clone, an error wrapping ErrHistoryUnavailable is returned. These operations
+	// don't wait for ongoing Git operations, so they can also be used while the
+	// GitDirectory is suspended, e.g. in a transaction.
+	Diff(fromRev, toRev string) ([]FileChange, error)
+	// VerifyCommit verifies the signature of the commit at the given revision using the
+	// configured Verifier. A *SignatureError is returned if the verification fails.
+	VerifyCommit(rev string) error
+	// OpenRevision returns read-only access to the files under Dir() at the given
+	// revision, which can be used concurrently with the other operations.
+	OpenRevision(rev string) (Revision, error)
 
 	// Cleanup terminates any pending operations, and removes the temporary directory.
 	Cleanup() error
@@ -104,25 +257,66 @@ type GitDirectory interface {
 
 // Create a new GitDirectory implementation. In order to start using this, run StartCheckoutLoop().
 func NewGitDirectory(repoRef gitprovider.RepositoryRef, opts GitDirectoryOptions) (GitDirectory, error) {
+	if repoRef == nil {
+		return nil, errors.New("repoRef is required")
+	}
+	return newGitDirectory(repoRef, "", opts)
+}
+
+// NewGitDirectoryFromURL creates a new GitDirectory implementation for a plain Git URL, without
+// a Git provider. The URL can be any URL supported by go-git, including local paths and file://
+// URLs, e.g. for bare repositories. opts.AuthMethod is optional: without it, the GitDirectory is
+// read-only, except for local repositories, which are always writable. In order to start using
+// this, run StartCheckoutLoop().
+func NewGitDirectoryFromURL(url string, opts GitDirectoryOptions) (GitDirectory, error) {
+	if len(url) == 0 {
+		return nil, errors.New("url is required")
+	}
+	if _, err := transport.NewEndpoint(url); err != nil {
+		return nil, fmt.Errorf("invalid Git URL %q: %v", url, err)
+	}
+	return newGitDirectory(nil, url, opts)
+}
+
+func newGitDirectory(repoRef gitprovider.RepositoryRef, url string, opts GitDirectoryOptions) (GitDirectory, error) {
 	log.Info("Initializing the Git repo...")
 
-	// Default the options
+	// Default and validate the options
 	opts.Default()
-
-	// Create a temporary directory for the clone
-	tmpDir, err := ioutil.TempDir("", "libgitops")
-	if err != nil {
+	if err := opts.Validate(); err != nil {
 		return nil, err
 	}
-	log.Debugf("Created temporary directory for the git clone at %q", tmpDir)
+
+	// Use the cache directory if given, otherwise create a temporary directory for the clone
+	var cloneDir string
+	var lockFile *os.File
+	if len(opts.CacheDir) != 0 {
+		var err error
+		if cloneDir, err = filepath.Abs(opts.CacheDir); err != nil {
+			return nil, err
+		}
+		if lockFile, err = lockCacheDir(cloneDir); err != nil {
+			return nil, err
+		}
+		log.Debugf("Locked cache directory for the git clone at %q", cloneDir)
+	} else {
+		tmpDir, err := ioutil.TempDir("", "libgitops")
+		if err != nil {
+			return nil, err
+		}
+		cloneDir = tmpDir
+		log.Debugf("Created temporary directory for the git clone at %q", tmpDir)
+	}
 
 	d := &gitDirectory{
 		repoRef:             repoRef,
+		url:                 url,
 		GitDirectoryOptions: opts,
-		cloneDir:            tmpDir,
-		// TODO: This needs to be large, otherwise it can start blocking unnecessarily if nobody reads it
-		commitChan: make(chan string, 1024),
-		lock:       &sync.Mutex{},
+		cloneDir:            cloneDir,
+		lockFile:            lockFile,
+		subscribers:         make(map[chan CommitEvent]struct{}),
+		pullTrigger:         make(chan struct{}, 1),
+		lock:                &sync.Mutex{},
 	}
 	// Set up the parent context for this class. d.cancel() is called only at Cleanup()
 	d.ctx, d.cancel = context.WithCancel(context.Background())
@@ -140,12 +334,15 @@ func NewGitDirectory(repoRef gitprovider.RepositoryRef, opts GitDirectoryOptions
 
 // gitDirectory is an implementation which keeps a directory
 type gitDirectory struct {
-	// user-specified options
+	// user-specified options, either repoRef or url is set
 	repoRef gitprovider.RepositoryRef
+	url     string
 	GitDirectoryOptions
 
-	// the temporary directory used for the clone
+	// the temporary directory used for the clone, or the cache directory
 	cloneDir string
+	// the lock file for the cache directory, if used
+	lockFile *os.File
 
 	// go-git objects. wt is the worktree of the repo, persistent during the lifetime of repo.
 	repo *git.Repository
@@ -153,8 +350,18 @@ type gitDirectory struct {
 
 	// latest known commit to the system
 	lastCommit string
-	// events channel from new commits
+	// latest known commit of the main branch, which new commits are verified against
+	mainCommit plumbing.Hash
+	// the health of the checkout loop, guarded by statusLock
+	status     Status
+	statusLock sync.Mutex
+	// events channel from new commits, created by CommitChannel, and guarded by subLock
 	commitChan chan string
+	// the subscribers to commit events, guarded by subLock
+	subscribers map[chan CommitEvent]struct{}
+	subLock     sync.Mutex
+	// signals the checkout loop to pull immediately, multiple signals are coalesced
+	pullTrigger chan struct{}
 
 	// the context and its cancel function for the lifetime of this struct (until Cleanup())
 	ctx    context.Context
@@ -164,7 +371,7 @@ type gitDirectory struct {
 }
 
 func (d *gitDirectory) Dir() string {
-	return d.cloneDir
+	return filepath.Join(d.cloneDir, filepath.FromSlash(d.Subdirectory))
 }
 
 func (d *gitDirectory) MainBranch() string {
@@ -198,31 +405,86 @@ func (d *gitDirectory) Resume() {
 }
 
 func (d *gitDirectory) CommitChannel() chan string {
+	d.subLock.Lock()
+	defer d.subLock.Unlock()
+	if d.commitChan == nil {
+		d.commitChan = make(chan string, subscriberBuffer)
+	}
 	return d.commitChan
 }
 
+// TriggerPull makes the checkout loop pull immediately, instead of waiting for the next Interval.
+// If a triggered pull is already pending, this is a no-op.
+func (d *gitDirectory) TriggerPull() {
+	select {
+	case d.pullTrigger <- struct{}{}:
+	default:
+	}
+}
+
 func (d *gitDirectory) checkoutLoop() {
 	log.Info("Starting the checkout loop...")
 
-	wait.NonSlidingUntilWithContext(d.ctx, func(_ context.Context) {
+	for {
+		select {
+		case <-d.ctx.Done():
+			log.Info("Exiting the checkout loop...")
+			return
+		case <-time.After(d.pullDelay()):
+		case <-d.pullTrigger:
+			log.Debug("checkoutLoop: Pull triggered")
+		}
 
 		log.Trace("checkoutLoop: Will perform pull operation")
 		// Perform a pull & checkout of the new revision
 		if err := d.Pull(d.ctx); err != nil {
-			log.Errorf("checkoutLoop: git pull failed with error: %v", err)
-			return
+			log.Errorf("checkoutLoop: git pull failed %d time(s) in a row with error: %v", d.Status().ConsecutiveErrors, err)
 		}
-
-	}, d.Interval)
-	log.Info("Exiting the checkout loop...")
+	}
 }
 
 func (d *gitDirectory) cloneURL() string {
+	if d.repoRef == nil {
+		return d.url
+	}
+	// Default to HTTPS for unauthenticated (read-only) access
+	if d.AuthMethod == nil {
+		return d.repoRef.GetCloneURL(gitprovider.TransportTypeHTTPS)
+	}
 	return d.repoRef.GetCloneURL(d.AuthMethod.TransportType())
 }
 
+// displayURL returns the clone URL without any credentials, for logging
+func (d *gitDirectory) displayURL() string {
+	if d.repoRef != nil {
+		return d.repoRef.String()
+	}
+	if u, err := neturl.Parse(d.url); err == nil && u.User != nil {
+		u.User = nil
+		return u.String()
+	}
+	return d.url
+}
+
 func (d *gitDirectory) canWrite() bool {
-	return d.AuthMethod != nil
+	return d.AuthMethod != nil || d.isLocal()
+}
+
+// isLocal checks if the repository is accessed using the local file transport
+func (d *gitDirectory) isLocal() bool {
+	if d.repoRef != nil {
+		return false
+	}
+	ep, err := transport.NewEndpoint(d.url)
+	return err == nil && ep.Protocol == "file"
+}
+
+// auth returns the go-git AuthMethod to use, if any
+func (d *gitDirectory) auth() transport.AuthMethod {
+	if d.AuthMethod == nil {
+		return nil
+	}
+	return d.AuthMethod
 }
 
 // verifyRead makes sure it's ok to start a read-something-from-git process
@@ -252,22 +514,47 @@ func (d *gitDirectory) clone() error {
 	d.lock.Lock()
 	defer d.lock.Unlock()
 
-	log.Infof("Starting to clone the repository %s with timeout %s", d.repoRef, d.Timeout)
+	err := d.cloneRepo()
+	if d.ctx.Err() == nil {
+		d.recordPull(err)
+	}
+	return err
+}
+
+func (d *gitDirectory) cloneRepo() error {
+	log.Infof("Starting to clone the repository %s with timeout %s", d.displayURL(), d.Timeout)
 	// Do a clone operation to the temporary directory, with a timeout
 	err := d.contextWithTimeout(d.ctx, func(ctx context.Context) error {
+		// Reuse the clone in the cache directory, if possible
+		if len(d.CacheDir) != 0 {
+			if reused, err := d.openCache(ctx); err != nil || reused {
+				return err
+			}
+		}
+
 		var err error
-		d.repo, err = git.PlainCloneContext(ctx, d.Dir(), false, &git.CloneOptions{
-			URL:           d.cloneURL(),
-			Auth:          d.AuthMethod,
-			RemoteName:    defaultRemote,
-			ReferenceName: plumbing.NewBranchReferenceName(d.Branch),
-			SingleBranch:  true,
-			NoCheckout:    false,
-			//Depth:             1, // ref: https://github.com/src-d/go-git/issues/1143
+		d.repo, err = git.PlainCloneContext(ctx, d.cloneDir, false, &git.CloneOptions{
+			URL:               d.cloneURL(),
+			Auth:              d.auth(),
+			RemoteName:        defaultRemote,
+			ReferenceName:     plumbing.NewBranchReferenceName(d.Branch),
+			SingleBranch:      *d.SingleBranch,
+			NoCheckout:        false,
+			Depth:             d.Depth,
 			RecurseSubmodules: 0,
 			Progress:          nil,
 			Tags:              git.NoTags,
 		})
+		if len(d.CacheDir) != 0 {
+			if err != nil {
+				// The cache directory was empty, so only the partial clone is removed
+				if rmErr := d.removeCache(); rmErr != nil {
+					log.Warnf("Failed to remove the partial clone in %q: %v", d.cloneDir, rmErr)
+				}
+				return err
+			}
+			return d.markCache()
+		}
 		return err
 	})
 	// Handle errors
@@ -280,7 +567,7 @@ func (d *gitDirectory) clone() error {
 		log.Tracef("context was cancelled")
 		return nil // if Cleanup() was called, just exit the goroutine
 	default:
-		return fmt.Errorf("git clone error: %v", err)
+		return fmt.Errorf("git clone error: %w", err)
 	}
 
 	// Populate the worktree pointer
@@ -289,21 +576,43 @@ func (d *gitDirectory) clone() error {
 		return fmt.Errorf("git get worktree error: %v", err)
 	}
 
+	// Make sure the subdirectory exists, so it can be watched
+	if err := os.MkdirAll(d.Dir(), 0755); err != nil {
+		return fmt.Errorf("failed to create subdirectory %q: %v", d.Subdirectory, err)
+	}
+
 	// Get the latest HEAD commit and report it to the user
 	ref, err := d.repo.Head()
 	if err != nil {
 		return err
 	}
 
+	// Refuse to start with an unverified commit
+	if d.Verifier != nil {
+		if err := d.verifyCommit(ref.Hash()); err != nil {
+			return err
+		}
+	}
+
 	d.observeCommit(ref.Hash())
 	return nil
 }
 
+// Pull fetches and checks out the latest commit of the main branch, and updates the Status.
 func (d *gitDirectory) Pull(ctx context.Context) error {
 	// Lock the mutex now that we're starting, and unlock it when exiting
 	d.lock.Lock()
 	defer d.lock.Unlock()
 
+	err := d.pull(ctx)
+	// Cancelled pulls are neither successes nor failures
+	if ctx.Err() == nil {
+		d.recordPull(err)
+	}
+	return err
+}
+
+func (d *gitDirectory) pull(ctx context.Context) error {
 	// Make sure it's okay to read
 	if err := d.verifyRead(); err != nil {
 		return err
@@ -312,9 +621,12 @@ func (d *gitDirectory) Pull(ctx context.Context) error {
 	// Perform the git pull operation using the timeout
 	err := d.contextWithTimeout(ctx, func(innerCtx context.Context) error {
 		log.Trace("checkoutLoop: Starting pull operation")
+		if d.Depth > 0 {
+			return d.shallowPull(innerCtx)
+		}
 		return d.wt.PullContext(innerCtx, &git.PullOptions{
-			Auth:         d.AuthMethod,
-			SingleBranch: true,
+			Auth:         d.auth(),
+			SingleBranch: *d.SingleBranch,
 		})
 	})
 	// Handle errors
@@ -340,6 +652,31 @@ func (d *gitDirectory) Pull(ctx context.Context) error {
 
 	// check if we changed commits
 	if d.lastCommit != ref.Hash().String() {
+		// Roll back to the last observed commit of the main branch if any new commit can't be verified
+		if d.Verifier != nil && d.mainCommit != ref.Hash() {
+			if err := d.verifyNewCommits(d.mainCommit, ref.Hash()); err != nil {
+				if !d.mainCommit.IsZero() {
+					if resetErr := d.wt.Reset(&git.ResetOptions{Commit: d.mainCommit, Mode: git.HardReset}); resetErr != nil {
+						log.Errorf("Failed to roll back to commit %s: %v", d.mainCommit, resetErr)
+					}
+				}
+				return err
+			}
+		}
+		d.mainCommit = ref.Hash()
+
+		// Only notify upstream if the new commit changed the subdirectory
+		changed, err := d.subdirectoryChanged(plumbing.NewHash(d.lastCommit), ref.Hash())
+		if err != nil {
+			return err
+		}
+
+		if !changed {
+			log.Debugf("New commit %s on branch %q doesn't change subdirectory %q", ref.Hash(), d.Branch, d.Subdirectory)
+			d.lastCommit = ref.Hash().String()
+			return nil
+		}
+
 		// Notify upstream that we now have a new commit, and allow writing again
 		d.observeCommit(ref.Hash())
 	}
@@ -347,6 +684,143 @@ func (d *gitDirectory) Pull(ctx context.Context) error {
 	return nil
 }
 
+// subdirectoryChanged checks if the subdirectory differs between the two given commits.
+// If no subdirectory is configured, this compares the trees of the whole repository.
+func (d *gitDirectory) subdirectoryChanged(oldCommit, newCommit plumbing.Hash) (bool, error) {
+	if d.Subdirectory == "" || oldCommit.IsZero() {
+		return true, nil
+	}
+
+	oldHash, err := d.subdirectoryHash(oldCommit)
+	if errors.Is(err, ErrHistoryUnavailable) {
+		return true, nil // Assume a change, as the old state is unknown
+	} else if err != nil {
+		return false, err
+	}
+
+	newHash, err := d.subdirectoryHash(newCommit)
+	if err != nil {
+		return false, err
+	}
+
+	return oldHash != newHash, nil
+}
+
+// subdirectoryHash returns the hash of the tree of the subdirectory at the given commit,
+// or the zero hash if the subdirectory doesn't exist at the commit
+func (d *gitDirectory) subdirectoryHash(commit plumbing.Hash) (plumbing.Hash, error) {
+	c, err := d.commitObject(commit)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	tree, err := c.Tree()
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("failed to get tree of commit %s: %v", commit, err)
+	}
+
+	entry, err := tree.FindEntry(d.Subdirectory)
+	switch err {
+	case nil:
+		return entry.Hash, nil
+	case object.ErrEntryNotFound, object.ErrDirectoryNotFound:
+		return plumbing.ZeroHash, nil
+	default:
+		return plumbing.ZeroHash, err
+	}
+}
+
+// commitObject returns the commit with the given hash. If the commit isn't available
+// in a shallow clone, an error wrapping ErrHistoryUnavailable is returned.
+func (d *gitDirectory) commitObject(hash plumbing.Hash) (*object.Commit, error) {
+	return d.commitObjectIn(d.repo, hash)
+}
+
+// commitObjectIn is like commitObject, but looks up the commit in the given handle to the repository
+func (d *gitDirectory) commitObjectIn(repo *git.Repository, hash plumbing.Hash) (*object.Commit, error) {
+	c, err := repo.CommitObject(hash)
+	if err == plumbing.ErrObjectNotFound && d.Depth > 0 {
+		return nil, fmt.Errorf("commit %s: %w", hash, ErrHistoryUnavailable)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get commit %s: %v", hash, err)
+	}
+	return c, nil
+}
+
+// inSubdirectory checks if the given slash-separated path relative to the
+// repository root is in the subdirectory
+func (d *gitDirectory) inSubdirectory(file string) bool {
+	return d.Subdirectory == "" || strings.HasPrefix(file, d.Subdirectory+"/")
+}
+
+// stage adds the modified and deleted files in the subdirectory to the index, in the same way
+// as git.CommitOptions.All does for the whole repository. Returns true if anything is staged.
+func (d *gitDirectory) stage(s git.Status) (bool, error) {
+	staged := false
+	for file, status := range s {
+		if !d.inSubdirectory(file) {
+			continue
+		}
+
+		// Include changes already added to the index, e.g. by Revert or Restore
+		if status.Staging != git.Unmodified && status.Staging != git.Untracked {
+			staged = true
+		}
+
+		if status.Worktree == git.Unmodified || status.Worktree == git.Untracked {
+			continue
+		}
+
+		if _, err := d.wt.Add(file); err != nil {
+			return false, fmt.Errorf("git add %q failed: %v", file, err)
+		}
+		staged = true
+	}
+
+	return staged, nil
+}
+
+// stagePaths adds the changes of the files with the given slash-separated paths, relative to Dir(), to the
+// index. Changes of other files under Dir() are left in the worktree, and logged as a warning, or returned
+// as a *DirtyWorktreeError if rejectDirty is true. Returns true if anything is staged.
+func (d *gitDirectory) stagePaths(s git.Status, paths []string, rejectDirty bool) (bool, error) {
+	selected := make(map[string]bool, len(paths))
+	for _, p := range paths {
+		selected[d.repoPath(p)] = true
+	}
+
+	var dirty []string
+	for file, status := range s {
+		if !selected[file] && d.inSubdirectory(file) && (status.Staging != git.Unmodified || status.Worktree != git.Unmodified) {
+			dirty = append(dirty, d.dirPath(file))
+		}
+	}
+	if len(dirty) != 0 {
+		sort.Strings(dirty)
+		dirtyErr := &DirtyWorktreeError{Paths: dirty}
+		if rejectDirty {
+			return false, dirtyErr
+		}
+		log.Warnf("Not committing %v", dirtyErr)
+	}
+
+	staged := false
+	for file := range selected {
+		// Files that were created and removed again aren't in the status
+		if _, ok := s[file]; !ok {
+			continue
+		}
+
+		// Add stages both modifications and removals
+		if _, err := d.wt.Add(file); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return false, fmt.Errorf("git add %q failed: %v", file, err)
+		}
+		staged = true
+	}
+
+	return staged, nil
+}
+
 func (d *gitDirectory) CheckoutNewBranch(branchName string) error {
 	// Make sure it's okay to write
 	if err := d.verifyWrite(); err != nil {
@@ -359,6 +833,34 @@ func (d *gitDirectory) CheckoutNewBranch(branchName string) error {
 	})
 }
 
+func (d *gitDirectory) CheckoutBranch(ctx context.Context, branchName string) error {
+	// Make sure it's okay to write
+	if err := d.verifyWrite(); err != nil {
+		return err
+	}
+
+	err := d.contextWithTimeout(ctx, func(innerCtx context.Context) error {
+		return d.fetchBranch(innerCtx, d.repo, branchName)
+	})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return fmt.Errorf("failed to fetch branch %q: %v", branchName, err)
+	}
+	remoteRef, err := d.repo.Reference(plumbing.NewRemoteReferenceName(defaultRemote, branchName), true)
+	if err != nil {
+		return fmt.Errorf("couldn't find remote branch %q: %w", branchName, err)
+	}
+
+	// Point the local branch to the remote one, creating it if needed
+	branch := plumbing.NewBranchReferenceName(branchName)
+	if err := d.repo.Storer.SetReference(plumbing.NewHashReference(branch, remoteRef.Hash())); err != nil {
+		return err
+	}
+	return d.wt.Checkout(&git.CheckoutOptions{
+		Branch: branch,
+		Force:  true,
+	})
+}
+
 func (d *gitDirectory) CheckoutMainBranch() error {
 	// Make sure it's okay to write
 	if err := d.verifyWrite(); err != nil {
@@ -376,23 +878,39 @@ func (d *gitDirectory) CheckoutMainBranch() error {
 	})
 }
 
-// observeCommit sets the lastCommit variable so that we know the latest state
+// onMainBranch checks if the main branch is checked out
+func (d *gitDirectory) onMainBranch() bool {
+	head, err := d.repo.Storer.Reference(plumbing.HEAD)
+	return err == nil && head.Target() == plumbing.NewBranchReferenceName(d.Branch)
+}
+
+// observeCommit sets the lastCommit variable so that we know the latest state,
+// and notifies the subscribers about the change from the previous state
 func (d *gitDirectory) observeCommit(commit plumbing.Hash) {
+	event := d.newCommitEvent(plumbing.NewHash(d.lastCommit), commit)
 	d.lastCommit = commit.String()
-	d.commitChan <- commit.String()
-	log.Infof("New commit observed on branch %q: %s", d.Branch, commit)
+	if d.onMainBranch() {
+		d.mainCommit = commit
+		d.recordHead(commit)
+	}
+
+	d.publish(event)
+	log.Infof("New commit observed on branch %q: %s", event.Branch, commit)
 }
 
 // Commit creates a commit of all changes in the current worktree with the given parameters.
-// It also automatically pushes the branch after the commit.
+// It also automatically pushes the branch after the commit. If the push is rejected, as the
+// remote branch has new commits, the commit is rebased onto them and pushed again.
 // ErrNotStarted is returned if the repo hasn't been cloned yet.
-// ErrCannotWriteToReadOnly is returned if opts.AuthMethod wasn't provided.
-func (d *gitDirectory) Commit(ctx context.Context, authorName, authorEmail, msg string) error {
+// ErrCannotWriteToReadOnly is returned if opts.AuthMethod wasn't provided for a remote repository.
+func (d *gitDirectory) Commit(ctx context.Context, authorName, authorEmail, msg string, opts ...CommitOption) error {
 	// Make sure it's okay to write
 	if err := d.verifyWrite(); err != nil {
 		return err
 	}
 
+	o := makeCommitOptions(opts...)
+
 	s, err := d.wt.Status()
 	if err != nil {
 		return fmt.Errorf("git status failed: %v", err)
@@ -402,27 +920,59 @@ func (d *gitDirectory) Commit(ctx context.Context, authorName, authorEmail, msg
 		return nil
 	}
 
+	// If limited to some paths, or scoped to a subdirectory, only stage the changes to them
+	if o.Paths != nil || d.Subdirectory != "" {
+		var staged bool
+		if o.Paths != nil {
+			staged, err = d.stagePaths(s, o.Paths, o.RejectDirty)
+		} else {
+			staged, err = d.stage(s)
+		}
+		if err != nil {
+			return err
+		}
+
+		if !staged {
+			log.Debugf("No changed files to commit in subdirectory %q...", d.Subdirectory)
+			return nil
+		}
+	}
+
 	// Do a commit and push
 	log.Debug("commitLoop: Committing all local changes")
+	author := &object.Signature{
+		Name:  authorName,
+		Email: authorEmail,
+		When:  time.Now(),
+	}
+	committer := author
+	if o.CommitterName != "" {
+		committer = &object.Signature{Name: o.CommitterName, Email: o.CommitterEmail, When: author.When}
+	}
+	var parents []plumbing.Hash
+	if o.Squash {
+		if parents, err = d.squashParents(); err != nil {
+			return err
+		}
+	}
 	hash, err := d.wt.Commit(msg, &git.CommitOptions{
-		All: true,
-		Author: &object.Signature{
-			Name:  authorName,
-			Email: authorEmail,
-			When:  time.Now(),
-		},
+		All:       o.Paths == nil && d.Subdirectory == "",
+		Author:    author,
+		Committer: committer,
+		Parents:   parents,
 	})
 	if err != nil {
 		return fmt.Errorf("git commit error: %v", err)
 	}
 
-	// Perform the git push operation using the timeout
-	err = d.contextWithTimeout(ctx, func(innerCtx context.Context) error {
-		log.Debug("commitLoop: Will push with timeout")
-		return d.repo.PushContext(innerCtx, &git.PushOptions{
-			Auth: d.AuthMethod,
-		})
-	})
+	if d.Signer != nil {
+		if hash, err = d.signCommit(hash); err != nil {
+			return err
+		}
+	}
+
+	// Push the commit, rebasing it onto new remote commits if needed
+	hash, err = d.push(ctx, hash, o)
 	// Handle errors
 	switch err {
 	case nil, git.NoErrAlreadyUpToDate:
@@ -433,7 +983,11 @@ func (d *gitDirectory) Commit(ctx context.Context, authorName, authorEmail, msg
 		log.Tracef("context was cancelled")
 		return nil // if Cleanup() was called, just exit the goroutine
 	default:
-		return fmt.Errorf("failed to push: %v", err)
+		var conflictErr *PushConflictError
+		if errors.As(err, &conflictErr) {
+			return err
+		}
+		return fmt.Errorf("failed to push: %w", err)
 	}
 
 	// Notify upstream that we now have a new commit, and allow writing again
@@ -460,13 +1014,26 @@ func (d *gitDirectory) contextWithTimeout(ctx context.Context, fn func(context.C
 	return fnErr
 }
 
-// Cleanup cancels running goroutines and operations, and removes the temporary clone directory
+// Cleanup cancels running goroutines and operations, and removes the temporary clone directory.
+// If a cache directory is used, it's kept for reuse, and only its lock is released.
 func (d *gitDirectory) Cleanup() error {
 	// Cancel the context for the two running goroutines, and any possible long-running operations
 	d.cancel()
 
+	if d.lockFile != nil {
+		// Wait for any ongoing operation before releasing the lock
+		d.lock.Lock()
+		defer d.lock.Unlock()
+		if err := unlockCacheDir(d.lockFile); err != nil {
+			log.Errorf("Failed to unlock the git cache directory: %v", err)
+			return err
+		}
+		d.lockFile = nil
+		return nil
+	}
+
 	// Remove the temporary directory
-	if err := os.RemoveAll(d.Dir()); err != nil {
+	if err := os.RemoveAll(d.cloneDir); err != nil {
 		log.Errorf("Failed to clean up temp git directory: %v", err)
 		return err
 	}
@@ -0,0 +1,402 @@
+package gitdir
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/weaveworks/libgitops/pkg/internal/testutil"
+)
+
+// newTestRepo initializes a repository in a temporary directory, and commits the given files
+func newTestRepo(t *testing.T, files map[string]string) (string, *git.Repository, *git.Worktree) {
+	dir, err := ioutil.TempDir("", "libgitops-gitdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeFiles(t, dir, files)
+	if err := wt.AddGlob("."); err != nil {
+		t.Fatal(err)
+	}
+	testCommit(t, wt, "initial commit")
+	return dir, repo, wt
+}
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for file, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(file))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func testCommit(t *testing.T, wt *git.Worktree, msg string) plumbing.Hash {
+	hash, err := wt.Commit(msg, &git.CommitOptions{
+		All:    true,
+		Author: &object.Signature{Name: "Test", Email: "test@example.com", When: time.Now()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func TestSubdirectory(t *testing.T) {
+	dir, repo, wt := newTestRepo(t, map[string]string{
+		"team-a/car.yaml": "kind: Car",
+		"team-b/car.yaml": "kind: Car",
+	})
+	defer os.RemoveAll(dir)
+
+	opts := GitDirectoryOptions{Subdirectory: "./team-a/"}
+	opts.Default()
+	if err := opts.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	d := &gitDirectory{GitDirectoryOptions: opts, cloneDir: dir, repo: repo, wt: wt}
+	if d.Dir() != filepath.Join(dir, "team-a") {
+		t.Errorf("unexpected Dir(): %q", d.Dir())
+	}
+
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Changes outside of the subdirectory are neither staged nor reported
+	writeFiles(t, dir, map[string]string{"team-b/car.yaml": "kind: Bike"})
+	outside := testCommit(t, wt, "change team-b")
+	if changed, err := d.subdirectoryChanged(head.Hash(), outside); err != nil || changed {
+		t.Errorf("expected no change in the subdirectory: %t, %v", changed, err)
+	}
+
+	writeFiles(t, dir, map[string]string{"team-a/car.yaml": "kind: Bike", "team-b/car.yaml": "kind: Car"})
+	s, err := wt.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if staged, err := d.stage(s); err != nil || !staged {
+		t.Fatalf("expected changes to be staged: %t, %v", staged, err)
+	}
+
+	if s, err = wt.Status(); err != nil {
+		t.Fatal(err)
+	}
+	if s.File("team-a/car.yaml").Staging != git.Modified || s.File("team-b/car.yaml").Staging != git.Unmodified {
+		t.Errorf("unexpected status:\n%s", s)
+	}
+
+	inside := testCommit(t, wt, "change team-a")
+	if changed, err := d.subdirectoryChanged(outside, inside); err != nil || !changed {
+		t.Errorf("expected a change in the subdirectory: %t, %v", changed, err)
+	}
+
+	for _, invalid := range []string{"..", "../team-a", "team-a/../.."} {
+		opts := GitDirectoryOptions{Subdirectory: invalid}
+		opts.Default()
+		if err := opts.Validate(); err == nil {
+			t.Errorf("expected subdirectory %q to be invalid", invalid)
+		}
+	}
+}
+
+func TestGitDirectoryFromURL(t *testing.T) {
+	bareDir, _ := testutil.NewBareRepo(t, map[string]string{"car.yaml": "kind: Car"})
+	defer os.RemoveAll(bareDir)
+
+	for _, url := range []string{bareDir, "file://" + bareDir} {
+		d, err := NewGitDirectoryFromURL(url, GitDirectoryOptions{Interval: time.Hour})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := d.StartCheckoutLoop(); err != nil {
+			t.Fatal(err)
+		}
+
+		if d.RepositoryRef() != nil {
+			t.Errorf("expected no RepositoryRef")
+		}
+
+		content, err := ioutil.ReadFile(filepath.Join(d.Dir(), "car.yaml"))
+		if err != nil || !strings.HasPrefix(string(content), "kind: Car") {
+			t.Fatalf("unexpected clone content: %q, %v", content, err)
+		}
+
+		// Local repositories are writable without authentication
+		d.Suspend()
+		writeFiles(t, d.Dir(), map[string]string{"car.yaml": string(content) + "\n# " + url})
+		err = d.Commit(context.Background(), "Test", "test@example.com", "update car")
+		d.Resume()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_ = d.Cleanup()
+	}
+
+	repo, err := git.PlainOpen(bareDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ref, err := repo.Reference(plumbing.NewBranchReferenceName(defaultBranch), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	commit, err := repo.CommitObject(ref.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if commit.Message != "update car" {
+		t.Errorf("expected the commit to be pushed, got %q", commit.Message)
+	}
+}
+
+func TestGitDirectoryCacheDir(t *testing.T) {
+	bareDir, _ := testutil.NewBareRepo(t, map[string]string{"car.yaml": "kind: Car"})
+	defer os.RemoveAll(bareDir)
+
+	tmpDir, err := ioutil.TempDir("", "libgitops-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	opts := GitDirectoryOptions{Interval: time.Hour, CacheDir: filepath.Join(tmpDir, "clone")}
+	d, err := NewGitDirectoryFromURL(bareDir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.StartCheckoutLoop(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The cache directory can't be shared
+	if _, err := NewGitDirectoryFromURL(bareDir, opts); !errors.Is(err, ErrCacheDirLocked) {
+		t.Fatalf("expected ErrCacheDirLocked, got %v", err)
+	}
+
+	// Leave the worktree dirty, and point the remote elsewhere
+	d.Suspend()
+	writeFiles(t, d.Dir(), map[string]string{"car.yaml": "kind: Dirty", "untracked.yaml": "kind: Car"})
+	d.Resume()
+	repo := d.(*gitDirectory).repo
+	if err := repo.DeleteRemote(defaultRemote); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.CreateRemote(&config.RemoteConfig{Name: defaultRemote, URLs: []string{"/nonexistent"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Push a new commit to the remote, which should be fetched on reuse
+	pushCommit(t, bareDir, map[string]string{"car.yaml": "kind: Upstream"}, "upstream change")
+
+	d, err = NewGitDirectoryFromURL(bareDir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = d.Cleanup() }()
+
+	if err := d.StartCheckoutLoop(); err != nil {
+		t.Fatal(err)
+	}
+
+	if content, err := ioutil.ReadFile(filepath.Join(d.Dir(), "car.yaml")); err != nil || string(content) != "kind: Upstream" {
+		t.Errorf("unexpected content after reuse: %q, %v", content, err)
+	}
+
+	if _, err := os.Stat(filepath.Join(d.Dir(), "untracked.yaml")); !os.IsNotExist(err) {
+		t.Errorf("expected the untracked file to be cleaned: %v", err)
+	}
+}
+
+func TestGitDirectoryCacheDirNotOwned(t *testing.T) {
+	bareDir, _ := testutil.NewBareRepo(t, map[string]string{"car.yaml": "kind: Car"})
+	defer os.RemoveAll(bareDir)
+
+	tmpDir, err := ioutil.TempDir("", "libgitops-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// A directory with unrelated files isn't wiped
+	opts := GitDirectoryOptions{Interval: time.Hour, CacheDir: filepath.Join(tmpDir, "clone")}
+	writeFiles(t, opts.CacheDir, map[string]string{"important.txt": "keep me"})
+	d, err := NewGitDirectoryFromURL(bareDir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.StartCheckoutLoop(); !errors.Is(err, ErrCacheDirNotEmpty) {
+		t.Errorf("expected ErrCacheDirNotEmpty, got %v", err)
+	}
+	if err := d.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(opts.CacheDir, "important.txt")); err != nil {
+		t.Errorf("expected the unrelated file to be kept: %v", err)
+	}
+
+	// Neither is an unrelated repository, but a clone of the same URL is adopted
+	for url, adopted := range map[string]bool{"/nonexistent": false, bareDir: true} {
+		opts.CacheDir = filepath.Join(tmpDir, filepath.Base(url))
+		if _, err := git.PlainClone(opts.CacheDir, false, &git.CloneOptions{URL: bareDir}); err != nil {
+			t.Fatal(err)
+		}
+		repo, err := git.PlainOpen(opts.CacheDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.DeleteRemote(defaultRemote); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := repo.CreateRemote(&config.RemoteConfig{Name: defaultRemote, URLs: []string{url}}); err != nil {
+			t.Fatal(err)
+		}
+
+		d, err := NewGitDirectoryFromURL(bareDir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = d.StartCheckoutLoop()
+		if adopted && err != nil {
+			t.Errorf("expected the clone of %s to be adopted, got %v", url, err)
+		} else if !adopted && !errors.Is(err, ErrCacheDirNotEmpty) {
+			t.Errorf("expected ErrCacheDirNotEmpty for the clone of %s, got %v", url, err)
+		}
+		if err := d.Cleanup(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(filepath.Join(opts.CacheDir, "car.yaml")); err != nil {
+			t.Errorf("expected the clone of %s to be kept: %v", url, err)
+		}
+	}
+}
+
+// pushCommit commits the given files to the given remote repository, and returns the hash of the commit
+func pushCommit(t *testing.T, url string, files map[string]string, msg string) plumbing.Hash {
+	dir, err := ioutil.TempDir("", "libgitops-upstream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := git.PlainClone(dir, false, &git.CloneOptions{URL: url})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeFiles(t, dir, files)
+	if err := wt.AddGlob("."); err != nil {
+		t.Fatal(err)
+	}
+	hash := testCommit(t, wt, msg)
+	if err := repo.Push(&git.PushOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func TestGitDirectoryShallow(t *testing.T) {
+	bareDir, _ := testutil.NewBareRepo(t, map[string]string{"car.yaml": "kind: Car"})
+	defer os.RemoveAll(bareDir)
+
+	first, err := getBranchHash(bareDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pushCommit(t, bareDir, map[string]string{"car.yaml": "kind: Car\nspec: {}"}, "second commit")
+
+	d, err := NewGitDirectoryFromURL("file://"+bareDir, GitDirectoryOptions{Interval: time.Hour, Depth: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = d.Cleanup() }()
+
+	if err := d.StartCheckoutLoop(); err != nil {
+		t.Fatal(err)
+	}
+
+	gd := d.(*gitDirectory)
+	if _, err := gd.commitObject(first); !errors.Is(err, ErrHistoryUnavailable) {
+		t.Errorf("expected ErrHistoryUnavailable, got %v", err)
+	}
+
+	// The changes of the oldest fetched commit are unknown, so the log can't go past it
+	if commits, err := d.Log(LogOptions{MaxCount: 1}); err != nil || len(commits) != 1 {
+		t.Errorf("expected the fetched commit to be logged, got %v: %v", commits, err)
+	}
+	for _, opts := range []LogOptions{{}, {Path: "car.yaml"}} {
+		if _, err := d.Log(opts); !errors.Is(err, ErrHistoryUnavailable) {
+			t.Errorf("expected ErrHistoryUnavailable for %+v, got %v", opts, err)
+		}
+	}
+
+	// Pulls and commits should still work in the shallow clone
+	pushCommit(t, bareDir, map[string]string{"bike.yaml": "kind: Bike"}, "third commit")
+	if err := d.Pull(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(d.Dir(), "bike.yaml")); err != nil {
+		t.Errorf("expected the pulled file to exist: %v", err)
+	}
+
+	d.Suspend()
+	writeFiles(t, d.Dir(), map[string]string{"car.yaml": "kind: Car\nspec: {shallow: true}"})
+	err = d.Commit(context.Background(), "Test", "test@example.com", "shallow commit")
+	d.Resume()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// getBranchHash returns the commit the default branch points to in the given repository
+func getBranchHash(dir string) (plumbing.Hash, error) {
+	repo, err := git.PlainOpen(dir)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	ref, err := repo.Reference(plumbing.NewBranchReferenceName(defaultBranch), true)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return ref.Hash(), nil
+}
@@ -0,0 +1,494 @@
+package gitdir
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/utils/merkletrie"
+)
+
+// CommitInfo describes a commit in the history of the GitDirectory
+type CommitInfo struct {
+	// Hash is the SHA of the commit
+	Hash string
+	// AuthorName and AuthorEmail identify the author of the commit
+	AuthorName  string
+	AuthorEmail string
+	// When is the time the commit was authored
+	When time.Time
+	// CommitterName and CommitterEmail identify the committer, who may differ from the author
+	CommitterName  string
+	CommitterEmail string
+	// Message is the full commit message
+	Message string
+	// Parents are the SHAs of the parent commits
+	Parents []string
+}
+
+// LogOptions specifies which commits Log returns
+type LogOptions struct {
+	// Revision is the revision to start from, by default the main branch
+	Revision string
+	// Path only includes commits changing the given slash-separated file or
+	// directory, relative to Dir(). By default, all commits changing Dir() are included.
+	Path string
+	// MaxCount limits the number of returned commits, zero means no limit
+	MaxCount int
+}
+
+// FileChangeType is an enum describing how a file changed between two commits
+type FileChangeType byte
+
+var _ fmt.Stringer = FileChangeType(0)
+
+const (
+	FileChangeNone   FileChangeType = iota // 0
+	FileChangeCreate                       // 1
+	FileChangeModify                       // 2
+	FileChangeDelete                       // 3
+)
+
+func (t FileChangeType) String() string {
+	switch t {
+	case 0:
+		return "NONE"
+	case 1:
+		return "CREATE"
+	case 2:
+		return "MODIFY"
+	case 3:
+		return "DELETE"
+	}
+
+	// Should never happen
+	return "UNKNOWN"
+}
+
+// FileChange describes a changed file between two commits
+type FileChange struct {
+	// Path is the slash-separated path of the file, relative to Dir()
+	Path string
+	// Type describes how the file was changed
+	Type FileChangeType
+	// From and To are the contents of the file in the old and new commit,
+	// From is nil for created files, and To is nil for deleted files
+	From []byte
+	To   []byte
+	// Patch is the change in the unified diff format
+	Patch string
+}
+
+// ResolveRevision resolves the given revision (e.g. a SHA, branch or tag) to a
+// commit SHA. An empty revision resolves to the main branch.
+// ErrNotStarted is returned if the repo hasn't been cloned yet.
+func (d *gitDirectory) ResolveRevision(rev string) (string, error) {
+	repo, err := d.openHistory()
+	if err != nil {
+		return "", err
+	}
+
+	hash, err := d.resolveRevision(repo, rev)
+	if err != nil {
+		return "", err
+	}
+	return hash.String(), nil
+}
+
+// Log lists the commits reachable from the given revision, newest first. Only commits
+// changing the given path (or the subdirectory) compared to all their parents are included.
+// In a shallow clone, if the walk reaches the oldest fetched commits before MaxCount commits
+// are found, an error wrapping ErrHistoryUnavailable is returned, as the changes of these
+// commits and the older history are unknown.
+// ErrNotStarted is returned if the repo hasn't been cloned yet.
+func (d *gitDirectory) Log(opts LogOptions) ([]CommitInfo, error) {
+	repo, err := d.openHistory()
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := d.resolveRevision(repo, opts.Revision)
+	if err != nil {
+		return nil, err
+	}
+
+	filePath := d.repoPath(opts.Path)
+	shallow, err := shallowCommits(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	start, err := d.commitObjectIn(repo, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	// Walk the history in reverse chronological order by committer time
+	var commits []CommitInfo
+	queue := []*object.Commit{start}
+	seen := map[plumbing.Hash]bool{start.Hash: true}
+	for len(queue) != 0 && (opts.MaxCount == 0 || len(commits) < opts.MaxCount) {
+		c := queue[0]
+		queue = queue[1:]
+
+		if shallow[c.Hash] {
+			// The parents of the commit at the boundary haven't been fetched. Without a path, the
+			// commit itself is included, but the history can't be followed further.
+			if filePath == "" {
+				commits = append(commits, newCommitInfo(c))
+				if opts.MaxCount != 0 && len(commits) >= opts.MaxCount {
+					break
+				}
+			}
+			return nil, fmt.Errorf("history before commit %s: %w", c.Hash, ErrHistoryUnavailable)
+		}
+
+		var parents []*object.Commit
+		for _, parentHash := range c.ParentHashes {
+			parent, err := d.commitObjectIn(repo, parentHash)
+			if err != nil {
+				return nil, err
+			}
+			parents = append(parents, parent)
+		}
+
+		changed, err := changesPath(c, parents, filePath)
+		if err != nil {
+			return nil, err
+		}
+		if changed {
+			commits = append(commits, newCommitInfo(c))
+		}
+
+		for _, parent := range parents {
+			if !seen[parent.Hash] {
+				seen[parent.Hash] = true
+				queue = append(queue, parent)
+			}
+		}
+		sort.SliceStable(queue, func(i, j int) bool {
+			return queue[i].Committer.When.After(queue[j].Committer.When)
+		})
+	}
+
+	return commits, nil
+}
+
+// ReadFile returns the contents of the file with the given slash-separated path, relative
+// to Dir(), at the given revision. If the file doesn't exist at the revision, an error
+// wrapping os.ErrNotExist is returned.
+// ErrNotStarted is returned if the repo hasn't been cloned yet.
+func (d *gitDirectory) ReadFile(rev, filePath string) ([]byte, error) {
+	repo, err := d.openHistory()
+	if err != nil {
+		return nil, err
+	}
+
+	tree, err := d.revisionTree(repo, rev)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := tree.File(d.repoPath(filePath))
+	if err == object.ErrFileNotFound {
+		return nil, fmt.Errorf("%q at revision %q: %w", filePath, rev, os.ErrNotExist)
+	} else if err != nil {
+		return nil, err
+	}
+
+	return readFile(f)
+}
+
+// ListFiles lists the slash-separated paths of all files under Dir() at the given revision
+// ErrNotStarted is returned if the repo hasn't been cloned yet.
+func (d *gitDirectory) ListFiles(rev string) ([]string, error) {
+	repo, err := d.openHistory()
+	if err != nil {
+		return nil, err
+	}
+
+	tree, err := d.subdirectoryTree(repo, rev)
+	if err != nil || tree == nil {
+		return nil, err
+	}
+
+	var files []string
+	err = tree.Files().ForEach(func(f *object.File) error {
+		files = append(files, f.Name)
+		return nil
+	})
+	return files, err
+}
+
+// Diff lists the files under Dir() that changed between the two given revisions
+// ErrNotStarted is returned if the repo hasn't been cloned yet.
+func (d *gitDirectory) Diff(fromRev, toRev string) ([]FileChange, error) {
+	repo, err := d.openHistory()
+	if err != nil {
+		return nil, err
+	}
+
+	fromTree, err := d.subdirectoryTree(repo, fromRev)
+	if err != nil {
+		return nil, err
+	}
+
+	toTree, err := d.subdirectoryTree(repo, toRev)
+	if err != nil {
+		return nil, err
+	}
+
+	changes, err := object.DiffTree(fromTree, toTree)
+	if err != nil {
+		return nil, fmt.Errorf("failed to diff %q and %q: %v", fromRev, toRev, err)
+	}
+
+	fileChanges := make([]FileChange, 0, len(changes))
+	for _, change := range changes {
+		fc, err := newFileChange(change)
+		if err != nil {
+			return nil, err
+		}
+		fileChanges = append(fileChanges, *fc)
+	}
+
+	return fileChanges, nil
+}
+
+// openHistory opens a separate handle to the repository for reading the history. Like for
+// OpenRevision, this doesn't need the lock for git operations, so the history can also be read
+// while the GitDirectory is suspended, e.g. in a transaction. A new handle is opened for every
+// operation, as go-git's storage isn't safe for concurrent use, and doesn't notice new packfiles.
+// ErrNotStarted is returned if the repo hasn't been cloned yet.
+func (d *gitDirectory) openHistory() (*git.Repository, error) {
+	if err := d.verifyRead(); err != nil {
+		return nil, err
+	}
+
+	repo, err := git.PlainOpen(d.cloneDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the clone: %v", err)
+	}
+	return repo, nil
+}
+
+// resolveRevision resolves the given revision to a commit hash in the given handle to the
+// repository, the empty revision is the main branch
+func (d *gitDirectory) resolveRevision(repo *git.Repository, rev string) (plumbing.Hash, error) {
+	if rev == "" {
+		rev = plumbing.NewBranchReferenceName(d.Branch).String()
+	}
+
+	hash, err := repo.ResolveRevision(plumbing.Revision(rev))
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("failed to resolve revision %q: %v", rev, err)
+	}
+	return *hash, nil
+}
+
+// revisionTree returns the tree of the whole repository at the given revision in the given handle to the repository
+func (d *gitDirectory) revisionTree(repo *git.Repository, rev string) (*object.Tree, error) {
+	hash, err := d.resolveRevision(repo, rev)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.commitTree(repo, hash)
+}
+
+// commitTree returns the tree of the whole repository at the given commit in the given handle to the repository
+func (d *gitDirectory) commitTree(repo *git.Repository, hash plumbing.Hash) (*object.Tree, error) {
+	c, err := d.commitObjectIn(repo, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	tree, err := c.Tree()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tree of commit %s: %v", hash, err)
+	}
+	return tree, nil
+}
+
+// subdirectoryTree returns the tree of the subdirectory at the given revision in the given
+// handle to the repository, or nil if the subdirectory doesn't exist at the revision
+func (d *gitDirectory) subdirectoryTree(repo *git.Repository, rev string) (*object.Tree, error) {
+	tree, err := d.revisionTree(repo, rev)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.subdirectoryOf(tree)
+}
+
+// subdirectoryOf returns the tree of the subdirectory in the given tree of the
+// whole repository, or nil if the subdirectory doesn't exist
+func (d *gitDirectory) subdirectoryOf(tree *object.Tree) (*object.Tree, error) {
+	if d.Subdirectory == "" {
+		return tree, nil
+	}
+
+	subTree, err := tree.Tree(d.Subdirectory)
+	if err == object.ErrDirectoryNotFound {
+		return nil, nil
+	}
+	return subTree, err
+}
+
+// repoPath converts the given slash-separated path relative to Dir() to a path relative to the repository root
+func (d *gitDirectory) repoPath(p string) string {
+	return strings.Trim(path.Join(d.Subdirectory, p), "/")
+}
+
+// shallowCommits returns the set of commits at the boundary of a shallow clone in the
+// given handle to the repository, which have parents that haven't been fetched
+func shallowCommits(repo *git.Repository) (map[plumbing.Hash]bool, error) {
+	hashes, err := repo.Storer.Shallow()
+	if err != nil {
+		return nil, err
+	}
+
+	shallow := make(map[plumbing.Hash]bool, len(hashes))
+	for _, hash := range hashes {
+		shallow[hash] = true
+	}
+	return shallow, nil
+}
+
+// changesPath checks if the given commit changes the given path compared to all its parents.
+// The empty path matches all commits.
+func changesPath(c *object.Commit, parents []*object.Commit, p string) (bool, error) {
+	if p == "" {
+		return true, nil
+	}
+
+	hash, err := pathHash(c, p)
+	if err != nil {
+		return false, err
+	}
+
+	if len(parents) == 0 {
+		return !hash.IsZero(), nil
+	}
+
+	for _, parent := range parents {
+		parentHash, err := pathHash(parent, p)
+		if err != nil {
+			return false, err
+		}
+		if parentHash == hash {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// pathHash returns the hash of the tree entry for the given path at the given commit,
+// or the zero hash if the path doesn't exist at the commit
+func pathHash(c *object.Commit, p string) (plumbing.Hash, error) {
+	tree, err := c.Tree()
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("failed to get tree of commit %s: %v", c.Hash, err)
+	}
+
+	return entryHash(tree, p)
+}
+
+// entryHash returns the hash of the entry for the given path in the given tree, or the
+// zero hash if the path doesn't exist in the tree. A nil tree is treated as empty.
+func entryHash(tree *object.Tree, p string) (plumbing.Hash, error) {
+	if tree == nil {
+		return plumbing.ZeroHash, nil
+	}
+
+	entry, err := tree.FindEntry(p)
+	switch err {
+	case nil:
+		return entry.Hash, nil
+	case object.ErrEntryNotFound, object.ErrDirectoryNotFound:
+		return plumbing.ZeroHash, nil
+	default:
+		return plumbing.ZeroHash, err
+	}
+}
+
+// newCommitInfo converts the given commit to a CommitInfo
+func newCommitInfo(c *object.Commit) CommitInfo {
+	parents := make([]string, 0, len(c.ParentHashes))
+	for _, parent := range c.ParentHashes {
+		parents = append(parents, parent.String())
+	}
+
+	return CommitInfo{
+		Hash:           c.Hash.String(),
+		AuthorName:     c.Author.Name,
+		AuthorEmail:    c.Author.Email,
+		When:           c.Author.When,
+		CommitterName:  c.Committer.Name,
+		CommitterEmail: c.Committer.Email,
+		Message:        c.Message,
+		Parents:        parents,
+	}
+}
+
+// newFileChange converts the given tree change to a FileChange, including the contents and patch
+func newFileChange(change *object.Change) (*FileChange, error) {
+	action, err := change.Action()
+	if err != nil {
+		return nil, err
+	}
+
+	from, to, err := change.Files()
+	if err != nil {
+		return nil, err
+	}
+
+	patch, err := change.Patch()
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute the patch for %q: %v", change, err)
+	}
+
+	fc := &FileChange{Patch: patch.String()}
+	switch action {
+	case merkletrie.Insert:
+		fc.Type, fc.Path = FileChangeCreate, change.To.Name
+	case merkletrie.Delete:
+		fc.Type, fc.Path = FileChangeDelete, change.From.Name
+	case merkletrie.Modify:
+		fc.Type, fc.Path = FileChangeModify, change.To.Name
+	default:
+		return nil, errors.New("unknown change action")
+	}
+
+	if from != nil {
+		if fc.From, err = readFile(from); err != nil {
+			return nil, err
+		}
+	}
+	if to != nil {
+		if fc.To, err = readFile(to); err != nil {
+			return nil, err
+		}
+	}
+
+	return fc, nil
+}
+
+// readFile reads the contents of the given file object
+func readFile(f *object.File) ([]byte, error) {
+	r, err := f.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+}
@@ -0,0 +1,133 @@
+package gitdir
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHistory(t *testing.T) {
+	dir, repo, wt := newTestRepo(t, map[string]string{
+		"team-a/cars/one.yaml": "kind: Car",
+		"team-a/cars/two.yaml": "kind: Car",
+		"team-b/car.yaml":      "kind: Car",
+	})
+	defer os.RemoveAll(dir)
+
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := head.Hash()
+
+	writeFiles(t, dir, map[string]string{"team-a/cars/one.yaml": "kind: Car\nspec: {}\n"})
+	second := testCommit(t, wt, "modify one")
+
+	writeFiles(t, dir, map[string]string{"team-b/car.yaml": "kind: Bike"})
+	testCommit(t, wt, "change team-b")
+
+	if err := os.Remove(filepath.Join(dir, "team-a", "cars", "two.yaml")); err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, dir, map[string]string{"team-a/cars/three.yaml": "kind: Car"})
+	if _, err := wt.Add("team-a/cars/three.yaml"); err != nil {
+		t.Fatal(err)
+	}
+	fourth := testCommit(t, wt, "replace two with three")
+
+	opts := GitDirectoryOptions{Subdirectory: "team-a"}
+	opts.Default()
+	d := &gitDirectory{GitDirectoryOptions: opts, cloneDir: dir, repo: repo, wt: wt, lock: &sync.Mutex{}}
+
+	if rev, err := d.ResolveRevision(""); err != nil || rev != fourth.String() {
+		t.Errorf("expected the main branch to resolve to %s, got %q: %v", fourth, rev, err)
+	}
+
+	// Commits not changing the subdirectory are skipped
+	commits, err := d.Log(LogOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commits) != 3 || commits[0].Hash != fourth.String() || commits[2].Hash != first.String() {
+		t.Errorf("unexpected log: %+v", commits)
+	}
+	if commits[0].AuthorEmail != "test@example.com" || len(commits[0].Parents) != 1 {
+		t.Errorf("unexpected commit info: %+v", commits[0])
+	}
+
+	// The path is relative to the subdirectory
+	commits, err = d.Log(LogOptions{Path: "cars/one.yaml"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commits) != 2 || commits[0].Hash != second.String() || commits[1].Hash != first.String() {
+		t.Errorf("unexpected log for path: %+v", commits)
+	}
+
+	if commits, err = d.Log(LogOptions{Path: "cars", MaxCount: 1}); err != nil || len(commits) != 1 || commits[0].Hash != fourth.String() {
+		t.Errorf("unexpected limited log: %+v, %v", commits, err)
+	}
+
+	content, err := d.ReadFile(first.String(), "cars/two.yaml")
+	if err != nil || string(content) != "kind: Car" {
+		t.Errorf("unexpected content: %q, %v", content, err)
+	}
+	if _, err := d.ReadFile("", "cars/two.yaml"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected os.ErrNotExist, got %v", err)
+	}
+
+	files, err := d.ListFiles(first.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	if !reflect.DeepEqual(files, []string{"cars/one.yaml", "cars/two.yaml"}) {
+		t.Errorf("unexpected files: %v", files)
+	}
+
+	changes, err := d.Diff(first.String(), fourth.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	types := map[string]FileChangeType{}
+	for _, c := range changes {
+		types[c.Path] = c.Type
+	}
+	expected := map[string]FileChangeType{
+		"cars/one.yaml":   FileChangeModify,
+		"cars/two.yaml":   FileChangeDelete,
+		"cars/three.yaml": FileChangeCreate,
+	}
+	if !reflect.DeepEqual(types, expected) {
+		t.Errorf("unexpected changes: %v", types)
+	}
+
+	for _, c := range changes {
+		if c.Path == "cars/one.yaml" && (string(c.From) != "kind: Car" || !strings.Contains(c.Patch, "+spec: {}")) {
+			t.Errorf("unexpected change: %+v", c)
+		}
+	}
+
+	// The history can be read while the GitDirectory is suspended, e.g. in a transaction
+	d.Suspend()
+	defer d.Resume()
+	done := make(chan error)
+	go func() {
+		_, err := d.Log(LogOptions{MaxCount: 1})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("reading the history blocked while suspended")
+	}
+}
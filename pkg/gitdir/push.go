@@ -0,0 +1,315 @@
+package gitdir
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	log "github.com/sirupsen/logrus"
+	"github.com/weaveworks/libgitops/pkg/util/gitmerge"
+)
+
+// CommitOptions provides optional parameters for Commit
+type CommitOptions struct {
+	// Validate is called with the slash-separated paths under Dir() changed by the commit, relative
+	// to Dir(), after the commit has been rebased onto new commits of the remote branch. Changes
+	// outside of the subdirectory, e.g. from squashed commits, aren't included. If it returns an
+	// error, the commit is discarded, and the error is returned by Commit.
+	Validate func(paths []string) error
+	// Paths limits the commit to the files with the given slash-separated paths, relative to Dir().
+	// Changes of other files aren't committed, and logged as a warning. They are left in the worktree,
+	// but discarded by the next checkout of a branch, or if the commit needs to be rebased. If nil,
+	// all changes under Dir() are committed.
+	Paths []string
+	// RejectDirty makes Commit fail with a *DirtyWorktreeError instead of warning,
+	// if Paths is set and files not included in it are changed.
+	RejectDirty bool
+	// CommitterName and CommitterEmail describe the committer, if different from the author.
+	CommitterName  string
+	CommitterEmail string
+	// Squash replaces the commits of the current branch since it diverged from the main branch
+	// with the new commit, which then contains all their changes, and force-pushes the branch.
+	// The commit is never rebased, if the push is rejected it's discarded.
+	Squash bool
+}
+
+// CommitOption is an interface which can be passed into Commit as a variadic-length argument list.
+type CommitOption interface {
+	// ApplyToCommitOptions applies the configuration of the current object into a target CommitOptions struct.
+	ApplyToCommitOptions(target *CommitOptions)
+}
+
+var _ CommitOption = &CommitOptions{}
+
+// ApplyToCommitOptions applies the set fields of o to target, so CommitOptions can be used as a CommitOption.
+func (o *CommitOptions) ApplyToCommitOptions(target *CommitOptions) {
+	if o.Validate != nil {
+		target.Validate = o.Validate
+	}
+	if o.Paths != nil {
+		target.Paths = o.Paths
+	}
+	if o.RejectDirty {
+		target.RejectDirty = true
+	}
+	if o.CommitterName != "" {
+		target.CommitterName = o.CommitterName
+	}
+	if o.CommitterEmail != "" {
+		target.CommitterEmail = o.CommitterEmail
+	}
+	if o.Squash {
+		target.Squash = true
+	}
+}
+
+// makeCommitOptions makes a completed CommitOptions struct from a list of CommitOption implementations.
+func makeCommitOptions(opts ...CommitOption) *CommitOptions {
+	o := &CommitOptions{}
+	for _, opt := range opts {
+		opt.ApplyToCommitOptions(o)
+	}
+	return o
+}
+
+// PushConflictError is returned by Commit, if the commit was rejected by the remote, and couldn't be
+// rebased onto the new remote commits, as they changed the same files. The commit is discarded.
+type PushConflictError struct {
+	// Branch is the name of the branch that was pushed
+	Branch string
+	// Remote is the SHA of the latest commit of the remote branch
+	Remote string
+	// Paths are the slash-separated paths of the conflicting files, relative to Dir(). Files
+	// outside of the subdirectory, e.g. changed by squashed commits, start with "../".
+	Paths []string
+}
+
+var _ error = &PushConflictError{}
+
+func (e *PushConflictError) Error() string {
+	return fmt.Sprintf("cannot push to branch %q, as commit %s changed the same files: %s", e.Branch, e.Remote, strings.Join(e.Paths, ", "))
+}
+
+// push pushes the current branch, and if the push is rejected as the remote branch has new commits, fetches
+// the remote branch and rebases the given commit onto it, up to PushRetries times. Squashed commits aren't
+// rebased. The hash of the pushed (possibly rebased) commit is returned. If the push fails for good, or for
+// another reason, the branch is reset to the remote branch, discarding the commit.
+func (d *gitDirectory) push(ctx context.Context, hash plumbing.Hash, o *CommitOptions) (plumbing.Hash, error) {
+	head, err := d.repo.Storer.Reference(plumbing.HEAD)
+	if err != nil {
+		return hash, err
+	}
+	branch := head.Target()
+	refSpec := fmt.Sprintf("%s:%[1]s", branch)
+	if o.Squash {
+		// The squashed commit replaces the commits of the remote branch
+		refSpec = "+" + refSpec
+	}
+
+	for attempt := 0; ; attempt++ {
+		// Perform the git push operation using the timeout
+		err = d.contextWithTimeout(ctx, func(innerCtx context.Context) error {
+			log.Debug("commitLoop: Will push with timeout")
+			return d.repo.PushContext(innerCtx, &git.PushOptions{
+				Auth:     d.auth(),
+				RefSpecs: []config.RefSpec{config.RefSpec(refSpec)},
+			})
+		})
+		switch err {
+		case nil, git.NoErrAlreadyUpToDate, context.Canceled:
+			return hash, err
+		case context.DeadlineExceeded:
+			d.discardCommit(branch)
+			return hash, err
+		}
+
+		// Only pushes rejected as the remote branch has new commits can succeed after rebasing. A squashed
+		// commit is force-pushed, and rebasing it would conflict with the earlier commits it replaces.
+		if !isNonFastForward(err) || o.Squash {
+			d.discardCommit(branch)
+			return hash, err
+		}
+		if attempt >= *d.PushRetries {
+			d.discardCommit(branch)
+			return hash, fmt.Errorf("failed to push after %d retries: %w", attempt, err)
+		}
+
+		log.Infof("Failed to push commit %s, rebasing it onto the remote branch %q: %v", hash, branch.Short(), err)
+		rebased, rebaseErr := d.rebase(ctx, hash, branch, o)
+		if rebaseErr != nil {
+			d.discardCommit(branch)
+			return hash, rebaseErr
+		}
+		if rebased.IsZero() {
+			// Nothing to rebase onto, so the push failed for another reason
+			d.discardCommit(branch)
+			return hash, err
+		}
+		hash = rebased
+	}
+}
+
+// rebase fetches the given remote branch, and re-applies the changes of the given commit onto it. The hash
+// of the new commit is returned, or the zero hash if the remote branch has no new commits to rebase onto.
+// If the remote commits changed the same files, a *PushConflictError is returned.
+func (d *gitDirectory) rebase(ctx context.Context, hash plumbing.Hash, branch plumbing.ReferenceName, o *CommitOptions) (plumbing.Hash, error) {
+	err := d.contextWithTimeout(ctx, func(innerCtx context.Context) error {
+		return d.fetchBranch(innerCtx, d.repo, branch.Short())
+	})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return plumbing.ZeroHash, fmt.Errorf("failed to fetch branch %q: %w", branch.Short(), err)
+	}
+
+	remoteRef, err := d.repo.Reference(plumbing.NewRemoteReferenceName(defaultRemote, branch.Short()), true)
+	if err == plumbing.ErrReferenceNotFound {
+		return plumbing.ZeroHash, nil
+	} else if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	c, err := d.commitObject(hash)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if c.NumParents() != 1 || c.ParentHashes[0] == remoteRef.Hash() || hash == remoteRef.Hash() {
+		return plumbing.ZeroHash, nil
+	}
+
+	baseTree, err := d.commitTree(d.repo, c.ParentHashes[0])
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	ourTree, err := d.commitTree(d.repo, hash)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	theirTree, err := d.commitTree(d.repo, remoteRef.Hash())
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	ourChanges, err := object.DiffTree(baseTree, ourTree)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	theirChanges, err := object.DiffTree(baseTree, theirTree)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	// Files changed in both commits conflict, unless they were changed in the same way
+	if conflicts := gitmerge.Conflicts(ourChanges, theirChanges); len(conflicts) != 0 {
+		for i, name := range conflicts {
+			conflicts[i] = d.dirPath(name)
+		}
+		return plumbing.ZeroHash, &PushConflictError{Branch: branch.Short(), Remote: remoteRef.Hash().String(), Paths: conflicts}
+	}
+
+	// Re-apply the changes on top of the remote commit
+	if err := d.wt.Reset(&git.ResetOptions{Commit: remoteRef.Hash(), Mode: git.HardReset}); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if err := gitmerge.ApplyChanges(d.wt, ourChanges); err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	var paths []string
+	for _, change := range ourChanges {
+		if name := gitmerge.ChangeName(change); d.inSubdirectory(name) {
+			paths = append(paths, d.dirPath(name))
+		}
+	}
+
+	if o.Validate != nil {
+		if err := o.Validate(paths); err != nil {
+			return plumbing.ZeroHash, fmt.Errorf("validation after rebasing onto %s failed: %w", remoteRef.Hash(), err)
+		}
+	}
+
+	rebased, err := d.wt.Commit(c.Message, &git.CommitOptions{
+		Author:    &c.Author,
+		Committer: &object.Signature{Name: c.Committer.Name, Email: c.Committer.Email, When: time.Now()},
+	})
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("git commit error: %v", err)
+	}
+	if d.Signer != nil {
+		if rebased, err = d.signCommit(rebased); err != nil {
+			return plumbing.ZeroHash, err
+		}
+	}
+
+	log.Infof("Rebased commit %s onto %s as %s", hash, remoteRef.Hash(), rebased)
+	return rebased, nil
+}
+
+// squashParents returns the parent of a commit squashing the commits of the current branch, the
+// commit the branch diverged from the main branch at. On the main branch, the parent is HEAD.
+func (d *gitDirectory) squashParents() ([]plumbing.Hash, error) {
+	head, err := d.repo.Head()
+	if err != nil {
+		return nil, err
+	}
+	mainRef, err := d.repo.Reference(plumbing.NewBranchReferenceName(d.Branch), true)
+	if err != nil {
+		return nil, err
+	}
+	if head.Hash() == mainRef.Hash() {
+		return []plumbing.Hash{head.Hash()}, nil
+	}
+
+	headCommit, err := d.commitObject(head.Hash())
+	if err != nil {
+		return nil, err
+	}
+	mainCommit, err := d.commitObject(mainRef.Hash())
+	if err != nil {
+		return nil, err
+	}
+	bases, err := headCommit.MergeBase(mainCommit)
+	if err != nil {
+		return nil, err
+	}
+	if len(bases) == 0 {
+		return nil, fmt.Errorf("branch %q has no common history with branch %q", head.Name().Short(), d.Branch)
+	}
+	return []plumbing.Hash{bases[0].Hash}, nil
+}
+
+// discardCommit resets the given branch, which must be checked out, to the remote branch if known
+func (d *gitDirectory) discardCommit(branch plumbing.ReferenceName) {
+	remoteRef, err := d.repo.Reference(plumbing.NewRemoteReferenceName(defaultRemote, branch.Short()), true)
+	if err != nil {
+		return
+	}
+
+	log.Warnf("Discarding the unpushed commit, resetting branch %q to %s", branch.Short(), remoteRef.Hash())
+	if err := d.wt.Reset(&git.ResetOptions{Commit: remoteRef.Hash(), Mode: git.HardReset}); err != nil {
+		log.Errorf("Failed to reset branch %q: %v", branch.Short(), err)
+	}
+}
+
+// isNonFastForward checks if the given push error means that the push was rejected, as the remote
+// branch has commits the pushed commit isn't based on. go-git checks this before pushing, but the
+// remote may also reject the push, e.g. if the branch was updated concurrently.
+func isNonFastForward(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "non-fast-forward") || strings.Contains(msg, "fetch first")
+}
+
+// dirPath converts the given slash-separated path relative to the repository root to a path relative
+// to Dir(). Paths outside of the subdirectory start with "../".
+func (d *gitDirectory) dirPath(p string) string {
+	if d.Subdirectory == "" {
+		return p
+	}
+	if d.inSubdirectory(p) {
+		return strings.TrimPrefix(p, d.Subdirectory+"/")
+	}
+	return strings.Repeat("../", strings.Count(d.Subdirectory, "/")+1) + p
+}
@@ -0,0 +1,221 @@
+package gitdir
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/weaveworks/libgitops/pkg/internal/testutil"
+)
+
+func TestPushRebase(t *testing.T) {
+	bareDir, _ := testutil.NewBareRepo(t, map[string]string{"car.yaml": "kind: Car", "bike.yaml": "kind: Bike"})
+	defer os.RemoveAll(bareDir)
+
+	d, err := NewGitDirectoryFromURL(bareDir, GitDirectoryOptions{Interval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = d.Cleanup() }()
+	if err := d.StartCheckoutLoop(); err != nil {
+		t.Fatal(err)
+	}
+
+	commit := func(files map[string]string, opts ...CommitOption) error {
+		d.Suspend()
+		defer d.Resume()
+		writeFiles(t, d.Dir(), files)
+		return d.Commit(context.Background(), "Test", "test@example.com", "local commit", opts...)
+	}
+
+	// Changes to other files are rebased onto the remote commit, and validated
+	theirs := pushCommit(t, bareDir, map[string]string{"bike.yaml": "kind: Bike\nspec: {}"}, "remote commit")
+	var validated []string
+	validate := &CommitOptions{Validate: func(paths []string) error {
+		validated = paths
+		return nil
+	}}
+	if err := commit(map[string]string{"car.yaml": "kind: Car\nspec: {}"}, validate); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(validated, []string{"car.yaml"}) {
+		t.Errorf("expected car.yaml to be validated, got %v", validated)
+	}
+
+	head, err := getBranchHash(bareDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log, err := d.Log(LogOptions{MaxCount: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(log) != 2 || log[0].Hash != head.String() || log[1].Hash != theirs.String() {
+		t.Errorf("expected the local commit to be rebased onto %s and pushed, got %v", theirs, log)
+	}
+	for file, expected := range map[string]string{"car.yaml": "kind: Car\nspec: {}", "bike.yaml": "kind: Bike\nspec: {}"} {
+		if content, err := d.ReadFile("", file); err != nil || string(content) != expected {
+			t.Errorf("unexpected content of %s: %q, %v", file, content, err)
+		}
+	}
+
+	// Changes to the same file conflict, and the local commit is discarded
+	theirs = pushCommit(t, bareDir, map[string]string{"car.yaml": "kind: Car\nspec: {color: red}"}, "conflicting commit")
+	err = commit(map[string]string{"car.yaml": "kind: Car\nspec: {color: blue}"})
+	var conflictErr *PushConflictError
+	if !errors.As(err, &conflictErr) {
+		t.Fatalf("expected a PushConflictError, got %v", err)
+	}
+	if !reflect.DeepEqual(conflictErr.Paths, []string{"car.yaml"}) || conflictErr.Remote != theirs.String() {
+		t.Errorf("unexpected conflict: %v", conflictErr)
+	}
+	if head, err := d.ResolveRevision(""); err != nil || head != theirs.String() {
+		t.Errorf("expected the branch to be reset to %s, got %s: %v", theirs, head, err)
+	}
+	if content, err := ioutil.ReadFile(filepath.Join(d.Dir(), "car.yaml")); err != nil || string(content) != "kind: Car\nspec: {color: red}" {
+		t.Errorf("expected the worktree to be reset, got %q: %v", content, err)
+	}
+
+	// Failing validation discards the local commit
+	theirs = pushCommit(t, bareDir, map[string]string{"bike.yaml": "kind: Bike"}, "another remote commit")
+	invalid := errors.New("invalid")
+	err = commit(map[string]string{"car.yaml": "kind: Car"}, &CommitOptions{Validate: func([]string) error { return invalid }})
+	if !errors.Is(err, invalid) {
+		t.Errorf("expected the validation error, got %v", err)
+	}
+	if head, err := d.ResolveRevision(""); err != nil || head != theirs.String() {
+		t.Errorf("expected the branch to be reset to %s, got %s: %v", theirs, head, err)
+	}
+}
+
+func TestCheckoutBranchSquash(t *testing.T) {
+	bareDir, _ := testutil.NewBareRepo(t, map[string]string{"car.yaml": "kind: Car", "bike.yaml": "kind: Bike"})
+	defer os.RemoveAll(bareDir)
+	base, err := getBranchHash(bareDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := NewGitDirectoryFromURL(bareDir, GitDirectoryOptions{Interval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = d.Cleanup() }()
+	if err := d.StartCheckoutLoop(); err != nil {
+		t.Fatal(err)
+	}
+
+	// commitTo commits the files to the given branch, creating it if new is true
+	commitTo := func(branch string, new bool, files map[string]string, opts ...CommitOption) {
+		d.Suspend()
+		defer d.Resume()
+		defer func() { _ = d.CheckoutMainBranch() }()
+
+		if new {
+			err = d.CheckoutNewBranch(branch)
+		} else {
+			err = d.CheckoutBranch(context.Background(), branch)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeFiles(t, d.Dir(), files)
+		if err := d.Commit(context.Background(), "Test", "test@example.com", "commit to "+branch, opts...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	commitTo("update", true, map[string]string{"car.yaml": "kind: Car\nspec: {}"})
+	// Commits appended to the branch keep the earlier ones
+	commitTo("update", false, map[string]string{"bike.yaml": "kind: Bike\nspec: {}"})
+	if _, err := d.ResolveRevision("update~2"); err != nil {
+		t.Errorf("expected two commits on the branch: %v", err)
+	}
+	// A squashed commit replaces them, containing all their changes
+	commitTo("update", false, map[string]string{"car.yaml": "kind: Car\nspec: {color: red}"}, &CommitOptions{Squash: true})
+
+	repo, err := git.PlainOpen(bareDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := repo.Reference(plumbing.NewBranchReferenceName("update"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := repo.CommitObject(ref.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.NumParents() != 1 || c.ParentHashes[0] != base {
+		t.Errorf("expected the squashed commit to be based on %s, got %v", base, c.ParentHashes)
+	}
+	for file, expected := range map[string]string{"car.yaml": "kind: Car\nspec: {color: red}", "bike.yaml": "kind: Bike\nspec: {}"} {
+		if f, err := c.File(file); err != nil {
+			t.Error(err)
+		} else if content, _ := f.Contents(); content != expected {
+			t.Errorf("unexpected content of %s: %q", file, content)
+		}
+	}
+
+	// Missing branches can't be checked out
+	d.Suspend()
+	defer d.Resume()
+	if err := d.CheckoutBranch(context.Background(), "missing"); err == nil {
+		t.Error("expected error checking out a missing branch")
+	}
+}
+
+func TestPushFailure(t *testing.T) {
+	bareDir, _ := testutil.NewBareRepo(t, map[string]string{"car.yaml": "kind: Car"})
+	defer os.RemoveAll(bareDir)
+
+	d, err := NewGitDirectoryFromURL(bareDir, GitDirectoryOptions{Interval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = d.Cleanup() }()
+	if err := d.StartCheckoutLoop(); err != nil {
+		t.Fatal(err)
+	}
+	head := mustResolve(t, d, "")
+
+	// Pushes failing for other reasons than new remote commits aren't rebased and retried
+	if err := os.RemoveAll(bareDir); err != nil {
+		t.Fatal(err)
+	}
+	d.Suspend()
+	writeFiles(t, d.Dir(), map[string]string{"car.yaml": "kind: Car\nspec: {}"})
+	err = d.Commit(context.Background(), "Test", "test@example.com", "unpushable commit")
+	d.Resume()
+	if err == nil || strings.Contains(err.Error(), "fetch") || strings.Contains(err.Error(), "retries") {
+		t.Errorf("expected the push to fail without retrying, got %v", err)
+	}
+	if rev := mustResolve(t, d, ""); rev != head {
+		t.Errorf("expected the commit to be discarded, got %s", rev)
+	}
+}
+
+func TestDirPath(t *testing.T) {
+	tests := []struct {
+		subdirectory, path, expected string
+	}{
+		{"", "cars/car.yaml", "cars/car.yaml"},
+		{"cars", "cars/car.yaml", "car.yaml"},
+		{"cars", "bikes/bike.yaml", "../bikes/bike.yaml"},
+		{"team/cars", "README.md", "../../README.md"},
+		{"cars", "carsharing/car.yaml", "../carsharing/car.yaml"},
+	}
+	for _, tt := range tests {
+		d := &gitDirectory{GitDirectoryOptions: GitDirectoryOptions{Subdirectory: tt.subdirectory}}
+		if actual := d.dirPath(tt.path); actual != tt.expected {
+			t.Errorf("dirPath(%q) in %q: expected %q, got %q", tt.path, tt.subdirectory, tt.expected, actual)
+		}
+	}
+}
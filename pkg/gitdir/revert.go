@@ -0,0 +1,169 @@
+package gitdir
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/object"
+	log "github.com/sirupsen/logrus"
+	"github.com/weaveworks/libgitops/pkg/util/gitmerge"
+)
+
+// ConflictError is returned by Revert, if files changed by the reverted
+// commit have been changed again by later commits
+type ConflictError struct {
+	// Commit is the SHA of the commit that was reverted
+	Commit string
+	// Paths are the slash-separated paths of the conflicting files, relative to Dir()
+	Paths []string
+}
+
+var _ error = &ConflictError{}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("cannot revert commit %s, as later commits changed the same files: %s", e.Commit, strings.Join(e.Paths, ", "))
+}
+
+// Revert applies the inverse of the changes of the given commit (compared to its parent) under Dir()
+// to the worktree, and adds them to the index. The changes are committed by the next call to Commit.
+// The slash-separated paths of the changed files, relative to Dir(), are returned. If any of the
+// changed files have been changed since the commit, nothing is applied, and a *ConflictError is
+// returned. Merge commits can't be reverted.
+// As with Commit, the GitDirectory must be suspended while reverting, e.g. during a transaction.
+// ErrNotStarted is returned if the repo hasn't been cloned yet.
+// ErrCannotWriteToReadOnly is returned if opts.AuthMethod wasn't provided for a remote repository.
+func (d *gitDirectory) Revert(commit string) ([]string, error) {
+	if err := d.verifyWrite(); err != nil {
+		return nil, err
+	}
+
+	hash, err := d.resolveRevision(d.repo, commit)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := d.commitObject(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.NumParents() > 1 {
+		return nil, fmt.Errorf("cannot revert merge commit %s", hash)
+	}
+
+	// The parent tree is nil for the root commit, which is treated as empty
+	var parentTree *object.Tree
+	if c.NumParents() == 1 {
+		if parentTree, err = d.commitTree(d.repo, c.ParentHashes[0]); err != nil {
+			return nil, err
+		}
+		if parentTree, err = d.subdirectoryOf(parentTree); err != nil {
+			return nil, err
+		}
+	}
+
+	tree, err := d.commitTree(d.repo, hash)
+	if err != nil {
+		return nil, err
+	}
+	if tree, err = d.subdirectoryOf(tree); err != nil {
+		return nil, err
+	}
+
+	headTree, err := d.headTree()
+	if err != nil {
+		return nil, err
+	}
+
+	changes, err := object.DiffTree(parentTree, tree)
+	if err != nil {
+		return nil, fmt.Errorf("failed to diff commit %s: %v", hash, err)
+	}
+
+	// Make sure the files are still as the commit left them, before changing anything
+	var conflicts []string
+	for _, change := range changes {
+		current, err := entryHash(headTree, gitmerge.ChangeName(change))
+		if err != nil {
+			return nil, err
+		}
+		if current != change.To.TreeEntry.Hash {
+			conflicts = append(conflicts, gitmerge.ChangeName(change))
+		}
+	}
+	if len(conflicts) != 0 {
+		sort.Strings(conflicts)
+		return nil, &ConflictError{Commit: hash.String(), Paths: conflicts}
+	}
+
+	paths := make([]string, 0, len(changes))
+	for _, change := range changes {
+		from, _, err := change.Files()
+		if err != nil {
+			return nil, err
+		}
+		if err := d.applyFile(gitmerge.ChangeName(change), from); err != nil {
+			return nil, err
+		}
+		paths = append(paths, gitmerge.ChangeName(change))
+	}
+
+	log.Infof("Reverted commit %s, changing %d files", hash, len(changes))
+	return paths, nil
+}
+
+// Restore sets the files with the given slash-separated paths, relative to Dir(), in the worktree to
+// their state at the given revision, and adds them to the index. Files not existing at the revision are
+// removed. The changes are committed by the next call to Commit.
+// As with Commit, the GitDirectory must be suspended while restoring, e.g. during a transaction.
+// ErrNotStarted is returned if the repo hasn't been cloned yet.
+// ErrCannotWriteToReadOnly is returned if opts.AuthMethod wasn't provided for a remote repository.
+func (d *gitDirectory) Restore(rev string, paths []string) error {
+	if err := d.verifyWrite(); err != nil {
+		return err
+	}
+
+	tree, err := d.subdirectoryTree(d.repo, rev)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range paths {
+		var f *object.File
+		if tree != nil {
+			f, err = tree.File(p)
+			if err == object.ErrFileNotFound {
+				f = nil
+			} else if err != nil {
+				return err
+			}
+		}
+
+		if err := d.applyFile(p, f); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// headTree returns the tree of the subdirectory at HEAD, or nil if it doesn't exist
+func (d *gitDirectory) headTree() (*object.Tree, error) {
+	head, err := d.repo.Head()
+	if err != nil {
+		return nil, err
+	}
+
+	tree, err := d.commitTree(d.repo, head.Hash())
+	if err != nil {
+		return nil, err
+	}
+	return d.subdirectoryOf(tree)
+}
+
+// applyFile sets the file with the given slash-separated path, relative to Dir(), in the worktree
+// to the contents of the given file object, or removes it if f is nil. The change is added to the index.
+func (d *gitDirectory) applyFile(p string, f *object.File) error {
+	return gitmerge.ApplyFile(d.wt, d.repoPath(p), f)
+}
@@ -0,0 +1,122 @@
+package gitdir
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/weaveworks/libgitops/pkg/internal/testutil"
+)
+
+func TestRevertAndRestore(t *testing.T) {
+	bareDir, _ := testutil.NewBareRepo(t, map[string]string{"cars/one.yaml": "kind: Car", "cars/two.yaml": "kind: Car"})
+	defer os.RemoveAll(bareDir)
+
+	d, err := NewGitDirectoryFromURL(bareDir, GitDirectoryOptions{Interval: time.Hour, Subdirectory: "cars"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = d.Cleanup() }()
+
+	if err := d.StartCheckoutLoop(); err != nil {
+		t.Fatal(err)
+	}
+	initial, err := d.ResolveRevision("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// commit runs fn with the GitDirectory suspended, commits, and returns the new HEAD
+	commit := func(msg string, fn func() error) string {
+		d.Suspend()
+		err := fn()
+		if err == nil {
+			err = d.Commit(context.Background(), "Test", "test@example.com", msg)
+		}
+		d.Resume()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		head, err := d.ResolveRevision("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return head
+	}
+
+	readFile := func(name string) string {
+		content, err := ioutil.ReadFile(filepath.Join(d.Dir(), name))
+		if os.IsNotExist(err) {
+			return ""
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		return string(content)
+	}
+
+	changeOne := commit("change one", func() error {
+		writeFiles(t, d.Dir(), map[string]string{"one.yaml": "kind: Bike"})
+		return os.Remove(filepath.Join(d.Dir(), "two.yaml"))
+	})
+	changeOneAgain := commit("change one again", func() error {
+		writeFiles(t, d.Dir(), map[string]string{"one.yaml": "kind: Boat"})
+		return nil
+	})
+
+	// Reverting the first change conflicts with the second one
+	d.Suspend()
+	_, err = d.Revert(changeOne)
+	d.Resume()
+	conflictErr, ok := err.(*ConflictError)
+	if !ok || !reflect.DeepEqual(conflictErr.Paths, []string{"one.yaml"}) {
+		t.Fatalf("expected a conflict for one.yaml, got %v", err)
+	}
+	if readFile("one.yaml") != "kind: Boat" || readFile("two.yaml") != "" {
+		t.Error("expected the worktree to be unchanged after a conflict")
+	}
+
+	commit("revert change one again", func() error {
+		paths, err := d.Revert(changeOneAgain)
+		if err == nil && !reflect.DeepEqual(paths, []string{"one.yaml"}) {
+			t.Errorf("unexpected reverted paths: %v", paths)
+		}
+		return err
+	})
+	if readFile("one.yaml") != "kind: Bike" {
+		t.Errorf("unexpected content after revert: %q", readFile("one.yaml"))
+	}
+
+	commit("revert change one", func() error {
+		_, err := d.Revert(changeOne)
+		return err
+	})
+	if readFile("one.yaml") != "kind: Car" || readFile("two.yaml") != "kind: Car" {
+		t.Error("expected the deleted file to be restored by the revert")
+	}
+
+	commit("restore", func() error {
+		writeFiles(t, d.Dir(), map[string]string{"three.yaml": "kind: Car"})
+		return d.Restore(changeOne, []string{"one.yaml", "two.yaml"})
+	})
+	if readFile("one.yaml") != "kind: Bike" || readFile("two.yaml") != "" {
+		t.Error("expected the files to be restored to their state at the revision")
+	}
+
+	// The restore is committed and pushed
+	changes, err := d.Diff(initial, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	types := map[string]FileChangeType{}
+	for _, c := range changes {
+		types[c.Path] = c.Type
+	}
+	if !reflect.DeepEqual(types, map[string]FileChangeType{"one.yaml": FileChangeModify, "two.yaml": FileChangeDelete}) {
+		t.Errorf("unexpected committed changes: %v", types)
+	}
+}
@@ -0,0 +1,122 @@
+package gitdir
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// Revision gives read-only access to the files under Dir() at a fixed commit,
+// read directly from the Git object database without touching the worktree.
+// A Revision is safe for concurrent use, also with the checkout loop.
+type Revision interface {
+	// Hash returns the SHA of the commit
+	Hash() string
+	// ReadFile returns the contents of the file with the given slash-separated path,
+	// relative to Dir(). If the file doesn't exist, an error wrapping os.ErrNotExist
+	// is returned.
+	ReadFile(path string) ([]byte, error)
+	// FileHash returns the SHA of the blob of the file with the given slash-separated
+	// path, relative to Dir(). If the file doesn't exist, an error wrapping
+	// os.ErrNotExist is returned.
+	FileHash(path string) (string, error)
+	// ListFiles lists the slash-separated paths of all files under Dir()
+	ListFiles() ([]string, error)
+}
+
+// OpenRevision resolves the given revision (e.g. a SHA, branch or tag), and returns a
+// Revision for the resolved commit. The Revision uses its own handle to the object
+// database, as go-git's storage isn't safe for concurrent use. The Revision can't be
+// used anymore after Cleanup.
+// ErrNotStarted is returned if the repo hasn't been cloned yet.
+func (d *gitDirectory) OpenRevision(rev string) (Revision, error) {
+	repo, err := d.openHistory()
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := d.resolveRevision(repo, rev)
+	if err != nil {
+		return nil, err
+	}
+
+	tree, err := d.commitTree(repo, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	if tree, err = d.subdirectoryOf(tree); err != nil {
+		return nil, err
+	}
+
+	return &gitRevision{hash: hash, tree: tree}, nil
+}
+
+// gitRevision implements Revision for a tree in a separate handle to the repository
+type gitRevision struct {
+	hash plumbing.Hash
+	// tree is the tree of the subdirectory, or nil if it doesn't exist
+	tree *object.Tree
+	// mux guards the storage of tree
+	mux sync.Mutex
+}
+
+var _ Revision = &gitRevision{}
+
+func (r *gitRevision) Hash() string {
+	return r.hash.String()
+}
+
+func (r *gitRevision) ReadFile(path string) ([]byte, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	f, err := r.file(path)
+	if err != nil {
+		return nil, err
+	}
+	return readFile(f)
+}
+
+func (r *gitRevision) FileHash(path string) (string, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	f, err := r.file(path)
+	if err != nil {
+		return "", err
+	}
+	return f.Hash.String(), nil
+}
+
+func (r *gitRevision) ListFiles() ([]string, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if r.tree == nil {
+		return nil, nil
+	}
+
+	var files []string
+	err := r.tree.Files().ForEach(func(f *object.File) error {
+		files = append(files, f.Name)
+		return nil
+	})
+	return files, err
+}
+
+// file looks up the file with the given path in the tree, the lock must be held
+func (r *gitRevision) file(path string) (*object.File, error) {
+	if r.tree == nil {
+		return nil, fmt.Errorf("%q at %s: %w", path, r.hash, os.ErrNotExist)
+	}
+
+	f, err := r.tree.File(path)
+	if err == object.ErrFileNotFound {
+		return nil, fmt.Errorf("%q at %s: %w", path, r.hash, os.ErrNotExist)
+	}
+	return f, err
+}
@@ -0,0 +1,67 @@
+package gitdir
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestOpenRevision(t *testing.T) {
+	dir, repo, wt := newTestRepo(t, map[string]string{
+		"team-a/car.yaml": "kind: Car",
+		"team-b/car.yaml": "kind: Car",
+	})
+	defer os.RemoveAll(dir)
+
+	opts := GitDirectoryOptions{Subdirectory: "team-a"}
+	opts.Default()
+	d := &gitDirectory{GitDirectoryOptions: opts, cloneDir: dir, repo: repo, wt: wt, lock: &sync.Mutex{}}
+
+	r, err := d.OpenRevision("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// New commits don't affect the opened revision
+	writeFiles(t, dir, map[string]string{"team-a/car.yaml": "kind: Bike", "team-a/bike.yaml": "kind: Bike"})
+	if _, err := wt.Add("team-a/bike.yaml"); err != nil {
+		t.Fatal(err)
+	}
+	head := testCommit(t, wt, "add bike")
+	if r.Hash() == head.String() {
+		t.Fatal("expected the revision to stay at the first commit")
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if content, err := r.ReadFile("car.yaml"); err != nil || string(content) != "kind: Car" {
+				t.Errorf("unexpected content: %q, %v", content, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if files, err := r.ListFiles(); err != nil || len(files) != 1 || files[0] != "car.yaml" {
+		t.Errorf("unexpected files: %v, %v", files, err)
+	}
+	if _, err := r.ReadFile("bike.yaml"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected os.ErrNotExist, got %v", err)
+	}
+	if _, err := r.FileHash("../team-b/car.yaml"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected os.ErrNotExist outside of the subdirectory, got %v", err)
+	}
+
+	latest, err := d.OpenRevision(head.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldHash, _ := r.FileHash("car.yaml")
+	newHash, err := latest.FileHash("car.yaml")
+	if err != nil || newHash == oldHash {
+		t.Errorf("expected the file hash to change: %q, %v", newHash, err)
+	}
+}
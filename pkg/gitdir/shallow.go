@@ -0,0 +1,79 @@
+package gitdir
+
+import (
+	"context"
+	"fmt"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/storage"
+)
+
+// shallowPull fetches the configured branch with the configured depth, and resets the worktree
+// to it while keeping local changes. This is needed as go-git's pull walks the history of the
+// local references for fetch negotiation, and fails when reaching the boundary of the shallow
+// clone (ref: https://github.com/src-d/go-git/issues/1143). As every commit is pushed directly,
+// the branch is never expected to diverge from the remote.
+func (d *gitDirectory) shallowPull(ctx context.Context) error {
+	branch := plumbing.NewBranchReferenceName(d.Branch)
+	remoteBranch := plumbing.NewRemoteReferenceName(defaultRemote, d.Branch)
+
+	if err := d.fetchBranch(ctx, d.repo, d.Branch); err != nil {
+		return err
+	}
+
+	ref, err := d.repo.Reference(remoteBranch, true)
+	if err != nil {
+		return err
+	}
+
+	head, err := d.repo.Head()
+	if err != nil {
+		return err
+	}
+	if head.Hash() == ref.Hash() {
+		return git.NoErrAlreadyUpToDate
+	}
+
+	if err := d.repo.Storer.SetReference(plumbing.NewHashReference(branch, ref.Hash())); err != nil {
+		return err
+	}
+	return d.wt.Reset(&git.ResetOptions{Commit: ref.Hash(), Mode: git.MergeReset})
+}
+
+// fetchBranch fetches the given branch into the remote-tracking branch in the given handle to the
+// repository. In a shallow clone, the configured depth is fetched using a Remote which doesn't see
+// the local references, so that no history is walked. In that case up to Depth commits are
+// re-fetched if the branch changed.
+func (d *gitDirectory) fetchBranch(ctx context.Context, repo *git.Repository, branchName string) error {
+	branch := plumbing.NewBranchReferenceName(branchName)
+	remoteBranch := plumbing.NewRemoteReferenceName(defaultRemote, branchName)
+
+	remote, err := repo.Remote(defaultRemote)
+	if err != nil {
+		return err
+	}
+	if d.Depth > 0 {
+		remote = git.NewRemote(&noRefsStorer{repo.Storer}, remote.Config())
+	}
+
+	return remote.FetchContext(ctx, &git.FetchOptions{
+		RemoteName: defaultRemote,
+		RefSpecs:   []config.RefSpec{config.RefSpec(fmt.Sprintf("+%s:%s", branch, remoteBranch))},
+		Auth:       d.auth(),
+		Depth:      d.Depth,
+		Tags:       git.NoTags,
+		Force:      true,
+	})
+}
+
+// noRefsStorer hides the references of the embedded Storer from iteration
+type noRefsStorer struct {
+	storage.Storer
+}
+
+func (s *noRefsStorer) IterReferences() (storer.ReferenceIter, error) {
+	return storer.NewReferenceSliceIter(nil), nil
+}
@@ -0,0 +1,437 @@
+package gitdir
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	// ErrUnsignedCommit happens if a commit without a signature is verified
+	ErrUnsignedCommit = errors.New("the commit isn't signed")
+	// ErrNoVerifier happens if VerifyCommit is called without a Verifier configured
+	ErrNoVerifier = errors.New("no commit verifier configured")
+)
+
+// CommitSigner signs the commits created by the GitDirectory
+type CommitSigner interface {
+	// Sign returns the armored signature of the given encoded commit
+	Sign(message io.Reader) (string, error)
+}
+
+// CommitVerifier verifies the signatures of the commits observed by the GitDirectory
+type CommitVerifier interface {
+	// Verify verifies the given armored signature of the given encoded commit
+	Verify(message io.Reader, signature string) error
+}
+
+// SignatureError is returned if the signature of a commit couldn't be verified
+type SignatureError struct {
+	// Commit is the SHA of the commit
+	Commit string
+	// Err is the underlying error
+	Err error
+}
+
+var _ error = &SignatureError{}
+
+func (e *SignatureError) Error() string {
+	return fmt.Sprintf("failed to verify the signature of commit %s: %v", e.Commit, e.Err)
+}
+
+func (e *SignatureError) Unwrap() error {
+	return e.Err
+}
+
+// NewOpenPGPSigner creates a CommitSigner signing with the given OpenPGP entity,
+// which must have a decrypted private key
+func NewOpenPGPSigner(entity *openpgp.Entity) CommitSigner {
+	return &openPGPSigner{entity}
+}
+
+type openPGPSigner struct {
+	entity *openpgp.Entity
+}
+
+func (s *openPGPSigner) Sign(message io.Reader) (string, error) {
+	var b bytes.Buffer
+	if err := openpgp.ArmoredDetachSign(&b, s.entity, message, nil); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// NewOpenPGPVerifier creates a CommitVerifier accepting OpenPGP signatures by keys in the given keyring
+func NewOpenPGPVerifier(keyring openpgp.KeyRing) CommitVerifier {
+	return &openPGPVerifier{keyring}
+}
+
+type openPGPVerifier struct {
+	keyring openpgp.KeyRing
+}
+
+func (v *openPGPVerifier) Verify(message io.Reader, signature string) error {
+	_, err := openpgp.CheckArmoredDetachedSignature(v.keyring, message, strings.NewReader(signature))
+	return err
+}
+
+const (
+	sshSigMagic     = "SSHSIG"
+	sshSigVersion   = 1
+	sshSigNamespace = "git"
+	sshSigArmorHead = "-----BEGIN SSH SIGNATURE-----"
+	sshSigArmorTail = "-----END SSH SIGNATURE-----"
+)
+
+// sshSigSignedData is the data signed by the SSH key, prefixed by sshSigMagic
+type sshSigSignedData struct {
+	Namespace     string
+	Reserved      string
+	HashAlgorithm string
+	Hash          []byte
+}
+
+// sshSigBlob is the signature, prefixed by sshSigMagic
+type sshSigBlob struct {
+	Version       uint32
+	PublicKey     []byte
+	Namespace     string
+	Reserved      string
+	HashAlgorithm string
+	Signature     []byte
+}
+
+// NewSSHSigner creates a CommitSigner signing with the given SSH key, in the format used
+// by "ssh-keygen -Y sign" and Git's gpg.format=ssh
+func NewSSHSigner(signer ssh.Signer) CommitSigner {
+	return &sshSigner{signer}
+}
+
+type sshSigner struct {
+	signer ssh.Signer
+}
+
+func (s *sshSigner) Sign(message io.Reader) (string, error) {
+	h := sha512.New()
+	if _, err := io.Copy(h, message); err != nil {
+		return "", err
+	}
+
+	data := sshSigData(h.Sum(nil), "sha512")
+	var sig *ssh.Signature
+	var err error
+	if algSigner, ok := s.signer.(ssh.AlgorithmSigner); ok && s.signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+		// SHA-1 RSA signatures are rejected by ssh-keygen
+		sig, err = algSigner.SignWithAlgorithm(rand.Reader, data, ssh.SigAlgoRSASHA2512)
+	} else {
+		sig, err = s.signer.Sign(rand.Reader, data)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	blob := append([]byte(sshSigMagic), ssh.Marshal(&sshSigBlob{
+		Version:       sshSigVersion,
+		PublicKey:     s.signer.PublicKey().Marshal(),
+		Namespace:     sshSigNamespace,
+		HashAlgorithm: "sha512",
+		Signature:     ssh.Marshal(sig),
+	})...)
+
+	encoded := base64.StdEncoding.EncodeToString(blob)
+	var b strings.Builder
+	b.WriteString(sshSigArmorHead + "\n")
+	for len(encoded) > 70 {
+		b.WriteString(encoded[:70] + "\n")
+		encoded = encoded[70:]
+	}
+	b.WriteString(encoded + "\n" + sshSigArmorTail + "\n")
+	return b.String(), nil
+}
+
+// NewSSHVerifier creates a CommitVerifier accepting SSH signatures by any of the given keys
+func NewSSHVerifier(allowedKeys ...ssh.PublicKey) CommitVerifier {
+	return &sshVerifier{allowedKeys}
+}
+
+type sshVerifier struct {
+	allowedKeys []ssh.PublicKey
+}
+
+func (v *sshVerifier) Verify(message io.Reader, signature string) error {
+	signature = strings.TrimSpace(signature)
+	if !strings.HasPrefix(signature, sshSigArmorHead) || !strings.HasSuffix(signature, sshSigArmorTail) {
+		return errors.New("not an SSH signature")
+	}
+
+	encoded := strings.TrimSuffix(strings.TrimPrefix(signature, sshSigArmorHead), sshSigArmorTail)
+	blob, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(encoded), ""))
+	if err != nil {
+		return fmt.Errorf("invalid SSH signature encoding: %v", err)
+	}
+
+	if !bytes.HasPrefix(blob, []byte(sshSigMagic)) {
+		return errors.New("invalid SSH signature preamble")
+	}
+
+	var sigBlob sshSigBlob
+	if err := ssh.Unmarshal(blob[len(sshSigMagic):], &sigBlob); err != nil {
+		return fmt.Errorf("invalid SSH signature: %v", err)
+	}
+	if sigBlob.Version != sshSigVersion || sigBlob.Namespace != sshSigNamespace {
+		return fmt.Errorf("unsupported SSH signature version %d or namespace %q", sigBlob.Version, sigBlob.Namespace)
+	}
+
+	pub, err := ssh.ParsePublicKey(sigBlob.PublicKey)
+	if err != nil {
+		return fmt.Errorf("invalid public key in SSH signature: %v", err)
+	}
+	if !v.allowed(pub) {
+		return fmt.Errorf("the commit is signed by an unknown key %s", ssh.FingerprintSHA256(pub))
+	}
+
+	var h hash.Hash
+	switch sigBlob.HashAlgorithm {
+	case "sha512":
+		h = sha512.New()
+	case "sha256":
+		h = sha256.New()
+	default:
+		return fmt.Errorf("unsupported SSH signature hash algorithm %q", sigBlob.HashAlgorithm)
+	}
+	if _, err := io.Copy(h, message); err != nil {
+		return err
+	}
+
+	var sig ssh.Signature
+	if err := ssh.Unmarshal(sigBlob.Signature, &sig); err != nil {
+		return fmt.Errorf("invalid SSH signature: %v", err)
+	}
+	return pub.Verify(sshSigData(h.Sum(nil), sigBlob.HashAlgorithm), &sig)
+}
+
+func (v *sshVerifier) allowed(pub ssh.PublicKey) bool {
+	for _, key := range v.allowedKeys {
+		if bytes.Equal(key.Marshal(), pub.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+// sshSigData returns the data to be signed for the given message hash
+func sshSigData(messageHash []byte, hashAlgorithm string) []byte {
+	return append([]byte(sshSigMagic), ssh.Marshal(&sshSigSignedData{
+		Namespace:     sshSigNamespace,
+		HashAlgorithm: hashAlgorithm,
+		Hash:          messageHash,
+	})...)
+}
+
+// signCommit replaces the given commit created on the current branch by a commit signed using
+// the configured Signer, and returns the hash of the signed commit
+func (d *gitDirectory) signCommit(hash plumbing.Hash) (plumbing.Hash, error) {
+	c, err := d.repo.CommitObject(hash)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	unsigned := &plumbing.MemoryObject{}
+	if err := c.EncodeWithoutSignature(unsigned); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	r, err := unsigned.Reader()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	if c.PGPSignature, err = d.Signer.Sign(r); err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("failed to sign commit: %v", err)
+	}
+
+	obj := d.repo.Storer.NewEncodedObject()
+	if err := c.Encode(obj); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	signed, err := d.repo.Storer.SetEncodedObject(obj)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	// Point the current branch to the signed commit
+	head, err := d.repo.Storer.Reference(plumbing.HEAD)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if err := d.repo.Storer.SetReference(plumbing.NewHashReference(head.Target(), signed)); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return signed, nil
+}
+
+// VerifyCommit verifies the signature of the commit at the given revision using the configured Verifier.
+// ErrNoVerifier is returned if no Verifier is configured, and a *SignatureError if the verification fails.
+// ErrNotStarted is returned if the repo hasn't been cloned yet.
+func (d *gitDirectory) VerifyCommit(rev string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if err := d.verifyRead(); err != nil {
+		return err
+	}
+
+	hash, err := d.resolveRevision(d.repo, rev)
+	if err != nil {
+		return err
+	}
+	return d.verifyCommit(hash)
+}
+
+// verifyCommit verifies the signature of the given commit using the configured Verifier
+func (d *gitDirectory) verifyCommit(hash plumbing.Hash) error {
+	if d.Verifier == nil {
+		return ErrNoVerifier
+	}
+
+	c, err := d.commitObject(hash)
+	if err != nil {
+		return err
+	}
+
+	if c.PGPSignature == "" {
+		return &SignatureError{Commit: hash.String(), Err: ErrUnsignedCommit}
+	}
+
+	unsigned := &plumbing.MemoryObject{}
+	if err := c.EncodeWithoutSignature(unsigned); err != nil {
+		return err
+	}
+	r, err := unsigned.Reader()
+	if err != nil {
+		return err
+	}
+
+	if err := d.Verifier.Verify(r, c.PGPSignature); err != nil {
+		return &SignatureError{Commit: hash.String(), Err: err}
+	}
+	return nil
+}
+
+// verifyNewCommits verifies the signatures of the commits reachable from newCommit, but not
+// from oldCommit, e.g. including the commits of a merged branch, but not the older commits
+// the branch was based on. If oldCommit is zero, only newCommit is verified. In a shallow
+// clone, only the commits up to the boundary are verified.
+func (d *gitDirectory) verifyNewCommits(oldCommit, newCommit plumbing.Hash) error {
+	// Only verify the latest commit if the previous state is unknown
+	if oldCommit.IsZero() {
+		return d.verifyCommit(newCommit)
+	}
+
+	commits, err := d.newCommits(oldCommit, newCommit)
+	if err != nil {
+		return err
+	}
+
+	for _, hash := range commits {
+		if err := d.verifyCommit(hash); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+const (
+	// reachableFromNew and reachableFromOld mark the commits walked by newCommits
+	reachableFromNew byte = 1 << iota
+	reachableFromOld
+)
+
+// newCommits returns the commits reachable from newCommit, but not from oldCommit, up to the
+// boundary of a shallow clone. Like for finding the merge base in Git, both histories are walked
+// at once, newest commit first, and the walk stops once only commits reachable from oldCommit are
+// left. Hence only the history since the branches diverged is walked, not all of it.
+func (d *gitDirectory) newCommits(oldCommit, newCommit plumbing.Hash) ([]plumbing.Hash, error) {
+	shallow, err := shallowCommits(d.repo)
+	if err != nil {
+		return nil, err
+	}
+
+	flags := map[plumbing.Hash]byte{}
+	var queue []*object.Commit
+	// push marks the given commit with the given flags, and queues it if they're new, newest commit first
+	push := func(hash plumbing.Hash, flag byte) error {
+		if flags[hash]&flag == flag {
+			return nil
+		}
+		flags[hash] |= flag
+
+		c, err := d.commitObject(hash)
+		if err != nil {
+			return err
+		}
+		i := sort.Search(len(queue), func(i int) bool { return queue[i].Committer.When.Before(c.Committer.When) })
+		queue = append(queue, nil)
+		copy(queue[i+1:], queue[i:])
+		queue[i] = c
+		return nil
+	}
+	// onlyOld checks if all queued commits are reachable from oldCommit
+	onlyOld := func() bool {
+		for _, c := range queue {
+			if flags[c.Hash]&reachableFromOld == 0 {
+				return false
+			}
+		}
+		return true
+	}
+
+	if err := push(newCommit, reachableFromNew); err != nil {
+		return nil, err
+	}
+	if err := push(oldCommit, reachableFromOld); err != nil {
+		return nil, err
+	}
+
+	var walked []plumbing.Hash
+	for len(queue) != 0 && !onlyOld() {
+		c := queue[0]
+		queue = queue[1:]
+
+		flag := flags[c.Hash]
+		if flag == reachableFromNew {
+			walked = append(walked, c.Hash)
+		}
+		if shallow[c.Hash] {
+			continue
+		}
+		for _, parent := range c.ParentHashes {
+			if err := push(parent, flag); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Commits may have been found to be reachable from oldCommit after they were walked
+	commits := make([]plumbing.Hash, 0, len(walked))
+	for _, hash := range walked {
+		if flags[hash]&reachableFromOld == 0 {
+			commits = append(commits, hash)
+		}
+	}
+
+	return commits, nil
+}
@@ -0,0 +1,185 @@
+package gitdir
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/weaveworks/libgitops/pkg/internal/testutil"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSigners(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ssh.NewPublicKey(otherPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entity, err := openpgp.NewEntity("Test", "", "test@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		signer   CommitSigner
+		verifier CommitVerifier
+		wrong    CommitVerifier
+	}{
+		{"ssh", NewSSHSigner(signer), NewSSHVerifier(otherKey, signer.PublicKey()), NewSSHVerifier(otherKey)},
+		{"openpgp", NewOpenPGPSigner(entity), NewOpenPGPVerifier(openpgp.EntityList{entity}), NewSSHVerifier(signer.PublicKey())},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sig, err := tt.signer.Sign(strings.NewReader("tree 1234\n\nmessage\n"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := tt.verifier.Verify(strings.NewReader("tree 1234\n\nmessage\n"), sig); err != nil {
+				t.Errorf("expected the signature to be valid: %v", err)
+			}
+			if err := tt.verifier.Verify(strings.NewReader("tree 1234\n\nchanged\n"), sig); err == nil {
+				t.Error("expected the signature of a changed message to be invalid")
+			}
+			if err := tt.wrong.Verify(strings.NewReader("tree 1234\n\nmessage\n"), sig); err == nil {
+				t.Error("expected the signature to be rejected by the wrong verifier")
+			}
+		})
+	}
+}
+
+func TestSignedCommits(t *testing.T) {
+	bareDir, _ := testutil.NewBareRepo(t, map[string]string{"car.yaml": "kind: Car"})
+	defer os.RemoveAll(bareDir)
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writer, err := NewGitDirectoryFromURL(bareDir, GitDirectoryOptions{Interval: time.Hour, Signer: NewSSHSigner(signer)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = writer.Cleanup() }()
+	if err := writer.StartCheckoutLoop(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The initial commit isn't signed, so verifying clones must fail
+	reader, err := NewGitDirectoryFromURL(bareDir, GitDirectoryOptions{Interval: time.Hour, Verifier: NewSSHVerifier(signer.PublicKey())})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reader.StartCheckoutLoop(); !errors.Is(err, ErrUnsignedCommit) {
+		t.Errorf("expected ErrUnsignedCommit, got %v", err)
+	}
+	_ = reader.Cleanup()
+
+	writer.Suspend()
+	writeFiles(t, writer.Dir(), map[string]string{"car.yaml": "kind: Car\nspec: {}"})
+	err = writer.Commit(context.Background(), "Test", "test@example.com", "signed commit")
+	writer.Resume()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err = NewGitDirectoryFromURL(bareDir, GitDirectoryOptions{Interval: time.Hour, Verifier: NewSSHVerifier(signer.PublicKey())})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = reader.Cleanup() }()
+	if err := reader.StartCheckoutLoop(); err != nil {
+		t.Fatal(err)
+	}
+	if err := reader.VerifyCommit(""); err != nil {
+		t.Errorf("expected the pushed commit to be verified: %v", err)
+	}
+	signed, err := reader.ResolveRevision("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Merging a branch based on older, unsigned commits only verifies the commits of the branch
+	wd := writer.(*gitDirectory)
+	writer.Suspend()
+	signedCommit, err := wd.repo.CommitObject(plumbing.NewHash(signed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wd.wt.Checkout(&git.CheckoutOptions{Hash: signedCommit.ParentHashes[0], Branch: plumbing.NewBranchReferenceName("old"), Create: true}); err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, writer.Dir(), map[string]string{"bike.yaml": "kind: Bike"})
+	if err := writer.Commit(context.Background(), "Test", "test@example.com", "signed commit on an old branch"); err != nil {
+		t.Fatal(err)
+	}
+	branchHead, err := wd.repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.CheckoutMainBranch(); err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, writer.Dir(), map[string]string{"bike.yaml": "kind: Bike"})
+	if _, err := wd.wt.Add("bike.yaml"); err != nil {
+		t.Fatal(err)
+	}
+	merge, err := wd.wt.Commit("merge old branch", &git.CommitOptions{
+		Author:  &object.Signature{Name: "Test", Email: "test@example.com", When: time.Now()},
+		Parents: []plumbing.Hash{signedCommit.Hash, branchHead.Hash()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if merge, err = wd.signCommit(merge); err != nil {
+		t.Fatal(err)
+	}
+	err = wd.repo.Push(&git.PushOptions{RemoteName: defaultRemote})
+	writer.Resume()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reader.Pull(context.Background()); err != nil {
+		t.Fatalf("expected the merge to be verified: %v", err)
+	}
+	if signed, err = reader.ResolveRevision(""); err != nil || signed != merge.String() {
+		t.Fatalf("expected the merge %s to be pulled, got %s: %v", merge, signed, err)
+	}
+
+	// Pulling an unsigned commit is rolled back
+	pushCommit(t, bareDir, map[string]string{"bike.yaml": "kind: Bike"}, "unsigned commit")
+	var sigErr *SignatureError
+	if err := reader.Pull(context.Background()); !errors.As(err, &sigErr) {
+		t.Fatalf("expected a SignatureError, got %v", err)
+	}
+	if head, err := reader.ResolveRevision(""); err != nil || head != signed {
+		t.Errorf("expected the pull to be rolled back to %s, got %s: %v", signed, head, err)
+	}
+}
@@ -0,0 +1,80 @@
+package gitdir
+
+import (
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// backoffJitter is the maximum factor of random jitter added to the backoff delay
+const backoffJitter = 0.2
+
+// Status describes the health of the checkout loop of a GitDirectory
+type Status struct {
+	// LastSuccessfulPull is the time of the latest successful clone or pull, zero if none succeeded yet
+	LastSuccessfulPull time.Time
+	// Head is the SHA of the latest commit checked out on the main branch
+	Head string
+	// ConsecutiveErrors is the number of pulls that have failed since the latest successful one
+	ConsecutiveErrors int
+	// LastError is the error of the latest failed pull, nil if the latest pull succeeded
+	LastError error
+}
+
+// Stale returns true if no pull has succeeded within the given duration before now,
+// e.g. for a readiness probe to report when the Git mirror is out of date
+func (s Status) Stale(maxAge time.Duration) bool {
+	return s.LastSuccessfulPull.IsZero() || time.Since(s.LastSuccessfulPull) > maxAge
+}
+
+// Status returns the current health of the checkout loop. It doesn't block on ongoing operations.
+func (d *gitDirectory) Status() Status {
+	d.statusLock.Lock()
+	defer d.statusLock.Unlock()
+	return d.status
+}
+
+// recordPull updates the status after a clone or pull with the given result
+func (d *gitDirectory) recordPull(err error) {
+	d.statusLock.Lock()
+	defer d.statusLock.Unlock()
+
+	if !d.mainCommit.IsZero() {
+		d.status.Head = d.mainCommit.String()
+	}
+	if err != nil {
+		d.status.ConsecutiveErrors++
+		d.status.LastError = err
+		return
+	}
+	d.status.LastSuccessfulPull = time.Now()
+	d.status.ConsecutiveErrors = 0
+	d.status.LastError = nil
+}
+
+// recordHead updates the HEAD reported in the status after a commit to the main branch.
+// Commits to other branches, e.g. of transactions, must not be recorded.
+func (d *gitDirectory) recordHead(commit plumbing.Hash) {
+	d.statusLock.Lock()
+	defer d.statusLock.Unlock()
+	d.status.Head = commit.String()
+}
+
+// pullDelay returns the delay until the next pull of the checkout loop. After failed pulls, the
+// Interval is doubled for each consecutive failure up to MaxBackoff, and a random jitter is added.
+func (d *gitDirectory) pullDelay() time.Duration {
+	failures := d.Status().ConsecutiveErrors
+	if failures == 0 {
+		return d.Interval
+	}
+
+	delay := d.Interval
+	for i := 0; i < failures && delay < d.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > d.MaxBackoff {
+		delay = d.MaxBackoff
+	}
+	return wait.Jitter(delay, backoffJitter)
+}
@@ -0,0 +1,98 @@
+package gitdir
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/weaveworks/libgitops/pkg/internal/testutil"
+)
+
+func TestPullDelay(t *testing.T) {
+	d := &gitDirectory{GitDirectoryOptions: GitDirectoryOptions{Interval: time.Second, MaxBackoff: 10 * time.Second}}
+
+	for failures, expected := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second} {
+		d.status.ConsecutiveErrors = failures
+		delay := d.pullDelay()
+		maxDelay := expected
+		if failures != 0 {
+			maxDelay += time.Duration(float64(expected) * backoffJitter)
+		}
+		if delay < expected || delay > maxDelay {
+			t.Errorf("expected a delay between %s and %s after %d failures, got %s", expected, maxDelay, failures, delay)
+		}
+	}
+}
+
+func TestStatus(t *testing.T) {
+	bareDir, _ := testutil.NewBareRepo(t, map[string]string{"car.yaml": "kind: Car"})
+	defer os.RemoveAll(bareDir)
+
+	head, err := getBranchHash(bareDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := NewGitDirectoryFromURL(bareDir, GitDirectoryOptions{Interval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = d.Cleanup() }()
+	if !d.Status().Stale(time.Hour) {
+		t.Error("expected the status to be stale before the clone")
+	}
+	if err := d.StartCheckoutLoop(); err != nil {
+		t.Fatal(err)
+	}
+
+	status := d.Status()
+	if status.Head != head.String() || status.ConsecutiveErrors != 0 || status.LastError != nil || status.Stale(time.Hour) {
+		t.Errorf("unexpected status after the clone: %+v", status)
+	}
+	cloned := status.LastSuccessfulPull
+
+	// Only commits to the main branch update the head
+	commit := func(branch string) {
+		d.Suspend()
+		defer d.Resume()
+		if branch != "" {
+			if err := d.CheckoutNewBranch(branch); err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = d.CheckoutMainBranch() }()
+		}
+		writeFiles(t, d.Dir(), map[string]string{"car.yaml": "kind: Car\nspec: {branch: " + branch + "}"})
+		if err := d.Commit(context.Background(), "Test", "test@example.com", "commit"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	commit("feature")
+	if status := d.Status(); status.Head != head.String() {
+		t.Errorf("expected the head to stay at %s after a commit to another branch, got %s", head, status.Head)
+	}
+	commit("")
+	if head, err = getBranchHash(bareDir); err != nil {
+		t.Fatal(err)
+	}
+	if status := d.Status(); status.Head != head.String() {
+		t.Errorf("expected the head to be %s after a commit to the main branch, got %s", head, status.Head)
+	}
+
+	// Failed pulls are counted, and keep the time of the latest successful pull
+	if err := os.RemoveAll(bareDir); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := d.Pull(context.Background()); err == nil {
+			t.Fatal("expected the pull to fail")
+		}
+	}
+	status = d.Status()
+	if status.ConsecutiveErrors != 2 || status.LastError == nil || !status.LastSuccessfulPull.Equal(cloned) || status.Head != head.String() {
+		t.Errorf("unexpected status after failed pulls: %+v", status)
+	}
+	if !status.Stale(0) {
+		t.Error("expected the status to be stale")
+	}
+}
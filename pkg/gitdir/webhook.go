@@ -0,0 +1,233 @@
+package gitdir
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultWebhookDebounce = 1 * time.Second
+	// maxWebhookPayload limits the size of the accepted push event payloads
+	maxWebhookPayload = 5 << 20
+)
+
+// WebhookOptions provides options for the handler created by NewWebhookHandler
+type WebhookOptions struct {
+	// Secret validates the push events: the HMAC-SHA256 signature of GitHub and Gitea
+	// events, and the token of GitLab events. If empty, events aren't validated.
+	Secret string
+	// Repository is the slash-separated path of the repository, e.g. "weaveworks/libgitops", which
+	// the push events must match. By default, it's derived from the GitDirectory's repository.
+	Repository string
+	// Debounce is the time to wait for further push events, before triggering a single pull. Default 1s.
+	Debounce time.Duration
+}
+
+func (o *WebhookOptions) Default() {
+	o.Repository = strings.ToLower(strings.Trim(o.Repository, "/"))
+	if o.Debounce == 0 {
+		o.Debounce = defaultWebhookDebounce
+	}
+}
+
+// Validate validates the (defaulted) options.
+func (o *WebhookOptions) Validate() error {
+	if o.Repository == "" {
+		return errors.New("the repository of the webhook is required")
+	}
+	if o.Debounce < 0 {
+		return fmt.Errorf("debounce %s must not be negative", o.Debounce)
+	}
+	return nil
+}
+
+// pushEvent holds the fields of the push event payloads of GitHub, GitLab and Gitea used by the handler
+type pushEvent struct {
+	Ref string `json:"ref"`
+	// Repository is set by GitHub and Gitea
+	Repository *struct {
+		FullName string `json:"full_name"`
+	} `json:"repository"`
+	// Project is set by GitLab
+	Project *struct {
+		PathWithNamespace string `json:"path_with_namespace"`
+	} `json:"project"`
+}
+
+// repository returns the slash-separated path of the pushed repository
+func (e *pushEvent) repository() string {
+	if e.Project != nil && e.Project.PathWithNamespace != "" {
+		return e.Project.PathWithNamespace
+	}
+	if e.Repository != nil {
+		return e.Repository.FullName
+	}
+	return ""
+}
+
+// NewWebhookHandler creates an HTTP handler for the push events of GitHub, GitLab and Gitea, which
+// triggers an immediate pull of the given GitDirectory when its repository and main branch are pushed
+// to. Bursts of push events within opts.Debounce are coalesced into a single pull. Other events are
+// acknowledged, but ignored. Events with an invalid signature or token are rejected.
+func NewWebhookHandler(d GitDirectory, opts WebhookOptions) (http.Handler, error) {
+	if opts.Repository == "" {
+		if ref := d.RepositoryRef(); ref != nil {
+			opts.Repository = ref.GetIdentity() + "/" + ref.GetRepository()
+		} else if gd, ok := d.(*gitDirectory); ok {
+			opts.Repository = repositoryPath(gd.url)
+		}
+	}
+	opts.Default()
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &webhookHandler{
+		gitDir: d,
+		opts:   opts,
+	}, nil
+}
+
+type webhookHandler struct {
+	gitDir GitDirectory
+	opts   WebhookOptions
+
+	// the timer of the pending debounced pull, nil if none is pending
+	timer     *time.Timer
+	timerLock sync.Mutex
+}
+
+func (h *webhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	payload, err := ioutil.ReadAll(io.LimitReader(r.Body, maxWebhookPayload))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	isPush, err := h.validate(r.Header, payload)
+	if err != nil {
+		log.Warnf("webhook: Rejecting event: %v", err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if !isPush {
+		_, _ = io.WriteString(w, "ignored: not a push event\n")
+		return
+	}
+
+	var event pushEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		http.Error(w, fmt.Sprintf("invalid push event: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if repo := strings.ToLower(event.repository()); repo != h.opts.Repository {
+		log.Debugf("webhook: Ignoring push to repository %q", repo)
+		_, _ = io.WriteString(w, "ignored: other repository\n")
+		return
+	}
+	if event.Ref != plumbing.NewBranchReferenceName(h.gitDir.MainBranch()).String() {
+		log.Debugf("webhook: Ignoring push to %q", event.Ref)
+		_, _ = io.WriteString(w, "ignored: other branch\n")
+		return
+	}
+
+	log.Debugf("webhook: Got push to branch %q, triggering a pull", h.gitDir.MainBranch())
+	h.triggerPull()
+	w.WriteHeader(http.StatusAccepted)
+	_, _ = io.WriteString(w, "pull triggered\n")
+}
+
+// validate checks the signature or token of the event using the provider-specific
+// headers, and returns true if the event is a push event
+func (h *webhookHandler) validate(header http.Header, payload []byte) (bool, error) {
+	switch {
+	case header.Get("X-Gitea-Event") != "":
+		// Gitea also sets the GitHub headers, so check it first
+		if err := h.validateHMAC(header.Get("X-Gitea-Signature"), payload); err != nil {
+			return false, err
+		}
+		return header.Get("X-Gitea-Event") == "push", nil
+	case header.Get("X-GitHub-Event") != "":
+		signature := header.Get("X-Hub-Signature-256")
+		if h.opts.Secret != "" && !strings.HasPrefix(signature, "sha256=") {
+			return false, errors.New("missing X-Hub-Signature-256 header")
+		}
+		if err := h.validateHMAC(strings.TrimPrefix(signature, "sha256="), payload); err != nil {
+			return false, err
+		}
+		return header.Get("X-GitHub-Event") == "push", nil
+	case header.Get("X-Gitlab-Event") != "":
+		if h.opts.Secret != "" && !hmac.Equal([]byte(header.Get("X-Gitlab-Token")), []byte(h.opts.Secret)) {
+			return false, errors.New("invalid X-Gitlab-Token header")
+		}
+		return header.Get("X-Gitlab-Event") == "Push Hook", nil
+	}
+
+	return false, errors.New("unknown webhook event format")
+}
+
+// validateHMAC checks the given hex-encoded HMAC-SHA256 signature of the payload, if a secret is set
+func (h *webhookHandler) validateHMAC(signature string, payload []byte) error {
+	if h.opts.Secret == "" {
+		return nil
+	}
+
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding: %v", err)
+	}
+
+	mac := hmac.New(sha256.New, []byte(h.opts.Secret))
+	_, _ = mac.Write(payload)
+	if !hmac.Equal(mac.Sum(nil), expected) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+// triggerPull triggers a pull of the GitDirectory after the debounce time, unless one is already pending
+func (h *webhookHandler) triggerPull() {
+	h.timerLock.Lock()
+	defer h.timerLock.Unlock()
+
+	if h.timer != nil {
+		return
+	}
+	h.timer = time.AfterFunc(h.opts.Debounce, func() {
+		h.timerLock.Lock()
+		h.timer = nil
+		h.timerLock.Unlock()
+
+		h.gitDir.TriggerPull()
+	})
+}
+
+// repositoryPath returns the slash-separated path of the repository with the given URL, without the
+// ".git" suffix, e.g. "weaveworks/libgitops" for "git@github.com:weaveworks/libgitops.git"
+func repositoryPath(url string) string {
+	ep, err := transport.NewEndpoint(url)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSuffix(strings.Trim(ep.Path, "/"), ".git")
+}
@@ -0,0 +1,138 @@
+package gitdir
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fluxcd/go-git-providers/gitprovider"
+	"github.com/weaveworks/libgitops/pkg/internal/testutil"
+)
+
+// fakeTriggerDirectory counts the triggered pulls of a GitDirectory
+type fakeTriggerDirectory struct {
+	GitDirectory
+	triggers int32
+}
+
+func (d *fakeTriggerDirectory) MainBranch() string                       { return "main" }
+func (d *fakeTriggerDirectory) RepositoryRef() gitprovider.RepositoryRef { return nil }
+func (d *fakeTriggerDirectory) TriggerPull()                             { atomic.AddInt32(&d.triggers, 1) }
+
+func TestWebhookHandler(t *testing.T) {
+	d := &fakeTriggerDirectory{}
+	handler, err := NewWebhookHandler(d, WebhookOptions{Secret: "s3cret", Repository: "Org/Repo", Debounce: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	sign := func(payload string) string {
+		mac := hmac.New(sha256.New, []byte("s3cret"))
+		_, _ = mac.Write([]byte(payload))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+	const (
+		githubPush = `{"ref": "refs/heads/main", "repository": {"full_name": "org/repo"}}`
+		gitlabPush = `{"ref": "refs/heads/main", "project": {"path_with_namespace": "org/repo"}}`
+		otherRepo  = `{"ref": "refs/heads/main", "repository": {"full_name": "org/other"}}`
+		otherRef   = `{"ref": "refs/heads/feature", "repository": {"full_name": "org/repo"}}`
+	)
+
+	tests := []struct {
+		name     string
+		payload  string
+		headers  map[string]string
+		expected int
+	}{
+		{"github", githubPush, map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": "sha256=" + sign(githubPush)}, http.StatusAccepted},
+		{"gitea", githubPush, map[string]string{"X-Gitea-Event": "push", "X-Gitea-Signature": sign(githubPush)}, http.StatusAccepted},
+		{"gitlab", gitlabPush, map[string]string{"X-Gitlab-Event": "Push Hook", "X-Gitlab-Token": "s3cret"}, http.StatusAccepted},
+		{"invalid signature", githubPush, map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": "sha256=" + sign("other")}, http.StatusUnauthorized},
+		{"missing signature", githubPush, map[string]string{"X-GitHub-Event": "push"}, http.StatusUnauthorized},
+		{"invalid token", gitlabPush, map[string]string{"X-Gitlab-Event": "Push Hook", "X-Gitlab-Token": "wrong"}, http.StatusUnauthorized},
+		{"unknown format", githubPush, nil, http.StatusUnauthorized},
+		{"ping", githubPush, map[string]string{"X-GitHub-Event": "ping", "X-Hub-Signature-256": "sha256=" + sign(githubPush)}, http.StatusOK},
+		{"other repository", otherRepo, map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": "sha256=" + sign(otherRepo)}, http.StatusOK},
+		{"other branch", otherRef, map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": "sha256=" + sign(otherRef)}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest(http.MethodPost, server.URL, bytes.NewBufferString(tt.payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for key, value := range tt.headers {
+			req.Header.Set(key, value)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.expected {
+			t.Errorf("%s: expected status %d, got %d", tt.name, tt.expected, resp.StatusCode)
+		}
+	}
+
+	// The three accepted push events are coalesced into a single pull
+	time.Sleep(200 * time.Millisecond)
+	if triggers := atomic.LoadInt32(&d.triggers); triggers != 1 {
+		t.Errorf("expected a single triggered pull, got %d", triggers)
+	}
+}
+
+func TestWebhookTriggersPull(t *testing.T) {
+	bareDir, _ := testutil.NewBareRepo(t, map[string]string{"car.yaml": "kind: Car"})
+	defer os.RemoveAll(bareDir)
+
+	d, err := NewGitDirectoryFromURL("file://"+bareDir, GitDirectoryOptions{Interval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = d.Cleanup() }()
+	commits := d.CommitChannel()
+	if err := d.StartCheckoutLoop(); err != nil {
+		t.Fatal(err)
+	}
+	<-commits // the commit observed by the clone
+
+	handler, err := NewWebhookHandler(d, WebhookOptions{Debounce: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	pushed := pushCommit(t, bareDir, map[string]string{"car.yaml": "kind: Car\nspec: {}"}, "second commit")
+	payload := `{"ref": "refs/heads/master", "repository": {"full_name": "` + repositoryPath("file://"+bareDir) + `"}}`
+	req, err := http.NewRequest(http.MethodPost, server.URL, bytes.NewBufferString(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-GitHub-Event", "push")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected status %d, got %d", http.StatusAccepted, resp.StatusCode)
+	}
+
+	select {
+	case commit := <-commits:
+		if commit != pushed.String() {
+			t.Errorf("expected commit %s to be pulled, got %s", pushed, commit)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("expected the push to trigger a pull")
+	}
+}
@@ -0,0 +1,99 @@
+// Package testutil contains helpers shared by the tests of several packages.
+package testutil
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// NewBareRepo creates a bare repository in a temporary directory, with a master branch containing
+// the given files, and a clone of it. Commits made in the clone using CommitFiles are pushed to the
+// bare repository. The caller removes the bare repository, the clone is removed when the test ends.
+func NewBareRepo(t *testing.T, files map[string]string) (string, *git.Repository) {
+	t.Helper()
+
+	bareDir, err := ioutil.TempDir("", "libgitops-bare")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := git.PlainInit(bareDir, true); err != nil {
+		t.Fatal(err)
+	}
+
+	cloneDir, err := ioutil.TempDir("", "libgitops-clone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(cloneDir) })
+	repo, err := git.PlainInit(cloneDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.CreateRemote(&config.RemoteConfig{Name: "origin", URLs: []string{bareDir}}); err != nil {
+		t.Fatal(err)
+	}
+	CommitFiles(t, repo, "master", files, "initial commit")
+	return bareDir, repo
+}
+
+// CommitFiles checks out the given branch, writes the files with the given slash-separated paths, removing
+// those with empty content, and commits and pushes them
+func CommitFiles(t *testing.T, repo *git.Repository, branch string, files map[string]string, msg string) {
+	t.Helper()
+
+	wt := Checkout(t, repo, branch)
+	for name, content := range files {
+		if content == "" {
+			if _, err := wt.Remove(name); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		file := filepath.Join(wt.Filesystem.Root(), filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := wt.Add(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sig := &object.Signature{Name: "Test", Email: "test@example.com", When: time.Now()}
+	if _, err := wt.Commit(msg, &git.CommitOptions{Author: sig}); err != nil {
+		t.Fatal(err)
+	}
+	ref := plumbing.NewBranchReferenceName(branch)
+	if err := repo.Push(&git.PushOptions{RefSpecs: []config.RefSpec{config.RefSpec(ref + ":" + ref)}}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Checkout checks out the given branch, creating it from HEAD if it doesn't exist
+func Checkout(t *testing.T, repo *git.Repository, branch string) *git.Worktree {
+	t.Helper()
+
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nothing to check out before the first commit
+	if _, err := repo.Head(); err != nil {
+		return wt
+	}
+	ref := plumbing.NewBranchReferenceName(branch)
+	_, refErr := repo.Reference(ref, true)
+	if err := wt.Checkout(&git.CheckoutOptions{Branch: ref, Create: refErr != nil}); err != nil {
+		t.Fatal(err)
+	}
+	return wt
+}
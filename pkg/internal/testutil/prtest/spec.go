@@ -0,0 +1,26 @@
+// Package prtest contains the fixtures shared by the tests of the PullRequestProviders. It's separate
+// from testutil, as the tests of gitdir can't import the transaction package.
+package prtest
+
+import (
+	"github.com/fluxcd/go-git-providers/gitprovider"
+	"github.com/weaveworks/libgitops/pkg/storage/transaction"
+)
+
+// NewSpec returns a spec of a PR from mergeBranch into mainBranch of the given repository,
+// authored by Jane, with the given title and labels
+func NewSpec(ref gitprovider.RepositoryRef, mainBranch, mergeBranch, title string, labels ...string) *transaction.GenericPullRequestSpec {
+	return &transaction.GenericPullRequestSpec{
+		PullRequestResult: &transaction.GenericPullRequestResult{
+			CommitResult: &transaction.GenericCommitResult{
+				AuthorName:  "Jane",
+				AuthorEmail: "jane@example.com",
+				Title:       title,
+			},
+			Labels: labels,
+		},
+		MainBranch:    mainBranch,
+		MergeBranch:   mergeBranch,
+		RepositoryRef: ref,
+	}
+}
@@ -28,6 +28,8 @@ type MappedRawStorage interface {
 	// path mapping matching the given Key
 	RemoveMapping(key ObjectKey)
 
+	// GetMappings returns a copy of all known mappings
+	GetMappings() map[ObjectKey]string
 	// SetMappings overwrites all known mappings
 	SetMappings(m map[ObjectKey]string)
 }
@@ -112,6 +114,8 @@ func (r *GenericMappedRawStorage) Delete(key ObjectKey) (err error) {
 func (r *GenericMappedRawStorage) List(kind KindKey) ([]ObjectKey, error) {
 	result := make([]ObjectKey, 0)
 
+	r.mux.Lock()
+	defer r.mux.Unlock()
 	for key := range r.fileMappings {
 		// Include objects with the same kind and group, ignore version mismatches
 		if key.EqualsGVK(kind, false) {
@@ -146,6 +150,8 @@ func (r *GenericMappedRawStorage) WatchDir() string {
 }
 
 func (r *GenericMappedRawStorage) GetKey(path string) (ObjectKey, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
 	for key, p := range r.fileMappings {
 		if p == path {
 			return key, nil
@@ -169,6 +175,17 @@ func (r *GenericMappedRawStorage) RemoveMapping(key ObjectKey) {
 	r.mux.Unlock()
 }
 
+func (r *GenericMappedRawStorage) GetMappings() map[ObjectKey]string {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	m := make(map[ObjectKey]string, len(r.fileMappings))
+	for key, path := range r.fileMappings {
+		m[key] = path
+	}
+
+	return m
+}
+
 func (r *GenericMappedRawStorage) SetMappings(m map[ObjectKey]string) {
 	log.Debugf("GenericMappedRawStorage: SetMappings: %v", m)
 	r.mux.Lock()
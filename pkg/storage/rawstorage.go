@@ -8,10 +8,12 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/weaveworks/libgitops/pkg/runtime"
 	"github.com/weaveworks/libgitops/pkg/serializer"
 	"github.com/weaveworks/libgitops/pkg/util"
+	"github.com/weaveworks/libgitops/pkg/util/ignore"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 )
 
@@ -46,15 +48,41 @@ type RawStorage interface {
 }
 
 func NewGenericRawStorage(dir string, gv schema.GroupVersion, ct serializer.ContentType) RawStorage {
+	return NewGenericRawStorageWithOptions(dir, gv, ct, DefaultGenericRawStorageOptions())
+}
+
+// GenericRawStorageOptions specifies options for the GenericRawStorage
+type GenericRawStorageOptions struct {
+	// IgnoreFiles specifies the names of the gitignore-style pattern files to read in
+	// the storage directory. Objects matching the patterns are skipped by List.
+	IgnoreFiles []string
+	// Ignore, if set, is used instead of reading IgnoreFiles. Pass the Matcher also to
+	// the FileWatcher watching the directory to reload it when the ignore files change,
+	// otherwise the ignore files are read only once.
+	Ignore *ignore.Matcher
+}
+
+// DefaultGenericRawStorageOptions returns the default options
+func DefaultGenericRawStorageOptions() GenericRawStorageOptions {
+	return GenericRawStorageOptions{
+		IgnoreFiles: ignore.DefaultFiles(),
+	}
+}
+
+// NewGenericRawStorageWithOptions is like NewGenericRawStorage,
+// but allows customizing the behavior using the given options.
+func NewGenericRawStorageWithOptions(dir string, gv schema.GroupVersion, ct serializer.ContentType, opts GenericRawStorageOptions) RawStorage {
 	ext := extForContentType(ct)
 	if ext == "" {
 		panic("Invalid content type")
 	}
 	return &GenericRawStorage{
-		dir: dir,
-		gv:  gv,
-		ct:  ct,
-		ext: ext,
+		dir:         dir,
+		gv:          gv,
+		ct:          ct,
+		ext:         ext,
+		ignoreFiles: opts.IgnoreFiles,
+		ignore:      opts.Ignore,
 	}
 }
 
@@ -67,6 +95,10 @@ type GenericRawStorage struct {
 	gv  schema.GroupVersion
 	ct  serializer.ContentType
 	ext string
+	// ignore is created from ignoreFiles on first use, unless given in the options
+	ignoreFiles []string
+	ignore      *ignore.Matcher
+	ignoreMux   sync.Mutex
 }
 
 func (r *GenericRawStorage) keyPath(key ObjectKey) string {
@@ -151,14 +183,40 @@ func (r *GenericRawStorage) List(kind KindKey) ([]ObjectKey, error) {
 		return nil, err
 	}
 
+	// Skip the entries ignored by the ignore files in the storage directory
+	matcher, err := r.getIgnore()
+	if err != nil {
+		return nil, err
+	}
+
 	result := make([]ObjectKey, 0, len(entries))
 	for _, entry := range entries {
+		if matcher.Match(path.Join(r.kindKeyPath(kind), entry.Name()), entry.IsDir()) {
+			continue
+		}
+
 		result = append(result, NewObjectKey(kind, runtime.NewIdentifier(entry.Name())))
 	}
 
 	return result, nil
 }
 
+// getIgnore returns the Matcher for the ignore files, reading them on first use
+func (r *GenericRawStorage) getIgnore() (*ignore.Matcher, error) {
+	r.ignoreMux.Lock()
+	defer r.ignoreMux.Unlock()
+	if r.ignore == nil {
+		matcher, err := ignore.NewMatcher(r.dir, r.ignoreFiles)
+		if err != nil {
+			return nil, err
+		}
+
+		r.ignore = matcher
+	}
+
+	return r.ignore, nil
+}
+
 // This returns the modification time as a UnixNano string
 // If the file doesn't exist, return ErrNotFound
 func (r *GenericRawStorage) Checksum(key ObjectKey) (string, error) {
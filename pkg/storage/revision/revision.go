@@ -0,0 +1,194 @@
+package revision
+
+import (
+	"errors"
+	"fmt"
+	"path"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/weaveworks/libgitops/pkg/gitdir"
+	"github.com/weaveworks/libgitops/pkg/runtime"
+	"github.com/weaveworks/libgitops/pkg/serializer"
+	"github.com/weaveworks/libgitops/pkg/storage"
+)
+
+// ErrReadOnly is returned when trying to write to a RevisionRawStorage
+var ErrReadOnly = errors.New("the storage of a Git revision is read-only")
+
+// NewRevisionStorage creates a read-only Storage serving the objects stored under the Dir() of the
+// given GitDirectory at the given revision (e.g. a SHA, branch or tag). The objects are read directly
+// from the Git object database, so the Storage can be used concurrently with the checkout loop.
+func NewRevisionStorage(gitDir gitdir.GitDirectory, rev string, ser serializer.Serializer, identifiers []runtime.IdentifierFactory) (storage.ReadStorage, error) {
+	r, err := gitDir.OpenRevision(rev)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := NewRevisionRawStorage(r)
+	s := storage.NewGenericStorage(raw, ser, identifiers)
+	if err := raw.computeMappings(s); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// NewRevisionRawStorage creates a RevisionRawStorage for the given Revision. The mappings
+// between the objects and files are empty, until set using SetMappings.
+func NewRevisionRawStorage(r gitdir.Revision) *RevisionRawStorage {
+	return &RevisionRawStorage{
+		rev:          r,
+		fileMappings: make(map[storage.ObjectKey]string),
+	}
+}
+
+// RevisionRawStorage is a read-only RawStorage for the files of a Git revision. The objects
+// are mapped to slash-separated file paths relative to the Dir() of the GitDirectory, in the
+// same way as the GenericMappedRawStorage does for files on disk. The mappings are immutable
+// after construction, as the revision can't change.
+type RevisionRawStorage struct {
+	rev          gitdir.Revision
+	fileMappings map[storage.ObjectKey]string
+}
+
+var _ storage.RawStorage = &RevisionRawStorage{}
+
+// Revision returns the SHA of the commit served by this RawStorage
+func (r *RevisionRawStorage) Revision() string {
+	return r.rev.Hash()
+}
+
+// SetMappings overwrites all known mappings. This must be called before the RawStorage is used.
+func (r *RevisionRawStorage) SetMappings(m map[storage.ObjectKey]string) {
+	r.fileMappings = m
+}
+
+// GetMappings returns a copy of all known mappings
+func (r *RevisionRawStorage) GetMappings() map[storage.ObjectKey]string {
+	m := make(map[storage.ObjectKey]string, len(r.fileMappings))
+	for key, path := range r.fileMappings {
+		m[key] = path
+	}
+
+	return m
+}
+
+func (r *RevisionRawStorage) realPath(key storage.ObjectKey) (string, error) {
+	path, ok := r.fileMappings[key]
+	if !ok {
+		return "", fmt.Errorf("RevisionRawStorage: cannot resolve %q: %w", key, storage.ErrNotTracked)
+	}
+
+	return path, nil
+}
+
+// If the file doesn't exist, returns ErrNotFound + ErrNotTracked.
+func (r *RevisionRawStorage) Read(key storage.ObjectKey) ([]byte, error) {
+	file, err := r.realPath(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.rev.ReadFile(file)
+}
+
+func (r *RevisionRawStorage) Exists(key storage.ObjectKey) bool {
+	_, err := r.realPath(key)
+	return err == nil
+}
+
+// Write always returns ErrReadOnly
+func (r *RevisionRawStorage) Write(_ storage.ObjectKey, _ []byte) error {
+	return ErrReadOnly
+}
+
+// Delete always returns ErrReadOnly
+func (r *RevisionRawStorage) Delete(_ storage.ObjectKey) error {
+	return ErrReadOnly
+}
+
+func (r *RevisionRawStorage) List(kind storage.KindKey) ([]storage.ObjectKey, error) {
+	result := make([]storage.ObjectKey, 0)
+	for key := range r.fileMappings {
+		// Include objects with the same kind and group, ignore version mismatches
+		if key.EqualsGVK(kind, false) {
+			result = append(result, key)
+		}
+	}
+
+	return result, nil
+}
+
+// Checksum returns the SHA of the Git blob of the object.
+// If the file doesn't exist, returns ErrNotFound + ErrNotTracked.
+func (r *RevisionRawStorage) Checksum(key storage.ObjectKey) (string, error) {
+	file, err := r.realPath(key)
+	if err != nil {
+		return "", err
+	}
+
+	return r.rev.FileHash(file)
+}
+
+func (r *RevisionRawStorage) ContentType(key storage.ObjectKey) (ct serializer.ContentType) {
+	if file, err := r.realPath(key); err == nil {
+		ct = storage.ContentTypes[path.Ext(file)] // Retrieve the correct format based on the extension
+	}
+
+	return
+}
+
+// WatchDir returns an empty path, as a revision never changes
+func (r *RevisionRawStorage) WatchDir() string {
+	return ""
+}
+
+// GetKey returns the key of the object stored in the file with the given
+// slash-separated path, relative to the Dir() of the GitDirectory
+func (r *RevisionRawStorage) GetKey(p string) (storage.ObjectKey, error) {
+	for key, path := range r.fileMappings {
+		if path == p {
+			return key, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no mapping found for path %q", p)
+}
+
+// computeMappings decodes all files of supported content types in the revision to
+// compute the mappings. Files that can't be decoded are skipped.
+func (r *RevisionRawStorage) computeMappings(s storage.Storage) error {
+	files, err := r.rev.ListFiles()
+	if err != nil {
+		return err
+	}
+
+	m := make(map[storage.ObjectKey]string, len(files))
+	for _, file := range files {
+		if _, ok := storage.ContentTypes[path.Ext(file)]; !ok {
+			continue
+		}
+
+		content, err := r.rev.ReadFile(file)
+		if err != nil {
+			return err
+		}
+
+		partObjs, err := storage.DecodePartialObjects(serializer.FromBytes(content), s.Serializer().Scheme(), false, nil)
+		if err != nil {
+			log.Debugf("RevisionRawStorage: Skipping %q at %s: %v", file, r.rev.Hash(), err)
+			continue
+		}
+
+		key, err := s.ObjectKeyFor(partObjs[0])
+		if err != nil {
+			log.Debugf("RevisionRawStorage: Skipping %q at %s: %v", file, r.rev.Hash(), err)
+			continue
+		}
+
+		m[key] = file
+	}
+
+	r.SetMappings(m)
+	return nil
+}
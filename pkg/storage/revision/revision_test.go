@@ -0,0 +1,75 @@
+package revision
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/weaveworks/libgitops/pkg/runtime"
+	"github.com/weaveworks/libgitops/pkg/serializer"
+	"github.com/weaveworks/libgitops/pkg/storage"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// fakeRevision is a gitdir.Revision backed by a map of files
+type fakeRevision map[string]string
+
+func (r fakeRevision) Hash() string {
+	return "0123456789abcdef"
+}
+
+func (r fakeRevision) ReadFile(path string) ([]byte, error) {
+	content, ok := r[path]
+	if !ok {
+		return nil, fmt.Errorf("%q: %w", path, os.ErrNotExist)
+	}
+	return []byte(content), nil
+}
+
+func (r fakeRevision) FileHash(path string) (string, error) {
+	content, err := r.ReadFile(path)
+	return fmt.Sprintf("%x", len(content)), err
+}
+
+func (r fakeRevision) ListFiles() ([]string, error) {
+	files := make([]string, 0, len(r))
+	for file := range r {
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+func TestRevisionRawStorage(t *testing.T) {
+	carKind := storage.NewKindKey(schema.GroupVersionKind{Group: "sample", Version: "v1", Kind: "Car"})
+	car := storage.NewObjectKey(carKind, runtime.NewIdentifier("car"))
+	bike := storage.NewObjectKey(storage.NewKindKey(schema.GroupVersionKind{Group: "sample", Version: "v1", Kind: "Bike"}), runtime.NewIdentifier("bike"))
+
+	raw := NewRevisionRawStorage(fakeRevision{"cars/car.yaml": "kind: Car"})
+	raw.SetMappings(map[storage.ObjectKey]string{car: "cars/car.yaml"})
+
+	if content, err := raw.Read(car); err != nil || string(content) != "kind: Car" {
+		t.Errorf("unexpected content: %q, %v", content, err)
+	}
+	if raw.Exists(bike) {
+		t.Error("expected the bike not to exist")
+	}
+	if _, err := raw.Read(bike); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	if keys, err := raw.List(carKind); err != nil || len(keys) != 1 || keys[0] != car {
+		t.Errorf("unexpected keys: %v, %v", keys, err)
+	}
+	if ct := raw.ContentType(car); ct != serializer.ContentTypeYAML {
+		t.Errorf("unexpected content type %q", ct)
+	}
+	if key, err := raw.GetKey("cars/car.yaml"); err != nil || key != car {
+		t.Errorf("unexpected key: %v, %v", key, err)
+	}
+	if err := raw.Write(car, []byte("kind: Bike")); err != ErrReadOnly {
+		t.Errorf("expected ErrReadOnly, got %v", err)
+	}
+	if err := raw.Delete(car); err != ErrReadOnly {
+		t.Errorf("expected ErrReadOnly, got %v", err)
+	}
+}
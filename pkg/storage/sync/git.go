@@ -0,0 +1,163 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	gosync "sync"
+
+	"github.com/weaveworks/libgitops/pkg/gitdir"
+	"github.com/weaveworks/libgitops/pkg/storage"
+)
+
+// GitParticipant is a Participant for a Storage backed by the worktree of a GitDirectory,
+// i.e. a Storage whose RawStorage is rooted at the Dir() of the GitDirectory. The write is
+// executed in Prepare like for the SnapshotParticipant, and committed and pushed in Commit.
+// If the push fails, Rollback restores the previous state of the worktree.
+//
+// The GitDirectory is suspended from Prepare until Commit or Rollback, so that the
+// checkout loop doesn't discard the prepared write. Hence only one write can be
+// prepared at a time, like the SyncStorage does. As pushed writes can't be rolled
+// back, Compensate pushes a commit restoring the previous state instead.
+type GitParticipant struct {
+	*SnapshotParticipant
+
+	gitDir      gitdir.GitDirectory
+	authorName  string
+	authorEmail string
+	suspended   bool
+	// committed holds the snapshots of the pushed writes, until the next write of the object
+	committed map[storage.ObjectKey]*snapshot
+	mux       gosync.Mutex
+}
+
+var _ CompensatingParticipant = &GitParticipant{}
+
+// NewGitParticipant wraps the given Storage, backed by the worktree of the given GitDirectory,
+// in a GitParticipant. The commits are authored using the given name and email.
+func NewGitParticipant(s storage.Storage, gitDir gitdir.GitDirectory, authorName, authorEmail string) *GitParticipant {
+	return &GitParticipant{
+		SnapshotParticipant: NewSnapshotParticipant(s),
+		gitDir:              gitDir,
+		authorName:          authorName,
+		authorEmail:         authorEmail,
+		committed:           make(map[storage.ObjectKey]*snapshot),
+	}
+}
+
+func (p *GitParticipant) Prepare(key storage.ObjectKey, write WriteFunc) error {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if !p.suspended {
+		p.gitDir.Suspend()
+		p.suspended = true
+	}
+	delete(p.committed, key)
+
+	return p.SnapshotParticipant.Prepare(key, write)
+}
+
+// Commit commits the files of the written object, and pushes the commit. If the push
+// fails, the GitDirectory discards the commit, and the write needs to be rolled back.
+func (p *GitParticipant) Commit(key storage.ObjectKey) error {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	paths, err := p.paths(key)
+	if err != nil {
+		return err
+	}
+
+	msg := fmt.Sprintf("Write %s", key)
+	if err := p.gitDir.Commit(context.Background(), p.authorName, p.authorEmail, msg, &gitdir.CommitOptions{Paths: paths}); err != nil {
+		return err
+	}
+
+	p.resume()
+	p.SnapshotParticipant.mux.Lock()
+	p.committed[key] = p.snapshots[key]
+	p.SnapshotParticipant.mux.Unlock()
+	return p.SnapshotParticipant.Commit(key)
+}
+
+// Compensate restores the state from before the pushed write for the given key, and
+// commits and pushes it. If the push fails, the GitDirectory discards the commit.
+func (p *GitParticipant) Compensate(key storage.ObjectKey) error {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	snap, ok := p.committed[key]
+	delete(p.committed, key)
+	if !ok {
+		return fmt.Errorf("no committed write for %s", key)
+	}
+
+	p.gitDir.Suspend()
+	defer p.gitDir.Resume()
+
+	// Roll back the write like a prepared one, the paths include the previous file of the object
+	p.SnapshotParticipant.mux.Lock()
+	p.snapshots[key] = snap
+	p.SnapshotParticipant.mux.Unlock()
+	paths, err := p.paths(key)
+	if err != nil {
+		return err
+	}
+	if err := p.SnapshotParticipant.Rollback(key); err != nil {
+		return err
+	}
+
+	msg := fmt.Sprintf("Revert write %s", key)
+	return p.gitDir.Commit(context.Background(), p.authorName, p.authorEmail, msg, &gitdir.CommitOptions{Paths: paths})
+}
+
+func (p *GitParticipant) Rollback(key storage.ObjectKey) error {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	defer p.resume()
+
+	return p.SnapshotParticipant.Rollback(key)
+}
+
+// resume resumes the GitDirectory, if suspended by Prepare. This must be called with the lock held.
+func (p *GitParticipant) resume() {
+	if p.suspended {
+		p.suspended = false
+		p.gitDir.Resume()
+	}
+}
+
+// paths returns the slash-separated paths of the files changed by the write of the given
+// object, relative to Dir(). If the files aren't known, as the Storage isn't backed by a
+// MappedRawStorage, nil is returned, so that all changes are committed.
+func (p *GitParticipant) paths(key storage.ObjectKey) ([]string, error) {
+	mapped, ok := p.RawStorage().(storage.MappedRawStorage)
+	if !ok {
+		return nil, nil
+	}
+
+	// The object may have been moved, created or deleted by the write
+	files := []string{mapped.GetMappings()[key]}
+	p.SnapshotParticipant.mux.Lock()
+	if snap, ok := p.snapshots[key]; ok {
+		files = append(files, snap.path)
+	}
+	p.SnapshotParticipant.mux.Unlock()
+
+	paths := make([]string, 0, len(files))
+	for i, file := range files {
+		if len(file) == 0 || (i > 0 && file == files[0]) {
+			continue
+		}
+
+		rel, err := filepath.Rel(p.gitDir.Dir(), file)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			return nil, fmt.Errorf("file %q of %s is outside of the Git directory %q", file, key, p.gitDir.Dir())
+		}
+
+		paths = append(paths, filepath.ToSlash(rel))
+	}
+
+	return paths, nil
+}
@@ -0,0 +1,242 @@
+package sync
+
+import (
+	"fmt"
+	gosync "sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/weaveworks/libgitops/pkg/storage"
+)
+
+// WriteFunc is a write operation executed on a Storage
+type WriteFunc func(s storage.Storage) error
+
+// Participant is implemented by Storages that can take part in the two-phase commit
+// protocol used by the SyncStorage for atomic writes. Storages not implementing this
+// interface are wrapped using NewSnapshotParticipant.
+type Participant interface {
+	// Prepare executes the given write operation for the object with the given key, in
+	// a way that can be undone by Rollback. If Prepare returns an error (e.g. because
+	// of failed validation or a conflict), the write is aborted for all Storages.
+	Prepare(key storage.ObjectKey, write WriteFunc) error
+	// Commit finalizes the prepared write for the given key, e.g. by pushing it.
+	// If Commit fails, the write is rolled back using Rollback.
+	Commit(key storage.ObjectKey) error
+	// Rollback restores the state from before the prepared write for the given key
+	Rollback(key storage.ObjectKey) error
+}
+
+// CompensatingParticipant is a Participant whose committed writes are published, e.g. pushed,
+// so that they can't be undone by re-syncing the Storage from the primary. If another Storage
+// fails to commit the write afterwards, Compensate is called instead.
+type CompensatingParticipant interface {
+	Participant
+	// Compensate undoes the committed write for the given key, e.g. by pushing a revert commit
+	Compensate(key storage.ObjectKey) error
+}
+
+// snapshot holds the raw content of an object before a write
+type snapshot struct {
+	content []byte
+	exists  bool
+	// path is the file the object is mapped to, for MappedRawStorages
+	path string
+}
+
+// SnapshotParticipant is a Participant for any Storage, which executes the write
+// operation directly in Prepare, but records the previous raw content of the object
+// first. On Rollback, the recorded content is written back using the RawStorage.
+type SnapshotParticipant struct {
+	storage.Storage
+	snapshots map[storage.ObjectKey]*snapshot
+	mux       gosync.Mutex
+}
+
+var _ Participant = &SnapshotParticipant{}
+
+// NewSnapshotParticipant wraps the given Storage in a SnapshotParticipant
+func NewSnapshotParticipant(s storage.Storage) *SnapshotParticipant {
+	return &SnapshotParticipant{
+		Storage:   s,
+		snapshots: make(map[storage.ObjectKey]*snapshot),
+	}
+}
+
+func (p *SnapshotParticipant) Prepare(key storage.ObjectKey, write WriteFunc) error {
+	raw := p.RawStorage()
+	snap := &snapshot{}
+	if mapped, ok := raw.(storage.MappedRawStorage); ok {
+		snap.path = mapped.GetMappings()[key]
+	}
+
+	if raw.Exists(key) {
+		content, err := raw.Read(key)
+		if err != nil {
+			return fmt.Errorf("failed to snapshot %s: %w", key, err)
+		}
+
+		snap.content = content
+		snap.exists = true
+	}
+
+	p.mux.Lock()
+	p.snapshots[key] = snap
+	p.mux.Unlock()
+
+	return write(p.Storage)
+}
+
+// Commit discards the snapshot, as the write has already been executed
+func (p *SnapshotParticipant) Commit(key storage.ObjectKey) error {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	delete(p.snapshots, key)
+	return nil
+}
+
+func (p *SnapshotParticipant) Rollback(key storage.ObjectKey) error {
+	p.mux.Lock()
+	snap, ok := p.snapshots[key]
+	delete(p.snapshots, key)
+	p.mux.Unlock()
+
+	if !ok {
+		return fmt.Errorf("no prepared write for %s", key)
+	}
+
+	raw := p.RawStorage()
+	if !snap.exists {
+		if !raw.Exists(key) {
+			return nil
+		}
+
+		return raw.Delete(key)
+	}
+
+	// Restore the mapping, in case the object was deleted
+	if mapped, ok := raw.(storage.MappedRawStorage); ok && len(snap.path) != 0 {
+		mapped.AddMapping(key, snap.path)
+	}
+
+	return raw.Write(key, snap.content)
+}
+
+// participant returns the given Storage as a Participant, wrapping it if needed
+func participant(s storage.Storage) Participant {
+	if p, ok := s.(Participant); ok {
+		return p
+	}
+
+	return NewSnapshotParticipant(s)
+}
+
+// atomicWrite executes the given write operation on the primary, and copies the
+// result to all replicas using a two-phase commit. If any Storage fails to prepare
+// or commit the write, all Storages are rolled back to their previous state, and
+// the writes already committed by CompensatingParticipants are compensated.
+// This must be called with the lock held.
+func (ss *SyncStorage) atomicWrite(key storage.ObjectKey, write WriteFunc) error {
+	storages := ss.storages()
+	participants := make([]Participant, 0, len(storages))
+
+	// rollback rolls back the given participants in reverse order
+	rollback := func(ps []Participant, cause error) error {
+		var errs []string
+		for i := len(ps) - 1; i >= 0; i-- {
+			if err := ps[i].Rollback(key); err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+
+		if len(errs) != 0 {
+			return fmt.Errorf("%w, rollback failed: %v", cause, errs)
+		}
+
+		return cause
+	}
+
+	// Phase 1: Prepare the write in the primary, and copy the result to the replicas
+	for i, s := range storages {
+		p := participant(s)
+		fn := write
+		if i > 0 {
+			fn = func(s storage.Storage) error {
+				return copyObject(ss.Storage, s, key)
+			}
+		}
+
+		if err := p.Prepare(key, fn); err != nil {
+			// The failed participant may have partially applied the write
+			participants = append(participants, p)
+			err = rollback(participants, &AtomicWriteError{Key: key, Storage: i, Err: err})
+			ss.recordSyncAll(key)
+			return err
+		}
+
+		participants = append(participants, p)
+	}
+
+	// Phase 2: Commit the replicas first, and the primary last. If the primary fails to commit,
+	// the committed replicas are re-synced from the primary, or compensated if they can't be.
+	order := append(participants[1:len(participants):len(participants)], participants[0])
+	for n, p := range order {
+		if commitErr := p.Commit(key); commitErr != nil {
+			idx := (n + 1) % len(order) // The primary is last in order, but has index 0
+			err := rollback(order[n:], &AtomicWriteError{Key: key, Storage: idx, Err: commitErr})
+			for i := 0; i < n; i++ {
+				if cp, ok := order[i].(CompensatingParticipant); ok {
+					if compErr := cp.Compensate(key); compErr != nil {
+						log.Errorf("SyncStorage: Failed to compensate the committed write in replica %d: %v", i, compErr)
+					}
+					continue
+				}
+
+				if syncErr := ss.syncReplica(i, key); syncErr != nil {
+					log.Warnf("SyncStorage: Failed to repair replica %d after rollback, queueing retry: %v", i, syncErr)
+					if qErr := ss.queue.add(i, key); qErr != nil {
+						log.Errorf("SyncStorage: Failed to persist the retry queue: %v", qErr)
+					}
+				}
+			}
+
+			ss.recordSyncAll(key)
+			return err
+		}
+	}
+
+	ss.recordSyncAll(key)
+	return nil
+}
+
+// recordSyncAll records the syncState of the given object for all replicas, so
+// that rolled back writes aren't mistaken for changes done outside of the SyncStorage
+func (ss *SyncStorage) recordSyncAll(key storage.ObjectKey) {
+	for i := range ss.replicas {
+		if err := ss.recordSync(i, key); err != nil {
+			log.Warnf("SyncStorage: Failed to record the state of %s in replica %d: %v", key, i, err)
+		}
+	}
+}
+
+// AtomicWriteError is returned when an atomic write fails, and has been rolled back
+type AtomicWriteError struct {
+	// Key is the key of the written object
+	Key storage.ObjectKey
+	// Storage is the index of the failing Storage, zero for the primary,
+	// and the index of the replica plus one for the replicas
+	Storage int
+	// Err is the underlying error
+	Err error
+}
+
+func (e *AtomicWriteError) Error() string {
+	if e.Storage == 0 {
+		return fmt.Sprintf("atomic write of %s failed in the primary: %v", e.Key, e.Err)
+	}
+
+	return fmt.Sprintf("atomic write of %s failed in replica %d: %v", e.Key, e.Storage-1, e.Err)
+}
+
+func (e *AtomicWriteError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,311 @@
+package sync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/weaveworks/libgitops/pkg/gitdir"
+	"github.com/weaveworks/libgitops/pkg/runtime"
+	"github.com/weaveworks/libgitops/pkg/serializer"
+	"github.com/weaveworks/libgitops/pkg/storage"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// rawOnlyStorage is a Storage only backed by a RawStorage, the other methods panic
+type rawOnlyStorage struct {
+	storage.Storage
+	raw storage.RawStorage
+}
+
+func (s *rawOnlyStorage) RawStorage() storage.RawStorage { return s.raw }
+
+func TestSnapshotParticipantRollback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "libgitops-participant")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	gv := schema.GroupVersion{Group: "sample-app.weave.works", Version: "v1alpha1"}
+	raw := storage.NewGenericRawStorage(dir, gv, serializer.ContentTypeYAML)
+	kind := storage.NewKindKey(gv.WithKind("Car"))
+	existing := storage.NewObjectKey(kind, runtime.NewIdentifier("existing"))
+	created := storage.NewObjectKey(kind, runtime.NewIdentifier("created"))
+
+	original := []byte("kind: Car\n")
+	if err := raw.Write(existing, original); err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewSnapshotParticipant(&rawOnlyStorage{raw: raw})
+	for _, key := range []storage.ObjectKey{existing, created} {
+		key := key
+		if err := p.Prepare(key, func(s storage.Storage) error {
+			return s.RawStorage().Write(key, []byte("kind: Modified\n"))
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := p.Rollback(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if content, err := raw.Read(existing); err != nil || !bytes.Equal(content, original) {
+		t.Errorf("existing object not restored: %q, %v", content, err)
+	}
+
+	if raw.Exists(created) {
+		t.Errorf("created object not removed")
+	}
+
+	// A committed write can't be rolled back
+	if err := p.Prepare(existing, func(s storage.Storage) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.Commit(existing); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.Rollback(existing); err == nil {
+		t.Errorf("expected rollback of committed write to fail")
+	}
+}
+
+// recordingParticipant is a SnapshotParticipant recording the calls to it,
+// which fails to commit if failCommit is set
+type recordingParticipant struct {
+	*SnapshotParticipant
+	name       string
+	calls      *[]string
+	failCommit bool
+}
+
+func (p *recordingParticipant) Prepare(key storage.ObjectKey, write WriteFunc) error {
+	*p.calls = append(*p.calls, "prepare "+p.name)
+	return p.SnapshotParticipant.Prepare(key, write)
+}
+
+func (p *recordingParticipant) Commit(key storage.ObjectKey) error {
+	*p.calls = append(*p.calls, "commit "+p.name)
+	if p.failCommit {
+		return errFail
+	}
+	return p.SnapshotParticipant.Commit(key)
+}
+
+func (p *recordingParticipant) Rollback(key storage.ObjectKey) error {
+	*p.calls = append(*p.calls, "rollback "+p.name)
+	return p.SnapshotParticipant.Rollback(key)
+}
+
+func TestAtomicWrite(t *testing.T) {
+	tests := []struct {
+		name string
+		// failPrepare and failCommit are the indexes of the failing storages, -1 for none
+		failPrepare, failCommit int
+		calls                   []string
+		color                   string
+	}{
+		{"success", -1, -1, []string{"prepare p", "prepare r0", "prepare r1", "commit r0", "commit r1", "commit p"}, "blue"},
+		{"primary fails to prepare", 0, -1, []string{"prepare p", "rollback p"}, "red"},
+		{"replica fails to prepare", 2, -1, []string{"prepare p", "prepare r0", "prepare r1", "rollback r1", "rollback r0", "rollback p"}, "red"},
+		{"replica fails to commit", -1, 1, []string{"prepare p", "prepare r0", "prepare r1", "commit r0", "rollback p", "rollback r1", "rollback r0"}, "red"},
+		{"primary fails to commit", -1, 0, []string{"prepare p", "prepare r0", "prepare r1", "commit r0", "commit r1", "commit p", "rollback p"}, "red"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls []string
+			mems := make([]*memStorage, 3)
+			ps := make([]storage.Storage, 3)
+			for i, name := range []string{"p", "r0", "r1"} {
+				mems[i] = newMemStorage()
+				ps[i] = &recordingParticipant{
+					SnapshotParticipant: NewSnapshotParticipant(mems[i]),
+					name:                name,
+					calls:               &calls,
+				}
+			}
+
+			opts := DefaultOptions()
+			opts.Atomic = true
+			opts.RetryInterval = time.Hour
+			opts.ReconcileInterval = 0
+			ss, err := NewSyncStorageWithOptions(opts, ps[0], ps[1:]...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ss.Close()
+
+			if err := ss.Create(newCar("red")); err != nil {
+				t.Fatal(err)
+			}
+			if tt.failCommit >= 0 {
+				ps[tt.failCommit].(*recordingParticipant).failCommit = true
+			}
+			if tt.failPrepare >= 0 {
+				mems[tt.failPrepare].setFail(true)
+			}
+
+			calls = nil
+			err = ss.Update(newCar("blue"))
+			var writeErr *AtomicWriteError
+			switch failing := tt.failPrepare + tt.failCommit + 1; {
+			case failing < 0 && err != nil:
+				t.Fatal(err)
+			case failing >= 0 && (!errors.As(err, &writeErr) || writeErr.Storage != failing || !errors.Is(err, errFail)):
+				t.Errorf("expected an AtomicWriteError for storage %d, got %v", failing, err)
+			}
+
+			if !reflect.DeepEqual(calls, tt.calls) {
+				t.Errorf("expected calls %v, got %v", tt.calls, calls)
+			}
+			for i, s := range mems {
+				if color := colorOf(t, s); color != tt.color {
+					t.Errorf("expected color %q in storage %d, got %q", tt.color, i, color)
+				}
+			}
+		})
+	}
+}
+
+// fakeGitDirectory is a GitDirectory for a plain directory, which records the messages and
+// paths of the commits instead of committing. The other methods panic.
+type fakeGitDirectory struct {
+	gitdir.GitDirectory
+	dir string
+	// failPush makes the commits fail, like if they couldn't be pushed
+	failPush  bool
+	commits   []string
+	paths     [][]string
+	suspended int
+}
+
+func (d *fakeGitDirectory) Dir() string { return d.dir }
+func (d *fakeGitDirectory) Suspend()    { d.suspended++ }
+func (d *fakeGitDirectory) Resume()     { d.suspended-- }
+
+func (d *fakeGitDirectory) Commit(ctx context.Context, authorName, authorEmail, msg string, opts ...gitdir.CommitOption) error {
+	if d.failPush {
+		return errors.New("push failed")
+	}
+	o := &gitdir.CommitOptions{}
+	for _, opt := range opts {
+		opt.ApplyToCommitOptions(o)
+	}
+	d.commits = append(d.commits, msg)
+	d.paths = append(d.paths, o.Paths)
+	return nil
+}
+
+// newGitStorage creates a GitParticipant for a Storage backed by the worktree of a fakeGitDirectory
+func newGitStorage(t *testing.T) (*GitParticipant, storage.Storage, *fakeGitDirectory) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "libgitops-participant")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &fakeGitDirectory{dir: dir}
+	raw := storage.NewGenericMappedRawStorage(dir)
+	raw.AddMapping(carKey, filepath.Join(dir, "car.yaml"))
+	gitStorage := &memStorage{raw: raw}
+	return NewGitParticipant(gitStorage, d, "Test", "test@example.com"), gitStorage, d
+}
+
+func TestGitParticipantRollback(t *testing.T) {
+	p, gitStorage, d := newGitStorage(t)
+	defer os.RemoveAll(d.Dir())
+	primary, replica := newMemStorage(), newMemStorage()
+
+	opts := DefaultOptions()
+	opts.Atomic = true
+	opts.RetryInterval = time.Hour
+	opts.ReconcileInterval = 0
+	ss, err := NewSyncStorageWithOptions(opts, primary, p, replica)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ss.Close()
+
+	// The write is committed and pushed
+	if err := ss.Create(newCar("red")); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.commits) != 1 || !strings.HasPrefix(d.commits[0], "Write") {
+		t.Errorf("expected the write to be committed, got %v", d.commits)
+	}
+	if !reflect.DeepEqual(d.paths, [][]string{{"car.yaml"}}) {
+		t.Errorf("expected only the file of the object to be committed, got %v", d.paths)
+	}
+
+	// A failing push rolls back the write in all storages
+	d.failPush = true
+	err = ss.Update(newCar("blue"))
+	var writeErr *AtomicWriteError
+	if !errors.As(err, &writeErr) || writeErr.Storage != 1 {
+		t.Fatalf("expected an AtomicWriteError for the Git storage, got %v", err)
+	}
+	for i, s := range []storage.Storage{primary, gitStorage, replica} {
+		if color := colorOf(t, s); color != "red" {
+			t.Errorf("expected color red in storage %d, got %q", i, color)
+		}
+	}
+	if d.suspended != 0 {
+		t.Errorf("expected the GitDirectory to be resumed, got %d suspensions", d.suspended)
+	}
+}
+
+func TestGitParticipantCompensate(t *testing.T) {
+	p, gitStorage, d := newGitStorage(t)
+	defer os.RemoveAll(d.Dir())
+	var calls []string
+	primary := &recordingParticipant{SnapshotParticipant: NewSnapshotParticipant(newMemStorage()), name: "p", calls: &calls}
+
+	opts := DefaultOptions()
+	opts.Atomic = true
+	opts.RetryInterval = time.Hour
+	opts.ReconcileInterval = 0
+	ss, err := NewSyncStorageWithOptions(opts, primary, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ss.Close()
+
+	if err := ss.Create(newCar("red")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The Git storage has pushed the write when the primary fails to commit it,
+	// hence the write is reverted by pushing another commit
+	primary.failCommit = true
+	err = ss.Update(newCar("blue"))
+	var writeErr *AtomicWriteError
+	if !errors.As(err, &writeErr) || writeErr.Storage != 0 {
+		t.Fatalf("expected an AtomicWriteError for the primary, got %v", err)
+	}
+	for i, s := range []storage.Storage{primary, gitStorage} {
+		if color := colorOf(t, s); color != "red" {
+			t.Errorf("expected color red in storage %d, got %q", i, color)
+		}
+	}
+	if len(d.commits) != 3 || !strings.HasPrefix(d.commits[2], "Revert write") {
+		t.Errorf("expected the write and its revert to be pushed, got %v", d.commits)
+	}
+	if !reflect.DeepEqual(d.paths[2], []string{"car.yaml"}) {
+		t.Errorf("expected only the file of the object to be reverted, got %v", d.paths[2])
+	}
+	if d.suspended != 0 {
+		t.Errorf("expected the GitDirectory to be resumed, got %d suspensions", d.suspended)
+	}
+}
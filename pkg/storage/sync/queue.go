@@ -0,0 +1,137 @@
+package sync
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	gosync "sync"
+
+	"github.com/weaveworks/libgitops/pkg/runtime"
+	"github.com/weaveworks/libgitops/pkg/storage"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// queueEntry describes a replica which failed to receive the
+// state of an object, and needs to be synced from the primary
+type queueEntry struct {
+	Replica    int    `json:"replica"`
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	ID         string `json:"id"`
+}
+
+func newQueueEntry(replica int, key storage.ObjectKey) queueEntry {
+	apiVersion, kind := key.GetGVK().ToAPIVersionAndKind()
+	return queueEntry{
+		Replica:    replica,
+		APIVersion: apiVersion,
+		Kind:       kind,
+		ID:         key.GetIdentifier(),
+	}
+}
+
+func (e queueEntry) key() storage.ObjectKey {
+	gvk := schema.FromAPIVersionAndKind(e.APIVersion, e.Kind)
+	return storage.NewObjectKey(storage.NewKindKey(gvk), runtime.NewIdentifier(e.ID))
+}
+
+// retryQueue is a set of queueEntries, which is persisted to the
+// given file on every change, so that it survives restarts. If no
+// file is given, the queue is only kept in memory.
+type retryQueue struct {
+	file    string
+	entries []queueEntry
+	mux     gosync.Mutex
+}
+
+// newRetryQueue creates a new retryQueue, and loads the entries from the given file if it exists
+func newRetryQueue(file string) (*retryQueue, error) {
+	q := &retryQueue{file: file}
+	if len(file) == 0 {
+		return q, nil
+	}
+
+	content, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return q, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(content, &q.entries); err != nil {
+		return nil, err
+	}
+
+	return q, nil
+}
+
+// add adds an entry for the given replica and key, unless it's already queued
+func (q *retryQueue) add(replica int, key storage.ObjectKey) error {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	entry := newQueueEntry(replica, key)
+	for _, e := range q.entries {
+		if e == entry {
+			return nil
+		}
+	}
+
+	q.entries = append(q.entries, entry)
+	return q.save()
+}
+
+// remove removes the entry for the given replica and key, if it's queued
+func (q *retryQueue) remove(replica int, key storage.ObjectKey) error {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	entry := newQueueEntry(replica, key)
+	for i, e := range q.entries {
+		if e == entry {
+			q.entries = append(q.entries[:i], q.entries[i+1:]...)
+			return q.save()
+		}
+	}
+
+	return nil
+}
+
+// list returns a copy of the queued entries, in the order they were added
+func (q *retryQueue) list() []queueEntry {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	return append([]queueEntry(nil), q.entries...)
+}
+
+// save writes the entries to the file atomically, it must be called with the lock held
+func (q *retryQueue) save() error {
+	if len(q.file) == 0 {
+		return nil
+	}
+
+	content, err := json.Marshal(q.entries)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first, so that the queue can't be left half-written
+	tmp, err := ioutil.TempFile(filepath.Dir(q.file), filepath.Base(q.file)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(content); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), q.file)
+}
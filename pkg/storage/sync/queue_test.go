@@ -0,0 +1,59 @@
+package sync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/weaveworks/libgitops/pkg/runtime"
+	"github.com/weaveworks/libgitops/pkg/storage"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestRetryQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "libgitops-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	kind := storage.NewKindKey(schema.GroupVersionKind{Group: "sample-app.weave.works", Version: "v1alpha1", Kind: "Car"})
+	car := storage.NewObjectKey(kind, runtime.NewIdentifier("car"))
+	bike := storage.NewObjectKey(kind, runtime.NewIdentifier("bike"))
+
+	file := filepath.Join(dir, "queue.json")
+	q, err := newRetryQueue(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, entry := range []struct {
+		replica int
+		key     storage.ObjectKey
+	}{{0, car}, {1, car}, {0, bike}, {0, car}} {
+		if err := q.add(entry.replica, entry.key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := q.remove(1, car); err != nil {
+		t.Fatal(err)
+	}
+
+	// The queue should survive a restart
+	q, err = newRetryQueue(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []queueEntry{newQueueEntry(0, car), newQueueEntry(0, bike)}
+	if entries := q.list(); !reflect.DeepEqual(entries, expected) {
+		t.Errorf("unexpected entries: %v != %v", entries, expected)
+	}
+
+	if key := q.list()[1].key(); key != bike {
+		t.Errorf("unexpected key: %s != %s", key, bike)
+	}
+}
@@ -0,0 +1,167 @@
+package sync
+
+import (
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/weaveworks/libgitops/pkg/storage"
+	"github.com/weaveworks/libgitops/pkg/storage/watch/update"
+	"k8s.io/apimachinery/pkg/api/equality"
+)
+
+// Reconcile compares the objects of the configured Kinds between the primary and
+// every replica, and repairs any drift. Objects changed only in the primary are
+// copied to the replica, and objects changed in a replica outside of the SyncStorage
+// are resolved according to the ConflictPolicy. Failures to sync single objects are
+// logged, an error is only returned if the objects couldn't be listed.
+func (ss *SyncStorage) Reconcile() error {
+	log.Debug("SyncStorage: Starting reconciliation")
+	for _, kind := range ss.opts.Kinds {
+		primaryKeys, err := listKeys(ss.Storage, kind)
+		if err != nil {
+			return fmt.Errorf("failed to list %s in the primary: %w", kind, err)
+		}
+
+		for i, replica := range ss.replicas {
+			replicaKeys, err := listKeys(replica, kind)
+			if err != nil {
+				return fmt.Errorf("failed to list %s in replica %d: %w", kind, i, err)
+			}
+
+			for _, key := range unionKeys(primaryKeys, replicaKeys) {
+				ss.mux.Lock()
+				event, err := ss.reconcileKey(i, key)
+				ss.mux.Unlock()
+
+				if err != nil {
+					log.Errorf("SyncStorage: Failed to reconcile %s with replica %d: %v", key, i, err)
+				} else if event != update.ObjectEventNone {
+					ss.sendPrimaryEvent(event, key)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// reconcileKey syncs the given object between the primary and the replica with the given
+// index, based on which one has changed since they were last synced. If the primary is
+// changed as a result (using ConflictPolicyReplicaWins), the event describing the change
+// is returned. This must be called with the lock held.
+func (ss *SyncStorage) reconcileKey(i int, key storage.ObjectKey) (update.ObjectEvent, error) {
+	replica := ss.replicas[i]
+	primarySum, primaryFound, err := checksum(ss.Storage, key)
+	if err != nil {
+		return update.ObjectEventNone, err
+	}
+
+	replicaSum, replicaFound, err := checksum(replica, key)
+	if err != nil {
+		return update.ObjectEventNone, err
+	}
+
+	var primaryChanged, replicaChanged bool
+	if last, ok := ss.synced[i][key]; ok {
+		primaryChanged = primarySum != last.primary
+		replicaChanged = replicaSum != last.replica
+	} else if !primaryFound && !replicaFound {
+		return update.ObjectEventNone, nil
+	} else {
+		// The object hasn't been synced yet (e.g. after a restart), so compare the contents.
+		// Checksums can't be compared between Storages, as they are implementation-specific.
+		if primaryFound && replicaFound {
+			equal, err := equalObjects(ss.Storage, replica, key)
+			if err != nil {
+				return update.ObjectEventNone, err
+			}
+
+			if equal {
+				return update.ObjectEventNone, ss.recordSync(i, key)
+			}
+		}
+
+		primaryChanged = primaryFound
+		replicaChanged = replicaFound
+	}
+
+	if !replicaChanged {
+		if primaryChanged {
+			log.Debugf("SyncStorage: Repairing drift of %s in replica %d", key, i)
+			return update.ObjectEventNone, ss.syncReplica(i, key)
+		}
+
+		return update.ObjectEventNone, nil
+	}
+
+	log.Infof("SyncStorage: %s was changed in replica %d, resolving using %s", key, i, ss.opts.ConflictPolicy)
+	switch ss.opts.ConflictPolicy {
+	case ConflictPolicyPrimaryWins:
+		return update.ObjectEventNone, ss.syncReplica(i, key)
+	case ConflictPolicyReplicaWins:
+		if err := copyObject(replica, ss.Storage, key); err != nil {
+			return update.ObjectEventNone, err
+		}
+
+		if err := ss.syncReplica(i, key); err != nil {
+			return update.ObjectEventNone, err
+		}
+
+		ss.syncReplicas(key, i)
+		switch {
+		case !replicaFound:
+			return update.ObjectEventDelete, nil
+		case !primaryFound:
+			return update.ObjectEventCreate, nil
+		default:
+			return update.ObjectEventModify, nil
+		}
+	}
+
+	// ConflictPolicySkip leaves the Storages as-is, the conflict is
+	// detected again in every reconciliation until it's resolved
+	log.Warnf("SyncStorage: Skipping conflicting changes of %s in replica %d", key, i)
+	return update.ObjectEventNone, nil
+}
+
+// listKeys lists the keys of the given kind, a missing directory for the kind counts as empty
+func listKeys(s storage.Storage, kind storage.KindKey) ([]storage.ObjectKey, error) {
+	keys, err := s.RawStorage().List(kind)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	return keys, err
+}
+
+// equalObjects checks if the given object has the same contents in both Storages
+func equalObjects(a, b storage.Storage, key storage.ObjectKey) (bool, error) {
+	objA, err := a.Get(key)
+	if err != nil {
+		return false, err
+	}
+
+	objB, err := b.Get(key)
+	if err != nil {
+		return false, err
+	}
+
+	return equality.Semantic.DeepEqual(objA, objB), nil
+}
+
+// unionKeys returns the keys present in either of the given lists, without duplicates
+func unionKeys(a, b []storage.ObjectKey) []storage.ObjectKey {
+	seen := make(map[storage.ObjectKey]bool, len(a)+len(b))
+	result := make([]storage.ObjectKey, 0, len(a)+len(b))
+	for _, keys := range [][]storage.ObjectKey{a, b} {
+		for _, key := range keys {
+			if !seen[key] {
+				seen[key] = true
+				result = append(result, key)
+			}
+		}
+	}
+
+	return result
+}
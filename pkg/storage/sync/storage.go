@@ -1,11 +1,10 @@
 package sync
 
-/*
-
-TODO: Revisit if we need this file/package in the future.
-
 import (
-	"fmt"
+	"errors"
+	"sort"
+	gosync "sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/weaveworks/libgitops/pkg/runtime"
@@ -17,172 +16,480 @@ import (
 
 const updateBuffer = 4096 // How many updates to buffer, 4096 should be enough for even a high update frequency
 
-// SyncStorage is a Storage implementation taking in multiple Storages and
-// keeping them in sync. Any write operation executed on the SyncStorage
-// is propagated to all of the Storages it manages (including the embedded
-// one). For any retrieval or generation operation, the embedded Storage
-// will be used (it is treated as read-write). As all other Storages only
-// receive write operations, they can be thought of as write-only.
+// ConflictPolicy is an enum describing how to resolve a conflict, i.e. when
+// the state of an object in a replica has been changed outside of the SyncStorage
+type ConflictPolicy byte
+
+const (
+	// ConflictPolicyPrimaryWins overwrites the replica with the state of the primary
+	ConflictPolicyPrimaryWins ConflictPolicy = iota // 0
+	// ConflictPolicyReplicaWins copies the state of the replica to the primary and all other replicas
+	ConflictPolicyReplicaWins // 1
+	// ConflictPolicySkip leaves the object as-is in all storages, until it's written again
+	ConflictPolicySkip // 2
+)
+
+func (p ConflictPolicy) String() string {
+	switch p {
+	case 0:
+		return "PRIMARY_WINS"
+	case 1:
+		return "REPLICA_WINS"
+	case 2:
+		return "SKIP"
+	}
+
+	return "UNKNOWN"
+}
+
+// Options specifies options for the SyncStorage
+type Options struct {
+	// QueueFile specifies the file the retry queue of failed replica writes is
+	// persisted to, so that the writes are retried after restarts. If empty,
+	// the queue is only kept in memory. The entries refer to the replicas by
+	// index, so the replicas must be given in the same order after a restart.
+	QueueFile string
+	// RetryInterval specifies how often failed replica writes are retried
+	RetryInterval time.Duration
+	// ReconcileInterval specifies how often the objects of the given Kinds are
+	// compared between the primary and the replicas, to repair any drift. The
+	// reconciliation also runs on startup. Zero disables the reconciliation.
+	ReconcileInterval time.Duration
+	// Kinds specifies the kinds of objects to reconcile
+	Kinds []storage.KindKey
+	// ConflictPolicy specifies how to resolve changes made to a replica outside
+	// of the SyncStorage, e.g. by a Git pull in the replica's directory
+	ConflictPolicy ConflictPolicy
+	// Atomic specifies whether writes should be all-or-nothing. If set, writes
+	// are applied to all Storages using a two-phase commit (see Participant),
+	// and if any Storage fails, the write is rolled back in all of them. If
+	// unset, failing replicas are queued for retrying instead.
+	Atomic bool
+}
+
+// DefaultOptions returns the default options
+func DefaultOptions() Options {
+	return Options{
+		RetryInterval:     10 * time.Second,
+		ReconcileInterval: 5 * time.Minute,
+		ConflictPolicy:    ConflictPolicyPrimaryWins,
+	}
+}
+
+// syncState holds the checksums of an object in the primary and
+// a replica at the time the replica was last synced
+type syncState struct {
+	primary string
+	replica string
+}
+
+// SyncStorage is a Storage implementation taking in a primary Storage and
+// any number of replicas, and keeping them in sync. Any write operation is
+// first executed on the primary, and if it succeeds, the resulting state is
+// copied to every replica. For any retrieval or generation operation, the
+// primary is used. Writes that fail for a replica are queued and retried,
+// and a periodic reconciliation repairs any drift between the Storages.
+// Changes done to a replica outside of the SyncStorage are detected using
+// the Storages' checksums, and resolved according to the ConflictPolicy.
 type SyncStorage struct {
 	storage.Storage
-	storages       []storage.Storage
-	inboundStream  update.UpdateStream
-	outboundStream update.UpdateStream
-	monitor        *sync.Monitor
+	replicas []storage.Storage
+	opts     Options
+	queue    *retryQueue
+	// synced holds the syncState of every object for every replica
+	synced []map[storage.ObjectKey]syncState
+	// mux serializes the writes and the syncing
+	mux     gosync.Mutex
+	inbound update.UpdateStream
+	events  update.UpdateStream
+	stopCh  chan struct{}
+	monitor *sync.Monitor
 }
 
 // SyncStorage implements update.EventStorage.
 var _ update.EventStorage = &SyncStorage{}
 
 // NewSyncStorage constructs a new SyncStorage
-func NewSyncStorage(rwStorage storage.Storage, wStorages ...storage.Storage) storage.Storage {
+func NewSyncStorage(primary storage.Storage, replicas ...storage.Storage) (*SyncStorage, error) {
+	return NewSyncStorageWithOptions(DefaultOptions(), primary, replicas...)
+}
+
+// NewSyncStorageWithOptions is like NewSyncStorage,
+// but allows customizing the behavior using the given Options.
+func NewSyncStorageWithOptions(opts Options, primary storage.Storage, replicas ...storage.Storage) (*SyncStorage, error) {
+	queue, err := newRetryQueue(opts.QueueFile)
+	if err != nil {
+		return nil, err
+	}
+
 	ss := &SyncStorage{
-		Storage:  rwStorage,
-		storages: append(wStorages, rwStorage),
+		Storage:  primary,
+		replicas: replicas,
+		opts:     opts,
+		queue:    queue,
+		synced:   make([]map[storage.ObjectKey]syncState, len(replicas)),
+		stopCh:   make(chan struct{}),
+	}
+
+	for i := range ss.synced {
+		ss.synced[i] = make(map[storage.ObjectKey]syncState)
+	}
+
+	// Drop any entries for replicas that aren't configured anymore
+	for _, entry := range queue.list() {
+		if entry.Replica < 0 || entry.Replica >= len(replicas) {
+			log.Warnf("SyncStorage: Dropping queued write of %s for unknown replica %d", entry.key(), entry.Replica)
+			if err := queue.remove(entry.Replica, entry.key()); err != nil {
+				return nil, err
+			}
+		}
 	}
 
-	for _, s := range ss.storages {
-		if watchStorage, ok := s.(watch.WatchStorage); ok {
-			// Populate eventStream if we found a watchstorage
-			if ss.inboundStream == nil {
-				ss.inboundStream = make(update.UpdateStream, updateBuffer)
+	for _, s := range ss.storages() {
+		if eventStorage, ok := s.(update.EventStorage); ok {
+			// Populate the inbound stream if we found an EventStorage
+			if ss.inbound == nil {
+				ss.inbound = make(update.UpdateStream, updateBuffer)
 			}
-			watchStorage.SetUpdateStream(ss.inboundStream)
+			eventStorage.SetUpdateStream(ss.inbound)
 		}
 	}
 
-	if ss.inboundStream != nil {
-		ss.monitor = sync.RunMonitor(ss.monitorFunc)
-		ss.outboundStream = make(update.UpdateStream, updateBuffer)
+	ss.monitor = sync.RunMonitor(ss.monitorFunc)
+	return ss, nil
+}
+
+// Create is executed on the primary, and then propagated to the replicas
+func (ss *SyncStorage) Create(obj runtime.Object) error {
+	key, err := ss.ObjectKeyFor(obj)
+	if err != nil {
+		return err
 	}
 
-	return ss
+	return ss.write(key, func(s storage.Storage) error {
+		return s.Create(obj)
+	})
 }
 
-// Set is propagated to all Storages
-func (ss *SyncStorage) Set(obj runtime.Object) error {
-	return ss.runAll(func(s storage.Storage) error {
-		return s.Set(obj)
+// Update is executed on the primary, and then propagated to the replicas
+func (ss *SyncStorage) Update(obj runtime.Object) error {
+	key, err := ss.ObjectKeyFor(obj)
+	if err != nil {
+		return err
+	}
+
+	return ss.write(key, func(s storage.Storage) error {
+		return s.Update(obj)
 	})
 }
 
-// Patch is propagated to all Storages
+// Patch is executed on the primary, and then propagated to the replicas
 func (ss *SyncStorage) Patch(key storage.ObjectKey, patch []byte) error {
-	return ss.runAll(func(s storage.Storage) error {
+	return ss.write(key, func(s storage.Storage) error {
 		return s.Patch(key, patch)
 	})
 }
 
-// Delete is propagated to all Storages
+// Delete is executed on the primary, and then propagated to the replicas
 func (ss *SyncStorage) Delete(key storage.ObjectKey) error {
-	return ss.runAll(func(s storage.Storage) error {
+	return ss.write(key, func(s storage.Storage) error {
 		return s.Delete(key)
 	})
 }
 
-func (ss *SyncStorage) Close() error {
-	// Close all WatchStorages
-	for _, s := range ss.storages {
-		if watchStorage, ok := s.(watch.WatchStorage); ok {
-			_ = watchStorage.Close()
+func (ss *SyncStorage) SetUpdateStream(eventStream update.UpdateStream) {
+	ss.events = eventStream
+}
+
+// SetErrorStream sets the given error stream for all EventStorages managed by the SyncStorage
+func (ss *SyncStorage) SetErrorStream(errorStream update.ErrorStream) {
+	for _, s := range ss.storages() {
+		if eventStorage, ok := s.(update.EventStorage); ok {
+			eventStorage.SetErrorStream(errorStream)
 		}
 	}
+}
 
-	// Close the event streams if set
-	if ss.inboundStream != nil {
-		close(ss.inboundStream)
-	}
-	if ss.outboundStream != nil {
-		close(ss.outboundStream)
+// InvalidFiles returns the invalid files of all EventStorages managed by the SyncStorage, sorted by path
+func (ss *SyncStorage) InvalidFiles() []*update.FileError {
+	var result []*update.FileError
+	for _, s := range ss.storages() {
+		if eventStorage, ok := s.(update.EventStorage); ok {
+			result = append(result, eventStorage.InvalidFiles()...)
+		}
 	}
-	// Wait for the monitor goroutine
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Path < result[j].Path
+	})
+	return result
+}
+
+// Pending returns the number of replica writes waiting to be retried
+func (ss *SyncStorage) Pending() int {
+	return len(ss.queue.list())
+}
+
+func (ss *SyncStorage) Close() error {
+	// Stop the monitor before closing the Storages
+	close(ss.stopCh)
 	ss.monitor.Wait()
+
+	for _, s := range ss.storages() {
+		_ = s.Close()
+	}
+
 	return nil
 }
 
-func (ss *SyncStorage) GetUpdateStream() update.UpdateStream {
-	return ss.outboundStream
+// storages returns the primary followed by the replicas
+func (ss *SyncStorage) storages() []storage.Storage {
+	return append([]storage.Storage{ss.Storage}, ss.replicas...)
 }
 
-// runAll runs the given function for all Storages in parallel and aggregates all errors
-func (ss *SyncStorage) runAll(f func(storage.Storage) error) (err error) {
-	type result struct {
-		int
-		error
+// write runs the given write operation on the primary, and if it succeeds, syncs all replicas.
+// Failing replicas don't fail the write, they are instead queued to be retried later. If
+// opts.Atomic is set, the write is instead done atomically for all Storages.
+func (ss *SyncStorage) write(key storage.ObjectKey, fn WriteFunc) error {
+	ss.mux.Lock()
+	defer ss.mux.Unlock()
+
+	if ss.opts.Atomic {
+		return ss.atomicWrite(key, fn)
 	}
 
-	errC := make(chan result)
-	for i, s := range ss.storages {
-		go func(i int, s storage.Storage) {
-			errC <- result{i, f(s)}
-		}(i, s) // NOTE: This requires i and s as arguments, otherwise they will be evaluated for one Storage only
+	if err := fn(ss.Storage); err != nil {
+		return err
 	}
 
-	for i := 0; i < len(ss.storages); i++ {
-		if result := <-errC; result.error != nil {
-			if err == nil {
-				err = fmt.Errorf("SyncStorage: Error in Storage %d: %v", result.int, result.error)
-			} else {
-				err = fmt.Errorf("%v\n%29s %d: %v", err, "and error in Storage", result.int, result.error)
+	ss.syncReplicas(key, -1)
+	return nil
+}
+
+// syncReplicas syncs the given object to all replicas except the one with the given index
+func (ss *SyncStorage) syncReplicas(key storage.ObjectKey, except int) {
+	for i := range ss.replicas {
+		if i == except {
+			continue
+		}
+
+		if err := ss.syncReplica(i, key); err != nil {
+			log.Warnf("SyncStorage: Failed to sync %s to replica %d, queueing retry: %v", key, i, err)
+			if err := ss.queue.add(i, key); err != nil {
+				log.Errorf("SyncStorage: Failed to persist the retry queue: %v", err)
 			}
 		}
 	}
+}
+
+// syncReplica copies the state of the given object from the primary to the replica with the given
+// index, and records the resulting syncState. Any queued retry for the object is removed on success.
+func (ss *SyncStorage) syncReplica(i int, key storage.ObjectKey) error {
+	if err := copyObject(ss.Storage, ss.replicas[i], key); err != nil {
+		return err
+	}
 
-	return
+	if err := ss.recordSync(i, key); err != nil {
+		return err
+	}
+
+	return ss.queue.remove(i, key)
+}
+
+// recordSync records the current checksums of the given object in the primary and the given replica
+func (ss *SyncStorage) recordSync(i int, key storage.ObjectKey) error {
+	primary, primaryFound, err := checksum(ss.Storage, key)
+	if err != nil {
+		return err
+	}
+
+	replica, replicaFound, err := checksum(ss.replicas[i], key)
+	if err != nil {
+		return err
+	}
+
+	if !primaryFound && !replicaFound {
+		delete(ss.synced[i], key)
+		return nil
+	}
+
+	ss.synced[i][key] = syncState{primary, replica}
+	return nil
 }
 
 func (ss *SyncStorage) monitorFunc() {
 	log.Debug("SyncStorage: Monitoring thread started")
 	defer log.Debug("SyncStorage: Monitoring thread stopped")
 
-	// TODO: Support detecting changes done when the GitOps daemon isn't running
-	// This is difficult to do though, as we have don't know which state is the latest
-	// For now, only update the state on write when the daemon is running
+	retryTicker := time.NewTicker(ss.retryInterval())
+	defer retryTicker.Stop()
+
+	// A nil channel blocks forever, which disables the periodic reconciliation
+	var reconcileC <-chan time.Time
+	if ss.opts.ReconcileInterval > 0 {
+		ticker := time.NewTicker(ss.opts.ReconcileInterval)
+		defer ticker.Stop()
+		reconcileC = ticker.C
+
+		if err := ss.Reconcile(); err != nil {
+			log.Errorf("SyncStorage: Reconciliation failed: %v", err)
+		}
+	}
+
+	// Retry the writes queued before a restart immediately
+	ss.retry()
+
 	for {
-		upd, ok := <-ss.inboundStream
-		if ok {
-			log.Debugf("SyncStorage: Received update %v %t", upd, ok)
-
-			gvk := upd.PartialObject.GetObjectKind().GroupVersionKind()
-			uid := upd.PartialObject.GetUID()
-			key := storage.NewObjectKey(storage.NewKindKey(gvk), runtime.NewIdentifier(string(uid)))
-			log.Debugf("SyncStorage: Object has gvk=%q and uid=%q", gvk, uid)
-
-			switch upd.Event {
-			case update.ObjectEventModify, update.ObjectEventCreate:
-				// First load the Object using the Storage given in the update,
-				// then set it using the client constructed above
-
-				obj, err := upd.Storage.Get(key)
-				if err != nil {
-					log.Errorf("Failed to get Object with UID %q: %v", upd.PartialObject.GetUID(), err)
-					continue
-				}
-
-				if err = ss.Set(obj); err != nil {
-					log.Errorf("Failed to set Object with UID %q: %v", upd.PartialObject.GetUID(), err)
-					continue
-				}
-			case update.ObjectEventDelete:
-				// For deletion we use the generated "fake" APIType object
-				if err := ss.Delete(key); err != nil {
-					log.Errorf("Failed to delete Object with UID %q: %v", upd.PartialObject.GetUID(), err)
-					continue
-				}
+		select {
+		case <-ss.stopCh:
+			return
+		case upd := <-ss.inbound:
+			ss.handleUpdate(upd)
+		case <-retryTicker.C:
+			ss.retry()
+		case <-reconcileC:
+			if err := ss.Reconcile(); err != nil {
+				log.Errorf("SyncStorage: Reconciliation failed: %v", err)
 			}
+		}
+	}
+}
 
-			// Send the update to the listeners unless the channel is full,
-			// in which case issue a warning. The channel can hold as many
-			// updates as updateBuffer specifies.
-			select {
-			case ss.outboundStream <- upd:
-				log.Debugf("SyncStorage: Sent update: %v", upd)
-			default:
-				log.Warn("SyncStorage: Failed to send update, channel full")
-			}
+func (ss *SyncStorage) retryInterval() time.Duration {
+	if ss.opts.RetryInterval > 0 {
+		return ss.opts.RetryInterval
+	}
+
+	return DefaultOptions().RetryInterval
+}
+
+// retry retries all queued replica writes
+func (ss *SyncStorage) retry() {
+	for _, entry := range ss.queue.list() {
+		ss.mux.Lock()
+		err := ss.syncReplica(entry.Replica, entry.key())
+		ss.mux.Unlock()
+
+		if err != nil {
+			log.Debugf("SyncStorage: Retry of %s for replica %d failed: %v", entry.key(), entry.Replica, err)
 		} else {
-			return
+			log.Infof("SyncStorage: Synced %s to replica %d after retrying", entry.key(), entry.Replica)
+		}
+	}
+}
+
+// handleUpdate propagates an update sent by one of the EventStorages
+func (ss *SyncStorage) handleUpdate(upd update.Update) {
+	log.Debugf("SyncStorage: Received update %v", upd.Event)
+	key, err := updateKey(upd)
+	if err != nil {
+		log.Errorf("SyncStorage: Failed to get the key of the updated object: %v", err)
+		return
+	}
+
+	if upd.Storage == ss.Storage {
+		// The primary was changed, sync the replicas and notify the listeners
+		ss.mux.Lock()
+		ss.syncReplicas(key, -1)
+		ss.mux.Unlock()
+
+		ss.sendEvent(upd.Event, upd.PartialObject)
+		return
+	}
+
+	for i, replica := range ss.replicas {
+		if upd.Storage != replica {
+			continue
+		}
+
+		// A replica was changed outside of the SyncStorage
+		ss.mux.Lock()
+		event, err := ss.reconcileKey(i, key)
+		ss.mux.Unlock()
+
+		if err != nil {
+			log.Errorf("SyncStorage: Failed to sync %s from replica %d: %v", key, i, err)
+		} else if event != update.ObjectEventNone {
+			ss.sendPrimaryEvent(event, key)
 		}
 	}
 }
-*/
+
+// sendPrimaryEvent sends an event for the state of the given object in the primary
+func (ss *SyncStorage) sendPrimaryEvent(event update.ObjectEvent, key storage.ObjectKey) {
+	if event == update.ObjectEventDelete {
+		ss.sendEvent(event, watch.NewDeletedObject(key))
+		return
+	}
+
+	partObj, err := ss.GetMeta(key)
+	if err != nil {
+		log.Errorf("SyncStorage: Failed to get %s: %v", key, err)
+		return
+	}
+
+	ss.sendEvent(event, partObj)
+}
+
+func (ss *SyncStorage) sendEvent(event update.ObjectEvent, partObj runtime.PartialObject) {
+	if ss.events == nil {
+		return
+	}
+
+	// Send the update to the listeners unless the channel is full,
+	// in which case issue a warning. The listener reads the object
+	// through the SyncStorage, which reads from the primary.
+	select {
+	case ss.events <- update.Update{Event: event, PartialObject: partObj, Storage: ss}:
+		log.Tracef("SyncStorage: Sent update: %v", event)
+	default:
+		log.Warn("SyncStorage: Failed to send update, channel full")
+	}
+}
+
+// updateKey returns the key of the object in the given update. The objects of deletion
+// updates are generated from the key of the deleted object, so the key can't be derived
+// using the identifiers of the Storage, but it's stored in the UID of the object.
+func updateKey(upd update.Update) (storage.ObjectKey, error) {
+	if upd.Event == update.ObjectEventDelete && upd.PartialObject.GetName() == watch.EventDeleteObjectName {
+		kind := storage.NewKindKey(upd.PartialObject.GetObjectKind().GroupVersionKind())
+		return storage.NewObjectKey(kind, runtime.NewIdentifier(string(upd.PartialObject.GetUID()))), nil
+	}
+
+	return upd.Storage.ObjectKeyFor(upd.PartialObject)
+}
+
+// copyObject copies the state of the given object from src to dst. If the object
+// doesn't exist in src, it's deleted from dst.
+func copyObject(src, dst storage.Storage, key storage.ObjectKey) error {
+	obj, err := src.Get(key)
+	if errors.Is(err, storage.ErrNotFound) {
+		if !dst.RawStorage().Exists(key) {
+			return nil
+		}
+
+		return dst.Delete(key)
+	} else if err != nil {
+		return err
+	}
+
+	if dst.RawStorage().Exists(key) {
+		return dst.Update(obj)
+	}
+
+	return dst.Create(obj)
+}
+
+// checksum returns the checksum of the given object, and whether it was found
+func checksum(s storage.Storage, key storage.ObjectKey) (string, bool, error) {
+	if !s.RawStorage().Exists(key) {
+		return "", false, nil
+	}
+
+	sum, err := s.Checksum(key)
+	if errors.Is(err, storage.ErrNotFound) {
+		return "", false, nil
+	}
+
+	return sum, err == nil, err
+}
@@ -0,0 +1,344 @@
+package sync
+
+import (
+	"errors"
+	"fmt"
+	gosync "sync"
+	"testing"
+	"time"
+
+	"github.com/weaveworks/libgitops/pkg/runtime"
+	"github.com/weaveworks/libgitops/pkg/storage"
+	"github.com/weaveworks/libgitops/pkg/storage/watch/update"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/yaml"
+)
+
+var (
+	carKind = storage.NewKindKey(schema.GroupVersionKind{Group: "sample-app.weave.works", Version: "v1alpha1", Kind: "Car"})
+	carKey  = storage.NewObjectKey(carKind, runtime.NewIdentifier("car"))
+	errFail = errors.New("write failed")
+)
+
+// memRawStorage is an in-memory RawStorage, its checksums count the writes
+type memRawStorage struct {
+	storage.RawStorage
+	objects map[storage.ObjectKey][]byte
+	sums    map[storage.ObjectKey]string
+	writes  int
+	// fail makes all writes fail
+	fail bool
+	mux  gosync.Mutex
+}
+
+func (r *memRawStorage) Exists(key storage.ObjectKey) bool {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	_, ok := r.objects[key]
+	return ok
+}
+
+func (r *memRawStorage) Read(key storage.ObjectKey) ([]byte, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	content, ok := r.objects[key]
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+	return content, nil
+}
+
+func (r *memRawStorage) Write(key storage.ObjectKey, content []byte) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.fail {
+		return errFail
+	}
+	r.writes++
+	r.objects[key] = content
+	r.sums[key] = fmt.Sprint(r.writes)
+	return nil
+}
+
+func (r *memRawStorage) Delete(key storage.ObjectKey) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.fail {
+		return errFail
+	}
+	if _, ok := r.objects[key]; !ok {
+		return storage.ErrNotFound
+	}
+	delete(r.objects, key)
+	delete(r.sums, key)
+	return nil
+}
+
+func (r *memRawStorage) List(kind storage.KindKey) ([]storage.ObjectKey, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	var keys []storage.ObjectKey
+	for key := range r.objects {
+		if storage.NewKindKey(key.GetGVK()) == kind {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (r *memRawStorage) Checksum(key storage.ObjectKey) (string, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	sum, ok := r.sums[key]
+	if !ok {
+		return "", storage.ErrNotFound
+	}
+	return sum, nil
+}
+
+// memStorage is a Storage backed by a RawStorage, by default a memRawStorage. The objects
+// are stored as PartialObjects, which don't need a scheme for encoding and decoding.
+type memStorage struct {
+	storage.Storage
+	raw storage.RawStorage
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{raw: &memRawStorage{
+		objects: make(map[storage.ObjectKey][]byte),
+		sums:    make(map[storage.ObjectKey]string),
+	}}
+}
+
+// setFail makes all writes to the memRawStorage of the storage fail
+func (s *memStorage) setFail(fail bool) {
+	raw := s.raw.(*memRawStorage)
+	raw.mux.Lock()
+	defer raw.mux.Unlock()
+	raw.fail = fail
+}
+
+func (s *memStorage) RawStorage() storage.RawStorage { return s.raw }
+func (s *memStorage) Close() error                   { return nil }
+
+func (s *memStorage) Get(key storage.ObjectKey) (runtime.Object, error) {
+	return s.GetMeta(key)
+}
+
+func (s *memStorage) GetMeta(key storage.ObjectKey) (runtime.PartialObject, error) {
+	content, err := s.raw.Read(key)
+	if err != nil {
+		return nil, err
+	}
+	return runtime.NewPartialObject(content)
+}
+
+func (s *memStorage) Checksum(key storage.ObjectKey) (string, error) {
+	return s.raw.Checksum(key)
+}
+
+func (s *memStorage) ObjectKeyFor(obj runtime.Object) (storage.ObjectKey, error) {
+	return storage.NewObjectKey(storage.NewKindKey(obj.GetObjectKind().GroupVersionKind()), runtime.NewIdentifier(obj.GetName())), nil
+}
+
+func (s *memStorage) Create(obj runtime.Object) error {
+	key, _ := s.ObjectKeyFor(obj)
+	if s.raw.Exists(key) {
+		return storage.ErrAlreadyExists
+	}
+	return s.write(key, obj)
+}
+
+func (s *memStorage) Update(obj runtime.Object) error {
+	key, _ := s.ObjectKeyFor(obj)
+	if !s.raw.Exists(key) {
+		return storage.ErrNotFound
+	}
+	return s.write(key, obj)
+}
+
+func (s *memStorage) Delete(key storage.ObjectKey) error {
+	return s.raw.Delete(key)
+}
+
+func (s *memStorage) write(key storage.ObjectKey, obj runtime.Object) error {
+	content, err := yaml.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	return s.raw.Write(key, content)
+}
+
+// newCar returns a car with the given color, which is stored as a label as
+// the PartialObjects of the memStorage only contain the metadata
+func newCar(color string) runtime.Object {
+	return &runtime.PartialObjectImpl{
+		TypeMeta: metav1.TypeMeta{APIVersion: carKind.GetGroup() + "/" + carKind.GetVersion(), Kind: carKind.GetKind()},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "car",
+			Labels: map[string]string{"color": color},
+		},
+	}
+}
+
+// colorOf returns the color of the car in the given storage, or an empty string if it doesn't exist
+func colorOf(t *testing.T, s storage.Storage) string {
+	t.Helper()
+
+	obj, err := s.Get(carKey)
+	if errors.Is(err, storage.ErrNotFound) {
+		return ""
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return obj.GetLabels()["color"]
+}
+
+// newTestSyncStorage creates a SyncStorage with the given options, and a primary and replicas
+// backed by memStorages. The periodic retries and reconciliations are disabled.
+func newTestSyncStorage(t *testing.T, opts Options, replicas int) (*SyncStorage, []*memStorage) {
+	t.Helper()
+
+	storages := []*memStorage{newMemStorage()}
+	rs := make([]storage.Storage, 0, replicas)
+	for i := 0; i < replicas; i++ {
+		storages = append(storages, newMemStorage())
+		rs = append(rs, storages[i+1])
+	}
+
+	opts.RetryInterval = time.Hour
+	opts.ReconcileInterval = 0
+	opts.Kinds = []storage.KindKey{carKind}
+	ss, err := NewSyncStorageWithOptions(opts, storages[0], rs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ss, storages
+}
+
+func TestSyncStorageWrite(t *testing.T) {
+	ss, storages := newTestSyncStorage(t, DefaultOptions(), 2)
+	defer ss.Close()
+
+	expectColors := func(step string, colors ...string) {
+		t.Helper()
+		for i, s := range storages {
+			if color := colorOf(t, s); color != colors[i] {
+				t.Errorf("%s: expected color %q in storage %d, got %q", step, colors[i], i, color)
+			}
+		}
+	}
+
+	// A failing replica doesn't fail the write, it's queued for retrying instead
+	storages[2].setFail(true)
+	if err := ss.Create(newCar("red")); err != nil {
+		t.Fatal(err)
+	}
+	expectColors("create", "red", "red", "")
+	if ss.Pending() != 1 {
+		t.Errorf("expected one pending write, got %d", ss.Pending())
+	}
+
+	storages[2].setFail(false)
+	ss.retry()
+	expectColors("retry", "red", "red", "red")
+	if ss.Pending() != 0 {
+		t.Errorf("expected no pending writes, got %d", ss.Pending())
+	}
+
+	if err := ss.Update(newCar("blue")); err != nil {
+		t.Fatal(err)
+	}
+	expectColors("update", "blue", "blue", "blue")
+
+	// Drift in the primary is repaired by the reconciliation
+	if err := storages[0].Update(newCar("green")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ss.Reconcile(); err != nil {
+		t.Fatal(err)
+	}
+	expectColors("reconcile", "green", "green", "green")
+
+	// A failing primary fails the write
+	storages[0].setFail(true)
+	if err := ss.Delete(carKey); !errors.Is(err, errFail) {
+		t.Errorf("expected the delete to fail, got %v", err)
+	}
+	storages[0].setFail(false)
+	if err := ss.Delete(carKey); err != nil {
+		t.Fatal(err)
+	}
+	expectColors("delete", "", "", "")
+}
+
+func TestSyncStorageConflictPolicies(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy ConflictPolicy
+		// replicaColor is written to the first replica outside of the SyncStorage, empty deletes the car
+		replicaColor string
+		colors       []string
+		event        update.ObjectEvent
+	}{
+		{"primary wins modify", ConflictPolicyPrimaryWins, "green", []string{"red", "red", "red"}, update.ObjectEventNone},
+		{"primary wins delete", ConflictPolicyPrimaryWins, "", []string{"red", "red", "red"}, update.ObjectEventNone},
+		{"replica wins modify", ConflictPolicyReplicaWins, "green", []string{"green", "green", "green"}, update.ObjectEventModify},
+		{"replica wins delete", ConflictPolicyReplicaWins, "", []string{"", "", ""}, update.ObjectEventDelete},
+		{"skip modify", ConflictPolicySkip, "green", []string{"red", "green", "red"}, update.ObjectEventNone},
+		{"skip delete", ConflictPolicySkip, "", []string{"red", "", "red"}, update.ObjectEventNone},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.ConflictPolicy = tt.policy
+			ss, storages := newTestSyncStorage(t, opts, 2)
+			defer ss.Close()
+			events := make(update.UpdateStream, 10)
+			ss.SetUpdateStream(events)
+
+			if err := ss.Create(newCar("red")); err != nil {
+				t.Fatal(err)
+			}
+
+			var err error
+			if len(tt.replicaColor) == 0 {
+				err = storages[1].Delete(carKey)
+			} else {
+				err = storages[1].Update(newCar(tt.replicaColor))
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The conflict is resolved the same way on every reconciliation
+			for i := 0; i < 2; i++ {
+				if err := ss.Reconcile(); err != nil {
+					t.Fatal(err)
+				}
+				for j, s := range storages {
+					if color := colorOf(t, s); color != tt.colors[j] {
+						t.Errorf("expected color %q in storage %d, got %q", tt.colors[j], j, color)
+					}
+				}
+			}
+
+			select {
+			case upd := <-events:
+				if upd.Event != tt.event {
+					t.Errorf("expected event %s, got %s", tt.event, upd.Event)
+				}
+			default:
+				if tt.event != update.ObjectEventNone {
+					t.Errorf("expected event %s", tt.event)
+				}
+			}
+			select {
+			case upd := <-events:
+				t.Errorf("unexpected event %s", upd.Event)
+			default:
+			}
+		})
+	}
+}
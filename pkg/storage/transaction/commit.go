@@ -27,8 +27,10 @@ type CommitResult interface {
 	Validate() error
 }
 
-// GenericCommitResult implements CommitResult.
+// GenericCommitResult implements CommitResult, CommitterResult and RenderedCommitResult.
 var _ CommitResult = &GenericCommitResult{}
+var _ CommitterResult = &GenericCommitResult{}
+var _ RenderedCommitResult = &GenericCommitResult{}
 
 // GenericCommitResult implements CommitResult.
 type GenericCommitResult struct {
@@ -44,6 +46,18 @@ type GenericCommitResult struct {
 	// Description contains optional extra information about the change.
 	// +optional
 	Description string
+	// CommitterName describes the committer's name, if different from the author.
+	// +optional
+	CommitterName string
+	// CommitterEmail describes the committer's email, if different from the author.
+	// +optional
+	CommitterEmail string
+	// Trailers are appended to the commit message, e.g. SignedOffBy, CoAuthoredBy or custom keys.
+	// +optional
+	Trailers []Trailer
+	// Renderer generates a body from the changed objects, which is added after the Description.
+	// +optional
+	Renderer MessageRenderer
 }
 
 func (r *GenericCommitResult) GetAuthorName() string {
@@ -58,12 +72,34 @@ func (r *GenericCommitResult) GetTitle() string {
 func (r *GenericCommitResult) GetDescription() string {
 	return r.Description
 }
+func (r *GenericCommitResult) GetCommitterName() string {
+	return r.CommitterName
+}
+func (r *GenericCommitResult) GetCommitterEmail() string {
+	return r.CommitterEmail
+}
 func (r *GenericCommitResult) GetMessage() string {
+	// Keep the "Title\nDescription" format, unless trailers are set. Trailers need to be in a
+	// separate paragraph, hence the title, description and trailers are separated by blank lines.
+	if len(r.Trailers) != 0 {
+		return formatMessage(r.Title, []string{r.Description}, r.Trailers)
+	}
 	if len(r.Description) == 0 {
 		return r.Title
 	}
 	return fmt.Sprintf("%s\n%s", r.Title, r.Description)
 }
+func (r *GenericCommitResult) RenderMessage(changes []ObjectChange) (string, error) {
+	if r.Renderer == nil {
+		return r.GetMessage(), nil
+	}
+
+	body, err := r.Renderer.RenderBody(r, changes)
+	if err != nil {
+		return "", fmt.Errorf("failed to render the commit message: %w", err)
+	}
+	return formatMessage(r.Title, []string{r.Description, body}, r.Trailers), nil
+}
 func (r *GenericCommitResult) Validate() error {
 	v := validation.New("GenericCommitResult")
 	if len(r.AuthorName) == 0 {
@@ -75,5 +111,11 @@ func (r *GenericCommitResult) Validate() error {
 	if len(r.Title) == 0 {
 		v.Required("Title")
 	}
+	if (len(r.CommitterName) == 0) != (len(r.CommitterEmail) == 0) {
+		v.Required("CommitterName", "CommitterEmail")
+	}
+	for i, t := range r.Trailers {
+		v.Append(t.Validate(), t, fmt.Sprintf("Trailers[%d]", i))
+	}
 	return v.Error()
 }
@@ -0,0 +1,115 @@
+package transaction
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/weaveworks/libgitops/pkg/gitdir"
+	"github.com/weaveworks/libgitops/pkg/storage"
+)
+
+// ConflictError is returned by a transaction, if its commit couldn't be pushed, as
+// new commits on the remote branch changed the same objects. The commit is discarded.
+// It's also returned by Revert, if later commits changed the objects of the reverted commit.
+type ConflictError struct {
+	// Keys are the keys of the conflicting objects, as far as they could be determined
+	Keys []storage.ObjectKey
+	// Paths are the slash-separated paths of the conflicting files, relative to the storage root.
+	// Files outside of the storage root, e.g. changed by squashed commits, start with "../".
+	Paths []string
+	// Err is the underlying error
+	Err error
+}
+
+var _ error = &ConflictError{}
+
+func (e *ConflictError) Error() string {
+	keys := make([]string, 0, len(e.Keys))
+	for _, key := range e.Keys {
+		keys = append(keys, key.String())
+	}
+	return fmt.Sprintf("conflicting changes to objects [%s]: %v", strings.Join(keys, ", "), e.Err)
+}
+
+func (e *ConflictError) Unwrap() error {
+	return e.Err
+}
+
+// conflictError converts a *gitdir.PushConflictError or *gitdir.ConflictError to
+// a *ConflictError, other errors are returned as-is
+func (s *GitStorage) conflictError(err error) error {
+	var paths []string
+	var pushErr *gitdir.PushConflictError
+	var revertErr *gitdir.ConflictError
+	if errors.As(err, &pushErr) {
+		paths = pushErr.Paths
+	} else if errors.As(err, &revertErr) {
+		paths = revertErr.Paths
+	} else {
+		return err
+	}
+
+	keys := make([]storage.ObjectKey, 0, len(paths))
+	for _, p := range paths {
+		if key, ok := s.keyForPath(p); ok {
+			keys = append(keys, key)
+		}
+	}
+
+	return &ConflictError{Keys: keys, Paths: paths, Err: err}
+}
+
+// keyForPath returns the key of the object stored in the file with the given
+// slash-separated path, relative to the storage root. The mappings are tried
+// first, before decoding the file in the worktree.
+func (s *GitStorage) keyForPath(p string) (storage.ObjectKey, bool) {
+	// Files outside of the storage root don't contain its objects
+	if strings.HasPrefix(p, "../") {
+		return nil, false
+	}
+
+	file := filepath.Join(s.gitDir.Dir(), filepath.FromSlash(p))
+	if key, err := s.raw.GetKey(file); err == nil {
+		return key, true
+	}
+
+	if !isObjectFile(p) {
+		return nil, false
+	}
+
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, false
+	}
+
+	key, err := s.objectKeyFor(content)
+	return key, err == nil
+}
+
+// validateFiles makes sure the object files with the given slash-separated paths,
+// relative to the storage root, can still be decoded after a rebase. Removed
+// files, and files outside of the storage root, are skipped.
+func (s *GitStorage) validateFiles(paths []string) error {
+	for _, p := range paths {
+		if !isObjectFile(p) || strings.HasPrefix(p, "../") || filepath.IsAbs(p) {
+			continue
+		}
+
+		content, err := ioutil.ReadFile(filepath.Join(s.gitDir.Dir(), filepath.FromSlash(p)))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if _, err := s.objectKeyFor(content); err != nil {
+			return fmt.Errorf("invalid object in %q: %w", p, err)
+		}
+	}
+
+	return nil
+}
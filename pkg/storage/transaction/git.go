@@ -51,13 +51,12 @@ type GitStorage struct {
 }
 
 func (s *GitStorage) syncLoop() {
+	events := s.gitDir.Subscribe(context.Background())
 	go func() {
-		for {
-			if commit, ok := <-s.gitDir.CommitChannel(); ok {
-				logrus.Debugf("GitStorage: Got info about commit %q, syncing...", commit)
-				if err := s.sync(); err != nil {
-					logrus.Errorf("GitStorage: Got sync error: %v", err)
-				}
+		for event := range events {
+			logrus.Debugf("GitStorage: Got info about commit %q, syncing...", event.NewCommit)
+			if err := s.sync(); err != nil {
+				logrus.Errorf("GitStorage: Got sync error: %v", err)
 			}
 		}
 	}()
@@ -73,19 +72,74 @@ func (s *GitStorage) sync() error {
 	return nil
 }
 
-func (s *GitStorage) Transaction(ctx context.Context, streamName string, fn TransactionFunc) error {
-	// Append random bytes to the end of the stream name if it ends with a dash
-	if strings.HasSuffix(streamName, "-") {
+// Transaction runs fn on a new branch with the given stream name, or on the main branch in
+// TransactionModeDirect. Only the files written and deleted using the Storage passed to fn
+// are committed. Changes of other files are discarded when switching back to the main branch,
+// or rejected with a *gitdir.DirtyWorktreeError if RejectDirty is set.
+func (s *GitStorage) Transaction(ctx context.Context, streamName string, fn TransactionFunc, opts ...TransactionOption) (*TransactionResult, error) {
+	return s.transaction(ctx, streamName, makeTransactionOptions(opts...), func(ctx context.Context) (*transactionResult, error) {
+		raw := newTrackingRawStorage(s.raw, s.gitDir.Dir())
+		result, err := fn(ctx, storage.NewGenericStorage(raw, s.s.Serializer(), []runtime.IdentifierFactory{runtime.Metav1NameIdentifier}))
+		if err != nil {
+			return nil, err
+		}
+
+		paths, err := raw.Paths()
+		if err != nil {
+			return nil, err
+		}
+		return &transactionResult{result: result, paths: paths, changes: raw.Changes()}, nil
+	})
+}
+
+// transactionResult is returned by the function run by transaction
+type transactionResult struct {
+	// result is used to commit the changes
+	result CommitResult
+	// paths are the slash-separated paths of the files to commit, relative to the
+	// storage root. If nil, all changes are committed.
+	paths []string
+	// changes are the changes of the objects, if known
+	changes []ObjectChange
+}
+
+// transaction runs fn on a new branch with the given stream name (or the main branch, or the branch of the open PR
+// of the stream, depending on the options), with the GitDirectory suspended. The changes made by fn are committed
+// and pushed using the returned result.
+func (s *GitStorage) transaction(ctx context.Context, streamName string, o *TransactionOptions, fn func(context.Context) (*transactionResult, error)) (*TransactionResult, error) {
+	// Look for an open PR of the stream to reuse, if asked for
+	updater, canUpdate := s.prProvider.(PullRequestUpdater)
+	var openPR *PullRequestInfo
+	if o.Mode == TransactionModePullRequest && o.Update != PullRequestUpdateNone {
+		if canUpdate {
+			var err error
+			openPR, err = updater.FindOpenPullRequest(ctx, s.gitDir.RepositoryRef(), s.gitDir.MainBranch(), streamName)
+			if err != nil {
+				return nil, fmt.Errorf("couldn't look up the open PR of stream %q: %w", streamName, err)
+			}
+		} else {
+			logrus.Warnf("The PullRequestProvider can't update PRs, creating a new PR for stream %q", streamName)
+		}
+	}
+
+	branch := streamName
+	switch {
+	case o.Mode == TransactionModeDirect:
+		branch = s.gitDir.MainBranch()
+	case openPR != nil:
+		branch = openPR.MergeBranch
+	case strings.HasSuffix(streamName, "-"):
+		// Append random bytes to the end of the stream name if it ends with a dash
 		suffix, err := util.RandomSHA(4)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		streamName += suffix
+		branch += suffix
 	}
 
 	// Make sure we have the latest available state
 	if err := s.gitDir.Pull(ctx); err != nil {
-		return err
+		return nil, err
 	}
 	// Make sure no other Git ops can take place during the transaction, wait for other ongoing operations.
 	s.gitDir.Suspend()
@@ -94,48 +148,88 @@ func (s *GitStorage) Transaction(ctx context.Context, streamName string, fn Tran
 	// TODO ordering of the defers, and return deferred error
 	defer func() { _ = s.gitDir.CheckoutMainBranch() }()
 
-	// Check out a new branch with the given name
-	if err := s.gitDir.CheckoutNewBranch(streamName); err != nil {
-		return err
+	// Check out the branch of the open PR, or a new branch with the given name, unless committing
+	// directly to the main branch
+	if openPR != nil {
+		if err := s.gitDir.CheckoutBranch(ctx, branch); err != nil {
+			return nil, err
+		}
+	} else if o.Mode != TransactionModeDirect {
+		if err := s.gitDir.CheckoutNewBranch(branch); err != nil {
+			return nil, err
+		}
 	}
 	// Invoke the transaction
-	result, err := fn(ctx, s.s)
+	tr, err := fn(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	result := tr.result
 	// Make sure the result is valid
 	if err := result.Validate(); err != nil {
-		return fmt.Errorf("transaction result is not valid: %w", err)
+		return nil, fmt.Errorf("transaction result is not valid: %w", err)
 	}
-	// Perform the commit
-	if err := s.gitDir.Commit(ctx, result.GetAuthorName(), result.GetAuthorEmail(), result.GetMessage()); err != nil {
-		return err
+	msg, err := commitMessage(result, tr.changes)
+	if err != nil {
+		return nil, err
+	}
+	// Perform the commit, validating the changed objects if it needs to be rebased
+	commitOpts := &gitdir.CommitOptions{
+		Validate:    s.validateFiles,
+		Paths:       tr.paths,
+		RejectDirty: o.RejectDirty,
+		Squash:      openPR != nil && o.Update == PullRequestUpdateSquash,
 	}
+	commitOpts.CommitterName, commitOpts.CommitterEmail = committer(result)
+	if err := s.gitDir.Commit(ctx, result.GetAuthorName(), result.GetAuthorEmail(), msg, commitOpts); err != nil {
+		return nil, s.conflictError(err)
+	}
+	txResult := &TransactionResult{Branch: branch}
 	// Return if no PR should be made
 	prResult, ok := result.(PullRequestResult)
-	if !ok {
-		return nil
+	if !ok || o.Mode != TransactionModePullRequest {
+		return txResult, nil
 	}
 	// If a PR was asked for, and no provider was given, error out
 	if s.prProvider == nil {
-		return ErrNoPullRequestProvider
+		return nil, ErrNoPullRequestProvider
 	}
-	// Create the PR using the provider.
-	return s.prProvider.CreatePullRequest(ctx, &GenericPullRequestSpec{
+	spec := &GenericPullRequestSpec{
 		PullRequestResult: prResult,
 		MainBranch:        s.gitDir.MainBranch(),
-		MergeBranch:       streamName,
+		MergeBranch:       branch,
 		RepositoryRef:     s.gitDir.RepositoryRef(),
-	})
+	}
+	// Update the open PR using the provider
+	if openPR != nil {
+		if err := updater.UpdatePullRequest(ctx, openPR.Number, spec); err != nil {
+			return nil, err
+		}
+		txResult.PullRequest = openPR
+		return txResult, nil
+	}
+	// Create the PR using the provider.
+	if err := s.prProvider.CreatePullRequest(ctx, spec); err != nil {
+		return nil, err
+	}
+	// Look up the number and URL of the created PR, if possible
+	if canUpdate {
+		if txResult.PullRequest, err = updater.FindOpenPullRequest(ctx, spec.RepositoryRef, spec.MainBranch, branch); err != nil {
+			logrus.Warnf("Couldn't look up the created PR for branch %q: %v", branch, err)
+		}
+	}
+	return txResult, nil
 }
 
 func computeMappings(dir string, s storage.Storage) (map[storage.ObjectKey]string, error) {
-	validExts := make([]string, 0, len(storage.ContentTypes))
+	opts := watcher.DefaultOptions()
+	opts.ExcludeDirs = excludeDirs
+	opts.ValidExtensions = make([]string, 0, len(storage.ContentTypes))
 	for ext := range storage.ContentTypes {
-		validExts = append(validExts, ext)
+		opts.ValidExtensions = append(opts.ValidExtensions, ext)
 	}
 
-	files, err := watcher.WalkDirectoryForFiles(dir, validExts, excludeDirs)
+	files, err := watcher.WalkDirectoryForFilesWithOptions(dir, opts)
 	if err != nil {
 		return nil, err
 	}
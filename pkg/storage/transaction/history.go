@@ -0,0 +1,215 @@
+package transaction
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+	"github.com/weaveworks/libgitops/pkg/gitdir"
+	"github.com/weaveworks/libgitops/pkg/runtime"
+	"github.com/weaveworks/libgitops/pkg/serializer"
+	"github.com/weaveworks/libgitops/pkg/storage"
+	"github.com/weaveworks/libgitops/pkg/storage/revision"
+	"github.com/weaveworks/libgitops/pkg/storage/watch/update"
+	kruntime "k8s.io/apimachinery/pkg/runtime"
+)
+
+// ErrObjectNotFound is returned if an object doesn't exist at the requested revision
+var ErrObjectNotFound = errors.New("object not found at revision")
+
+// ObjectChange describes how an object changed between two revisions
+type ObjectChange struct {
+	// Key is the key of the changed object
+	Key storage.ObjectKey
+	// Event describes whether the object was created, modified or deleted
+	Event update.ObjectEvent
+	// Path is the slash-separated path of the file storing the object, relative to the storage root
+	Path string
+	// Diff is the change of the file in the unified diff format
+	Diff string
+}
+
+// HistoryStorage is a TransactionStorage which can also access earlier revisions of the objects
+type HistoryStorage interface {
+	TransactionStorage
+
+	// Log lists the commits reachable from the given revision, newest first
+	Log(opts gitdir.LogOptions) ([]gitdir.CommitInfo, error)
+	// GetAt returns the object with the given key, as it was stored at the given revision
+	GetAt(rev string, key storage.ObjectKey) (runtime.Object, error)
+	// Changes lists the objects that changed between the two given revisions
+	Changes(fromRev, toRev string) ([]ObjectChange, error)
+	// AtRevision returns a read-only view of the objects at the given revision
+	AtRevision(rev string) (storage.ReadStorage, error)
+}
+
+var _ HistoryStorage = &GitStorage{}
+
+// Log lists the commits reachable from the given revision, newest first
+func (s *GitStorage) Log(opts gitdir.LogOptions) ([]gitdir.CommitInfo, error) {
+	return s.gitDir.Log(opts)
+}
+
+// AtRevision returns a read-only view of the objects at the given revision, served directly
+// from the Git object database. It can be used concurrently with transactions.
+func (s *GitStorage) AtRevision(rev string) (storage.ReadStorage, error) {
+	return revision.NewRevisionStorage(s.gitDir, rev, s.s.Serializer(), []runtime.IdentifierFactory{runtime.Metav1NameIdentifier})
+}
+
+// GetAt returns the object with the given key, as it was stored at the given revision.
+// ErrObjectNotFound is returned if the object didn't exist at the revision.
+func (s *GitStorage) GetAt(rev string, key storage.ObjectKey) (runtime.Object, error) {
+	filePath, content, err := s.findAt(rev, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.decodeAt(key, filePath, content)
+}
+
+// Changes lists the objects that changed between the two given revisions. Files
+// that can't be decoded into objects of known kinds are skipped.
+func (s *GitStorage) Changes(fromRev, toRev string) ([]ObjectChange, error) {
+	fileChanges, err := s.gitDir.Diff(fromRev, toRev)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make([]ObjectChange, 0, len(fileChanges))
+	for _, fc := range fileChanges {
+		if !isObjectFile(fc.Path) {
+			continue
+		}
+
+		// Deleted objects are identified by their old content
+		content := fc.To
+		if fc.Type == gitdir.FileChangeDelete {
+			content = fc.From
+		}
+
+		key, err := s.objectKeyFor(content)
+		if err != nil {
+			logrus.Debugf("GitStorage: Skipping changed file %q: %v", fc.Path, err)
+			continue
+		}
+
+		changes = append(changes, ObjectChange{
+			Key:   key,
+			Event: objectEventFor(fc.Type),
+			Path:  fc.Path,
+			Diff:  fc.Patch,
+		})
+	}
+
+	return changes, nil
+}
+
+// findAt looks up the file storing the object with the given key at the given revision.
+// The currently mapped file is tried first, before searching through all files.
+func (s *GitStorage) findAt(rev string, key storage.ObjectKey) (string, []byte, error) {
+	current, ok := s.currentPath(key)
+	if ok {
+		content, err := s.gitDir.ReadFile(rev, current)
+		if err == nil && s.hasKey(content, key) {
+			return current, content, nil
+		} else if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return "", nil, err
+		}
+	}
+
+	files, err := s.gitDir.ListFiles(rev)
+	if err != nil {
+		return "", nil, err
+	}
+
+	for _, file := range files {
+		if file == current || !isObjectFile(file) {
+			continue
+		}
+
+		content, err := s.gitDir.ReadFile(rev, file)
+		if err != nil {
+			return "", nil, err
+		}
+
+		if s.hasKey(content, key) {
+			return file, content, nil
+		}
+	}
+
+	return "", nil, fmt.Errorf("%s at %q: %w", key, rev, ErrObjectNotFound)
+}
+
+// currentPath returns the slash-separated path of the file currently storing the
+// object with the given key, relative to the storage root
+func (s *GitStorage) currentPath(key storage.ObjectKey) (string, bool) {
+	file, ok := s.raw.GetMappings()[key]
+	if !ok {
+		return "", false
+	}
+
+	rel, err := filepath.Rel(s.gitDir.Dir(), file)
+	if err != nil {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+// decodeAt decodes the given content of the given file into an object with the GVK of the key
+func (s *GitStorage) decodeAt(key storage.ObjectKey, filePath string, content []byte) (runtime.Object, error) {
+	gvk := key.GetGVK()
+	ct := storage.ContentTypes[path.Ext(filePath)]
+	obj, err := s.s.Serializer().Decoder(
+		serializer.WithConvertToHubDecode(gvk.Version == kruntime.APIVersionInternal),
+	).Decode(serializer.NewFrameReader(ct, serializer.FromBytes(content)))
+	if err != nil {
+		return nil, err
+	}
+
+	metaObj, ok := obj.(runtime.Object)
+	if !ok {
+		return nil, fmt.Errorf("can't convert to libgitops.runtime.Object")
+	}
+
+	metaObj.GetObjectKind().SetGroupVersionKind(gvk)
+	return metaObj, nil
+}
+
+// hasKey checks if the given content decodes into an object with the given key
+func (s *GitStorage) hasKey(content []byte, key storage.ObjectKey) bool {
+	k, err := s.objectKeyFor(content)
+	return err == nil && k == key
+}
+
+// objectKeyFor returns the key of the object stored in the given content
+func (s *GitStorage) objectKeyFor(content []byte) (storage.ObjectKey, error) {
+	partObjs, err := storage.DecodePartialObjects(serializer.FromBytes(content), s.s.Serializer().Scheme(), false, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.s.ObjectKeyFor(partObjs[0])
+}
+
+// isObjectFile checks if the given file has an extension of a supported content type
+func isObjectFile(file string) bool {
+	_, ok := storage.ContentTypes[path.Ext(file)]
+	return ok
+}
+
+// objectEventFor converts the given FileChangeType to the corresponding ObjectEvent
+func objectEventFor(t gitdir.FileChangeType) update.ObjectEvent {
+	switch t {
+	case gitdir.FileChangeCreate:
+		return update.ObjectEventCreate
+	case gitdir.FileChangeModify:
+		return update.ObjectEventModify
+	case gitdir.FileChangeDelete:
+		return update.ObjectEventDelete
+	}
+
+	return update.ObjectEventNone
+}
@@ -0,0 +1,173 @@
+package transaction
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+const (
+	// TrailerSignedOffBy is the key of the trailer certifying the Developer Certificate of Origin
+	TrailerSignedOffBy = "Signed-off-by"
+	// TrailerCoAuthoredBy is the key of the trailer crediting additional authors
+	TrailerCoAuthoredBy = "Co-authored-by"
+)
+
+// Trailer is a "Key: Value" line at the end of a commit message, e.g. "Signed-off-by: Jane <jane@example.com>".
+type Trailer struct {
+	// Key is the name of the trailer, e.g. "Signed-off-by", "Change-Id" or "Ticket"
+	// +required
+	Key string
+	// Value is the value of the trailer
+	// +required
+	Value string
+}
+
+func (t Trailer) String() string {
+	return fmt.Sprintf("%s: %s", t.Key, t.Value)
+}
+
+// Validate validates that the trailer can be parsed back from a commit message.
+func (t Trailer) Validate() error {
+	if len(t.Key) == 0 || strings.ContainsAny(t.Key, ": \t\n") {
+		return fmt.Errorf("invalid trailer key %q", t.Key)
+	}
+	if len(strings.TrimSpace(t.Value)) == 0 || strings.Contains(t.Value, "\n") {
+		return fmt.Errorf("invalid value %q of trailer %q", t.Value, t.Key)
+	}
+	return nil
+}
+
+// SignedOffBy returns a Signed-off-by trailer for the given person
+func SignedOffBy(name, email string) Trailer {
+	return Trailer{Key: TrailerSignedOffBy, Value: fmt.Sprintf("%s <%s>", name, email)}
+}
+
+// CoAuthoredBy returns a Co-authored-by trailer for the given person
+func CoAuthoredBy(name, email string) Trailer {
+	return Trailer{Key: TrailerCoAuthoredBy, Value: fmt.Sprintf("%s <%s>", name, email)}
+}
+
+// ParseTrailers returns the trailers in the last paragraph of the given commit message,
+// or nil if the last paragraph isn't made up of trailers only.
+func ParseTrailers(message string) []Trailer {
+	paragraphs := strings.Split(strings.TrimSpace(message), "\n\n")
+	// The first paragraph is the title
+	if len(paragraphs) < 2 {
+		return nil
+	}
+
+	var trailers []Trailer
+	for _, line := range strings.Split(paragraphs[len(paragraphs)-1], "\n") {
+		i := strings.Index(line, ": ")
+		if i < 1 {
+			return nil
+		}
+		t := Trailer{Key: line[:i], Value: strings.TrimSpace(line[i+2:])}
+		if t.Validate() != nil {
+			return nil
+		}
+		trailers = append(trailers, t)
+	}
+	return trailers
+}
+
+// formatMessage joins the title, the non-empty body paragraphs and the trailers into a commit message
+func formatMessage(title string, body []string, trailers []Trailer) string {
+	paragraphs := []string{title}
+	for _, p := range body {
+		if p = strings.TrimSpace(p); len(p) != 0 {
+			paragraphs = append(paragraphs, p)
+		}
+	}
+
+	if len(trailers) != 0 {
+		lines := make([]string, 0, len(trailers))
+		for _, t := range trailers {
+			lines = append(lines, t.String())
+		}
+		paragraphs = append(paragraphs, strings.Join(lines, "\n"))
+	}
+	return strings.Join(paragraphs, "\n\n")
+}
+
+// CommitterResult is an optional extension of CommitResult, specifying a
+// committer different from the author of the change.
+type CommitterResult interface {
+	CommitResult
+
+	// GetCommitterName describes the committer's name, the author's name is used if empty.
+	// +optional
+	GetCommitterName() string
+	// GetCommitterEmail describes the committer's email, the author's email is used if empty.
+	// +optional
+	GetCommitterEmail() string
+}
+
+// RenderedCommitResult is an optional extension of CommitResult, generating the
+// commit message from the objects changed by the transaction.
+type RenderedCommitResult interface {
+	CommitResult
+
+	// RenderMessage returns the commit message for the given changes. It's used instead of GetMessage().
+	RenderMessage(changes []ObjectChange) (string, error)
+}
+
+// MessageRenderer generates (a part of) the body of a commit message from the objects changed by a transaction
+type MessageRenderer interface {
+	// RenderBody returns the body for the given result and changes
+	RenderBody(result CommitResult, changes []ObjectChange) (string, error)
+}
+
+// MessageData is passed to the template of a renderer created by NewTemplateRenderer
+type MessageData struct {
+	// Title is the title of the commit
+	Title string
+	// Description is the description of the commit
+	Description string
+	// Changes are the changes of the objects, sorted by path. Diffs aren't set.
+	Changes []ObjectChange
+}
+
+// NewTemplateRenderer creates a MessageRenderer executing the given text/template with MessageData,
+// e.g. "{{range .Changes}}{{.Event}} {{.Key}}\n{{end}}".
+func NewTemplateRenderer(text string) (MessageRenderer, error) {
+	tmpl, err := template.New("message").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	return &templateRenderer{tmpl}, nil
+}
+
+type templateRenderer struct {
+	tmpl *template.Template
+}
+
+func (r *templateRenderer) RenderBody(result CommitResult, changes []ObjectChange) (string, error) {
+	var b bytes.Buffer
+	if err := r.tmpl.Execute(&b, &MessageData{
+		Title:       result.GetTitle(),
+		Description: result.GetDescription(),
+		Changes:     changes,
+	}); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// commitMessage returns the commit message of the result for the given changes
+func commitMessage(result CommitResult, changes []ObjectChange) (string, error) {
+	if r, ok := result.(RenderedCommitResult); ok {
+		return r.RenderMessage(changes)
+	}
+	return result.GetMessage(), nil
+}
+
+// committer returns the committer of the result, if specified
+func committer(result CommitResult) (string, string) {
+	if r, ok := result.(CommitterResult); ok {
+		return r.GetCommitterName(), r.GetCommitterEmail()
+	}
+	return "", ""
+}
@@ -0,0 +1,76 @@
+package transaction
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/weaveworks/libgitops/pkg/runtime"
+	"github.com/weaveworks/libgitops/pkg/storage"
+	"github.com/weaveworks/libgitops/pkg/storage/watch/update"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestGenericCommitResultMessage(t *testing.T) {
+	renderer, err := NewTemplateRenderer("{{range .Changes}}{{.Event}} {{.Path}}\n{{end}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := &GenericCommitResult{
+		AuthorName:  "Jane",
+		AuthorEmail: "jane@example.com",
+		Title:       "Update cars",
+		Description: "Speed them up.",
+		Trailers: []Trailer{
+			SignedOffBy("Jane", "jane@example.com"),
+			CoAuthoredBy("John", "john@example.com"),
+			{Key: "Ticket", Value: "CARS-1"},
+		},
+		Renderer: renderer,
+	}
+	if err := result.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	kind := storage.NewKindKey(schema.GroupVersionKind{Group: "sample", Version: "v1", Kind: "Car"})
+	msg, err := result.RenderMessage([]ObjectChange{
+		{Key: storage.NewObjectKey(kind, runtime.NewIdentifier("a")), Event: update.ObjectEventCreate, Path: "a.yaml"},
+		{Key: storage.NewObjectKey(kind, runtime.NewIdentifier("b")), Event: update.ObjectEventDelete, Path: "b.yaml"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "Update cars\n\nSpeed them up.\n\nCREATE a.yaml\nDELETE b.yaml\n\n" +
+		"Signed-off-by: Jane <jane@example.com>\nCo-authored-by: John <john@example.com>\nTicket: CARS-1"
+	if msg != expected {
+		t.Errorf("expected message %q, got %q", expected, msg)
+	}
+	if trailers := ParseTrailers(msg); !reflect.DeepEqual(trailers, result.Trailers) {
+		t.Errorf("expected to parse trailers %v, got %v", result.Trailers, trailers)
+	}
+
+	// Without changes or a renderer, only the title, description and trailers are included
+	result.Renderer = nil
+	if msg := result.GetMessage(); msg != "Update cars\n\nSpeed them up.\n\nSigned-off-by: Jane <jane@example.com>\nCo-authored-by: John <john@example.com>\nTicket: CARS-1" {
+		t.Errorf("unexpected message %q", msg)
+	}
+	if trailers := ParseTrailers("Update cars\n\nJust a description."); trailers != nil {
+		t.Errorf("expected no trailers, got %v", trailers)
+	}
+
+	// Without trailers, the title and description are only separated by a newline
+	result.Trailers = nil
+	if msg := result.GetMessage(); msg != "Update cars\nSpeed them up." {
+		t.Errorf("unexpected message %q", msg)
+	}
+	if trailers := ParseTrailers(result.GetMessage()); trailers != nil {
+		t.Errorf("expected no trailers, got %v", trailers)
+	}
+
+	result.Trailers = []Trailer{{Key: "Bad Key", Value: "value"}}
+	result.CommitterName = "Bot"
+	if err := result.Validate(); err == nil {
+		t.Error("expected the invalid trailer and missing committer email to fail validation")
+	}
+}
@@ -0,0 +1,115 @@
+package transaction
+
+import "fmt"
+
+// TransactionMode is an enum describing how the changes of a transaction are published.
+type TransactionMode byte
+
+var _ fmt.Stringer = TransactionMode(0)
+
+const (
+	// TransactionModePullRequest commits to a new branch, and creates a PR using the
+	// PullRequestProvider if the transaction returns a PullRequestResult. This is the default.
+	TransactionModePullRequest TransactionMode = iota // 0
+	// TransactionModeDirect commits directly to the main branch. The stream name is ignored.
+	// If new remote commits changed the same objects, a *ConflictError is returned.
+	TransactionModeDirect // 1
+	// TransactionModeBranch commits to a new branch, but never creates a PR.
+	TransactionModeBranch // 2
+)
+
+func (m TransactionMode) String() string {
+	switch m {
+	case 0:
+		return "PULL_REQUEST"
+	case 1:
+		return "DIRECT"
+	case 2:
+		return "BRANCH"
+	}
+
+	// Should never happen
+	return "UNKNOWN"
+}
+
+// PullRequestUpdate is an enum describing whether, and how, the open PR of a stream is reused by transactions.
+type PullRequestUpdate byte
+
+var _ fmt.Stringer = PullRequestUpdate(0)
+
+const (
+	// PullRequestUpdateNone makes every transaction create a new branch and PR. This is the default.
+	PullRequestUpdateNone PullRequestUpdate = iota // 0
+	// PullRequestUpdateAppend pushes a new commit to the branch of the open PR of the stream, if
+	// any, and updates the PR. Requires the PullRequestProvider to be a PullRequestUpdater.
+	PullRequestUpdateAppend // 1
+	// PullRequestUpdateSquash is like PullRequestUpdateAppend, but force-pushes a single commit
+	// containing all changes of the PR, replacing its earlier commits.
+	PullRequestUpdateSquash // 2
+)
+
+func (u PullRequestUpdate) String() string {
+	switch u {
+	case 0:
+		return "NONE"
+	case 1:
+		return "APPEND"
+	case 2:
+		return "SQUASH"
+	}
+
+	// Should never happen
+	return "UNKNOWN"
+}
+
+// TransactionOptions provides optional parameters for transactions
+type TransactionOptions struct {
+	// Mode describes how the changes are published, TransactionModePullRequest by default.
+	Mode TransactionMode
+	// Update describes whether the open PR of the stream is reused, PullRequestUpdateNone by default.
+	// It only applies to TransactionModePullRequest.
+	Update PullRequestUpdate
+	// RejectDirty makes the transaction fail with a *gitdir.DirtyWorktreeError, if files not written
+	// using the Storage passed to the transaction have been changed, instead of discarding these changes.
+	RejectDirty bool
+}
+
+// TransactionOption is an interface which can be passed into transactions as a variadic-length argument list.
+type TransactionOption interface {
+	// ApplyToTransactionOptions applies the configuration of the current object into a target TransactionOptions struct.
+	ApplyToTransactionOptions(target *TransactionOptions)
+}
+
+var _ TransactionOption = &TransactionOptions{}
+
+// ApplyToTransactionOptions applies the set fields of o to target, so TransactionOptions can be used as a TransactionOption.
+func (o *TransactionOptions) ApplyToTransactionOptions(target *TransactionOptions) {
+	if o.Mode != TransactionModePullRequest {
+		target.Mode = o.Mode
+	}
+	if o.Update != PullRequestUpdateNone {
+		target.Update = o.Update
+	}
+	if o.RejectDirty {
+		target.RejectDirty = true
+	}
+}
+
+// ApplyToTransactionOptions sets the mode of target, so a TransactionMode can be used as a TransactionOption.
+func (m TransactionMode) ApplyToTransactionOptions(target *TransactionOptions) {
+	target.Mode = m
+}
+
+// ApplyToTransactionOptions sets the PR update of target, so a PullRequestUpdate can be used as a TransactionOption.
+func (u PullRequestUpdate) ApplyToTransactionOptions(target *TransactionOptions) {
+	target.Update = u
+}
+
+// makeTransactionOptions makes a completed TransactionOptions struct from a list of TransactionOption implementations.
+func makeTransactionOptions(opts ...TransactionOption) *TransactionOptions {
+	o := &TransactionOptions{}
+	for _, opt := range opts {
+		opt.ApplyToTransactionOptions(o)
+	}
+	return o
+}
@@ -0,0 +1,25 @@
+package transaction
+
+import "testing"
+
+func TestMakeTransactionOptions(t *testing.T) {
+	tests := []struct {
+		opts     []TransactionOption
+		expected TransactionOptions
+	}{
+		{nil, TransactionOptions{Mode: TransactionModePullRequest}},
+		{[]TransactionOption{TransactionModeDirect}, TransactionOptions{Mode: TransactionModeDirect}},
+		{[]TransactionOption{&TransactionOptions{Mode: TransactionModeBranch}}, TransactionOptions{Mode: TransactionModeBranch}},
+		// Unset fields don't override earlier options
+		{[]TransactionOption{TransactionModeDirect, &TransactionOptions{}}, TransactionOptions{Mode: TransactionModeDirect}},
+		{[]TransactionOption{TransactionModeDirect, TransactionModePullRequest}, TransactionOptions{Mode: TransactionModePullRequest}},
+		{[]TransactionOption{PullRequestUpdateSquash}, TransactionOptions{Update: PullRequestUpdateSquash}},
+		{[]TransactionOption{PullRequestUpdateAppend, &TransactionOptions{Mode: TransactionModeBranch}}, TransactionOptions{Mode: TransactionModeBranch, Update: PullRequestUpdateAppend}},
+		{[]TransactionOption{&TransactionOptions{RejectDirty: true}, TransactionModeDirect}, TransactionOptions{Mode: TransactionModeDirect, RejectDirty: true}},
+	}
+	for i, tt := range tests {
+		if o := makeTransactionOptions(tt.opts...); *o != tt.expected {
+			t.Errorf("%d: expected %+v, got %+v", i, tt.expected, *o)
+		}
+	}
+}
@@ -2,6 +2,8 @@ package transaction
 
 import (
 	"context"
+	"fmt"
+	"strings"
 
 	"github.com/fluxcd/go-git-providers/gitprovider"
 	"github.com/fluxcd/go-git-providers/validation"
@@ -25,8 +27,27 @@ type PullRequestResult interface {
 	GetMilestone() string
 }
 
+// DraftPullRequestResult is an optional extension of PullRequestResult, specifying
+// whether the PR should be opened as a draft. Use IsDraft to check a PullRequestResult.
+type DraftPullRequestResult interface {
+	PullRequestResult
+
+	// GetDraft specifies whether the PR should be opened as a draft (or work in progress).
+	// +optional
+	GetDraft() bool
+}
+
+// IsDraft returns true if the given result is a DraftPullRequestResult asking for a draft PR
+func IsDraft(r PullRequestResult) bool {
+	d, ok := r.(DraftPullRequestResult)
+	return ok && d.GetDraft()
+}
+
 // GenericPullRequestResult implements PullRequestResult.
 var _ PullRequestResult = &GenericPullRequestResult{}
+var _ DraftPullRequestResult = &GenericPullRequestResult{}
+var _ CommitterResult = &GenericPullRequestResult{}
+var _ RenderedCommitResult = &GenericPullRequestResult{}
 
 // GenericPullRequestResult implements PullRequestResult.
 type GenericPullRequestResult struct {
@@ -43,6 +64,26 @@ type GenericPullRequestResult struct {
 	// Milestone specifies what milestone this should be attached to.
 	// +optional
 	Milestone string
+	// Draft specifies whether the PR should be opened as a draft (or work in progress).
+	// +optional
+	Draft bool
+}
+
+// GetCommitterName returns the committer's name of the inner CommitResult, if it's a CommitterResult
+func (r *GenericPullRequestResult) GetCommitterName() string {
+	name, _ := committer(r.CommitResult)
+	return name
+}
+
+// GetCommitterEmail returns the committer's email of the inner CommitResult, if it's a CommitterResult
+func (r *GenericPullRequestResult) GetCommitterEmail() string {
+	_, email := committer(r.CommitResult)
+	return email
+}
+
+// RenderMessage renders the message of the inner CommitResult, if it's a RenderedCommitResult
+func (r *GenericPullRequestResult) RenderMessage(changes []ObjectChange) (string, error) {
+	return commitMessage(r.CommitResult, changes)
 }
 
 func (r *GenericPullRequestResult) GetLabels() []string {
@@ -54,6 +95,9 @@ func (r *GenericPullRequestResult) GetAssignees() []string {
 func (r *GenericPullRequestResult) GetMilestone() string {
 	return r.Milestone
 }
+func (r *GenericPullRequestResult) GetDraft() bool {
+	return r.Draft
+}
 func (r *GenericPullRequestResult) Validate() error {
 	v := validation.New("GenericPullRequestResult")
 	// Just validate the "inner" object
@@ -79,6 +123,10 @@ type PullRequestSpec interface {
 	GetRepositoryRef() gitprovider.RepositoryRef
 }
 
+// GenericPullRequestSpec implements PullRequestSpec and DraftPullRequestResult.
+var _ PullRequestSpec = &GenericPullRequestSpec{}
+var _ DraftPullRequestResult = &GenericPullRequestSpec{}
+
 // GenericPullRequestSpec implements PullRequestSpec.
 type GenericPullRequestSpec struct {
 	// GenericPullRequestSpec is a superset of PullRequestResult.
@@ -104,6 +152,11 @@ func (r *GenericPullRequestSpec) GetMergeBranch() string {
 func (r *GenericPullRequestSpec) GetRepositoryRef() gitprovider.RepositoryRef {
 	return r.RepositoryRef
 }
+
+// GetDraft returns whether the inner PullRequestResult asks for a draft PR
+func (r *GenericPullRequestSpec) GetDraft() bool {
+	return IsDraft(r.PullRequestResult)
+}
 func (r *GenericPullRequestSpec) Validate() error {
 	v := validation.New("GenericPullRequestSpec")
 	// Just validate the "inner" object
@@ -128,3 +181,45 @@ type PullRequestProvider interface {
 	// CreatePullRequest creates a Pull Request using the given specification.
 	CreatePullRequest(ctx context.Context, spec PullRequestSpec) error
 }
+
+// PullRequestInfo identifies a PR created or updated by a PullRequestProvider
+type PullRequestInfo struct {
+	// Number is the number (or ID) of the PR
+	Number int
+	// URL is the web URL of the PR, if known
+	URL string
+	// MergeBranch is the branch that is pending to be merged into main with this PR.
+	MergeBranch string
+}
+
+// PullRequestUpdater is an optional extension of PullRequestProvider, for providers that can find and update
+// open PRs. It's required to reuse the open PR of a stream, see PullRequestUpdate, and to return the number and
+// URL of created PRs in the TransactionResult.
+type PullRequestUpdater interface {
+	PullRequestProvider
+
+	// FindOpenPullRequest returns the newest open PR into mainBranch from the branch with the given stream name, or
+	// from a branch prefixed with it if it ends with a dash. If there's no such PR, nil is returned.
+	FindOpenPullRequest(ctx context.Context, ref gitprovider.RepositoryRef, mainBranch, streamName string) (*PullRequestInfo, error)
+	// UpdatePullRequest updates the title, description and labels of the PR with the given number using the given
+	// specification. The assignees and milestone are updated, if set.
+	UpdatePullRequest(ctx context.Context, number int, spec PullRequestSpec) error
+}
+
+// MatchesStream returns true if the given branch belongs to the given stream, i.e. is named like the stream,
+// or prefixed with its name if it ends with a dash.
+func MatchesStream(branch, streamName string) bool {
+	if strings.HasSuffix(streamName, "-") {
+		return strings.HasPrefix(branch, streamName)
+	}
+	return branch == streamName
+}
+
+// ValidatePullRequestSpec validates the given spec, wrapping the cause if it's invalid. It's
+// used by all PullRequestProviders, to report invalid specs in the same way.
+func ValidatePullRequestSpec(spec PullRequestSpec) error {
+	if err := spec.Validate(); err != nil {
+		return fmt.Errorf("given PullRequestSpec wasn't valid: %w", err)
+	}
+	return nil
+}
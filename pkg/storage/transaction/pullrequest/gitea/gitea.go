@@ -0,0 +1,219 @@
+package gitea
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/fluxcd/go-git-providers/gitprovider"
+	"github.com/weaveworks/libgitops/pkg/storage/transaction"
+	"github.com/weaveworks/libgitops/pkg/storage/transaction/pullrequest/rest"
+)
+
+const (
+	apiPath = "/api/v1"
+	// draftPrefix marks pull requests as work in progress
+	draftPrefix = "WIP:"
+)
+
+// NewGiteaPRProvider returns a new transaction.PullRequestProvider creating Gitea pull requests
+// using the given access token. baseURL is the URL of the Gitea instance, e.g.
+// "https://gitea.example.com"; if empty, the domain of the repository is used. The provider is
+// also a transaction.PullRequestUpdater.
+func NewGiteaPRProvider(baseURL, token string) (transaction.PullRequestProvider, error) {
+	if len(token) == 0 {
+		return nil, errors.New("a Gitea token is required")
+	}
+	return &prCreator{
+		baseURL: baseURL,
+		token:   token,
+	}, nil
+}
+
+type prCreator struct {
+	baseURL string
+	token   string
+	// httpClient is used for the requests, http.DefaultClient if nil
+	httpClient *http.Client
+}
+
+var _ transaction.PullRequestUpdater = &prCreator{}
+
+type pullRequest struct {
+	Head      string   `json:"head,omitempty"`
+	Base      string   `json:"base"`
+	Title     string   `json:"title"`
+	Body      string   `json:"body"`
+	Assignees []string `json:"assignees,omitempty"`
+	Labels    []int64  `json:"labels"`
+	Milestone int64    `json:"milestone,omitempty"`
+}
+
+type label struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+type milestone struct {
+	ID    int64  `json:"id"`
+	Title string `json:"title"`
+}
+
+type branchRef struct {
+	Ref  string `json:"ref"`
+	Repo struct {
+		ID int64 `json:"id"`
+	} `json:"repo"`
+}
+
+type listedPullRequest struct {
+	Number  int       `json:"number"`
+	HTMLURL string    `json:"html_url"`
+	Head    branchRef `json:"head"`
+	Base    branchRef `json:"base"`
+}
+
+// pageSize is the page size used when listing pull requests and labels
+const pageSize = 50
+
+func (c *prCreator) CreatePullRequest(ctx context.Context, spec transaction.PullRequestSpec) error {
+	// First, validate the input
+	if err := transaction.ValidatePullRequestSpec(spec); err != nil {
+		return err
+	}
+
+	client, repo := c.client(spec.GetRepositoryRef())
+	pr, err := newPullRequest(ctx, client, repo, spec)
+	if err != nil {
+		return err
+	}
+
+	// Create the pull request, including all fields at once
+	return client.Do(ctx, http.MethodPost, repo+"/pulls", nil, pr, nil)
+}
+
+func (c *prCreator) FindOpenPullRequest(ctx context.Context, ref gitprovider.RepositoryRef, mainBranch, streamName string) (*transaction.PullRequestInfo, error) {
+	client, repo := c.client(ref)
+
+	var found *transaction.PullRequestInfo
+	for page := 1; ; page++ {
+		query := url.Values{
+			"state": {"open"},
+			"limit": {strconv.Itoa(pageSize)},
+			"page":  {strconv.Itoa(page)},
+		}
+		var prs []listedPullRequest
+		if err := client.Do(ctx, http.MethodGet, repo+"/pulls", query, nil, &prs); err != nil {
+			return nil, err
+		}
+		for _, pr := range prs {
+			// Only consider branches of the repository itself, not of forks. Prefer the newest pull request.
+			if pr.Base.Ref != mainBranch || pr.Head.Repo.ID != pr.Base.Repo.ID || !transaction.MatchesStream(pr.Head.Ref, streamName) {
+				continue
+			}
+			if found == nil || pr.Number > found.Number {
+				found = &transaction.PullRequestInfo{Number: pr.Number, URL: pr.HTMLURL, MergeBranch: pr.Head.Ref}
+			}
+		}
+		if len(prs) < pageSize {
+			return found, nil
+		}
+	}
+}
+
+func (c *prCreator) UpdatePullRequest(ctx context.Context, number int, spec transaction.PullRequestSpec) error {
+	// First, validate the input
+	if err := transaction.ValidatePullRequestSpec(spec); err != nil {
+		return err
+	}
+
+	client, repo := c.client(spec.GetRepositoryRef())
+	pr, err := newPullRequest(ctx, client, repo, spec)
+	if err != nil {
+		return err
+	}
+	// The head branch of a pull request can't be changed
+	pr.Head = ""
+
+	return client.Do(ctx, http.MethodPatch, fmt.Sprintf("%s/pulls/%d", repo, number), nil, pr, nil)
+}
+
+// client returns a REST client for the Gitea instance of the given repository, and the path of the repository
+func (c *prCreator) client(ref gitprovider.RepositoryRef) (*rest.Client, string) {
+	client := &rest.Client{
+		BaseURL:    rest.BaseURL(c.baseURL, ref, apiPath),
+		HTTPClient: c.httpClient,
+		Authorize: func(req *http.Request) {
+			req.Header.Set("Authorization", "token "+c.token)
+		},
+	}
+	return client, "/repos/" + rest.RepositoryPath(ref)
+}
+
+// newPullRequest creates the request body for the given spec, looking up the IDs of the labels and milestone
+func newPullRequest(ctx context.Context, client *rest.Client, repo string, spec transaction.PullRequestSpec) (*pullRequest, error) {
+	pr := &pullRequest{
+		Head:      spec.GetMergeBranch(),
+		Base:      spec.GetMainBranch(),
+		Title:     rest.DraftTitle(spec, draftPrefix),
+		Body:      spec.GetDescription(),
+		Assignees: spec.GetAssignees(),
+		Labels:    []int64{},
+	}
+
+	// Labels are referenced by their IDs
+	if len(spec.GetLabels()) != 0 {
+		ids, err := labelIDs(ctx, client, repo)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range spec.GetLabels() {
+			id, ok := ids[name]
+			if !ok {
+				return nil, fmt.Errorf("couldn't find label with name: %s", name)
+			}
+			pr.Labels = append(pr.Labels, id)
+		}
+	}
+
+	if len(spec.GetMilestone()) != 0 {
+		var milestones []milestone
+		if err := client.Do(ctx, http.MethodGet, repo+"/milestones", url.Values{"state": {"all"}, "name": {spec.GetMilestone()}}, nil, &milestones); err != nil {
+			return nil, err
+		}
+		for _, m := range milestones {
+			if m.Title == spec.GetMilestone() {
+				pr.Milestone = m.ID
+				break
+			}
+		}
+		if pr.Milestone == 0 {
+			return nil, fmt.Errorf("couldn't find milestone with name: %s", spec.GetMilestone())
+		}
+	}
+	return pr, nil
+}
+
+// labelIDs returns the IDs of all labels of the given repository by their names
+func labelIDs(ctx context.Context, client *rest.Client, repo string) (map[string]int64, error) {
+	ids := map[string]int64{}
+	for page := 1; ; page++ {
+		query := url.Values{
+			"limit": {strconv.Itoa(pageSize)},
+			"page":  {strconv.Itoa(page)},
+		}
+		var labels []label
+		if err := client.Do(ctx, http.MethodGet, repo+"/labels", query, nil, &labels); err != nil {
+			return nil, err
+		}
+		for _, l := range labels {
+			ids[l.Name] = l.ID
+		}
+		if len(labels) < pageSize {
+			return ids, nil
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package gitea
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fluxcd/go-git-providers/gitprovider"
+	"github.com/weaveworks/libgitops/pkg/storage/transaction"
+	"github.com/weaveworks/libgitops/pkg/storage/transaction/pullrequest/rest"
+)
+
+func TestCreatePullRequest(t *testing.T) {
+	var got pullRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "token secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/api/v1/repos/weaveworks/libgitops/labels":
+			// The labels are paginated, the requested label is on the second page
+			labels := []label{{ID: 2, Name: "kind/feature"}}
+			if r.URL.Query().Get("page") == "1" {
+				labels = nil
+				for i := 0; i < pageSize; i++ {
+					labels = append(labels, label{ID: int64(i + 100), Name: fmt.Sprintf("label-%d", i)})
+				}
+			}
+			_ = json.NewEncoder(w).Encode(labels)
+		case "/api/v1/repos/weaveworks/libgitops/pulls":
+			if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+				t.Error(err)
+			}
+			w.WriteHeader(http.StatusCreated)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	spec := &transaction.GenericPullRequestSpec{
+		PullRequestResult: &transaction.GenericPullRequestResult{
+			CommitResult: &transaction.GenericCommitResult{
+				AuthorName:  "Jane",
+				AuthorEmail: "jane@example.com",
+				Title:       "Update car",
+			},
+			Labels:    []string{"kind/feature"},
+			Assignees: []string{"jane"},
+		},
+		MainBranch:  "main",
+		MergeBranch: "update-car",
+		RepositoryRef: gitprovider.UserRepositoryRef{
+			UserRef:        gitprovider.UserRef{Domain: "gitea.example.com", UserLogin: "weaveworks"},
+			RepositoryName: "libgitops",
+		},
+	}
+
+	p, err := NewGiteaPRProvider(srv.URL, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.CreatePullRequest(context.Background(), spec); err != nil {
+		t.Fatal(err)
+	}
+	if got.Title != "Update car" || got.Head != "update-car" || got.Base != "main" {
+		t.Errorf("unexpected pull request: %+v", got)
+	}
+	if len(got.Labels) != 1 || got.Labels[0] != 2 || len(got.Assignees) != 1 || got.Assignees[0] != "jane" {
+		t.Errorf("unexpected pull request: %+v", got)
+	}
+
+	// Wrong credentials are reported as an *rest.HTTPError
+	p, err = NewGiteaPRProvider(srv.URL, "wrong")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var httpErr *rest.HTTPError
+	if err := p.CreatePullRequest(context.Background(), spec); !errors.As(err, &httpErr) || httpErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 HTTPError, got %v", err)
+	}
+}
+
+func TestFindAndUpdatePullRequest(t *testing.T) {
+	var updated map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/api/v1/repos/weaveworks/libgitops/pulls":
+			_, _ = w.Write([]byte(`[
+				{"number": 5, "html_url": "https://gitea.example.com/pulls/5", "head": {"ref": "car-update-1234", "repo": {"id": 1}}, "base": {"ref": "release", "repo": {"id": 1}}},
+				{"number": 4, "html_url": "https://gitea.example.com/pulls/4", "head": {"ref": "car-update-abcd", "repo": {"id": 1}}, "base": {"ref": "main", "repo": {"id": 1}}},
+				{"number": 3, "html_url": "https://gitea.example.com/pulls/3", "head": {"ref": "car-update-5678", "repo": {"id": 1}}, "base": {"ref": "main", "repo": {"id": 1}}}
+			]`))
+		case r.Method == http.MethodPatch && r.URL.Path == "/api/v1/repos/weaveworks/libgitops/pulls/4":
+			if err := json.NewDecoder(r.Body).Decode(&updated); err != nil {
+				t.Error(err)
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	p, err := NewGiteaPRProvider(srv.URL, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	updater := p.(transaction.PullRequestUpdater)
+	ref := gitprovider.UserRepositoryRef{
+		UserRef:        gitprovider.UserRef{Domain: "gitea.example.com", UserLogin: "weaveworks"},
+		RepositoryName: "libgitops",
+	}
+
+	pr, err := updater.FindOpenPullRequest(context.Background(), ref, "main", "car-update-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pr == nil || pr.Number != 4 || pr.URL != "https://gitea.example.com/pulls/4" || pr.MergeBranch != "car-update-abcd" {
+		t.Fatalf("unexpected pull request: %+v", pr)
+	}
+
+	err = updater.UpdatePullRequest(context.Background(), pr.Number, &transaction.GenericPullRequestSpec{
+		PullRequestResult: &transaction.GenericPullRequestResult{
+			CommitResult: &transaction.GenericCommitResult{
+				AuthorName:  "Jane",
+				AuthorEmail: "jane@example.com",
+				Title:       "Update car again",
+			},
+		},
+		MainBranch:    "main",
+		MergeBranch:   pr.MergeBranch,
+		RepositoryRef: ref,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The labels are cleared, and the head branch isn't changed
+	if labels, ok := updated["labels"].([]interface{}); updated["title"] != "Update car again" || !ok || len(labels) != 0 {
+		t.Errorf("unexpected update: %v", updated)
+	}
+	if _, ok := updated["head"]; ok {
+		t.Errorf("expected no head branch in update: %v", updated)
+	}
+}
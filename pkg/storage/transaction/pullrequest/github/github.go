@@ -16,6 +16,7 @@ import (
 var ErrProviderNotSupported = errors.New("only the Github go-git-providers provider is supported at the moment")
 
 // NewGitHubPRProvider returns a new transaction.PullRequestProvider from a gitprovider.Client.
+// The provider is also a transaction.PullRequestUpdater.
 func NewGitHubPRProvider(c gitprovider.Client) (transaction.PullRequestProvider, error) {
 	// Make sure a Github client was passed
 	if c.ProviderID() != github.ProviderID {
@@ -24,14 +25,16 @@ func NewGitHubPRProvider(c gitprovider.Client) (transaction.PullRequestProvider,
 	return &prCreator{c}, nil
 }
 
+var _ transaction.PullRequestUpdater = &prCreator{}
+
 type prCreator struct {
 	c gitprovider.Client
 }
 
 func (c *prCreator) CreatePullRequest(ctx context.Context, spec transaction.PullRequestSpec) error {
 	// First, validate the input
-	if err := spec.Validate(); err != nil {
-		return fmt.Errorf("given PullRequestSpec wasn't valid")
+	if err := transaction.ValidatePullRequestSpec(spec); err != nil {
+		return err
 	}
 
 	// Use the "raw" go-github client to do this
@@ -51,6 +54,7 @@ func (c *prCreator) CreatePullRequest(ctx context.Context, spec transaction.Pull
 		Base:  gogithub.String(spec.GetMainBranch()),
 		Title: gogithub.String(spec.GetTitle()),
 		Body:  body,
+		Draft: gogithub.Bool(transaction.IsDraft(spec)),
 	})
 	if err != nil {
 		return err
@@ -93,6 +97,80 @@ func (c *prCreator) CreatePullRequest(ctx context.Context, spec transaction.Pull
 	return nil
 }
 
+func (c *prCreator) FindOpenPullRequest(ctx context.Context, ref gitprovider.RepositoryRef, mainBranch, streamName string) (*transaction.PullRequestInfo, error) {
+	// Use the "raw" go-github client to do this
+	ghClient := c.c.Raw().(*gogithub.Client)
+
+	// List the open PRs into the main branch, newest first
+	opts := &gogithub.PullRequestListOptions{
+		State:       "open",
+		Base:        mainBranch,
+		Sort:        "created",
+		Direction:   "desc",
+		ListOptions: gogithub.ListOptions{PerPage: 100},
+	}
+	for {
+		prs, resp, err := ghClient.PullRequests.List(ctx, ref.GetIdentity(), ref.GetRepository(), opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, pr := range prs {
+			// Only consider branches of the repository itself, not of forks. The first match is the newest.
+			if pr.GetHead().GetRepo().GetID() != pr.GetBase().GetRepo().GetID() || !transaction.MatchesStream(pr.GetHead().GetRef(), streamName) {
+				continue
+			}
+			return &transaction.PullRequestInfo{
+				Number:      pr.GetNumber(),
+				URL:         pr.GetHTMLURL(),
+				MergeBranch: pr.GetHead().GetRef(),
+			}, nil
+		}
+		if resp.NextPage == 0 {
+			return nil, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+func (c *prCreator) UpdatePullRequest(ctx context.Context, number int, spec transaction.PullRequestSpec) error {
+	// First, validate the input
+	if err := transaction.ValidatePullRequestSpec(spec); err != nil {
+		return err
+	}
+
+	// Use the "raw" go-github client to do this
+	ghClient := c.c.Raw().(*gogithub.Client)
+
+	// Helper variables
+	owner := spec.GetRepositoryRef().GetIdentity()
+	repo := spec.GetRepositoryRef().GetRepository()
+
+	// The title, body and labels are always set, so they can be cleared
+	labels := spec.GetLabels()
+	if labels == nil {
+		labels = []string{}
+	}
+	req := &gogithub.IssueRequest{
+		Title:  gogithub.String(spec.GetTitle()),
+		Body:   gogithub.String(spec.GetDescription()),
+		Labels: &labels,
+	}
+	if len(spec.GetMilestone()) != 0 {
+		milestoneID, err := getMilestoneID(ctx, ghClient, owner, repo, spec.GetMilestone())
+		if err != nil {
+			return err
+		}
+		req.Milestone = milestoneID
+	}
+	if a := spec.GetAssignees(); len(a) != 0 {
+		req.Assignees = &a
+	}
+
+	// PRs are edited as issues, which covers all the fields
+	_, _, err := ghClient.Issues.Edit(ctx, owner, repo, number, req)
+	return err
+}
+
 func getMilestoneID(ctx context.Context, c *gogithub.Client, owner, repo, milestoneName string) (*int, error) {
 	// List all milestones in the repo
 	// TODO: This could/should use pagination
@@ -0,0 +1,149 @@
+package github
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/fluxcd/go-git-providers/github"
+	"github.com/fluxcd/go-git-providers/gitprovider"
+	"github.com/fluxcd/go-git-providers/validation"
+	gogithub "github.com/google/go-github/v32/github"
+	"github.com/weaveworks/libgitops/pkg/internal/testutil/prtest"
+	"github.com/weaveworks/libgitops/pkg/storage/transaction"
+)
+
+var repoRef = gitprovider.OrgRepositoryRef{
+	OrganizationRef: gitprovider.OrganizationRef{Domain: github.DefaultDomain, Organization: "weaveworks"},
+	RepositoryName:  "libgitops",
+}
+
+// newTestPRProvider creates a provider using a GitHub client pointed to the given test server
+func newTestPRProvider(t *testing.T, srv *httptest.Server) transaction.PullRequestUpdater {
+	t.Helper()
+
+	c, err := github.NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseURL, err := url.Parse(srv.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Raw().(*gogithub.Client).BaseURL = baseURL
+
+	p, err := NewGitHubPRProvider(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p.(transaction.PullRequestUpdater)
+}
+
+func TestCreatePullRequest(t *testing.T) {
+	var created, edited map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/repos/weaveworks/libgitops/pulls":
+			if err := json.NewDecoder(r.Body).Decode(&created); err != nil {
+				t.Error(err)
+			}
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write([]byte(`{"number": 7}`))
+		case r.Method == http.MethodGet && r.URL.Path == "/repos/weaveworks/libgitops/milestones":
+			_, _ = w.Write([]byte(`[{"number": 2, "title": "v0.1.0"}, {"number": 3, "title": "v0.2.0"}]`))
+		case r.Method == http.MethodPatch && r.URL.Path == "/repos/weaveworks/libgitops/issues/7":
+			if err := json.NewDecoder(r.Body).Decode(&edited); err != nil {
+				t.Error(err)
+			}
+			_, _ = w.Write([]byte(`{"number": 7}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	spec := prtest.NewSpec(repoRef, "main", "update-car", "Update car", "kind/feature")
+	spec.PullRequestResult.(*transaction.GenericPullRequestResult).Milestone = "v0.2.0"
+	spec.PullRequestResult.(*transaction.GenericPullRequestResult).Draft = true
+
+	p := newTestPRProvider(t, srv)
+	if err := p.CreatePullRequest(context.Background(), spec); err != nil {
+		t.Fatal(err)
+	}
+	if created["title"] != "Update car" || created["head"] != "update-car" || created["base"] != "main" || created["draft"] != true {
+		t.Errorf("unexpected pull request: %v", created)
+	}
+	// The labels and milestone are set by editing the pull request as an issue
+	if labels, ok := edited["labels"].([]interface{}); !ok || len(labels) != 1 || labels[0] != "kind/feature" || edited["milestone"] != float64(3) {
+		t.Errorf("unexpected edit: %v", edited)
+	}
+
+	// Validation errors are wrapped
+	if err := p.CreatePullRequest(context.Background(), prtest.NewSpec(repoRef, "main", "update-car", "")); !errors.Is(err, validation.ErrFieldRequired) {
+		t.Errorf("expected ErrFieldRequired, got %v", err)
+	}
+}
+
+func TestFindAndUpdatePullRequest(t *testing.T) {
+	var updated map[string]interface{}
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/repos/weaveworks/libgitops/pulls":
+			if q := r.URL.Query(); q.Get("state") != "open" || q.Get("base") != "main" || q.Get("sort") != "created" || q.Get("direction") != "desc" {
+				t.Errorf("unexpected query: %v", q)
+			}
+			// The pull requests are paginated, newest first. The newest matching one is on the second page.
+			if r.URL.Query().Get("page") != "2" {
+				w.Header().Set("Link", fmt.Sprintf(`<%s/repos/weaveworks/libgitops/pulls?page=2>; rel="next"`, srv.URL))
+				_, _ = w.Write([]byte(`[
+					{"number": 6, "html_url": "https://github.com/weaveworks/libgitops/pull/6", "head": {"ref": "car-update-fork", "repo": {"id": 2}}, "base": {"ref": "main", "repo": {"id": 1}}},
+					{"number": 5, "html_url": "https://github.com/weaveworks/libgitops/pull/5", "head": {"ref": "bike-update-1234", "repo": {"id": 1}}, "base": {"ref": "main", "repo": {"id": 1}}}
+				]`))
+				return
+			}
+			_, _ = w.Write([]byte(`[
+				{"number": 4, "html_url": "https://github.com/weaveworks/libgitops/pull/4", "head": {"ref": "car-update-abcd", "repo": {"id": 1}}, "base": {"ref": "main", "repo": {"id": 1}}},
+				{"number": 3, "html_url": "https://github.com/weaveworks/libgitops/pull/3", "head": {"ref": "car-update-5678", "repo": {"id": 1}}, "base": {"ref": "main", "repo": {"id": 1}}}
+			]`))
+		case r.Method == http.MethodPatch && r.URL.Path == "/repos/weaveworks/libgitops/issues/4":
+			if err := json.NewDecoder(r.Body).Decode(&updated); err != nil {
+				t.Error(err)
+			}
+			_, _ = w.Write([]byte(`{"number": 4}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	p := newTestPRProvider(t, srv)
+	pr, err := p.FindOpenPullRequest(context.Background(), repoRef, "main", "car-update-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pr == nil || pr.Number != 4 || pr.URL != "https://github.com/weaveworks/libgitops/pull/4" || pr.MergeBranch != "car-update-abcd" {
+		t.Fatalf("unexpected pull request: %+v", pr)
+	}
+	if pr, err := p.FindOpenPullRequest(context.Background(), repoRef, "main", "boat-update-"); err != nil || pr != nil {
+		t.Errorf("expected no pull request, got %+v, %v", pr, err)
+	}
+
+	if err := p.UpdatePullRequest(context.Background(), pr.Number, prtest.NewSpec(repoRef, "main", pr.MergeBranch, "Update car again")); err != nil {
+		t.Fatal(err)
+	}
+	// The labels are cleared
+	if labels, ok := updated["labels"].([]interface{}); updated["title"] != "Update car again" || !ok || len(labels) != 0 {
+		t.Errorf("unexpected update: %v", updated)
+	}
+
+	// Validation errors are wrapped
+	if err := p.UpdatePullRequest(context.Background(), pr.Number, prtest.NewSpec(repoRef, "main", pr.MergeBranch, "")); !errors.Is(err, validation.ErrFieldRequired) {
+		t.Errorf("expected ErrFieldRequired, got %v", err)
+	}
+}
@@ -0,0 +1,186 @@
+package gitlab
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/fluxcd/go-git-providers/gitprovider"
+	"github.com/weaveworks/libgitops/pkg/storage/transaction"
+	"github.com/weaveworks/libgitops/pkg/storage/transaction/pullrequest/rest"
+)
+
+const (
+	apiPath = "/api/v4"
+	// draftPrefix marks merge requests as drafts
+	draftPrefix = "Draft:"
+)
+
+// NewGitLabPRProvider returns a new transaction.PullRequestProvider creating GitLab merge requests
+// using the given personal, project or group access token. baseURL is the URL of the GitLab instance,
+// e.g. "https://gitlab.example.com"; if empty, the domain of the repository is used. The provider
+// is also a transaction.PullRequestUpdater.
+func NewGitLabPRProvider(baseURL, token string) (transaction.PullRequestProvider, error) {
+	if len(token) == 0 {
+		return nil, errors.New("a GitLab token is required")
+	}
+	return &prCreator{
+		baseURL: baseURL,
+		token:   token,
+	}, nil
+}
+
+type prCreator struct {
+	baseURL string
+	token   string
+	// httpClient is used for the requests, http.DefaultClient if nil
+	httpClient *http.Client
+}
+
+var _ transaction.PullRequestUpdater = &prCreator{}
+
+type mergeRequest struct {
+	SourceBranch string `json:"source_branch,omitempty"`
+	TargetBranch string `json:"target_branch"`
+	Title        string `json:"title"`
+	Description  string `json:"description"`
+	Labels       string `json:"labels"`
+	AssigneeIDs  []int  `json:"assignee_ids,omitempty"`
+	MilestoneID  int    `json:"milestone_id,omitempty"`
+}
+
+type idObject struct {
+	ID    int    `json:"id"`
+	Title string `json:"title"`
+}
+
+type listedMergeRequest struct {
+	IID             int    `json:"iid"`
+	WebURL          string `json:"web_url"`
+	SourceBranch    string `json:"source_branch"`
+	SourceProjectID int    `json:"source_project_id"`
+	TargetProjectID int    `json:"target_project_id"`
+}
+
+// perPage is the page size used when listing merge requests
+const perPage = 100
+
+func (c *prCreator) CreatePullRequest(ctx context.Context, spec transaction.PullRequestSpec) error {
+	// First, validate the input
+	if err := transaction.ValidatePullRequestSpec(spec); err != nil {
+		return err
+	}
+
+	client, project := c.client(spec.GetRepositoryRef())
+	mr, err := newMergeRequest(ctx, client, project, spec)
+	if err != nil {
+		return err
+	}
+
+	// Create the merge request, including all fields at once
+	return client.Do(ctx, http.MethodPost, project+"/merge_requests", nil, mr, nil)
+}
+
+func (c *prCreator) FindOpenPullRequest(ctx context.Context, ref gitprovider.RepositoryRef, mainBranch, streamName string) (*transaction.PullRequestInfo, error) {
+	client, project := c.client(ref)
+
+	var found *transaction.PullRequestInfo
+	for page := 1; ; page++ {
+		query := url.Values{
+			"state":         {"opened"},
+			"target_branch": {mainBranch},
+			"per_page":      {strconv.Itoa(perPage)},
+			"page":          {strconv.Itoa(page)},
+		}
+		var mrs []listedMergeRequest
+		if err := client.Do(ctx, http.MethodGet, project+"/merge_requests", query, nil, &mrs); err != nil {
+			return nil, err
+		}
+		for _, mr := range mrs {
+			// Only consider branches of the project itself, not of forks. Prefer the newest merge request.
+			if mr.SourceProjectID != mr.TargetProjectID || !transaction.MatchesStream(mr.SourceBranch, streamName) {
+				continue
+			}
+			if found == nil || mr.IID > found.Number {
+				found = &transaction.PullRequestInfo{Number: mr.IID, URL: mr.WebURL, MergeBranch: mr.SourceBranch}
+			}
+		}
+		if len(mrs) < perPage {
+			return found, nil
+		}
+	}
+}
+
+func (c *prCreator) UpdatePullRequest(ctx context.Context, number int, spec transaction.PullRequestSpec) error {
+	// First, validate the input
+	if err := transaction.ValidatePullRequestSpec(spec); err != nil {
+		return err
+	}
+
+	client, project := c.client(spec.GetRepositoryRef())
+	mr, err := newMergeRequest(ctx, client, project, spec)
+	if err != nil {
+		return err
+	}
+	// The source branch of a merge request can't be changed
+	mr.SourceBranch = ""
+
+	return client.Do(ctx, http.MethodPut, fmt.Sprintf("%s/merge_requests/%d", project, number), nil, mr, nil)
+}
+
+// client returns a REST client for the GitLab instance of the given repository, and the path of its project
+func (c *prCreator) client(ref gitprovider.RepositoryRef) (*rest.Client, string) {
+	client := &rest.Client{
+		BaseURL:    rest.BaseURL(c.baseURL, ref, apiPath),
+		HTTPClient: c.httpClient,
+		Authorize: func(req *http.Request) {
+			req.Header.Set("PRIVATE-TOKEN", c.token)
+		},
+	}
+	// The project can be identified by its URL-encoded path
+	return client, "/projects/" + url.PathEscape(rest.RepositoryPath(ref))
+}
+
+// newMergeRequest creates the request body for the given spec, looking up the IDs of the assignees and milestone
+func newMergeRequest(ctx context.Context, client *rest.Client, project string, spec transaction.PullRequestSpec) (*mergeRequest, error) {
+	mr := &mergeRequest{
+		SourceBranch: spec.GetMergeBranch(),
+		TargetBranch: spec.GetMainBranch(),
+		Title:        rest.DraftTitle(spec, draftPrefix),
+		Description:  spec.GetDescription(),
+		Labels:       strings.Join(spec.GetLabels(), ","),
+	}
+
+	// Look up the IDs of the assignees and milestone
+	for _, username := range spec.GetAssignees() {
+		var users []idObject
+		if err := client.Do(ctx, http.MethodGet, "/users", url.Values{"username": {username}}, nil, &users); err != nil {
+			return nil, err
+		}
+		if len(users) == 0 {
+			return nil, fmt.Errorf("couldn't find user with username: %s", username)
+		}
+		mr.AssigneeIDs = append(mr.AssigneeIDs, users[0].ID)
+	}
+
+	if len(spec.GetMilestone()) != 0 {
+		var milestones []idObject
+		if err := client.Do(ctx, http.MethodGet, project+"/milestones", url.Values{"title": {spec.GetMilestone()}}, nil, &milestones); err != nil {
+			return nil, err
+		}
+		for _, milestone := range milestones {
+			if milestone.Title == spec.GetMilestone() {
+				mr.MilestoneID = milestone.ID
+				break
+			}
+		}
+		if mr.MilestoneID == 0 {
+			return nil, fmt.Errorf("couldn't find milestone with name: %s", spec.GetMilestone())
+		}
+	}
+	return mr, nil
+}
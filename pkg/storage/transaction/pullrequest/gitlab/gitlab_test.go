@@ -0,0 +1,139 @@
+package gitlab
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fluxcd/go-git-providers/gitprovider"
+	"github.com/weaveworks/libgitops/pkg/storage/transaction"
+)
+
+func TestCreatePullRequest(t *testing.T) {
+	var got mergeRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("PRIVATE-TOKEN") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.EscapedPath() {
+		case "/api/v4/users":
+			_, _ = w.Write([]byte(`[{"id": 7}]`))
+		case "/api/v4/projects/weaveworks%2Flibgitops/milestones":
+			_, _ = w.Write([]byte(`[{"id": 3, "title": "v0.1.0"}]`))
+		case "/api/v4/projects/weaveworks%2Flibgitops/merge_requests":
+			if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+				t.Error(err)
+			}
+			w.WriteHeader(http.StatusCreated)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	p, err := NewGitLabPRProvider(srv.URL, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.CreatePullRequest(context.Background(), &transaction.GenericPullRequestSpec{
+		PullRequestResult: &transaction.GenericPullRequestResult{
+			CommitResult: &transaction.GenericCommitResult{
+				AuthorName:  "Jane",
+				AuthorEmail: "jane@example.com",
+				Title:       "Update car",
+			},
+			Labels:    []string{"kind/feature", "area/storage"},
+			Assignees: []string{"jane"},
+			Milestone: "v0.1.0",
+			Draft:     true,
+		},
+		MainBranch:  "main",
+		MergeBranch: "update-car",
+		RepositoryRef: gitprovider.OrgRepositoryRef{
+			OrganizationRef: gitprovider.OrganizationRef{Domain: "gitlab.example.com", Organization: "weaveworks"},
+			RepositoryName:  "libgitops",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Title != "Draft: Update car" || got.SourceBranch != "update-car" || got.TargetBranch != "main" {
+		t.Errorf("unexpected merge request: %+v", got)
+	}
+	if got.Labels != "kind/feature,area/storage" || len(got.AssigneeIDs) != 1 || got.AssigneeIDs[0] != 7 || got.MilestoneID != 3 {
+		t.Errorf("unexpected merge request: %+v", got)
+	}
+}
+
+func TestFindAndUpdatePullRequest(t *testing.T) {
+	var updated map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.EscapedPath() == "/api/v4/projects/weaveworks%2Flibgitops/merge_requests":
+			if r.URL.Query().Get("state") != "opened" || r.URL.Query().Get("target_branch") != "main" {
+				t.Errorf("unexpected query: %s", r.URL.RawQuery)
+			}
+			_, _ = w.Write([]byte(`[
+				{"iid": 4, "web_url": "https://gitlab.example.com/mr/4", "source_branch": "car-update-1234", "source_project_id": 2, "target_project_id": 1},
+				{"iid": 3, "web_url": "https://gitlab.example.com/mr/3", "source_branch": "car-update-abcd", "source_project_id": 1, "target_project_id": 1},
+				{"iid": 2, "web_url": "https://gitlab.example.com/mr/2", "source_branch": "car-update-5678", "source_project_id": 1, "target_project_id": 1}
+			]`))
+		case r.Method == http.MethodPut && r.URL.EscapedPath() == "/api/v4/projects/weaveworks%2Flibgitops/merge_requests/3":
+			if err := json.NewDecoder(r.Body).Decode(&updated); err != nil {
+				t.Error(err)
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	p, err := NewGitLabPRProvider(srv.URL, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	updater := p.(transaction.PullRequestUpdater)
+	ref := gitprovider.OrgRepositoryRef{
+		OrganizationRef: gitprovider.OrganizationRef{Domain: "gitlab.example.com", Organization: "weaveworks"},
+		RepositoryName:  "libgitops",
+	}
+
+	// The newest merge request of the stream from the project itself is found
+	pr, err := updater.FindOpenPullRequest(context.Background(), ref, "main", "car-update-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pr == nil || pr.Number != 3 || pr.URL != "https://gitlab.example.com/mr/3" || pr.MergeBranch != "car-update-abcd" {
+		t.Fatalf("unexpected merge request: %+v", pr)
+	}
+	if pr, err := updater.FindOpenPullRequest(context.Background(), ref, "main", "bike-update-"); err != nil || pr != nil {
+		t.Errorf("expected no merge request, got %+v, %v", pr, err)
+	}
+
+	err = updater.UpdatePullRequest(context.Background(), pr.Number, &transaction.GenericPullRequestSpec{
+		PullRequestResult: &transaction.GenericPullRequestResult{
+			CommitResult: &transaction.GenericCommitResult{
+				AuthorName:  "Jane",
+				AuthorEmail: "jane@example.com",
+				Title:       "Update car again",
+			},
+		},
+		MainBranch:    "main",
+		MergeBranch:   pr.MergeBranch,
+		RepositoryRef: ref,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The labels are cleared, and the source branch isn't changed
+	if updated["title"] != "Update car again" || updated["labels"] != "" {
+		t.Errorf("unexpected update: %v", updated)
+	}
+	if _, ok := updated["source_branch"]; ok {
+		t.Errorf("expected no source branch in update: %v", updated)
+	}
+}
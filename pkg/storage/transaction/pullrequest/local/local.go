@@ -0,0 +1,482 @@
+// Package local contains a PullRequestProvider recording the PRs in a file next to a local (bare) Git
+// repository, and merging them into its main branch. It makes it possible to use the GitStorage, e.g.
+// in integration tests and demos, without a Git provider.
+package local
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fluxcd/go-git-providers/gitprovider"
+	"github.com/fluxcd/go-git-providers/validation"
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	log "github.com/sirupsen/logrus"
+	"github.com/weaveworks/libgitops/pkg/storage/transaction"
+	"github.com/weaveworks/libgitops/pkg/util/gitmerge"
+)
+
+// StateFile is the name of the file the PRs are recorded in, in the directory of the repository
+const StateFile = "libgitops-pullrequests.json"
+
+// ErrNotFound is returned if no PR with the given number exists
+var ErrNotFound = errors.New("pull request not found")
+
+// PullRequestState describes whether a PR is open, merged or closed
+type PullRequestState byte
+
+const (
+	// PullRequestStateOpen describes a PR that is pending to be merged
+	PullRequestStateOpen PullRequestState = iota
+	// PullRequestStateMerged describes a PR that has been merged into the main branch
+	PullRequestStateMerged
+	// PullRequestStateClosed describes a PR that has been closed without merging it
+	PullRequestStateClosed
+)
+
+func (s PullRequestState) String() string {
+	switch s {
+	case 0:
+		return "Open"
+	case 1:
+		return "Merged"
+	case 2:
+		return "Closed"
+	}
+
+	// Should never happen
+	return "UNKNOWN"
+}
+
+// MarshalText encodes the state as its name in the state file
+func (s PullRequestState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText decodes the state from its name
+func (s *PullRequestState) UnmarshalText(text []byte) error {
+	for _, state := range []PullRequestState{PullRequestStateOpen, PullRequestStateMerged, PullRequestStateClosed} {
+		if string(text) == state.String() {
+			*s = state
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown pull request state %q", text)
+}
+
+// PullRequest is a PR recorded by the Provider
+type PullRequest struct {
+	// Number identifies the PR, starting from 1
+	Number int `json:"number"`
+	// State describes whether the PR is open, merged or closed
+	State PullRequestState `json:"state"`
+
+	// Title and Description describe the PR
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	// AuthorName and AuthorEmail describe the author of the commit the PR was created for
+	AuthorName  string `json:"authorName"`
+	AuthorEmail string `json:"authorEmail"`
+	// Labels, Assignees, Milestone and Draft are recorded as given in the PullRequestSpec
+	Labels    []string `json:"labels,omitempty"`
+	Assignees []string `json:"assignees,omitempty"`
+	Milestone string   `json:"milestone,omitempty"`
+	Draft     bool     `json:"draft,omitempty"`
+
+	// MainBranch is the branch the PR is merged into
+	MainBranch string `json:"mainBranch"`
+	// MergeBranch is the branch containing the changes of the PR
+	MergeBranch string `json:"mergeBranch"`
+	// MergeCommit is the SHA of the merge commit, set once the PR has been merged
+	MergeCommit string `json:"mergeCommit,omitempty"`
+
+	// CreatedAt and UpdatedAt describe when the PR was created and last changed state
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// MergeConflictError is returned by MergePullRequest, if both the main branch and the
+// branch of the PR changed the same files since they diverged. Nothing is merged.
+type MergeConflictError struct {
+	// Number is the number of the PR
+	Number int
+	// Paths are the slash-separated paths of the conflicting files, relative to the repository root
+	Paths []string
+}
+
+var _ error = &MergeConflictError{}
+
+func (e *MergeConflictError) Error() string {
+	return fmt.Sprintf("pull request #%d conflicts with its main branch in: %s", e.Number, strings.Join(e.Paths, ", "))
+}
+
+// NewLocalPRProvider creates a new Provider for the Git repository in the given directory, usually a
+// bare repository the GitDirectory is cloned from, e.g. using gitdir.NewGitDirectoryFromURL. The PRs
+// are recorded in StateFile in the same directory, and loaded from it if it exists.
+func NewLocalPRProvider(repoDir string) (*Provider, error) {
+	repo, err := git.PlainOpen(repoDir)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open repository %q: %w", repoDir, err)
+	}
+
+	p := &Provider{
+		repoDir:   repoDir,
+		repo:      repo,
+		stateFile: filepath.Join(repoDir, StateFile),
+	}
+	content, err := ioutil.ReadFile(p.stateFile)
+	if os.IsNotExist(err) {
+		return p, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, &p.prs); err != nil {
+		return nil, fmt.Errorf("couldn't decode %q: %w", p.stateFile, err)
+	}
+	return p, nil
+}
+
+var _ transaction.PullRequestUpdater = &Provider{}
+
+// Provider is a transaction.PullRequestProvider for a local Git repository, see NewLocalPRProvider.
+type Provider struct {
+	repoDir   string
+	repo      *git.Repository
+	stateFile string
+
+	// mu guards prs and the state file
+	mu  sync.Mutex
+	prs []*PullRequest
+}
+
+// CreatePullRequest records a new open PR for the given spec. The merge branch must exist in the repository.
+func (p *Provider) CreatePullRequest(_ context.Context, spec transaction.PullRequestSpec) error {
+	// The RepositoryRef isn't required, as the repository is given
+	if err := validateSpec(spec); err != nil {
+		return fmt.Errorf("given PullRequestSpec wasn't valid: %w", err)
+	}
+	if _, err := p.repo.Reference(plumbing.NewBranchReferenceName(spec.GetMergeBranch()), true); err != nil {
+		return fmt.Errorf("couldn't find branch %q: %w", spec.GetMergeBranch(), err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now().UTC()
+	pr := &PullRequest{
+		Number:      len(p.prs) + 1,
+		State:       PullRequestStateOpen,
+		Title:       spec.GetTitle(),
+		Description: spec.GetDescription(),
+		AuthorName:  spec.GetAuthorName(),
+		AuthorEmail: spec.GetAuthorEmail(),
+		Labels:      spec.GetLabels(),
+		Assignees:   spec.GetAssignees(),
+		Milestone:   spec.GetMilestone(),
+		Draft:       transaction.IsDraft(spec),
+		MainBranch:  spec.GetMainBranch(),
+		MergeBranch: spec.GetMergeBranch(),
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	p.prs = append(p.prs, pr)
+	if err := p.save(); err != nil {
+		p.prs = p.prs[:len(p.prs)-1]
+		return err
+	}
+
+	log.Infof("Created pull request #%d %q for branch %q", pr.Number, pr.Title, pr.MergeBranch)
+	return nil
+}
+
+// FindOpenPullRequest returns the newest open PR into mainBranch from the branch of the given stream, or nil.
+// The RepositoryRef is ignored. The URL of the returned PullRequestInfo isn't set.
+func (p *Provider) FindOpenPullRequest(_ context.Context, _ gitprovider.RepositoryRef, mainBranch, streamName string) (*transaction.PullRequestInfo, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i := len(p.prs) - 1; i >= 0; i-- {
+		pr := p.prs[i]
+		if pr.State == PullRequestStateOpen && pr.MainBranch == mainBranch && transaction.MatchesStream(pr.MergeBranch, streamName) {
+			return &transaction.PullRequestInfo{Number: pr.Number, MergeBranch: pr.MergeBranch}, nil
+		}
+	}
+	return nil, nil
+}
+
+// UpdatePullRequest updates the title, description and labels of the open PR with the given
+// number using the given spec. The assignees, milestone and draft flag are updated, if set.
+func (p *Provider) UpdatePullRequest(_ context.Context, number int, spec transaction.PullRequestSpec) error {
+	if err := validateSpec(spec); err != nil {
+		return fmt.Errorf("given PullRequestSpec wasn't valid: %w", err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pr, err := p.get(number)
+	if err != nil {
+		return err
+	}
+	if pr.State != PullRequestStateOpen {
+		return fmt.Errorf("pull request #%d is %s", number, strings.ToLower(pr.State.String()))
+	}
+
+	old := *pr
+	pr.Title = spec.GetTitle()
+	pr.Description = spec.GetDescription()
+	pr.Labels = spec.GetLabels()
+	if a := spec.GetAssignees(); len(a) != 0 {
+		pr.Assignees = a
+	}
+	if m := spec.GetMilestone(); len(m) != 0 {
+		pr.Milestone = m
+	}
+	if transaction.IsDraft(spec) {
+		pr.Draft = true
+	}
+	pr.UpdatedAt = time.Now().UTC()
+	if err := p.save(); err != nil {
+		*pr = old
+		return err
+	}
+
+	log.Infof("Updated pull request #%d %q", pr.Number, pr.Title)
+	return nil
+}
+
+// ListPullRequests returns copies of the recorded PRs, ordered by number
+func (p *Provider) ListPullRequests() []PullRequest {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	prs := make([]PullRequest, 0, len(p.prs))
+	for _, pr := range p.prs {
+		prs = append(prs, *pr)
+	}
+	return prs
+}
+
+// GetPullRequest returns a copy of the PR with the given number, or ErrNotFound
+func (p *Provider) GetPullRequest(number int) (*PullRequest, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pr, err := p.get(number)
+	if err != nil {
+		return nil, err
+	}
+	prCopy := *pr
+	return &prCopy, nil
+}
+
+// MergePullRequest merges the branch of the open PR with the given number into its main branch, creating a merge
+// commit by the given author. If both branches changed the same files, a *MergeConflictError is returned.
+// The merged PR is returned.
+func (p *Provider) MergePullRequest(ctx context.Context, number int, authorName, authorEmail string) (*PullRequest, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pr, err := p.get(number)
+	if err != nil {
+		return nil, err
+	}
+	if pr.State != PullRequestStateOpen {
+		return nil, fmt.Errorf("pull request #%d is %s", number, strings.ToLower(pr.State.String()))
+	}
+
+	hash, err := p.merge(ctx, pr, authorName, authorEmail)
+	if err != nil {
+		return nil, err
+	}
+
+	pr.State = PullRequestStateMerged
+	pr.MergeCommit = hash.String()
+	pr.UpdatedAt = time.Now().UTC()
+	if err := p.save(); err != nil {
+		return nil, err
+	}
+
+	log.Infof("Merged pull request #%d into branch %q as %s", pr.Number, pr.MainBranch, pr.MergeCommit)
+	prCopy := *pr
+	return &prCopy, nil
+}
+
+// ClosePullRequest closes the open PR with the given number without merging it. The branch is kept.
+func (p *Provider) ClosePullRequest(number int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pr, err := p.get(number)
+	if err != nil {
+		return err
+	}
+	if pr.State != PullRequestStateOpen {
+		return fmt.Errorf("pull request #%d is %s", number, strings.ToLower(pr.State.String()))
+	}
+
+	pr.State = PullRequestStateClosed
+	pr.UpdatedAt = time.Now().UTC()
+	if err := p.save(); err != nil {
+		return err
+	}
+
+	log.Infof("Closed pull request #%d", pr.Number)
+	return nil
+}
+
+// get returns the PR with the given number, p.mu must be held
+func (p *Provider) get(number int) (*PullRequest, error) {
+	if number < 1 || number > len(p.prs) {
+		return nil, fmt.Errorf("%w: #%d", ErrNotFound, number)
+	}
+	return p.prs[number-1], nil
+}
+
+// save writes the PRs to the state file, p.mu must be held
+func (p *Provider) save() error {
+	content, err := json.MarshalIndent(p.prs, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first, so the state file is never partially written
+	tmpFile := p.stateFile + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, p.stateFile)
+}
+
+// merge creates a merge commit of the main and merge branches of the PR in a temporary
+// clone of the repository, and pushes it to the main branch of the repository.
+func (p *Provider) merge(ctx context.Context, pr *PullRequest, authorName, authorEmail string) (plumbing.Hash, error) {
+	mainCommit, err := p.branchCommit(pr.MainBranch)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	mergeCommit, err := p.branchCommit(pr.MergeBranch)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if merged, err := mergeCommit.IsAncestor(mainCommit); err != nil {
+		return plumbing.ZeroHash, err
+	} else if merged || mergeCommit.Hash == mainCommit.Hash {
+		return plumbing.ZeroHash, fmt.Errorf("branch %q of pull request #%d has no changes to merge", pr.MergeBranch, pr.Number)
+	}
+
+	bases, err := mainCommit.MergeBase(mergeCommit)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if len(bases) == 0 {
+		return plumbing.ZeroHash, fmt.Errorf("branches %q and %q have no common history", pr.MainBranch, pr.MergeBranch)
+	}
+
+	ourChanges, err := diffCommits(bases[0], mainCommit)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	theirChanges, err := diffCommits(bases[0], mergeCommit)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	// Files changed on both branches conflict, unless they were changed in the same way
+	if conflicts := gitmerge.Conflicts(theirChanges, ourChanges); len(conflicts) != 0 {
+		return plumbing.ZeroHash, &MergeConflictError{Number: pr.Number, Paths: conflicts}
+	}
+
+	// Apply the changes of the PR onto the main branch in a temporary clone
+	cloneDir, err := ioutil.TempDir("", "libgitops-merge")
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	defer func() { _ = os.RemoveAll(cloneDir) }()
+
+	clone, err := git.PlainCloneContext(ctx, cloneDir, false, &git.CloneOptions{
+		URL:           p.repoDir,
+		ReferenceName: plumbing.NewBranchReferenceName(pr.MainBranch),
+		SingleBranch:  true,
+	})
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("couldn't clone %q: %w", p.repoDir, err)
+	}
+	wt, err := clone.Worktree()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if err := gitmerge.ApplyChanges(wt, theirChanges); err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	// The merge commit refers to the head of the merge branch, which only exists in the repository
+	msg := fmt.Sprintf("Merge pull request #%d from %s\n\n%s", pr.Number, pr.MergeBranch, pr.Title)
+	sig := &object.Signature{Name: authorName, Email: authorEmail, When: time.Now()}
+	hash, err := wt.Commit(msg, &git.CommitOptions{
+		Author:  sig,
+		Parents: []plumbing.Hash{mainCommit.Hash, mergeCommit.Hash},
+	})
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("git commit error: %v", err)
+	}
+
+	// Only the commit and the changed files need to be pushed, as the repository has the parents
+	branch := plumbing.NewBranchReferenceName(pr.MainBranch)
+	if err := clone.PushContext(ctx, &git.PushOptions{
+		RefSpecs: []config.RefSpec{config.RefSpec(fmt.Sprintf("%s:%[1]s", branch))},
+	}); err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("couldn't push the merge commit: %w", err)
+	}
+	return hash, nil
+}
+
+// branchCommit returns the commit the given branch of the repository points to
+func (p *Provider) branchCommit(branch string) (*object.Commit, error) {
+	ref, err := p.repo.Reference(plumbing.NewBranchReferenceName(branch), true)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't find branch %q: %w", branch, err)
+	}
+	return p.repo.CommitObject(ref.Hash())
+}
+
+// diffCommits returns the changes between the trees of the given commits
+func diffCommits(from, to *object.Commit) (object.Changes, error) {
+	fromTree, err := from.Tree()
+	if err != nil {
+		return nil, err
+	}
+	toTree, err := to.Tree()
+	if err != nil {
+		return nil, err
+	}
+	return object.DiffTree(fromTree, toTree)
+}
+
+// validateSpec validates the given spec like GenericPullRequestSpec does, except for the RepositoryRef,
+// which is nil if the GitDirectory was created from a plain URL
+func validateSpec(spec transaction.PullRequestSpec) error {
+	v := validation.New("PullRequestSpec")
+	if s, ok := spec.(*transaction.GenericPullRequestSpec); ok {
+		v.Append(s.PullRequestResult.Validate(), s.PullRequestResult, "PullRequestResult")
+	} else {
+		v.Append(spec.Validate(), spec, "PullRequestSpec")
+	}
+
+	if len(spec.GetMainBranch()) == 0 {
+		v.Required("MainBranch")
+	}
+	if len(spec.GetMergeBranch()) == 0 {
+		v.Required("MergeBranch")
+	}
+	return v.Error()
+}
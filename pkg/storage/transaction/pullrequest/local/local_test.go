@@ -0,0 +1,184 @@
+package local
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/weaveworks/libgitops/pkg/internal/testutil"
+	"github.com/weaveworks/libgitops/pkg/internal/testutil/prtest"
+)
+
+func readFile(t *testing.T, bareDir, branch, name string) string {
+	t.Helper()
+
+	repo, err := git.PlainOpen(bareDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := repo.Reference(plumbing.NewBranchReferenceName(branch), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := repo.CommitObject(ref.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := c.File(name)
+	if err == object.ErrFileNotFound {
+		return ""
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	content, err := f.Contents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+func TestProvider(t *testing.T) {
+	ctx := context.Background()
+	bareDir, repo := testutil.NewBareRepo(t, map[string]string{"car.yaml": "kind: Car", "bike.yaml": "kind: Bike"})
+	defer os.RemoveAll(bareDir)
+
+	p, err := NewLocalPRProvider(bareDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.CreatePullRequest(ctx, prtest.NewSpec(nil, "master", "missing", "Update missing")); err == nil {
+		t.Error("expected error for missing branch")
+	}
+
+	// Create two PRs changing the car, and one removing the bike
+	testutil.CommitFiles(t, repo, "car-red", map[string]string{"car.yaml": "kind: Car\nspec: {color: red}"}, "red car")
+	testutil.Checkout(t, repo, "master")
+	testutil.CommitFiles(t, repo, "car-blue", map[string]string{"car.yaml": "kind: Car\nspec: {color: blue}"}, "blue car")
+	testutil.Checkout(t, repo, "master")
+	testutil.CommitFiles(t, repo, "no-bike", map[string]string{"bike.yaml": ""}, "remove bike")
+	for _, branch := range []string{"car-red", "car-blue", "no-bike"} {
+		if err := p.CreatePullRequest(ctx, prtest.NewSpec(nil, "master", branch, "Update "+branch, "kind/status-update")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Change the main branch in the meantime
+	testutil.CommitFiles(t, repo, "master", map[string]string{"boat.yaml": "kind: Boat"}, "add boat")
+
+	prs := p.ListPullRequests()
+	if len(prs) != 3 || prs[0].Number != 1 || prs[0].MergeBranch != "car-red" || prs[0].State != PullRequestStateOpen || len(prs[0].Labels) != 1 {
+		t.Fatalf("unexpected PRs: %+v", prs)
+	}
+
+	// Merging the first PR creates a merge commit containing the changes of both branches
+	pr, err := p.MergePullRequest(ctx, 1, "Maintainer", "maintainer@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pr.State != PullRequestStateMerged || pr.MergeCommit == "" {
+		t.Errorf("unexpected merged PR: %+v", pr)
+	}
+	if got := readFile(t, bareDir, "master", "car.yaml"); got != "kind: Car\nspec: {color: red}" {
+		t.Errorf("unexpected car.yaml: %q", got)
+	}
+	if got := readFile(t, bareDir, "master", "boat.yaml"); got != "kind: Boat" {
+		t.Errorf("unexpected boat.yaml: %q", got)
+	}
+	c, err := p.repo.CommitObject(plumbing.NewHash(pr.MergeCommit))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.NumParents() != 2 || c.Author.Name != "Maintainer" {
+		t.Errorf("unexpected merge commit: %v", c)
+	}
+	if _, err := p.MergePullRequest(ctx, 1, "Maintainer", "maintainer@example.com"); err == nil {
+		t.Error("expected error merging a merged PR")
+	}
+
+	// The second PR changed the car too
+	var conflictErr *MergeConflictError
+	if _, err := p.MergePullRequest(ctx, 2, "Maintainer", "maintainer@example.com"); !errors.As(err, &conflictErr) {
+		t.Fatalf("expected MergeConflictError, got %v", err)
+	}
+	if len(conflictErr.Paths) != 1 || conflictErr.Paths[0] != "car.yaml" {
+		t.Errorf("unexpected conflicts: %v", conflictErr.Paths)
+	}
+	if err := p.ClosePullRequest(2); err != nil {
+		t.Fatal(err)
+	}
+
+	// Removals are merged as well
+	if _, err := p.MergePullRequest(ctx, 3, "Maintainer", "maintainer@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, bareDir, "master", "bike.yaml"); got != "" {
+		t.Errorf("expected bike.yaml to be removed, got %q", got)
+	}
+
+	// The PRs are loaded from the state file
+	p, err = NewLocalPRProvider(bareDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prs = p.ListPullRequests()
+	if len(prs) != 3 || prs[0].State != PullRequestStateMerged || prs[1].State != PullRequestStateClosed || prs[2].State != PullRequestStateMerged {
+		t.Errorf("unexpected PRs: %+v", prs)
+	}
+	if _, err := p.GetPullRequest(4); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestFindAndUpdatePullRequest(t *testing.T) {
+	ctx := context.Background()
+	bareDir, repo := testutil.NewBareRepo(t, map[string]string{"car.yaml": "kind: Car"})
+	defer os.RemoveAll(bareDir)
+
+	p, err := NewLocalPRProvider(bareDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, branch := range []string{"car-update-1234", "car-update-5678", "bike-update-1234"} {
+		testutil.CommitFiles(t, repo, branch, map[string]string{"car.yaml": "kind: Car\nspec: {}"}, branch)
+		testutil.Checkout(t, repo, "master")
+		if err := p.CreatePullRequest(ctx, prtest.NewSpec(nil, "master", branch, "Update "+branch, "kind/status-update")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.ClosePullRequest(2); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		mainBranch, streamName string
+		expected               int
+	}{
+		{"master", "car-update-", 1},
+		{"master", "bike-update-1234", 3},
+		{"master", "bike-update", 0},
+		{"main", "car-update-", 0},
+	}
+	for _, tt := range tests {
+		pr, err := p.FindOpenPullRequest(ctx, nil, tt.mainBranch, tt.streamName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.expected == 0 && pr != nil || tt.expected != 0 && (pr == nil || pr.Number != tt.expected) {
+			t.Errorf("%s: expected PR #%d, got %+v", tt.streamName, tt.expected, pr)
+		}
+	}
+
+	spec := prtest.NewSpec(nil, "master", "car-update-1234", "Update car-update-1234", "kind/bug")
+	if err := p.UpdatePullRequest(ctx, 1, spec); err != nil {
+		t.Fatal(err)
+	}
+	if pr, err := p.GetPullRequest(1); err != nil || len(pr.Labels) != 1 || pr.Labels[0] != "kind/bug" {
+		t.Errorf("unexpected updated PR: %+v, %v", pr, err)
+	}
+	if err := p.UpdatePullRequest(ctx, 2, spec); err == nil {
+		t.Error("expected error updating a closed PR")
+	}
+}
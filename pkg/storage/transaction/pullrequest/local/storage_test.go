@@ -0,0 +1,223 @@
+package local
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/weaveworks/libgitops/cmd/sample-app/apis/sample/scheme"
+	"github.com/weaveworks/libgitops/pkg/gitdir"
+	"github.com/weaveworks/libgitops/pkg/internal/testutil"
+	"github.com/weaveworks/libgitops/pkg/runtime"
+	"github.com/weaveworks/libgitops/pkg/storage"
+	"github.com/weaveworks/libgitops/pkg/storage/transaction"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var carKey = storage.NewObjectKey(
+	storage.NewKindKey(schema.GroupVersionKind{Group: "sample-app.weave.works", Version: "v1alpha1", Kind: "Car"}),
+	runtime.NewIdentifier("default/car"),
+)
+
+// carManifest returns the manifest of a car with the given color. The color is stored as
+// a label, as the storage is only read using GetMeta.
+func carManifest(color string) string {
+	return "apiVersion: sample-app.weave.works/v1alpha1\nkind: Car\nmetadata:\n  name: car\n  namespace: default\n  labels:\n    color: " + color + "\n"
+}
+
+// newTestGitStorage creates a GitStorage for a new bare repository containing a red car
+// and a README, using the local Provider for the repository
+func newTestGitStorage(t *testing.T) (transaction.TransactionStorage, gitdir.GitDirectory, *Provider, string) {
+	t.Helper()
+
+	bareDir, _ := testutil.NewBareRepo(t, map[string]string{"car.yaml": carManifest("red"), "README.md": "# Cars"})
+	gitDir, err := gitdir.NewGitDirectoryFromURL(bareDir, gitdir.GitDirectoryOptions{Interval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewLocalPRProvider(bareDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := transaction.NewGitStorage(gitDir, p, scheme.Serializer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, gitDir, p, bareDir
+}
+
+// paintCar returns a TransactionFunc painting the car in the given color
+func paintCar(color string) transaction.TransactionFunc {
+	return func(ctx context.Context, s storage.Storage) (transaction.CommitResult, error) {
+		if err := s.RawStorage().Write(carKey, []byte(carManifest(color))); err != nil {
+			return nil, err
+		}
+		return &transaction.GenericPullRequestResult{
+			CommitResult: &transaction.GenericCommitResult{
+				AuthorName:  "Jane",
+				AuthorEmail: "jane@example.com",
+				Title:       "Paint the car " + color,
+			},
+		}, nil
+	}
+}
+
+// colorOf returns the color of the car in the given storage
+func colorOf(t *testing.T, s storage.ReadStorage) string {
+	t.Helper()
+
+	obj, err := s.GetMeta(carKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return obj.GetLabels()["color"]
+}
+
+func TestGitStorage(t *testing.T) {
+	ctx := context.Background()
+	s, gitDir, p, bareDir := newTestGitStorage(t)
+	defer os.RemoveAll(bareDir)
+	defer func() { _ = gitDir.Cleanup() }()
+
+	result, err := s.Transaction(ctx, "paint-car-", paintCar("blue"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.PullRequest == nil || result.PullRequest.Number != 1 || result.PullRequest.MergeBranch != result.Branch {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	if got := readFile(t, bareDir, result.Branch, "car.yaml"); got != carManifest("blue") {
+		t.Errorf("unexpected car.yaml on branch %q: %q", result.Branch, got)
+	}
+
+	// The main branch is unchanged until the PR is merged
+	if color := colorOf(t, s); color != "red" {
+		t.Errorf("expected the car to be red before merging, got %q", color)
+	}
+	if _, err := p.MergePullRequest(ctx, result.PullRequest.Number, "Maintainer", "maintainer@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := gitDir.Pull(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if color := colorOf(t, s); color != "blue" {
+		t.Errorf("expected the car to be blue after merging, got %q", color)
+	}
+}
+
+// branchParent returns the SHA of the parent of the latest commit of the given branch
+func branchParent(t *testing.T, bareDir, branch string) string {
+	t.Helper()
+
+	repo, err := git.PlainOpen(bareDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := repo.Reference(plumbing.NewBranchReferenceName(branch), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := repo.CommitObject(ref.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c.ParentHashes[0].String()
+}
+
+func TestGitStoragePullRequestUpdate(t *testing.T) {
+	ctx := context.Background()
+	s, gitDir, p, bareDir := newTestGitStorage(t)
+	defer os.RemoveAll(bareDir)
+	defer func() { _ = gitDir.Cleanup() }()
+	master, err := p.branchCommit("master")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := s.Transaction(ctx, "paint-car-", paintCar("blue"), transaction.PullRequestUpdateAppend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.PullRequest == nil || first.PullRequest.Number != 1 {
+		t.Fatalf("unexpected result: %+v", first)
+	}
+
+	// The open PR of the stream is reused, a new commit is appended to its branch
+	second, err := s.Transaction(ctx, "paint-car-", paintCar("green"), transaction.PullRequestUpdateAppend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Branch != first.Branch || second.PullRequest == nil || second.PullRequest.Number != 1 {
+		t.Fatalf("expected PR #1 on branch %q to be reused, got %+v", first.Branch, second)
+	}
+	if got := readFile(t, bareDir, first.Branch, "car.yaml"); got != carManifest("green") {
+		t.Errorf("unexpected car.yaml after appending: %q", got)
+	}
+	if parent := branchParent(t, bareDir, first.Branch); parent == master.Hash.String() {
+		t.Error("expected the appended commit to be based on the earlier commit of the PR")
+	}
+
+	// Squashing replaces the commits of the PR with a single commit on top of the main branch
+	third, err := s.Transaction(ctx, "paint-car-", paintCar("yellow"), transaction.PullRequestUpdateSquash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third.Branch != first.Branch || third.PullRequest == nil || third.PullRequest.Number != 1 {
+		t.Fatalf("expected PR #1 on branch %q to be reused, got %+v", first.Branch, third)
+	}
+	if parent := branchParent(t, bareDir, first.Branch); parent != master.Hash.String() {
+		t.Errorf("expected the squashed commit to be based on %s, got %s", master.Hash, parent)
+	}
+
+	pr, err := p.GetPullRequest(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pr.Title != "Paint the car yellow" || len(p.ListPullRequests()) != 1 {
+		t.Errorf("expected PR #1 to be updated, got %+v", pr)
+	}
+	if _, err := p.MergePullRequest(ctx, pr.Number, "Maintainer", "maintainer@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := gitDir.Pull(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if color := colorOf(t, s); color != "yellow" {
+		t.Errorf("expected the car to be yellow after merging, got %q", color)
+	}
+}
+
+func TestGitStorageRevert(t *testing.T) {
+	ctx := context.Background()
+	s, gitDir, _, bareDir := newTestGitStorage(t)
+	defer os.RemoveAll(bareDir)
+	defer func() { _ = gitDir.Cleanup() }()
+
+	if _, err := s.Transaction(ctx, "paint-car-", paintCar("blue"), transaction.TransactionModeDirect); err != nil {
+		t.Fatal(err)
+	}
+	painted, err := gitDir.ResolveRevision("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the files changed by the reverted commit are committed
+	if err := ioutil.WriteFile(filepath.Join(gitDir.Dir(), "README.md"), []byte("# Boats"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	result := &transaction.GenericCommitResult{AuthorName: "Jane", AuthorEmail: "jane@example.com", Title: "Revert the paint job"}
+	if _, err := s.Revert(ctx, "revert-", painted, result, transaction.TransactionModeDirect); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, bareDir, "master", "car.yaml"); got != carManifest("red") {
+		t.Errorf("unexpected car.yaml after reverting: %q", got)
+	}
+	if got := readFile(t, bareDir, "master", "README.md"); got != "# Cars" {
+		t.Errorf("expected README.md not to be committed, got %q", got)
+	}
+}
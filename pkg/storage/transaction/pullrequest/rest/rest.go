@@ -0,0 +1,121 @@
+// Package rest contains the logic shared by the PullRequestProviders talking to the REST APIs of Git providers.
+package rest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/fluxcd/go-git-providers/gitprovider"
+	"github.com/weaveworks/libgitops/pkg/storage/transaction"
+)
+
+// maxErrorBody limits how much of the body of a failed response is included in an HTTPError
+const maxErrorBody = 1024
+
+// HTTPError is returned by Client.Do if the API responds with a non-2xx status code
+type HTTPError struct {
+	// Method and URL describe the failed request
+	Method string
+	URL    string
+	// StatusCode is the HTTP status code of the response
+	StatusCode int
+	// Body is the (truncated) body of the response
+	Body string
+}
+
+var _ error = &HTTPError{}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("%s %s failed with status %d: %s", e.Method, e.URL, e.StatusCode, e.Body)
+}
+
+// Client is a minimal JSON REST API client
+type Client struct {
+	// BaseURL is the URL the paths of the requests are relative to, e.g. "https://gitlab.com/api/v4"
+	BaseURL string
+	// HTTPClient is used to perform the requests, http.DefaultClient if nil
+	HTTPClient *http.Client
+	// Authorize adds the credentials to the requests, if set
+	Authorize func(req *http.Request)
+}
+
+// Do performs a request with the given method to the given path, relative to BaseURL, with the given
+// query parameters. If in is non-nil, it's encoded as the JSON body of the request. If out is non-nil,
+// the JSON body of the response is decoded into it. Non-2xx responses are returned as an *HTTPError.
+func (c *Client) Do(ctx context.Context, method, path string, query url.Values, in, out interface{}) error {
+	u := strings.TrimSuffix(c.BaseURL, "/") + path
+	if len(query) != 0 {
+		u += "?" + query.Encode()
+	}
+
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Authorize != nil {
+		c.Authorize(req)
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+		return &HTTPError{Method: method, URL: u, StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(b))}
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// BaseURL returns the given base URL if set, otherwise the HTTPS URL of the domain of the
+// given repository, with the given API path appended, e.g. "https://gitlab.com/api/v4"
+func BaseURL(baseURL string, ref gitprovider.RepositoryRef, apiPath string) string {
+	if len(baseURL) == 0 {
+		baseURL = "https://" + ref.GetDomain()
+	}
+	return strings.TrimSuffix(baseURL, "/") + apiPath
+}
+
+// RepositoryPath returns the slash-separated path of the repository, e.g. "weaveworks/libgitops"
+func RepositoryPath(ref gitprovider.RepositoryRef) string {
+	return ref.GetIdentity() + "/" + ref.GetRepository()
+}
+
+// DraftTitle prefixes the title of the PR with the given prefix, if a draft is asked for
+func DraftTitle(spec transaction.PullRequestSpec, prefix string) string {
+	if transaction.IsDraft(spec) && !strings.HasPrefix(spec.GetTitle(), prefix) {
+		return prefix + " " + spec.GetTitle()
+	}
+	return spec.GetTitle()
+}
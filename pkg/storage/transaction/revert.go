@@ -0,0 +1,50 @@
+package transaction
+
+import (
+	"context"
+	"errors"
+
+	"github.com/weaveworks/libgitops/pkg/storage"
+)
+
+// Revert creates a new transaction, which reverts the changes of the given commit, e.g. the commit
+// of an earlier transaction. Only the files changed by the commit are committed. The result is used
+// to commit the revert, and to create a PR if it's a PullRequestResult. If later commits changed the
+// same files, a *ConflictError wrapping the *gitdir.ConflictError is returned.
+func (s *GitStorage) Revert(ctx context.Context, streamName, commit string, result CommitResult, opts ...TransactionOption) (*TransactionResult, error) {
+	return s.transaction(ctx, streamName, makeTransactionOptions(opts...), func(context.Context) (*transactionResult, error) {
+		paths, err := s.gitDir.Revert(commit)
+		if err != nil {
+			return nil, s.conflictError(err)
+		}
+		return &transactionResult{result: result, paths: paths}, nil
+	})
+}
+
+// Restore creates a new transaction, which restores the objects with the given keys to their state
+// at the given revision. Objects that didn't exist at the revision are deleted. The result is used
+// to commit the change, and to create a PR if it's a PullRequestResult.
+func (s *GitStorage) Restore(ctx context.Context, streamName, rev string, keys []storage.ObjectKey, result CommitResult, opts ...TransactionOption) (*TransactionResult, error) {
+	// Look up the files before the transaction, as the GitDirectory is suspended during it
+	paths := make([]string, 0, len(keys))
+	for _, key := range keys {
+		path, _, err := s.findAt(rev, key)
+		if err == nil {
+			paths = append(paths, path)
+		} else if !errors.Is(err, ErrObjectNotFound) {
+			return nil, err
+		}
+
+		// The object may have been moved to another file since the revision
+		if current, ok := s.currentPath(key); ok && current != path {
+			paths = append(paths, current)
+		}
+	}
+
+	return s.transaction(ctx, streamName, makeTransactionOptions(opts...), func(context.Context) (*transactionResult, error) {
+		if err := s.gitDir.Restore(rev, paths); err != nil {
+			return nil, err
+		}
+		return &transactionResult{result: result, paths: paths}, nil
+	})
+}
@@ -15,6 +15,15 @@ var (
 
 type TransactionFunc func(ctx context.Context, s storage.Storage) (CommitResult, error)
 
+// TransactionResult describes where the changes of a transaction were published
+type TransactionResult struct {
+	// Branch is the branch the changes were committed to
+	Branch string
+	// PullRequest identifies the PR created or updated for the changes, if any. It's only
+	// known if the PullRequestProvider is a PullRequestUpdater.
+	PullRequest *PullRequestInfo
+}
+
 type TransactionStorage interface {
 	storage.ReadStorage
 
@@ -23,6 +32,17 @@ type TransactionStorage interface {
 	// The environment is made sure to be as up-to-date as possible before fn executes. When
 	// fn executes, the given storage can be used to modify the desired state. If you want to
 	// "commit" the changes made in fn, just return nil. If you want to abort, return ErrAbortTransaction.
-	// If you want to
-	Transaction(ctx context.Context, streamName string, fn TransactionFunc) error
+	// Only the files written and deleted using the given storage are committed.
+	// If the commit can't be pushed, as new remote commits changed the same objects, a *ConflictError is returned.
+	// The options select the TransactionMode, e.g. to commit directly to the main branch, or to never create a PR,
+	// and whether the open PR of the stream is updated instead of creating a new branch and PR, see PullRequestUpdate.
+	// The returned result describes the branch and PR the changes were published to.
+	Transaction(ctx context.Context, streamName string, fn TransactionFunc, opts ...TransactionOption) (*TransactionResult, error)
+	// Revert reverts the changes of the given commit (e.g. of an earlier transaction) in a new
+	// transaction with the given stream name, which is committed using the given result.
+	// If later commits changed the same objects, a *ConflictError is returned.
+	Revert(ctx context.Context, streamName, commit string, result CommitResult, opts ...TransactionOption) (*TransactionResult, error)
+	// Restore restores the objects with the given keys to their state at the given revision in
+	// a new transaction with the given stream name, which is committed using the given result.
+	Restore(ctx context.Context, streamName, rev string, keys []storage.ObjectKey, result CommitResult, opts ...TransactionOption) (*TransactionResult, error)
 }
@@ -0,0 +1,125 @@
+package transaction
+
+import (
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/weaveworks/libgitops/pkg/storage"
+	"github.com/weaveworks/libgitops/pkg/storage/watch/update"
+)
+
+// newTrackingRawStorage creates a trackingRawStorage recording the files written and deleted through raw
+func newTrackingRawStorage(raw storage.MappedRawStorage, dir string) *trackingRawStorage {
+	return &trackingRawStorage{
+		MappedRawStorage: raw,
+		dir:              dir,
+		paths:            make(map[string]struct{}),
+		changes:          make(map[storage.ObjectKey]ObjectChange),
+	}
+}
+
+// trackingRawStorage is a MappedRawStorage recording the files written and deleted through it,
+// so a transaction only commits the files changed using the Storage passed to it
+type trackingRawStorage struct {
+	storage.MappedRawStorage
+
+	dir     string
+	paths   map[string]struct{}
+	changes map[storage.ObjectKey]ObjectChange
+	mux     sync.Mutex
+}
+
+func (r *trackingRawStorage) Write(key storage.ObjectKey, content []byte) error {
+	event := update.ObjectEventModify
+	if !r.Exists(key) {
+		event = update.ObjectEventCreate
+	}
+
+	file, ok := r.GetMappings()[key]
+	if err := r.MappedRawStorage.Write(key, content); err != nil {
+		return err
+	}
+
+	// The file may have been mapped by the write
+	if !ok {
+		file, ok = r.GetMappings()[key]
+	}
+	if ok {
+		r.track(key, file, event)
+	}
+	return nil
+}
+
+func (r *trackingRawStorage) Delete(key storage.ObjectKey) error {
+	// Look up the file first, as the mapping is removed by the delete
+	file, ok := r.GetMappings()[key]
+	if err := r.MappedRawStorage.Delete(key); err != nil {
+		return err
+	}
+
+	if ok {
+		r.track(key, file, update.ObjectEventDelete)
+	}
+	return nil
+}
+
+func (r *trackingRawStorage) track(key storage.ObjectKey, file string, event update.ObjectEvent) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.paths[file] = struct{}{}
+
+	// Combine the event with the earlier changes of the object in the transaction
+	if earlier, ok := r.changes[key]; ok {
+		switch {
+		case earlier.Event == update.ObjectEventCreate && event == update.ObjectEventDelete:
+			delete(r.changes, key)
+			return
+		case earlier.Event == update.ObjectEventCreate:
+			event = update.ObjectEventCreate
+		case earlier.Event == update.ObjectEventDelete && event == update.ObjectEventCreate:
+			event = update.ObjectEventModify
+		}
+	}
+
+	rel, err := filepath.Rel(r.dir, file)
+	if err != nil {
+		rel = file
+	}
+	r.changes[key] = ObjectChange{Key: key, Event: event, Path: filepath.ToSlash(rel)}
+}
+
+// Paths returns the sorted slash-separated paths of the written and deleted files, relative to dir
+func (r *trackingRawStorage) Paths() ([]string, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	paths := make([]string, 0, len(r.paths))
+	for file := range r.paths {
+		rel, err := filepath.Rel(r.dir, file)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, filepath.ToSlash(rel))
+	}
+
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// Changes returns the changes of the objects written and deleted, sorted by path. The diffs
+// aren't set. Objects that were created and deleted again aren't included.
+func (r *trackingRawStorage) Changes() []ObjectChange {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	changes := make([]ObjectChange, 0, len(r.changes))
+	for _, change := range r.changes {
+		changes = append(changes, change)
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes
+}
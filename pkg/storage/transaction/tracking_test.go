@@ -0,0 +1,70 @@
+package transaction
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/weaveworks/libgitops/pkg/runtime"
+	"github.com/weaveworks/libgitops/pkg/storage"
+	"github.com/weaveworks/libgitops/pkg/storage/watch/update"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestTrackingRawStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "libgitops-tracking")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	kind := storage.NewKindKey(schema.GroupVersionKind{Group: "sample", Version: "v1", Kind: "Car"})
+	created := storage.NewObjectKey(kind, runtime.NewIdentifier("created"))
+	modified := storage.NewObjectKey(kind, runtime.NewIdentifier("modified"))
+	deleted := storage.NewObjectKey(kind, runtime.NewIdentifier("deleted"))
+	temporary := storage.NewObjectKey(kind, runtime.NewIdentifier("temporary"))
+
+	raw := storage.NewGenericMappedRawStorage(dir)
+	for key, file := range map[storage.ObjectKey]string{created: "created.yaml", modified: "modified.yaml", deleted: "sub/deleted.yaml", temporary: "temporary.yaml"} {
+		raw.AddMapping(key, filepath.Join(dir, filepath.FromSlash(file)))
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{"modified.yaml", "sub/deleted.yaml"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, filepath.FromSlash(file)), []byte("kind: Car"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tracking := newTrackingRawStorage(raw, dir)
+	for _, key := range []storage.ObjectKey{created, created, modified, temporary} {
+		if err := tracking.Write(key, []byte("kind: Car")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, key := range []storage.ObjectKey{deleted, temporary} {
+		if err := tracking.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	paths, err := tracking.Paths()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"created.yaml", "modified.yaml", "sub/deleted.yaml", "temporary.yaml"}; !reflect.DeepEqual(paths, expected) {
+		t.Errorf("expected paths %v, got %v", expected, paths)
+	}
+
+	expected := []ObjectChange{
+		{Key: created, Event: update.ObjectEventCreate, Path: "created.yaml"},
+		{Key: modified, Event: update.ObjectEventModify, Path: "modified.yaml"},
+		{Key: deleted, Event: update.ObjectEventDelete, Path: "sub/deleted.yaml"},
+	}
+	if changes := tracking.Changes(); !reflect.DeepEqual(changes, expected) {
+		t.Errorf("expected changes %v, got %v", expected, changes)
+	}
+}
@@ -2,6 +2,9 @@ package watch
 
 import (
 	"io/ioutil"
+	"sort"
+	gosync "sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/weaveworks/libgitops/pkg/runtime"
@@ -34,13 +37,46 @@ func NewManifestStorage(manifestDir string, ser serializer.Serializer) (update.E
 // Note: This WatchStorage only works for one-frame files (i.e. only one YAML document
 // per file is supported).
 func NewGenericWatchStorage(s storage.Storage) (update.EventStorage, error) {
+	return NewGenericWatchStorageWithOptions(s, DefaultOptions())
+}
+
+// Options specifies options for the GenericWatchStorage
+type Options struct {
+	// WatcherOptions specifies the options for the underlying FileWatcher,
+	// e.g. whether to use inotify or polling for detecting changes
+	WatcherOptions watcher.Options
+	// ResyncInterval specifies how often the watched directory should be fully
+	// re-walked to detect changes missed by the FileWatcher (e.g. if events were
+	// dropped). Zero disables the periodic resync.
+	ResyncInterval time.Duration
+	// ResyncModifyAll specifies whether a MODIFY event should be sent for every
+	// object on resync, and not only for the changed ones. This is similar to
+	// informer resyncs, and allows listeners to periodically re-reconcile.
+	ResyncModifyAll bool
+}
+
+// DefaultOptions returns the default options
+func DefaultOptions() Options {
+	return Options{
+		WatcherOptions: watcher.DefaultOptions(),
+	}
+}
+
+// NewGenericWatchStorageWithOptions is like NewGenericWatchStorage,
+// but allows customizing the behavior using the given Options.
+func NewGenericWatchStorageWithOptions(s storage.Storage, opts Options) (update.EventStorage, error) {
 	ws := &GenericWatchStorage{
-		Storage: s,
+		Storage:     s,
+		opts:        opts,
+		checksums:   make(map[storage.ObjectKey]string),
+		checksumMux: &gosync.Mutex{},
+		invalid:     make(map[string]*update.FileError),
+		invalidMux:  &gosync.Mutex{},
 	}
 
 	var err error
 	var files []string
-	if ws.watcher, files, err = watcher.NewFileWatcher(s.RawStorage().WatchDir()); err != nil {
+	if ws.watcher, files, err = watcher.NewFileWatcherWithOptions(s.RawStorage().WatchDir(), opts.WatcherOptions); err != nil {
 		return nil, err
 	}
 
@@ -61,6 +97,16 @@ type GenericWatchStorage struct {
 	watcher *watcher.FileWatcher
 	events  update.UpdateStream
 	monitor *sync.Monitor
+	opts    Options
+	// checksums holds the last known checksum of every object, it
+	// is used to detect drift between the disk and the mappings
+	checksums   map[storage.ObjectKey]string
+	checksumMux *gosync.Mutex
+	// errors is the stream for files that couldn't be processed, and invalid
+	// holds the last error for every file that's currently known to be invalid
+	errors     update.ErrorStream
+	invalid    map[string]*update.FileError
+	invalidMux *gosync.Mutex
 }
 
 var _ update.EventStorage = &GenericWatchStorage{}
@@ -68,31 +114,71 @@ var _ update.EventStorage = &GenericWatchStorage{}
 // Suspend modify events during Create
 func (s *GenericWatchStorage) Create(obj runtime.Object) error {
 	s.watcher.Suspend(watcher.FileEventModify)
-	return s.Storage.Create(obj)
+	if err := s.Storage.Create(obj); err != nil {
+		return err
+	}
+
+	s.recordObjectChecksum(obj)
+	return nil
 }
 
 // Suspend modify events during Update
 func (s *GenericWatchStorage) Update(obj runtime.Object) error {
 	s.watcher.Suspend(watcher.FileEventModify)
-	return s.Storage.Update(obj)
+	if err := s.Storage.Update(obj); err != nil {
+		return err
+	}
+
+	s.recordObjectChecksum(obj)
+	return nil
 }
 
 // Suspend modify events during Patch
 func (s *GenericWatchStorage) Patch(key storage.ObjectKey, patch []byte) error {
 	s.watcher.Suspend(watcher.FileEventModify)
-	return s.Storage.Patch(key, patch)
+	if err := s.Storage.Patch(key, patch); err != nil {
+		return err
+	}
+
+	s.recordChecksum(s.RawStorage(), key)
+	return nil
 }
 
 // Suspend delete events during Delete
 func (s *GenericWatchStorage) Delete(key storage.ObjectKey) error {
 	s.watcher.Suspend(watcher.FileEventDelete)
-	return s.Storage.Delete(key)
+	if err := s.Storage.Delete(key); err != nil {
+		return err
+	}
+
+	s.forgetChecksum(key)
+	return nil
 }
 
 func (s *GenericWatchStorage) SetUpdateStream(eventStream update.UpdateStream) {
 	s.events = eventStream
 }
 
+func (s *GenericWatchStorage) SetErrorStream(errorStream update.ErrorStream) {
+	s.errors = errorStream
+}
+
+// InvalidFiles returns the errors of all files which are currently known to be
+// invalid, i.e. files that couldn't be read or decoded, sorted by path.
+func (s *GenericWatchStorage) InvalidFiles() []*update.FileError {
+	s.invalidMux.Lock()
+	defer s.invalidMux.Unlock()
+	result := make([]*update.FileError, 0, len(s.invalid))
+	for _, fileErr := range s.invalid {
+		result = append(result, fileErr)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Path < result[j].Path
+	})
+	return result
+}
+
 func (s *GenericWatchStorage) Close() error {
 	s.watcher.Close()
 	s.monitor.Wait()
@@ -102,105 +188,186 @@ func (s *GenericWatchStorage) Close() error {
 func (s *GenericWatchStorage) monitorFunc(raw storage.RawStorage, files []string) {
 	log.Debug("GenericWatchStorage: Monitoring thread started")
 	defer log.Debug("GenericWatchStorage: Monitoring thread stopped")
-	var content []byte
 
 	// Send a MODIFY event for all files (and fill the mappings
 	// of the MappedRawStorage) before starting to monitor changes
 	for _, file := range files {
-		content, err := ioutil.ReadFile(file)
+		obj, err := s.readFile(raw, file)
 		if err != nil {
-			log.Warnf("Ignoring %q: %v", file, err)
-			continue
-		}
-
-		obj, err := runtime.NewPartialObject(content)
-		if err != nil {
-			log.Warnf("Ignoring %q: %v", file, err)
 			continue
 		}
 
 		// Add a mapping between this object and path
-		s.addMapping(raw, obj, file)
+		key := s.addMapping(raw, obj, file)
+		s.recordChecksum(raw, key)
 		// Send the event to the events channel
 		s.sendEvent(update.ObjectEventModify, obj)
 	}
 
+	// A nil channel blocks forever, which disables the periodic resync
+	var resyncC <-chan time.Time
+	if s.opts.ResyncInterval > 0 {
+		ticker := time.NewTicker(s.opts.ResyncInterval)
+		defer ticker.Stop()
+		resyncC = ticker.C
+	}
+
 	for {
-		if event, ok := <-s.watcher.GetFileUpdateStream(); ok {
-			var partObj runtime.PartialObject
-			var err error
-
-			var objectEvent update.ObjectEvent
-			switch event.Event {
-			case watcher.FileEventModify:
-				objectEvent = update.ObjectEventModify
-			case watcher.FileEventDelete:
-				objectEvent = update.ObjectEventDelete
+		select {
+		case event, ok := <-s.watcher.GetFileUpdateStream():
+			if !ok {
+				return
 			}
 
-			log.Tracef("GenericWatchStorage: Processing event: %s", event.Event)
-			if event.Event == watcher.FileEventDelete {
-				key, err := raw.GetKey(event.Path)
-				if err != nil {
-					log.Warnf("Failed to retrieve data for %q: %v", event.Path, err)
-					continue
-				}
-
-				// This creates a "fake" Object from the key to be used for
-				// deletion, as the original has already been removed from disk
-				apiVersion, kind := key.GetGVK().ToAPIVersionAndKind()
-				partObj = &runtime.PartialObjectImpl{
-					TypeMeta: metav1.TypeMeta{
-						APIVersion: apiVersion,
-						Kind:       kind,
-					},
-					ObjectMeta: metav1.ObjectMeta{
-						Name: EventDeleteObjectName,
-						// TODO: This doesn't take into account where e.g. the identifier is "{namespace}/{name}"
-						UID: types.UID(key.GetIdentifier()),
-					},
-				}
-				// remove the mapping for this key as it's now deleted
-				s.removeMapping(raw, key)
-			} else {
-				content, err = ioutil.ReadFile(event.Path)
-				if err != nil {
-					log.Warnf("Ignoring %q: %v", event.Path, err)
-					continue
-				}
-
-				if partObj, err = runtime.NewPartialObject(content); err != nil {
-					log.Warnf("Ignoring %q: %v", event.Path, err)
-					continue
-				}
-
-				if event.Event == watcher.FileEventMove {
-					// Update the mappings for the moved file (AddMapping overwrites)
-					s.addMapping(raw, partObj, event.Path)
-
-					// Internal move events are a no-op
-					continue
-				}
-
-				// This is based on the key's existence instead of watcher.EventCreate,
-				// as Objects can get updated (via watcher.FileEventModify) to be conformant
-				if _, err = raw.GetKey(event.Path); err != nil {
-					// Add a mapping between this object and path
-					s.addMapping(raw, partObj, event.Path)
-
-					// This is what actually determines if an Object is created,
-					// so update the event to update.ObjectEventCreate here
-					objectEvent = update.ObjectEventCreate
-				}
-			}
+			s.handleFileUpdate(raw, event)
+		case <-resyncC:
+			s.resync(raw)
+		}
+	}
+}
 
-			// Send the objectEvent to the events channel
-			if objectEvent != update.ObjectEventNone {
-				s.sendEvent(objectEvent, partObj)
-			}
-		} else {
+func (s *GenericWatchStorage) handleFileUpdate(raw storage.RawStorage, event *watcher.FileUpdate) {
+	var partObj runtime.PartialObject
+	var err error
+
+	var objectEvent update.ObjectEvent
+	switch event.Event {
+	case watcher.FileEventModify:
+		objectEvent = update.ObjectEventModify
+	case watcher.FileEventDelete:
+		objectEvent = update.ObjectEventDelete
+	}
+
+	log.Tracef("GenericWatchStorage: Processing event: %s", event.Event)
+	if event.Event == watcher.FileEventDelete {
+		// The file doesn't exist anymore, so it can't be invalid either
+		s.clearError(event.Path)
+
+		key, err := raw.GetKey(event.Path)
+		if err != nil {
+			log.Warnf("Failed to retrieve data for %q: %v", event.Path, err)
 			return
 		}
+
+		// This creates a "fake" Object from the key to be used for
+		// deletion, as the original has already been removed from disk
+		partObj = NewDeletedObject(key)
+		// remove the mapping for this key as it's now deleted
+		s.removeMapping(raw, key)
+		s.forgetChecksum(key)
+	} else {
+		if partObj, err = s.readFile(raw, event.Path); err != nil {
+			return
+		}
+
+		if event.Event == watcher.FileEventMove {
+			// Update the mappings for the moved file (AddMapping overwrites)
+			key := s.addMapping(raw, partObj, event.Path)
+			s.recordChecksum(raw, key)
+
+			// Internal move events are a no-op
+			return
+		}
+
+		// This is based on the key's existence instead of watcher.EventCreate,
+		// as Objects can get updated (via watcher.FileEventModify) to be conformant
+		if _, err = raw.GetKey(event.Path); err != nil {
+			// Add a mapping between this object and path
+			s.addMapping(raw, partObj, event.Path)
+
+			// This is what actually determines if an Object is created,
+			// so update the event to update.ObjectEventCreate here
+			objectEvent = update.ObjectEventCreate
+		}
+
+		s.recordObjectChecksum(partObj)
+	}
+
+	// Send the objectEvent to the events channel
+	if objectEvent != update.ObjectEventNone {
+		s.sendEvent(objectEvent, partObj)
+	}
+}
+
+// resync re-walks the watched directory and compares the result with the known
+// state, to recover from events dropped by the FileWatcher. Synthetic events are
+// sent for any discrepancies found, and if opts.ResyncModifyAll is set, a MODIFY
+// event is sent for every unchanged object as well.
+func (s *GenericWatchStorage) resync(raw storage.RawStorage) {
+	log.Debug("GenericWatchStorage: Starting resync")
+	files, err := s.watcher.ListFiles()
+	if err != nil {
+		log.Errorf("GenericWatchStorage: Resync failed: %v", err)
+		return
+	}
+
+	var mappings map[storage.ObjectKey]string
+	if mapped, ok := raw.(storage.MappedRawStorage); ok {
+		mappings = mapped.GetMappings()
+	}
+
+	found := make(map[storage.ObjectKey]bool, len(files))
+	foundFiles := make(map[string]bool, len(files))
+	for _, file := range files {
+		foundFiles[file] = true
+		obj, err := s.readFile(raw, file)
+		if err != nil {
+			// The error has been reported by readFile. Like on the event path, an object
+			// whose file became invalid keeps its mapping until the file is deleted.
+			if key, keyErr := raw.GetKey(file); keyErr == nil {
+				found[key] = true
+			}
+			continue
+		}
+
+		key, err := s.Storage.ObjectKeyFor(obj)
+		if err != nil {
+			continue
+		}
+		found[key] = true
+
+		// Make sure the mapping points to the file the object is currently stored in
+		if mappings != nil && mappings[key] != file {
+			s.addMapping(raw, obj, file)
+		}
+
+		checksum, err := raw.Checksum(key)
+		if err != nil {
+			log.Warnf("Failed to get checksum for %q: %v", file, err)
+			continue
+		}
+
+		objectEvent := update.ObjectEventNone
+		if known, ok := s.getChecksum(key); !ok {
+			objectEvent = update.ObjectEventCreate
+		} else if known != checksum || s.opts.ResyncModifyAll {
+			objectEvent = update.ObjectEventModify
+		}
+
+		s.setChecksum(key, checksum)
+		if objectEvent != update.ObjectEventNone {
+			log.Debugf("GenericWatchStorage: Resync detected %s for %q", objectEvent, file)
+			s.sendEvent(objectEvent, obj)
+		}
+	}
+
+	// Files that don't exist anymore can't be invalid either
+	for _, fileErr := range s.InvalidFiles() {
+		if !foundFiles[fileErr.Path] {
+			s.clearError(fileErr.Path)
+		}
+	}
+
+	// Objects which are known, but weren't found on disk have been deleted
+	for _, key := range s.knownKeys() {
+		if found[key] {
+			continue
+		}
+
+		log.Debugf("GenericWatchStorage: Resync detected %s for %s", update.ObjectEventDelete, key)
+		s.removeMapping(raw, key)
+		s.forgetChecksum(key)
+		s.sendEvent(update.ObjectEventDelete, NewDeletedObject(key))
 	}
 }
 
@@ -217,20 +384,19 @@ func (s *GenericWatchStorage) sendEvent(event update.ObjectEvent, partObj runtim
 
 // addMapping registers a mapping between the given object and the specified path, if raw is a
 // MappedRawStorage. If a given mapping already exists between this object and some path, it
-// will be overridden with the specified new path
-func (s *GenericWatchStorage) addMapping(raw storage.RawStorage, obj runtime.Object, file string) {
-	mapped, ok := raw.(storage.MappedRawStorage)
-	if !ok {
-		return
-	}
-
+// will be overridden with the specified new path. The key of the object is returned.
+func (s *GenericWatchStorage) addMapping(raw storage.RawStorage, obj runtime.Object, file string) storage.ObjectKey {
 	// Let the embedded storage decide using its identifiers how to
 	key, err := s.Storage.ObjectKeyFor(obj)
 	if err != nil {
 		log.Errorf("couldn't get object key for: gvk=%s, uid=%s, name=%s", obj.GetObjectKind().GroupVersionKind(), obj.GetUID(), obj.GetName())
 	}
 
-	mapped.AddMapping(key, file)
+	if mapped, ok := raw.(storage.MappedRawStorage); ok {
+		mapped.AddMapping(key, file)
+	}
+
+	return key
 }
 
 // removeMapping removes a mapping a file that doesn't exist
@@ -242,3 +408,134 @@ func (s *GenericWatchStorage) removeMapping(raw storage.RawStorage, key storage.
 
 	mapped.RemoveMapping(key)
 }
+
+// recordObjectChecksum records the current checksum of the given object
+func (s *GenericWatchStorage) recordObjectChecksum(obj runtime.Object) {
+	key, err := s.Storage.ObjectKeyFor(obj)
+	if err != nil {
+		return
+	}
+
+	s.recordChecksum(s.RawStorage(), key)
+}
+
+// recordChecksum records the current checksum of the object with the given key
+func (s *GenericWatchStorage) recordChecksum(raw storage.RawStorage, key storage.ObjectKey) {
+	if key == nil {
+		return
+	}
+
+	checksum, err := raw.Checksum(key)
+	if err != nil {
+		log.Debugf("GenericWatchStorage: Failed to get checksum for %s: %v", key, err)
+		return
+	}
+
+	s.setChecksum(key, checksum)
+}
+
+func (s *GenericWatchStorage) getChecksum(key storage.ObjectKey) (checksum string, ok bool) {
+	s.checksumMux.Lock()
+	defer s.checksumMux.Unlock()
+	checksum, ok = s.checksums[key]
+	return
+}
+
+func (s *GenericWatchStorage) setChecksum(key storage.ObjectKey, checksum string) {
+	s.checksumMux.Lock()
+	defer s.checksumMux.Unlock()
+	s.checksums[key] = checksum
+}
+
+func (s *GenericWatchStorage) forgetChecksum(key storage.ObjectKey) {
+	s.checksumMux.Lock()
+	defer s.checksumMux.Unlock()
+	delete(s.checksums, key)
+}
+
+func (s *GenericWatchStorage) knownKeys() []storage.ObjectKey {
+	s.checksumMux.Lock()
+	defer s.checksumMux.Unlock()
+	keys := make([]storage.ObjectKey, 0, len(s.checksums))
+	for key := range s.checksums {
+		keys = append(keys, key)
+	}
+
+	return keys
+}
+
+// readFile reads the given file, and decodes its metadata. If the file can't be read,
+// decoded or identified, the error is reported and returned. Otherwise any earlier
+// reported error for the file is cleared.
+func (s *GenericWatchStorage) readFile(raw storage.RawStorage, file string) (runtime.PartialObject, error) {
+	obj, err := readPartialObject(file)
+	if err == nil {
+		_, err = s.Storage.ObjectKeyFor(obj)
+	}
+
+	if err != nil {
+		// Include the key of the object if the file was valid earlier
+		var key storage.ObjectKey
+		if k, keyErr := raw.GetKey(file); keyErr == nil {
+			key = k
+		}
+
+		s.reportError(update.NewFileError(file, key, err))
+		return nil, err
+	}
+
+	s.clearError(file)
+	return obj, nil
+}
+
+// reportError registers the given file as invalid, and sends the error to the
+// error stream unless the channel is full, in which case it's dropped.
+func (s *GenericWatchStorage) reportError(fileErr *update.FileError) {
+	log.Warnf("Ignoring %v", fileErr)
+	s.invalidMux.Lock()
+	s.invalid[fileErr.Path] = fileErr
+	s.invalidMux.Unlock()
+
+	if s.errors != nil {
+		select {
+		case s.errors <- fileErr:
+		default:
+			log.Warn("GenericWatchStorage: Failed to send error, channel full")
+		}
+	}
+}
+
+// clearError unregisters the given file as invalid
+func (s *GenericWatchStorage) clearError(file string) {
+	s.invalidMux.Lock()
+	delete(s.invalid, file)
+	s.invalidMux.Unlock()
+}
+
+// readPartialObject reads the given file, and decodes its metadata
+func readPartialObject(file string) (runtime.PartialObject, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return runtime.NewPartialObject(content)
+}
+
+// NewDeletedObject creates a "fake" Object from the key to be used for deletion
+// events, as the original has already been removed from disk. Its name is
+// EventDeleteObjectName, and the identifier of the key is stored in its UID.
+func NewDeletedObject(key storage.ObjectKey) runtime.PartialObject {
+	apiVersion, kind := key.GetGVK().ToAPIVersionAndKind()
+	return &runtime.PartialObjectImpl{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: apiVersion,
+			Kind:       kind,
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name: EventDeleteObjectName,
+			// TODO: This doesn't take into account where e.g. the identifier is "{namespace}/{name}"
+			UID: types.UID(key.GetIdentifier()),
+		},
+	}
+}
@@ -0,0 +1,207 @@
+package watch
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/weaveworks/libgitops/pkg/runtime"
+	"github.com/weaveworks/libgitops/pkg/storage"
+	"github.com/weaveworks/libgitops/pkg/storage/watch/update"
+	"github.com/weaveworks/libgitops/pkg/util/watcher"
+)
+
+const (
+	validCar = `apiVersion: sample/v1
+kind: Car
+metadata:
+  name: car
+  namespace: default
+`
+	modifiedCar = validCar + "spec:\n  color: red\n"
+	invalidCar  = "apiVersion: sample/v1\nkind: [Car\n"
+	// unchanged leaves the file as it is
+	unchanged = "<unchanged>"
+)
+
+// newTestStorage creates a GenericWatchStorage for an empty temporary directory. The FileWatcher
+// polls so rarely that it never sends updates, so the tests drive the storage themselves.
+func newTestStorage(t *testing.T) (*GenericWatchStorage, string, update.UpdateStream, update.ErrorStream) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "libgitops-watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := DefaultOptions()
+	opts.WatcherOptions.Mode = watcher.WatchModePoll
+	opts.WatcherOptions.PollInterval = time.Hour
+	raw := storage.NewGenericMappedRawStorage(dir)
+	es, err := NewGenericWatchStorageWithOptions(storage.NewGenericStorage(raw, nil, []runtime.IdentifierFactory{runtime.Metav1NameIdentifier}), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := make(update.UpdateStream, 10)
+	errors := make(update.ErrorStream, 10)
+	s := es.(*GenericWatchStorage)
+	s.SetUpdateStream(events)
+	s.SetErrorStream(errors)
+	return s, dir, events, errors
+}
+
+// writeFile writes the given content to the file, or removes it if the content is empty. The
+// modification time is set explicitly, as it's used as the checksum of the file.
+func writeFile(t *testing.T, file, content string, modTime time.Time) {
+	t.Helper()
+
+	if len(content) == 0 {
+		if err := os.Remove(file); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(file, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// receiveEvent returns the event sent to the stream, or ObjectEventNone if there's none
+func receiveEvent(events update.UpdateStream) update.ObjectEvent {
+	select {
+	case upd := <-events:
+		return upd.Event
+	default:
+		return update.ObjectEventNone
+	}
+}
+
+func TestResync(t *testing.T) {
+	s, dir, events, _ := newTestStorage(t)
+	defer os.RemoveAll(dir)
+	defer s.Close()
+
+	raw := s.RawStorage()
+	file := filepath.Join(dir, "car.yaml")
+	modTime := time.Now()
+	tests := []struct {
+		name    string
+		content string
+		event   update.ObjectEvent
+		mapped  bool
+		invalid bool
+	}{
+		{"missed create", validCar, update.ObjectEventCreate, true, false},
+		{"unchanged", unchanged, update.ObjectEventNone, true, false},
+		{"missed modify", modifiedCar, update.ObjectEventModify, true, false},
+		{"invalid file keeps mapping", invalidCar, update.ObjectEventNone, true, true},
+		{"still invalid", unchanged, update.ObjectEventNone, true, true},
+		{"fixed file", validCar, update.ObjectEventModify, true, false},
+		{"missed delete", "", update.ObjectEventDelete, false, false},
+	}
+	for _, tt := range tests {
+		if tt.content != unchanged {
+			modTime = modTime.Add(time.Second)
+			writeFile(t, file, tt.content, modTime)
+		}
+
+		s.resync(raw)
+		if event := receiveEvent(events); event != tt.event {
+			t.Errorf("%s: expected %s, got %s", tt.name, tt.event, event)
+		}
+		if event := receiveEvent(events); event != update.ObjectEventNone {
+			t.Errorf("%s: unexpected extra event %s", tt.name, event)
+		}
+		if _, err := raw.GetKey(file); (err == nil) != tt.mapped {
+			t.Errorf("%s: expected mapped=%t, got error %v", tt.name, tt.mapped, err)
+		}
+		if invalid := len(s.InvalidFiles()) == 1; invalid != tt.invalid {
+			t.Errorf("%s: expected invalid=%t, got %v", tt.name, tt.invalid, s.InvalidFiles())
+		}
+	}
+}
+
+func TestResyncModifyAll(t *testing.T) {
+	s, dir, events, _ := newTestStorage(t)
+	defer os.RemoveAll(dir)
+	defer s.Close()
+
+	s.opts.ResyncModifyAll = true
+	writeFile(t, filepath.Join(dir, "car.yaml"), validCar, time.Now())
+	for _, expected := range []update.ObjectEvent{update.ObjectEventCreate, update.ObjectEventModify, update.ObjectEventModify} {
+		s.resync(s.RawStorage())
+		if event := receiveEvent(events); event != expected {
+			t.Errorf("expected %s, got %s", expected, event)
+		}
+	}
+}
+
+func TestInvalidFiles(t *testing.T) {
+	s, dir, events, errors := newTestStorage(t)
+	defer os.RemoveAll(dir)
+	defer s.Close()
+
+	raw := s.RawStorage()
+	car := filepath.Join(dir, "car.yaml")
+	bike := filepath.Join(dir, "bike.yaml")
+	tests := []struct {
+		name     string
+		file     string
+		content  string
+		event    update.ObjectEvent
+		reported bool
+		withKey  bool
+		invalid  []string
+	}{
+		{"valid file", car, validCar, update.ObjectEventCreate, false, false, nil},
+		{"file becomes invalid", car, invalidCar, update.ObjectEventNone, true, true, []string{car}},
+		{"never valid file", bike, invalidCar, update.ObjectEventNone, true, false, []string{bike, car}},
+		{"fixed file", car, modifiedCar, update.ObjectEventModify, false, false, []string{bike}},
+		{"invalid again", car, invalidCar, update.ObjectEventNone, true, true, []string{bike, car}},
+		{"deleted invalid file", car, "", update.ObjectEventDelete, false, false, []string{bike}},
+		{"deleted never valid file", bike, "", update.ObjectEventNone, false, false, nil},
+	}
+	for _, tt := range tests {
+		fileEvent := watcher.FileEventModify
+		if len(tt.content) == 0 {
+			fileEvent = watcher.FileEventDelete
+		}
+		writeFile(t, tt.file, tt.content, time.Now())
+		s.handleFileUpdate(raw, &watcher.FileUpdate{Event: fileEvent, Path: tt.file})
+
+		if event := receiveEvent(events); event != tt.event {
+			t.Errorf("%s: expected %s, got %s", tt.name, tt.event, event)
+		}
+
+		select {
+		case fileErr := <-errors:
+			if !tt.reported {
+				t.Errorf("%s: unexpected error %v", tt.name, fileErr)
+			} else if fileErr.Path != tt.file || (fileErr.Key != nil) != tt.withKey || fileErr.Line != 2 {
+				t.Errorf("%s: unexpected error %v, key %v", tt.name, fileErr, fileErr.Key)
+			}
+		default:
+			if tt.reported {
+				t.Errorf("%s: expected an error to be reported", tt.name)
+			}
+		}
+
+		invalid := s.InvalidFiles()
+		if len(invalid) != len(tt.invalid) {
+			t.Errorf("%s: expected invalid files %v, got %v", tt.name, tt.invalid, invalid)
+			continue
+		}
+		for i := range invalid {
+			if invalid[i].Path != tt.invalid[i] {
+				t.Errorf("%s: expected invalid files %v, got %v", tt.name, tt.invalid, invalid)
+			}
+		}
+	}
+}
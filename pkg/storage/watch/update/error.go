@@ -0,0 +1,58 @@
+package update
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/weaveworks/libgitops/pkg/storage"
+)
+
+// lineRegexp matches the line information in YAML decoding errors
+var lineRegexp = regexp.MustCompile(`line (\d+)`)
+
+// FileError describes a file that couldn't be processed
+// by an EventStorage, e.g. as it couldn't be decoded.
+type FileError struct {
+	// Path is the physical path of the file.
+	Path string
+	// Key is the key of the object stored in the file, if known.
+	Key storage.ObjectKey
+	// Line is the line the decoding error occurred on, if known.
+	Line int
+	// Err is the underlying error.
+	Err error
+}
+
+var _ error = &FileError{}
+
+// NewFileError creates a new FileError for the given path and error,
+// and extracts the line information from the error, if any.
+func NewFileError(path string, key storage.ObjectKey, err error) *FileError {
+	fe := &FileError{
+		Path: path,
+		Key:  key,
+		Err:  err,
+	}
+
+	if match := lineRegexp.FindStringSubmatch(err.Error()); match != nil {
+		fe.Line, _ = strconv.Atoi(match[1])
+	}
+
+	return fe
+}
+
+func (e *FileError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("%s:%d: %v", e.Path, e.Line, e.Err)
+	}
+
+	return fmt.Sprintf("%s: %v", e.Path, e.Err)
+}
+
+func (e *FileError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorStream is a channel of file errors.
+type ErrorStream chan *FileError
@@ -25,4 +25,10 @@ type EventStorage interface {
 	// blocking the underlying EventStorage implementation unnecessarily.
 	// TODO: In the future maybe enable sending events to multiple listeners?
 	SetUpdateStream(UpdateStream)
+	// SetErrorStream gives the EventStorage a channel to send errors to, for files
+	// which couldn't be read or decoded. Errors are sent without blocking, if the
+	// channel is full, the error is dropped (but still available in InvalidFiles).
+	SetErrorStream(ErrorStream)
+	// InvalidFiles returns the errors of all files which are currently known to be invalid.
+	InvalidFiles() []*FileError
 }
@@ -0,0 +1,96 @@
+// Package gitmerge contains helpers for merging the changes of Git commits, as go-git supports neither
+// merging nor rebasing. Changes are merged per file: files changed on both sides conflict, unless they
+// were changed in the same way. Otherwise, the changes of one side are applied to the worktree
+// checked out at the other side, and committed.
+package gitmerge
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// ChangeName returns the slash-separated path of the file changed by the given change,
+// the old path if the file was deleted
+func ChangeName(change *object.Change) string {
+	if change.To.Name != "" {
+		return change.To.Name
+	}
+	return change.From.Name
+}
+
+// Conflicts returns the sorted paths of the files changed by both ours and theirs, which
+// must be diffed against the same base tree, unless both changed them in the same way.
+func Conflicts(ours, theirs object.Changes) []string {
+	theirHashes := make(map[string]plumbing.Hash, len(theirs))
+	for _, change := range theirs {
+		theirHashes[ChangeName(change)] = change.To.TreeEntry.Hash
+	}
+
+	var conflicts []string
+	for _, change := range ours {
+		name := ChangeName(change)
+		if theirHash, ok := theirHashes[name]; ok && theirHash != change.To.TreeEntry.Hash {
+			conflicts = append(conflicts, name)
+		}
+	}
+	sort.Strings(conflicts)
+	return conflicts
+}
+
+// ApplyChanges applies the given changes to the given worktree, setting the changed files to
+// their new contents, and adds them to the index. The changes are committed by the caller.
+func ApplyChanges(wt *git.Worktree, changes object.Changes) error {
+	for _, change := range changes {
+		_, to, err := change.Files()
+		if err != nil {
+			return err
+		}
+		if err := ApplyFile(wt, ChangeName(change), to); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ApplyFile sets the file with the given slash-separated path, relative to the root of the given
+// worktree, to the contents of the given file object, or removes it if f is nil. The change is
+// added to the index.
+func ApplyFile(wt *git.Worktree, p string, f *object.File) error {
+	file := filepath.Join(wt.Filesystem.Root(), filepath.FromSlash(p))
+	if f == nil {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	} else {
+		content, err := f.Contents()
+		if err != nil {
+			return err
+		}
+
+		mode, err := f.Mode.ToOSFileMode()
+		if err != nil {
+			return err
+		}
+
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(file, []byte(content), mode); err != nil {
+			return err
+		}
+	}
+
+	// Add stages both modifications and removals
+	if _, err := wt.Add(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("git add %q failed: %v", p, err)
+	}
+	return nil
+}
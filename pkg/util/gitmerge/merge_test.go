@@ -0,0 +1,39 @@
+package gitmerge
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// change returns a change of the file with the given path to the given hash, or a deletion if hash is empty
+func change(path, hash string) *object.Change {
+	if hash == "" {
+		return &object.Change{From: object.ChangeEntry{Name: path}}
+	}
+	return &object.Change{To: object.ChangeEntry{Name: path, TreeEntry: object.TreeEntry{Name: path, Hash: plumbing.NewHash(hash)}}}
+}
+
+func TestConflicts(t *testing.T) {
+	tests := []struct {
+		name   string
+		ours   object.Changes
+		theirs object.Changes
+		want   []string
+	}{
+		{"different files", object.Changes{change("a.yaml", "01")}, object.Changes{change("b.yaml", "02")}, nil},
+		{"same change", object.Changes{change("a.yaml", "01")}, object.Changes{change("a.yaml", "01")}, nil},
+		{"both deleted", object.Changes{change("a.yaml", "")}, object.Changes{change("a.yaml", "")}, nil},
+		{"different changes", object.Changes{change("b.yaml", "01"), change("a.yaml", "01")}, object.Changes{change("a.yaml", "02"), change("b.yaml", "02")}, []string{"a.yaml", "b.yaml"}},
+		{"changed and deleted", object.Changes{change("a.yaml", "01")}, object.Changes{change("a.yaml", "")}, []string{"a.yaml"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Conflicts(tt.ours, tt.theirs); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Conflicts() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
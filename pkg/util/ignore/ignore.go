@@ -0,0 +1,175 @@
+package ignore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+)
+
+const (
+	// GitIgnoreFile is the name of the ignore file used by Git
+	GitIgnoreFile = ".gitignore"
+	// LibgitopsIgnoreFile is the name of the dedicated ignore file for libgitops,
+	// its patterns take precedence over the ones in GitIgnoreFile
+	LibgitopsIgnoreFile = ".libgitopsignore"
+
+	gitDir        = ".git"
+	commentPrefix = "#"
+)
+
+// DefaultFiles returns the names of the ignore files read by default, in increasing priority
+func DefaultFiles() []string {
+	return []string{GitIgnoreFile, LibgitopsIgnoreFile}
+}
+
+// Matcher matches paths in a directory tree against the gitignore-style
+// patterns in the ignore files of the tree. A nil Matcher matches nothing.
+// A Matcher is safe for concurrent use, and can be shared by e.g. a FileWatcher
+// and a storage, so that the ignore files only need to be read once.
+type Matcher struct {
+	dir     string
+	files   []string
+	matcher gitignore.Matcher
+	mux     sync.RWMutex
+}
+
+// NewMatcher reads the patterns of the ignore files with the given names recursively
+// in dir. As in Git, the patterns in subdirectories are relative to the subdirectory
+// and take precedence over the ones in parent directories. The ignore files are
+// given in increasing priority, i.e. the patterns of the last file win.
+func NewMatcher(dir string, files []string) (*Matcher, error) {
+	m := &Matcher{
+		dir:   filepath.Clean(dir),
+		files: files,
+	}
+
+	if err := m.Reload(); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// Reload re-reads the ignore files, e.g. after they have changed.
+// If that fails, the previously read patterns are kept.
+func (m *Matcher) Reload() error {
+	patterns, err := readTree(m.dir, m.files)
+	if err != nil {
+		return err
+	}
+
+	m.mux.Lock()
+	m.matcher = gitignore.NewMatcher(patterns)
+	m.mux.Unlock()
+	return nil
+}
+
+// Files returns the names of the ignore files read by the Matcher
+func (m *Matcher) Files() []string {
+	if m == nil {
+		return nil
+	}
+
+	return m.files
+}
+
+// Match returns true if the given path, either absolute or relative
+// to the directory of the Matcher, is ignored. Paths outside of the
+// directory are never ignored.
+func (m *Matcher) Match(path string, isDir bool) bool {
+	if m == nil {
+		return false
+	}
+
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(m.dir, path)
+	}
+
+	parts := splitPath(m.dir, path)
+	if len(parts) == 0 || parts[0] == ".." {
+		return false
+	}
+
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	return m.matcher.Match(parts, isDir)
+}
+
+// IsIgnoreFile returns true if the base name of path is one of the given ignore files
+func IsIgnoreFile(path string, files []string) bool {
+	name := filepath.Base(path)
+	for _, file := range files {
+		if name == file {
+			return true
+		}
+	}
+
+	return false
+}
+
+// readTree reads the patterns of the ignore files with the given names recursively in dir
+func readTree(dir string, files []string) ([]gitignore.Pattern, error) {
+	var patterns []gitignore.Pattern
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.IsDir() {
+			return nil
+		}
+
+		if info.Name() == gitDir {
+			return filepath.SkipDir
+		}
+
+		domain := splitPath(dir, path)
+		for _, file := range files {
+			ps, err := readPatterns(filepath.Join(path, file), domain)
+			if err != nil {
+				return err
+			}
+
+			patterns = append(patterns, ps...)
+		}
+
+		return nil
+	})
+
+	return patterns, err
+}
+
+// readPatterns reads the patterns of the given ignore file, if it exists
+func readPatterns(file string, domain []string) (ps []gitignore.Pattern, err error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+
+		return
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if !strings.HasPrefix(line, commentPrefix) && len(strings.TrimSpace(line)) > 0 {
+			ps = append(ps, gitignore.ParsePattern(line, domain))
+		}
+	}
+
+	return
+}
+
+// splitPath returns the components of path relative to dir
+func splitPath(dir, path string) []string {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil || rel == "." {
+		return nil
+	}
+
+	return strings.Split(rel, string(os.PathSeparator))
+}
@@ -0,0 +1,94 @@
+package ignore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var ignoreFiles = map[string]string{
+	GitIgnoreFile:       "*.swp\n# comment\ndocs/\nvendor/\n",
+	LibgitopsIgnoreFile: "!vendor/\ngenerated.yaml\n",
+	filepath.Join("cars", LibgitopsIgnoreFile): "/local.yaml\n",
+}
+
+var matches = []struct {
+	path    string
+	isDir   bool
+	ignored bool
+}{
+	{"car.yaml", false, false},
+	{".car.yaml.swp", false, true},
+	{"cars/.car.yaml.swp", false, true},
+	{"docs", true, true},
+	{"docs/car.yaml", false, true},
+	{"vendor/car.yaml", false, false},
+	{"generated.yaml", false, true},
+	{"cars/generated.yaml", false, true},
+	{"cars/local.yaml", false, true},
+	{"local.yaml", false, false},
+	{"cars/nested/local.yaml", false, false},
+}
+
+func TestMatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "libgitops-ignore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for file, content := range ignoreFiles {
+		path := filepath.Join(dir, file)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m, err := NewMatcher(dir, DefaultFiles())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, match := range matches {
+		if ignored := m.Match(filepath.Join(dir, match.path), match.isDir); ignored != match.ignored {
+			t.Errorf("%q: expected ignored=%t, got %t", match.path, match.ignored, ignored)
+		}
+	}
+
+	if m.Match(filepath.Join(filepath.Dir(dir), "docs"), true) {
+		t.Errorf("expected paths outside of the directory not to be ignored")
+	}
+}
+
+func TestMatcherReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "libgitops-ignore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m, err := NewMatcher(dir, DefaultFiles())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Match("car.yaml", false) {
+		t.Error("expected car.yaml not to be ignored")
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, GitIgnoreFile), []byte("car.yaml\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if m.Match("car.yaml", false) {
+		t.Error("expected the patterns to be read only once")
+	}
+	if err := m.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if !m.Match("car.yaml", false) {
+		t.Error("expected car.yaml to be ignored after reloading")
+	}
+}
@@ -12,6 +12,7 @@ func NewBatchWriter(duration time.Duration) *BatchWriter {
 	return &BatchWriter{
 		duration: duration,
 		flushCh:  make(chan struct{}),
+		closeCh:  make(chan struct{}),
 		syncMap:  &sync.Map{},
 	}
 }
@@ -26,7 +27,9 @@ type BatchWriter struct {
 	duration time.Duration
 	timer    *time.Timer
 	flushCh  chan struct{}
-	syncMap  *sync.Map
+	// closeCh is closed by Close, which stops any pending dispatch
+	closeCh chan struct{}
+	syncMap *sync.Map
 }
 
 // Load reads the key from the map
@@ -47,10 +50,11 @@ func (b *BatchWriter) Store(key, value interface{}) {
 	b.dispatchAfterTimeout()
 }
 
-// Close closes the underlying channel
+// Close closes the underlying channel. Batches stored
+// after, or not yet dispatched at that point are dropped.
 func (b *BatchWriter) Close() {
 	log.Trace("BatchWriter: Closing the batch channel")
-	close(b.flushCh)
+	close(b.closeCh)
 }
 
 // ProcessBatch is effectively a Range over the sync.Map, once a batch write is
@@ -58,7 +62,9 @@ func (b *BatchWriter) Close() {
 // reset after this call, so be sure to capture all the contents if needed. This
 // function returns false if Close() has been called.
 func (b *BatchWriter) ProcessBatch(fn func(key, val interface{}) bool) bool {
-	if _, ok := <-b.flushCh; !ok {
+	select {
+	case <-b.flushCh:
+	case <-b.closeCh:
 		// channel is closed
 		return false
 	}
@@ -80,6 +86,9 @@ func (b *BatchWriter) cancelUnfiredTimer() {
 func (b *BatchWriter) dispatchAfterTimeout() {
 	b.timer = time.AfterFunc(b.duration, func() {
 		log.Tracef("BatchWriter: Dispatching a batch job")
-		b.flushCh <- struct{}{}
+		select {
+		case b.flushCh <- struct{}{}:
+		case <-b.closeCh:
+		}
 	})
 }
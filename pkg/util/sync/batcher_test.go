@@ -70,3 +70,17 @@ func TestBatchWriter(t *testing.T) {
 
 	//t.Error("err")
 }
+
+func TestBatchWriterClose(t *testing.T) {
+	b := NewBatchWriter(10 * time.Millisecond)
+	b.Store("foo", "CREATE")
+	b.Close()
+	// The pending dispatch must not send on the closed channel
+	time.Sleep(50 * time.Millisecond)
+	b.Store("foo", "MODIFY")
+	time.Sleep(50 * time.Millisecond)
+
+	if b.ProcessBatch(func(key, val interface{}) bool { return true }) {
+		t.Error("expected ProcessBatch to return false after Close")
+	}
+}
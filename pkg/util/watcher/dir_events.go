@@ -0,0 +1,219 @@
+package watcher
+
+import (
+	"hash/fnv"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/rjeczalik/notify"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// syntheticEvent is an event generated by the FileWatcher itself, e.g.
+// for the files contained in a directory that was moved or deleted
+type syntheticEvent struct {
+	event  notify.Event
+	path   string
+	cookie uint32
+}
+
+var _ notify.EventInfo = &syntheticEvent{}
+
+func (e *syntheticEvent) Event() notify.Event { return e.event }
+func (e *syntheticEvent) Path() string        { return e.path }
+func (e *syntheticEvent) Sys() interface{} {
+	return &unix.InotifyEvent{Mask: uint32(e.event), Cookie: e.cookie}
+}
+
+// translatedEvent overrides the path of an event, it's used for reporting
+// events in symlinked directories using the path in the watched directory
+type translatedEvent struct {
+	notify.EventInfo
+	path string
+}
+
+func (e *translatedEvent) Path() string { return e.path }
+
+// translateEvent translates the path of the given event, as the events
+// are reported with symlinks resolved by notify
+func (w *FileWatcher) translateEvent(event notify.EventInfo) notify.EventInfo {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	// Find the longest matching real path, in case symlinks are nested
+	var realPath string
+	for target := range w.links {
+		if len(target) > len(realPath) && isSubPath(event.Path(), target) {
+			realPath = target
+		}
+	}
+
+	if len(realPath) == 0 {
+		return event
+	}
+
+	return &translatedEvent{event, w.links[realPath] + strings.TrimPrefix(event.Path(), realPath)}
+}
+
+// addLinks registers the given symlinked directories, and starts
+// watching them unless the FileWatcher is polling for changes
+func (w *FileWatcher) addLinks(links map[string]string) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	for target, link := range links {
+		if _, ok := w.links[target]; ok {
+			continue
+		}
+
+		if w.opts.Mode != WatchModePoll {
+			log.Tracef("FileWatcher: Starting recursive watch for symlink %q -> %q", link, target)
+			if err := notify.Watch(path.Join(target, "..."), w.events, listenEvents...); err != nil {
+				log.Warnf("FileWatcher: Failed to watch symlink %q -> %q: %v", link, target, err)
+				continue
+			}
+		}
+
+		w.links[target] = link
+	}
+}
+
+// handleDirEvent expands events for directories into events for all of the files
+// in them. Returns true if the event was handled (i.e. it was for a directory).
+func (w *FileWatcher) handleDirEvent(event notify.EventInfo) bool {
+	isDir := ievent(event).Mask&unix.IN_ISDIR != 0
+	cookie := ievent(event).Cookie
+
+	switch event.Event() {
+	case notify.InCreate, notify.InMovedTo:
+		// Stat follows symlinks, which aren't reported as directories by inotify
+		info, err := os.Stat(event.Path())
+		if err != nil || !info.IsDir() {
+			if err == nil && event.Event() == notify.InCreate && isSymlink(event.Path()) {
+				// A created symlink to a file won't get an InCloseWrite, register it as written
+				w.registerSyntheticEvent(notify.InCloseWrite, event.Path(), 0)
+				return true
+			}
+
+			return isDir
+		}
+
+		if isExcludedDir(event.Path(), w.opts.ExcludeDirs) || w.ignore.Match(event.Path(), true) {
+			return true
+		}
+
+		// Scan the directory, as files may have been written before it was watched
+		files, err := w.walk(event.Path())
+		if err != nil {
+			log.Warnf("FileWatcher: Failed to scan directory %q: %v", event.Path(), err)
+			return true
+		}
+
+		log.Tracef("FileWatcher: Registering %s for %d files in directory %q", event.Event(), len(files), event.Path())
+		for _, file := range files {
+			if event.Event() == notify.InCreate {
+				w.registerSyntheticEvent(notify.InCloseWrite, file, 0)
+			} else {
+				w.registerSyntheticEvent(notify.InMovedTo, file, fileCookie(cookie, event.Path(), file))
+			}
+		}
+
+		return true
+	case notify.InDelete, notify.InMovedFrom:
+		// The directory is gone, so look up the files that were known to be in it
+		files := w.knownFilesIn(event.Path())
+		if !isDir && len(files) == 0 {
+			return false // A regular file
+		}
+
+		log.Tracef("FileWatcher: Registering %s for %d files in directory %q", event.Event(), len(files), event.Path())
+		for _, file := range files {
+			if event.Event() == notify.InDelete {
+				w.registerSyntheticEvent(notify.InDelete, file, 0)
+			} else {
+				w.registerSyntheticEvent(notify.InMovedFrom, file, fileCookie(cookie, event.Path(), file))
+			}
+		}
+
+		return true
+	}
+
+	return isDir
+}
+
+func (w *FileWatcher) registerSyntheticEvent(event notify.Event, file string, cookie uint32) {
+	if w.validFile(file) {
+		w.registerEvent(&syntheticEvent{event, file, cookie})
+	}
+}
+
+// fileCookie derives a move cookie for a file in a moved directory from the
+// cookie of the directory move and the relative path of the file. This way
+// the "from" and "to" events of each file in the directory can be matched.
+func fileCookie(dirCookie uint32, dir, file string) uint32 {
+	rel, _ := filepath.Rel(dir, file)
+	h := fnv.New32a()
+	_, _ = h.Write([]byte{byte(dirCookie >> 24), byte(dirCookie >> 16), byte(dirCookie >> 8), byte(dirCookie)})
+	_, _ = h.Write([]byte(rel))
+	return h.Sum32()
+}
+
+// setKnownFiles overwrites the set of known files
+func (w *FileWatcher) setKnownFiles(files []string) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	w.files = make(map[string]bool, len(files))
+	for _, file := range files {
+		w.files[file] = true
+	}
+}
+
+// trackUpdate keeps the set of known files up to date
+func (w *FileWatcher) trackUpdate(update *FileUpdate) {
+	if update.Event == FileEventDelete {
+		w.forgetFile(update.Path)
+		return
+	}
+
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	if w.files != nil {
+		w.files[update.Path] = true
+	}
+}
+
+func (w *FileWatcher) forgetFile(file string) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	delete(w.files, file)
+}
+
+// knownFilesIn returns the known files in the given directory, sorted by path
+func (w *FileWatcher) knownFilesIn(dir string) (files []string) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	for file := range w.files {
+		if isSubPath(file, dir) && file != dir {
+			files = append(files, file)
+		}
+	}
+
+	sort.Strings(files)
+	return
+}
+
+// isSubPath checks if p is the same as, or is contained in dir
+func isSubPath(p, dir string) bool {
+	return p == dir || strings.HasPrefix(p, dir+string(os.PathSeparator))
+}
+
+func isSymlink(path string) bool {
+	info, err := os.Lstat(path)
+	return err == nil && info.Mode()&os.ModeSymlink != 0
+}
@@ -0,0 +1,248 @@
+package watcher
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/weaveworks/libgitops/pkg/util/ignore"
+)
+
+func TestWalkDirectoryForFilesSymlinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "libgitops-walk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	root := filepath.Join(dir, "root")
+	outside := filepath.Join(dir, "outside")
+	for _, d := range []string{filepath.Join(root, "cars"), outside} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, file := range []string{filepath.Join(root, "cars", "car.yaml"), filepath.Join(outside, "bike.yaml")} {
+		if err := ioutil.WriteFile(file, []byte("kind: Car"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	links := map[string]string{
+		filepath.Join(root, "external"):       outside,                           // followed
+		filepath.Join(root, "cars-link"):      filepath.Join(root, "cars"),       // within the tree, skipped
+		filepath.Join(outside, "loop"):        outside,                           // loop, skipped
+		filepath.Join(root, "cars", "dangle"): filepath.Join(dir, "nonexistent"), // dangling, skipped
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, link); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := WalkDirectoryForFiles(root, []string{".yaml"}, []string{".git"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{filepath.Join(root, "cars", "car.yaml"), filepath.Join(root, "external", "bike.yaml")}
+	sort.Strings(files)
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("unexpected files: %v != %v", files, expected)
+	}
+}
+
+func TestWalkDirectoryExcludeDirs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "libgitops-exclude")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, file := range []string{"car.yaml", ".git/HEAD", ".git/objects/ab/cdef", "cars/.git/config"} {
+		path := filepath.Join(dir, filepath.FromSlash(file))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte("kind: Car"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	matcher, err := ignore.NewMatcher(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Excluded directories aren't descended into at all
+	var walked []string
+	if _, err := walkDirectory(dir, dir, []string{".git"}, matcher, func(path string) {
+		walked = append(walked, path)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{filepath.Join(dir, "car.yaml")}; !reflect.DeepEqual(walked, expected) {
+		t.Errorf("unexpected walked files: %v != %v", walked, expected)
+	}
+}
+
+func TestFileWatcherDirectories(t *testing.T) {
+	dir, err := ioutil.TempDir("", "libgitops-dirs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.BatchTimeout = 100 * time.Millisecond
+	w, _, err := NewFileWatcherWithOptions(dir, opts)
+	if err != nil {
+		t.Skipf("inotify not available: %v", err)
+	}
+	defer w.Close()
+
+	expect := func(event FileEvent, path string) {
+		select {
+		case update := <-w.GetFileUpdateStream():
+			if update.Event != event || update.Path != path {
+				t.Errorf("unexpected update: %s %q, expected %s %q", update.Event, update.Path, event, path)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %s %q", event, path)
+		}
+	}
+
+	// Create a directory with a file outside of the watched directory, and move it in
+	staging, err := ioutil.TempDir("", "libgitops-staging")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(staging)
+
+	if err := ioutil.WriteFile(filepath.Join(staging, "car.yaml"), []byte("kind: Car"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cars := filepath.Join(dir, "cars")
+	if err := os.Rename(staging, cars); err != nil {
+		t.Fatal(err)
+	}
+	expect(FileEventModify, filepath.Join(cars, "car.yaml"))
+
+	// Rename the directory within the watched directory
+	vehicles := filepath.Join(dir, "vehicles")
+	if err := os.Rename(cars, vehicles); err != nil {
+		t.Fatal(err)
+	}
+	expect(FileEventMove, filepath.Join(vehicles, "car.yaml"))
+
+	// Move the directory out of the watched directory
+	if err := os.Rename(vehicles, staging); err != nil {
+		t.Fatal(err)
+	}
+	expect(FileEventDelete, filepath.Join(vehicles, "car.yaml"))
+}
+
+func TestWalkDirectoryForFilesIgnore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "libgitops-ignore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		".gitignore":               "*.swp.yaml\ndocs/\n",
+		".libgitopsignore":         "vendor/\n",
+		"cars/car.yaml":            "kind: Car",
+		"cars/.car.swp.yaml":       "kind: Car",
+		"docs/generated.yaml":      "kind: Doc",
+		"vendor/manifest.yaml":     "kind: Vendored",
+		"bikes/.gitignore":         "old.yaml\n",
+		"bikes/old.yaml":           "kind: Bike",
+		"bikes/new.yaml":           "kind: Bike",
+		"bikes/vendor/notes.json":  "{}",
+		"bikes/notvendor/car.json": "{}",
+	}
+	for file, content := range files {
+		path := filepath.Join(dir, file)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	found, err := WalkDirectoryForFilesWithOptions(dir, DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		filepath.Join(dir, "bikes", "new.yaml"),
+		filepath.Join(dir, "bikes", "notvendor", "car.json"),
+		filepath.Join(dir, "cars", "car.yaml"),
+	}
+	sort.Strings(found)
+	if !reflect.DeepEqual(found, expected) {
+		t.Errorf("unexpected files: %v != %v", found, expected)
+	}
+}
+
+func TestFileWatcherIgnoreChanges(t *testing.T) {
+	for _, mode := range []WatchMode{WatchModeNotify, WatchModePoll} {
+		t.Run(mode.String(), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "libgitops-ignore")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			car := filepath.Join(dir, "car.yaml")
+			if err := ioutil.WriteFile(car, []byte("kind: Car"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			opts := DefaultOptions()
+			opts.Mode = mode
+			opts.BatchTimeout = 100 * time.Millisecond
+			opts.PollInterval = 10 * time.Millisecond
+			w, _, err := NewFileWatcherWithOptions(dir, opts)
+			if err != nil {
+				t.Skipf("%s not available: %v", mode, err)
+			}
+			defer w.Close()
+
+			expect := func(event FileEvent, path string) {
+				select {
+				case update := <-w.GetFileUpdateStream():
+					if update.Event != event || update.Path != path {
+						t.Errorf("unexpected update: %s %q, expected %s %q", update.Event, update.Path, event, path)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("timed out waiting for %s %q", event, path)
+				}
+			}
+
+			// Ignoring the file deletes it, and unignoring it creates it again
+			gitignore := filepath.Join(dir, ".gitignore")
+			if err := ioutil.WriteFile(gitignore, []byte("car.yaml\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			expect(FileEventDelete, car)
+			if !w.ignore.Match(car, false) {
+				t.Error("expected the Matcher to be reloaded")
+			}
+
+			if err := os.Remove(gitignore); err != nil {
+				t.Fatal(err)
+			}
+			expect(FileEventModify, car)
+		})
+	}
+}
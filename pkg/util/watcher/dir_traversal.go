@@ -1,39 +1,201 @@
 package watcher
 
 import (
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/weaveworks/libgitops/pkg/util/ignore"
 )
 
 func (w *FileWatcher) getFiles() ([]string, error) {
-	return WalkDirectoryForFiles(w.dir, w.opts.ValidExtensions, w.opts.ExcludeDirs)
+	return w.walk(w.dir)
+}
+
+// walk returns the valid files in the given directory, and registers
+// any symlinked directories outside of the tree with the FileWatcher
+func (w *FileWatcher) walk(dir string) ([]string, error) {
+	files, links, err := walkDirectoryForFiles(w.dir, dir, w.opts, w.ignore)
+	if err != nil {
+		return nil, err
+	}
+
+	w.addLinks(links)
+	return files, nil
 }
 
 func (w *FileWatcher) validFile(path string) bool {
-	return isValidFile(path, w.opts.ValidExtensions, w.opts.ExcludeDirs)
+	return isValidFile(path, w.opts.ValidExtensions, w.opts.ExcludeDirs) && !w.ignore.Match(path, false)
 }
 
 // WalkDirectoryForFiles discovers all subdirectories and
-// returns a list of valid files in them
+// returns a list of valid files in them. Ignore files are
+// not read, use WalkDirectoryForFilesWithOptions for that.
 func WalkDirectoryForFiles(dir string, validExts, excludeDirs []string) (files []string, err error) {
-	err = filepath.Walk(dir,
-		func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
+	return WalkDirectoryForFilesWithOptions(dir, Options{
+		ValidExtensions: validExts,
+		ExcludeDirs:     excludeDirs,
+	})
+}
+
+// WalkDirectoryForFilesWithOptions discovers all subdirectories and returns a list
+// of valid files in them, as specified by the ValidExtensions, ExcludeDirs and
+// IgnoreFiles (or Ignore) options. Symlinks are followed, but every directory is only visited
+// once to protect against loops.
+func WalkDirectoryForFilesWithOptions(dir string, opts Options) (files []string, err error) {
+	matcher := opts.Ignore
+	if matcher == nil {
+		if matcher, err = ignore.NewMatcher(dir, opts.IgnoreFiles); err != nil {
+			return nil, err
+		}
+	}
+
+	files, _, err = walkDirectoryForFiles(dir, dir, opts, matcher)
+	return
+}
+
+// walkDirectoryForFiles is like WalkDirectoryForFilesWithOptions, but walks only the given directory of the
+// tree at root, and also returns the symlinked directories pointing outside of the tree, mapped
+// from their real paths to their paths in the tree
+func walkDirectoryForFiles(root, dir string, opts Options, matcher *ignore.Matcher) (files []string, links map[string]string, err error) {
+	links, err = walkDirectory(root, dir, opts.ExcludeDirs, matcher, func(path string) {
+		// Only include valid files
+		if isValidFile(path, opts.ValidExtensions, opts.ExcludeDirs) {
+			files = append(files, path)
+		}
+	})
+
+	return
+}
+
+// dirWalker walks a directory tree like filepath.Walk, but also follows symlinks.
+// The real paths of all visited directories are recorded so that every directory
+// is only visited once, which protects against symlink loops. Symlinks pointing to
+// directories within the tree are skipped, as the tree is walked anyways. Ignored
+// files and directories, and excluded directories, are skipped as well.
+type dirWalker struct {
+	root        string
+	visited     map[string]bool
+	links       map[string]string
+	excludeDirs []string
+	ignore      *ignore.Matcher
+	fn          func(path string)
+}
+
+// walkDirectory calls fn for all files in the given directory of the tree at root, not
+// descending into directories with any of the given excluded names, and returns the
+// symlinked directories pointing outside of the tree, mapped from their real paths to
+// their paths in the tree
+func walkDirectory(root, dir string, excludeDirs []string, matcher *ignore.Matcher, fn func(path string)) (map[string]string, error) {
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, err
+	}
+
+	realDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &dirWalker{
+		root:        realRoot,
+		visited:     make(map[string]bool),
+		links:       make(map[string]string),
+		excludeDirs: excludeDirs,
+		ignore:      matcher,
+		fn:          fn,
+	}
+
+	return w.links, w.walk(filepath.Clean(dir), realDir)
+}
+
+func (w *dirWalker) walk(path, realPath string) error {
+	if w.visited[realPath] {
+		log.Tracef("FileWatcher: Skipping already visited directory %q", path)
+		return nil
+	}
+	w.visited[realPath] = true
+
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		entryPath := filepath.Join(path, entry.Name())
+		if entry.Mode()&os.ModeSymlink == 0 {
+			if w.ignore.Match(entryPath, entry.IsDir()) {
+				continue
 			}
 
-			if !info.IsDir() {
-				// Only include valid files
-				if isValidFile(path, validExts, excludeDirs) {
-					files = append(files, path)
+			if entry.IsDir() {
+				if w.excluded(entry.Name()) {
+					continue
 				}
+
+				if err := w.walk(entryPath, filepath.Join(realPath, entry.Name())); err != nil {
+					return err
+				}
+			} else {
+				w.fn(entryPath)
 			}
 
-			return nil
-		})
+			continue
+		}
 
-	return
+		// Resolve the symlink, dangling symlinks are skipped
+		target, err := filepath.EvalSymlinks(entryPath)
+		if err != nil {
+			log.Tracef("FileWatcher: Skipping dangling symlink %q", entryPath)
+			continue
+		}
+
+		info, err := os.Stat(target)
+		if err != nil {
+			continue
+		}
+
+		if w.ignore.Match(entryPath, info.IsDir()) {
+			continue
+		}
+
+		if !info.IsDir() {
+			w.fn(entryPath)
+			continue
+		}
+
+		if w.excluded(entry.Name()) {
+			continue
+		}
+
+		if target == w.root || strings.HasPrefix(target, w.root+string(os.PathSeparator)) {
+			log.Tracef("FileWatcher: Skipping symlink %q pointing into the watched directory", entryPath)
+			continue
+		}
+
+		if !w.visited[target] {
+			w.links[target] = entryPath
+		}
+
+		if err := w.walk(entryPath, target); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// excluded checks if the directory with the given name is excluded
+func (w *dirWalker) excluded(name string) bool {
+	for _, exclude := range w.excludeDirs {
+		if name == exclude {
+			return true
+		}
+	}
+
+	return false
 }
 
 // isValidFile is used to filter out all unsupported
@@ -41,6 +203,14 @@ func WalkDirectoryForFiles(dir string, validExts, excludeDirs []string) (files [
 // if their path contains an excluded directory
 func isValidFile(path string, validExts, excludeDirs []string) bool {
 	parts := strings.Split(filepath.Clean(path), string(os.PathSeparator))
+	for i := 0; i < len(parts)-1; i++ {
+		for _, exclude := range excludeDirs {
+			if parts[i] == exclude {
+				return false
+			}
+		}
+	}
+
 	ext := filepath.Ext(parts[len(parts)-1])
 	for _, suffix := range validExts {
 		if ext == suffix {
@@ -48,10 +218,15 @@ func isValidFile(path string, validExts, excludeDirs []string) bool {
 		}
 	}
 
-	for i := 0; i < len(parts)-1; i++ {
+	return false
+}
+
+// isExcludedDir checks if the given directory path contains an excluded directory
+func isExcludedDir(path string, excludeDirs []string) bool {
+	for _, part := range strings.Split(filepath.Clean(path), string(os.PathSeparator)) {
 		for _, exclude := range excludeDirs {
-			if parts[i] == exclude {
-				return false
+			if part == exclude {
+				return true
 			}
 		}
 	}
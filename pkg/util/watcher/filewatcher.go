@@ -3,16 +3,19 @@ package watcher
 import (
 	"fmt"
 	"path"
+	"path/filepath"
+	gosync "sync"
 	"time"
 
 	"github.com/rjeczalik/notify"
 	log "github.com/sirupsen/logrus"
+	"github.com/weaveworks/libgitops/pkg/util/ignore"
 	"github.com/weaveworks/libgitops/pkg/util/sync"
 	"golang.org/x/sys/unix"
 )
 
 const eventBuffer = 4096 // How many events and updates we can buffer before watching is interrupted
-var listenEvents = []notify.Event{notify.InDelete, notify.InCloseWrite, notify.InMovedFrom, notify.InMovedTo}
+var listenEvents = []notify.Event{notify.InCreate, notify.InDelete, notify.InCloseWrite, notify.InMovedFrom, notify.InMovedTo}
 
 var eventMap = map[notify.Event]FileEvent{
 	notify.InDelete:     FileEventDelete,
@@ -50,6 +53,10 @@ var combinedEvents = []combinedEvent{
 	{[]notify.Event{notify.InDelete, notify.InCloseWrite}, 1},
 	// MODIFY + DELETE => NONE
 	{[]notify.Event{notify.InCloseWrite, notify.InDelete}, -1},
+	// MODIFY + MODIFY => MODIFY
+	{[]notify.Event{notify.InCloseWrite, notify.InCloseWrite}, 1},
+	// DELETE + DELETE => DELETE
+	{[]notify.Event{notify.InDelete, notify.InDelete}, 1},
 }
 
 type notifyEvents []notify.EventInfo
@@ -64,6 +71,22 @@ type Options struct {
 	BatchTimeout time.Duration
 	// ValidExtensions specifies what file extensions to look at
 	ValidExtensions []string
+	// IgnoreFiles specifies the names of the gitignore-style pattern files to read
+	// in the watched directory. Files matching the patterns are not watched.
+	IgnoreFiles []string
+	// Ignore, if set, is used instead of reading IgnoreFiles. This allows sharing the
+	// Matcher with e.g. a storage, which then sees the patterns reloaded by the
+	// FileWatcher when the ignore files change.
+	Ignore *ignore.Matcher
+	// Mode specifies how changes are detected, either using inotify (the default),
+	// or by periodically polling the directory for changes. Polling is useful where
+	// inotify isn't available, e.g. on NFS, some overlay mounts, or when the inotify
+	// watch limit is exhausted.
+	Mode WatchMode
+	// PollInterval specifies how often the directory is scanned in WatchModePoll
+	PollInterval time.Duration
+	// PollDetection specifies how changed files are detected in WatchModePoll
+	PollDetection ChangeDetection
 }
 
 // DefaultOptions returns the default options
@@ -72,6 +95,10 @@ func DefaultOptions() Options {
 		ExcludeDirs:     []string{".git"},
 		BatchTimeout:    1 * time.Second,
 		ValidExtensions: []string{".yaml", ".yml", ".json"},
+		IgnoreFiles:     ignore.DefaultFiles(),
+		Mode:            WatchModeNotify,
+		PollInterval:    defaultPollInterval,
+		PollDetection:   ChangeDetectionModTime,
 	}
 }
 
@@ -87,17 +114,38 @@ func NewFileWatcher(dir string) (w *FileWatcher, files []string, err error) {
 // MappedRawStorage fileMappings
 func NewFileWatcherWithOptions(dir string, opts Options) (w *FileWatcher, files []string, err error) {
 	w = &FileWatcher{
-		dir:     dir,
+		dir:     filepath.Clean(dir),
 		events:  make(eventStream, eventBuffer),
 		updates: make(FileUpdateStream, eventBuffer),
 		batcher: sync.NewBatchWriter(opts.BatchTimeout),
 		opts:    opts,
+		links:   make(map[string]string),
+		files:   make(map[string]bool),
+	}
+
+	if err = w.loadIgnore(); err != nil {
+		return
+	}
+
+	if opts.Mode == WatchModePoll {
+		files, err = w.startPolling()
+		return
+	}
+
+	// Events are reported with symlinks resolved, translate them back if dir is a symlink
+	realDir, err := filepath.EvalSymlinks(w.dir)
+	if err != nil {
+		return
+	}
+	if realDir != w.dir {
+		w.links[realDir] = w.dir
 	}
 
 	log.Tracef("FileWatcher: Starting recursive watch for %q", dir)
 	if err = notify.Watch(path.Join(dir, "..."), w.events, listenEvents...); err != nil {
 		notify.Stop(w.events)
 	} else if files, err = w.getFiles(); err == nil {
+		w.setKnownFiles(files)
 		w.monitor = sync.RunMonitor(w.monitorFunc)
 		w.dispatcher = sync.RunMonitor(w.dispatchFunc)
 	}
@@ -117,6 +165,17 @@ type FileWatcher struct {
 	monitor      *sync.Monitor
 	dispatcher   *sync.Monitor
 	opts         Options
+	// the poller is used instead of inotify if opts.Mode is WatchModePoll
+	poller *poller
+	// links maps the real paths of symlinked directories to their paths
+	// in the watched directory, and files contains all known files. Both
+	// are needed for handling events for whole directories
+	links map[string]string
+	files map[string]bool
+	mux   gosync.Mutex
+	// ignore matches the files ignored by the patterns in opts.IgnoreFiles,
+	// it's reloaded in place when the ignore files change
+	ignore *ignore.Matcher
 	// the batcher is used for properly sending many concurrent inotify events
 	// as a group, after a specified timeout. This fixes the issue of one single
 	// file operation being registered as many different inotify events
@@ -134,8 +193,22 @@ func (w *FileWatcher) monitorFunc() {
 			return
 		}
 
-		if ievent(event).Mask&unix.IN_ISDIR != 0 {
-			continue // Skip directories
+		// Report the event using the path in the watched directory
+		event = w.translateEvent(event)
+
+		if ignore.IsIgnoreFile(event.Path(), w.ignore.Files()) {
+			if w.reloadIgnore() {
+				w.registerIgnoreChanges()
+			}
+			continue // Ignore files are never valid files
+		}
+
+		if w.handleDirEvent(event) {
+			continue // Directories are expanded into events for their files
+		}
+
+		if event.Event() == notify.InCreate {
+			continue // The content of created files is registered on InCloseWrite
 		}
 
 		if !w.validFile(event.Path()) {
@@ -149,18 +222,24 @@ func (w *FileWatcher) monitorFunc() {
 			continue // Skip the suspended event
 		}
 
-		// Get any events registered for the specific file, and append the specified event
-		var eventList notifyEvents
-		if val, ok := w.batcher.Load(event.Path()); ok {
-			eventList = val.(notifyEvents)
-		}
-
-		eventList = append(eventList, event)
+		w.registerEvent(event)
+	}
+}
 
-		// Register the event in the map, and dispatch all the events at once after the timeout
-		w.batcher.Store(event.Path(), eventList)
-		log.Debugf("FileWatcher: Registered inotify events %v for path %q", eventList, event.Path())
+// registerEvent registers the given event in the batcher, so
+// that it's dispatched with the other events of the same path
+func (w *FileWatcher) registerEvent(event notify.EventInfo) {
+	// Get any events registered for the specific file, and append the specified event
+	var eventList notifyEvents
+	if val, ok := w.batcher.Load(event.Path()); ok {
+		eventList = val.(notifyEvents)
 	}
+
+	eventList = append(eventList, event)
+
+	// Register the event in the map, and dispatch all the events at once after the timeout
+	w.batcher.Store(event.Path(), eventList)
+	log.Debugf("FileWatcher: Registered inotify events %v for path %q", eventList, event.Path())
 }
 
 func (w *FileWatcher) dispatchFunc() {
@@ -188,6 +267,7 @@ func (w *FileWatcher) dispatchFunc() {
 
 func (w *FileWatcher) sendUpdate(update *FileUpdate) {
 	log.Debugf("FileWatcher: Sending update: %s -> %q", update.Event, update.Path)
+	w.trackUpdate(update)
 	w.updates <- update
 }
 
@@ -196,8 +276,72 @@ func (w *FileWatcher) GetFileUpdateStream() FileUpdateStream {
 	return w.updates
 }
 
+// loadIgnore reads the ignore files in the watched directory, unless a Matcher is given
+func (w *FileWatcher) loadIgnore() (err error) {
+	if w.ignore = w.opts.Ignore; w.ignore == nil {
+		w.ignore, err = ignore.NewMatcher(w.dir, w.opts.IgnoreFiles)
+	}
+
+	return
+}
+
+// reloadIgnore re-reads the ignore files after they have changed. If that
+// fails, the previously read patterns are kept and false is returned.
+func (w *FileWatcher) reloadIgnore() bool {
+	log.Debugf("FileWatcher: Reloading the ignore files in %q", w.dir)
+	if err := w.ignore.Reload(); err != nil {
+		log.Warnf("FileWatcher: Failed to reload the ignore files: %v", err)
+		return false
+	}
+
+	return true
+}
+
+// registerIgnoreChanges registers a delete event for every known file that is ignored after the
+// ignore files have changed, and a write event for every file that isn't ignored anymore
+func (w *FileWatcher) registerIgnoreChanges() {
+	files, err := w.getFiles()
+	if err != nil {
+		log.Warnf("FileWatcher: Failed to scan %q: %v", w.dir, err)
+		return
+	}
+
+	current := make(map[string]bool, len(files))
+	for _, file := range files {
+		current[file] = true
+	}
+
+	known := make(map[string]bool)
+	for _, file := range w.knownFilesIn(w.dir) {
+		known[file] = true
+		if !current[file] {
+			log.Tracef("FileWatcher: Registering %s for newly ignored file %q", notify.InDelete, file)
+			w.registerEvent(&syntheticEvent{notify.InDelete, file, 0})
+		}
+	}
+
+	for _, file := range files {
+		if !known[file] {
+			log.Tracef("FileWatcher: Registering %s for newly unignored file %q", notify.InCloseWrite, file)
+			w.registerEvent(&syntheticEvent{notify.InCloseWrite, file, 0})
+		}
+	}
+}
+
+// ListFiles walks the watched directory, and returns all files
+// the FileWatcher would send updates for
+func (w *FileWatcher) ListFiles() ([]string, error) {
+	return w.getFiles()
+}
+
 // Close closes active underlying resources
 func (w *FileWatcher) Close() {
+	if w.poller != nil {
+		w.poller.stop()
+		w.monitor.Wait()
+		return
+	}
+
 	notify.Stop(w.events)
 	w.batcher.Close()
 	close(w.events) // Close the event stream
@@ -307,6 +451,7 @@ func (w *FileWatcher) move(event notify.EventInfo) (moveUpdate *FileUpdate) {
 	case notify.InMovedTo:
 		cache.cancel()                                    // Cancel dispatching the cache's incomplete move
 		moveUpdate = &FileUpdate{FileEventMove, destPath} // Register an internal, complete move instead
+		w.forgetFile(sourcePath)                          // The source of the move doesn't exist anymore
 		log.Tracef("FileWatcher: Detected move: %q -> %q", sourcePath, destPath)
 	}
 
@@ -0,0 +1,310 @@
+package watcher
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/weaveworks/libgitops/pkg/util/ignore"
+	"github.com/weaveworks/libgitops/pkg/util/sync"
+)
+
+const defaultPollInterval = 2 * time.Second
+
+// WatchMode is an enum describing how the FileWatcher detects changes
+type WatchMode byte
+
+const (
+	WatchModeNotify WatchMode = iota // 0
+	WatchModePoll                    // 1
+)
+
+func (m WatchMode) String() string {
+	switch m {
+	case 0:
+		return "NOTIFY"
+	case 1:
+		return "POLL"
+	}
+
+	return "UNKNOWN"
+}
+
+// ChangeDetection is an enum describing how a polling FileWatcher
+// decides whether a file has been modified between two scans
+type ChangeDetection byte
+
+const (
+	ChangeDetectionModTime  ChangeDetection = iota // 0
+	ChangeDetectionChecksum                        // 1
+)
+
+func (c ChangeDetection) String() string {
+	switch c {
+	case 0:
+		return "MODTIME"
+	case 1:
+		return "CHECKSUM"
+	}
+
+	return "UNKNOWN"
+}
+
+// fileState describes the state of a file at the time of a scan. The
+// checksum is always recorded, as it's needed for detecting moves.
+type fileState struct {
+	modTime  time.Time
+	size     int64
+	checksum string
+}
+
+// pollState maps file paths to their states
+type pollState map[string]*fileState
+
+// poller periodically scans the directory of the FileWatcher, and
+// dispatches FileUpdates for the differences between the scans
+type poller struct {
+	watcher *FileWatcher
+	state   pollState
+	// ignoreState holds the states of the ignore files, to detect when they change
+	ignoreState pollState
+	stopCh      chan struct{}
+}
+
+func (w *FileWatcher) startPolling() ([]string, error) {
+	p := &poller{
+		watcher: w,
+		stopCh:  make(chan struct{}),
+	}
+
+	log.Tracef("FileWatcher: Starting to poll %q every %s", w.dir, p.interval())
+	state, err := p.scan(nil)
+	if err != nil {
+		return nil, err
+	}
+	p.state = state
+
+	files := make([]string, 0, len(state))
+	for file := range state {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+
+	w.poller = p
+	w.monitor = sync.RunMonitor(p.pollFunc)
+	return files, nil
+}
+
+func (p *poller) interval() time.Duration {
+	if p.watcher.opts.PollInterval > 0 {
+		return p.watcher.opts.PollInterval
+	}
+
+	return defaultPollInterval
+}
+
+func (p *poller) pollFunc() {
+	log.Debug("FileWatcher: Polling thread started")
+	defer log.Debug("FileWatcher: Polling thread stopped")
+	defer close(p.watcher.updates) // Close the update stream after the FileWatcher has stopped
+
+	ticker := time.NewTicker(p.interval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		state, err := p.scan(p.state)
+		if err != nil {
+			log.Warnf("FileWatcher: Failed to scan %q: %v", p.watcher.dir, err)
+			continue
+		}
+
+		for _, update := range p.diff(p.state, state) {
+			if p.watcher.suspendEvent > 0 && update.Event == p.watcher.suspendEvent {
+				p.watcher.suspendEvent = 0
+				log.Debugf("FileWatcher: Skipping suspended event %s for path: %q", update.Event, update.Path)
+				continue // Skip the suspended event
+			}
+
+			p.watcher.sendUpdate(update)
+		}
+
+		p.state = state
+	}
+}
+
+func (p *poller) stop() {
+	close(p.stopCh)
+}
+
+// scan walks the directory and records the state of all valid files. Checksums
+// of files that haven't changed according to their modification time and size
+// are reused from the previous state, unless ChangeDetectionChecksum is used.
+func (p *poller) scan(prev pollState) (pollState, error) {
+	files, ignoreFiles, err := p.walk()
+	if err != nil {
+		return nil, err
+	}
+
+	// Re-read the ignore files only when they have changed, and walk the directory again using
+	// the new patterns. Files that became (un)ignored are then reported as deleted (created).
+	ignoreState := make(pollState, len(ignoreFiles))
+	for _, file := range ignoreFiles {
+		if info, err := os.Stat(file); err == nil {
+			ignoreState[file] = &fileState{modTime: info.ModTime(), size: info.Size()}
+		}
+	}
+	if prev != nil && p.ignoreChanged(ignoreState) && p.watcher.reloadIgnore() {
+		if files, _, err = p.walk(); err != nil {
+			return nil, err
+		}
+	}
+	p.ignoreState = ignoreState
+
+	state := make(pollState, len(files))
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			continue // The file was removed during the scan
+		}
+
+		fs := &fileState{
+			modTime: info.ModTime(),
+			size:    info.Size(),
+		}
+
+		if old, ok := prev[file]; ok && p.watcher.opts.PollDetection == ChangeDetectionModTime &&
+			old.modTime.Equal(fs.modTime) && old.size == fs.size {
+			fs.checksum = old.checksum
+		} else if fs.checksum, err = checksumFile(file); err != nil {
+			continue // The file was removed during the scan
+		}
+
+		state[file] = fs
+	}
+
+	return state, nil
+}
+
+// walk returns the valid files and the ignore files in the watched directory
+func (p *poller) walk() (files, ignoreFiles []string, err error) {
+	w := p.watcher
+	links, err := walkDirectory(w.dir, w.dir, w.opts.ExcludeDirs, w.ignore, func(path string) {
+		if ignore.IsIgnoreFile(path, w.ignore.Files()) {
+			ignoreFiles = append(ignoreFiles, path)
+		} else if isValidFile(path, w.opts.ValidExtensions, w.opts.ExcludeDirs) {
+			files = append(files, path)
+		}
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	w.addLinks(links)
+	return
+}
+
+// ignoreChanged reports if any ignore file has been created, modified or removed since the last scan
+func (p *poller) ignoreChanged(state pollState) bool {
+	if len(state) != len(p.ignoreState) {
+		return true
+	}
+
+	for file, fs := range state {
+		if old, ok := p.ignoreState[file]; !ok || !old.modTime.Equal(fs.modTime) || old.size != fs.size {
+			return true
+		}
+	}
+
+	return false
+}
+
+// modified reports if a file has changed between two scans
+func (p *poller) modified(old, new *fileState) bool {
+	if p.watcher.opts.PollDetection == ChangeDetectionChecksum {
+		return old.checksum != new.checksum
+	}
+
+	return !old.modTime.Equal(new.modTime) || old.size != new.size
+}
+
+// diff computes the FileUpdates between two scans. A removed file and a
+// created file with the same content are reported as a single move.
+func (p *poller) diff(old, new pollState) FileUpdates {
+	var removed, created, modified []string
+	for file, fs := range new {
+		if oldFs, ok := old[file]; !ok {
+			created = append(created, file)
+		} else if p.modified(oldFs, fs) {
+			modified = append(modified, file)
+		}
+	}
+
+	// Index the removed files by checksum for the move detection
+	removedByChecksum := make(map[string][]string)
+	for file, fs := range old {
+		if _, ok := new[file]; !ok {
+			removed = append(removed, file)
+			removedByChecksum[fs.checksum] = append(removedByChecksum[fs.checksum], file)
+		}
+	}
+
+	sort.Strings(removed)
+	sort.Strings(created)
+	sort.Strings(modified)
+	for _, files := range removedByChecksum {
+		sort.Strings(files)
+	}
+
+	updates := make(FileUpdates, 0, len(removed)+len(created)+len(modified))
+	moved := make(map[string]bool)
+	for _, file := range created {
+		checksum := new[file].checksum
+		if sources := removedByChecksum[checksum]; len(sources) > 0 {
+			// Pair the created file with the first removed file with the same content
+			removedByChecksum[checksum] = sources[1:]
+			moved[sources[0]] = true
+			log.Tracef("FileWatcher: Detected move: %q -> %q", sources[0], file)
+			updates = append(updates, &FileUpdate{FileEventMove, file})
+			continue
+		}
+
+		updates = append(updates, &FileUpdate{FileEventModify, file})
+	}
+
+	for _, file := range modified {
+		updates = append(updates, &FileUpdate{FileEventModify, file})
+	}
+
+	for _, file := range removed {
+		if !moved[file] {
+			updates = append(updates, &FileUpdate{FileEventDelete, file})
+		}
+	}
+
+	return updates
+}
+
+func checksumFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
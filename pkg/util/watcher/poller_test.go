@@ -0,0 +1,120 @@
+package watcher
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testState(files map[string]string) pollState {
+	state := make(pollState, len(files))
+	for file, checksum := range files {
+		state[file] = &fileState{checksum: checksum}
+	}
+
+	return state
+}
+
+var pollDiffs = []struct {
+	old, new map[string]string
+	target   FileUpdates
+}{
+	{
+		old:    map[string]string{},
+		new:    map[string]string{"a.yaml": "1"},
+		target: FileUpdates{{FileEventModify, "a.yaml"}},
+	},
+	{
+		old:    map[string]string{"a.yaml": "1"},
+		new:    map[string]string{"a.yaml": "2"},
+		target: FileUpdates{{FileEventModify, "a.yaml"}},
+	},
+	{
+		old:    map[string]string{"a.yaml": "1"},
+		new:    map[string]string{},
+		target: FileUpdates{{FileEventDelete, "a.yaml"}},
+	},
+	{
+		old:    map[string]string{"a.yaml": "1", "b.yaml": "2"},
+		new:    map[string]string{"c.yaml": "1", "b.yaml": "2"},
+		target: FileUpdates{{FileEventMove, "c.yaml"}},
+	},
+	{
+		old:    map[string]string{"a.yaml": "1", "b.yaml": "1"},
+		new:    map[string]string{"c.yaml": "1", "d.yaml": "3"},
+		target: FileUpdates{{FileEventMove, "c.yaml"}, {FileEventModify, "d.yaml"}, {FileEventDelete, "b.yaml"}},
+	},
+}
+
+func TestPollDiff(t *testing.T) {
+	p := &poller{watcher: &FileWatcher{opts: Options{PollDetection: ChangeDetectionChecksum}}}
+	for i, d := range pollDiffs {
+		result := p.diff(testState(d.old), testState(d.new))
+		if len(result) != len(d.target) {
+			t.Errorf("%d: wrong diff result: %v != %v", i, extractEvents(result), extractEvents(d.target))
+			continue
+		}
+
+		for j := range result {
+			if *result[j] != *d.target[j] {
+				t.Errorf("%d: wrong update: %v != %v", i, *result[j], *d.target[j])
+			}
+		}
+	}
+}
+
+func TestPollingFileWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "libgitops-poll")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "car.yaml")
+	if err := ioutil.WriteFile(file, []byte("kind: Car"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := DefaultOptions()
+	opts.Mode = WatchModePoll
+	opts.PollInterval = 10 * time.Millisecond
+	opts.PollDetection = ChangeDetectionChecksum
+	w, files, err := NewFileWatcherWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	if len(files) != 1 || files[0] != file {
+		t.Fatalf("unexpected initial files: %v", files)
+	}
+
+	expect := func(event FileEvent, path string) {
+		select {
+		case update := <-w.GetFileUpdateStream():
+			if update.Event != event || update.Path != path {
+				t.Errorf("unexpected update: %s %q, expected %s %q", update.Event, update.Path, event, path)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %s %q", event, path)
+		}
+	}
+
+	if err := ioutil.WriteFile(file, []byte("kind: Motorcycle"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	expect(FileEventModify, file)
+
+	moved := filepath.Join(dir, "moved.yaml")
+	if err := os.Rename(file, moved); err != nil {
+		t.Fatal(err)
+	}
+	expect(FileEventMove, moved)
+
+	if err := os.Remove(moved); err != nil {
+		t.Fatal(err)
+	}
+	expect(FileEventDelete, moved)
+}